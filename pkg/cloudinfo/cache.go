@@ -0,0 +1,123 @@
+package cloudinfo
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sync"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+// refreshTimeout bounds how long a Refresh may wait for OpenStack
+const refreshTimeout = 2 * time.Minute
+
+// Cache holds the most recent CloudInfo fetched by a Provider so that it can
+// be shared between controllers. The CloudInfo is refreshed by the
+// ConfigSyncController; other controllers should treat it as read-only.
+type Cache struct {
+	provider Provider
+
+	// refreshLock serializes refreshes. It is held while OpenStack is
+	// queried, unlike lock, so that Get never waits for OpenStack.
+	refreshLock sync.Mutex
+
+	lock      sync.RWMutex
+	ci        *CloudInfo
+	fetchedAt time.Time
+	// expirations counts the calls to Expire, so that a refresh which was
+	// already under way doesn't undo one
+	expirations int
+}
+
+// NewCache returns an empty Cache backed by the given Provider
+func NewCache(provider Provider) *Cache {
+	return &Cache{
+		provider: provider,
+	}
+}
+
+// Get returns the most recently fetched CloudInfo, or nil if it hasn't been
+// fetched yet
+func (c *Cache) Get() *CloudInfo {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	return c.ci
+}
+
+// Refresh returns the cached CloudInfo, refetching it first if it is older
+// than ttl. If the cache was refreshed, the previously cached CloudInfo (if
+// any) is also returned so that callers can detect changes.
+func (c *Cache) Refresh(ctx context.Context, ttl time.Duration) (*CloudInfo, *CloudInfo, error) {
+	c.refreshLock.Lock()
+	defer c.refreshLock.Unlock()
+
+	c.lock.RLock()
+	cached, cachedAt, expirations := c.ci, c.fetchedAt, c.expirations
+	c.lock.RUnlock()
+
+	if cached != nil && time.Since(cachedAt) < ttl {
+		return cached, nil, nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, refreshTimeout)
+	defer cancel()
+
+	fetchedAt := time.Now()
+	ci, err := c.provider.GetCloudInfo(ctx)
+	if err != nil {
+		if cached != nil {
+			// we'd rather keep using slightly stale data than fail outright
+			klog.Warningf("Failed to refresh OpenStack cloud info; using cached data from %s: %v", cachedAt.Format(time.RFC3339), err)
+			return cached, nil, nil
+		}
+		return nil, nil, fmt.Errorf("couldn't collect info about cloud availability zones: %w", err)
+	}
+
+	if ci.VolumeTypesErr != nil && cached != nil && cached.VolumeTypesErr == nil {
+		klog.Warningf("Using cached volume types from %s", cachedAt.Format(time.RFC3339))
+		ci.VolumeTypes = cached.VolumeTypes
+		ci.VolumeTypesErr = nil
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.ci = ci
+	if c.expirations == expirations {
+		c.fetchedAt = fetchedAt
+	}
+
+	return ci, cached, nil
+}
+
+// Expire causes the next Refresh to refetch the CloudInfo regardless of its
+// age. The current CloudInfo is still returned by Get until then.
+func (c *Cache) Expire() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.fetchedAt = time.Time{}
+	c.expirations++
+}
+
+// ZonesChanged returns a human-readable description of how the availability
+// zones differ between the two CloudInfos, or an empty string if they don't
+func (ci *CloudInfo) ZonesChanged(previous *CloudInfo) string {
+	var msg string
+
+	if !reflect.DeepEqual(ci.ComputeZones, previous.ComputeZones) {
+		msg = fmt.Sprintf("compute availability zones changed from %v to %v", previous.ComputeZones, ci.ComputeZones)
+	}
+
+	if !reflect.DeepEqual(ci.VolumeZones, previous.VolumeZones) {
+		if msg != "" {
+			msg += "; "
+		}
+		msg += fmt.Sprintf("volume availability zones changed from %v to %v", previous.VolumeZones, ci.VolumeZones)
+	}
+
+	return msg
+}
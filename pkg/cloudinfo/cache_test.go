@@ -0,0 +1,211 @@
+package cloudinfo_test
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	. "github.com/onsi/gomega"
+
+	"github.com/openshift/openstack-cinder-csi-driver-operator/pkg/cloudinfo"
+	"github.com/openshift/openstack-cinder-csi-driver-operator/pkg/cloudinfo/fake"
+)
+
+func TestZonesChanged(t *testing.T) {
+	g := NewWithT(t)
+
+	previous := &cloudinfo.CloudInfo{
+		ComputeZones: []string{"az1", "az2"},
+		VolumeZones:  []string{"az1", "az2"},
+	}
+
+	g.Expect((&cloudinfo.CloudInfo{
+		ComputeZones: []string{"az1", "az2"},
+		VolumeZones:  []string{"az1", "az2"},
+	}).ZonesChanged(previous)).To(BeEmpty())
+
+	g.Expect((&cloudinfo.CloudInfo{
+		ComputeZones: []string{"az1", "az2", "az3"},
+		VolumeZones:  []string{"az1", "az2"},
+	}).ZonesChanged(previous)).To(Equal("compute availability zones changed from [az1 az2] to [az1 az2 az3]"))
+
+	g.Expect((&cloudinfo.CloudInfo{
+		ComputeZones: []string{"az1", "az2", "az3"},
+		VolumeZones:  []string{"az1", "az2", "az3"},
+	}).ZonesChanged(previous)).To(Equal("compute availability zones changed from [az1 az2] to [az1 az2 az3]; volume availability zones changed from [az1 az2] to [az1 az2 az3]"))
+}
+
+func TestGetCloudInfo(t *testing.T) {
+	g := NewWithT(t)
+
+	cloud := fake.New()
+	defer cloud.Close()
+
+	cloud.ComputeZones = fake.Zones("az2", "az1")
+	cloud.VolumeZones = append(fake.Zones("az1"), fake.AvailabilityZone{Name: "az2", Available: false})
+	cloud.VolumeTypes = []fake.VolumeType{
+		{ID: "2", Name: "ssd", ExtraSpecs: map[string]string{"volume_backend_name": "fast"}},
+		{ID: "1", Name: "hdd"},
+		{ID: "3", Name: "shared", ExtraSpecs: map[string]string{"multiattach": "<is> True"}},
+	}
+
+	ci, err := cloudinfo.NewProvider(cloud.ClientOpts(), nil).GetCloudInfo(context.TODO())
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(ci.ComputeZones).To(Equal([]string{"az1", "az2"}))
+	g.Expect(ci.VolumeZones).To(Equal([]string{"az1"}))
+	g.Expect(ci.VolumeTypes).To(Equal([]cloudinfo.VolumeType{
+		{Name: "hdd", ExtraSpecs: map[string]string{}},
+		{Name: "shared", ExtraSpecs: map[string]string{"multiattach": "<is> True"}, Multiattach: true},
+		{Name: "ssd", ExtraSpecs: map[string]string{"volume_backend_name": "fast"}},
+	}))
+	g.Expect(ci.MultiattachVolumeTypes()).To(Equal([]cloudinfo.VolumeType{ci.VolumeTypes[1]}))
+}
+
+func TestGetCloudInfoErrors(t *testing.T) {
+	tc := []struct {
+		name    string
+		service string
+		path    string
+		status  int
+	}{
+		{"Authentication failure", "identity", "/auth/tokens", http.StatusUnauthorized},
+		{"Compute availability zones", "compute", "/os-availability-zone", http.StatusInternalServerError},
+		{"Volume availability zones", "volume", "/os-availability-zone", http.StatusServiceUnavailable},
+	}
+
+	for _, tc := range tc {
+		t.Run(tc.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			cloud := fake.New()
+			defer cloud.Close()
+
+			method := http.MethodGet
+			if tc.service == "identity" {
+				method = http.MethodPost
+			}
+			cloud.Fail(tc.service, method, tc.path, tc.status)
+
+			_, err := cloudinfo.NewProvider(cloud.ClientOpts(), nil).GetCloudInfo(context.TODO())
+			g.Expect(err).To(HaveOccurred())
+		})
+	}
+}
+
+func TestGetCloudInfoVolumeTypesError(t *testing.T) {
+	g := NewWithT(t)
+
+	cloud := fake.New()
+	defer cloud.Close()
+	cloud.Fail("volume", http.MethodGet, "/types", http.StatusForbidden)
+
+	ci, err := cloudinfo.NewProvider(cloud.ClientOpts(), nil).GetCloudInfo(context.TODO())
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(ci.ComputeZones).To(Equal([]string{"nova"}))
+	g.Expect(ci.VolumeZones).To(Equal([]string{"nova"}))
+	g.Expect(ci.VolumeTypes).To(BeEmpty())
+	g.Expect(ci.VolumeTypesErr).To(HaveOccurred())
+}
+
+func TestCacheRefresh(t *testing.T) {
+	g := NewWithT(t)
+	ctx := context.TODO()
+
+	cloud := fake.New()
+	defer cloud.Close()
+
+	cache := cloudinfo.NewCache(cloudinfo.NewProvider(cloud.ClientOpts(), nil))
+	g.Expect(cache.Get()).To(BeNil())
+
+	// nothing cached and the cloud is broken
+	cloud.Fail("compute", http.MethodGet, "/os-availability-zone", http.StatusInternalServerError)
+	_, _, err := cache.Refresh(ctx, time.Hour)
+	g.Expect(err).To(MatchError(ContainSubstring("couldn't collect info about cloud availability zones")))
+	g.Expect(cache.Get()).To(BeNil())
+
+	// first successful fetch
+	cloud.Fail("compute", http.MethodGet, "/os-availability-zone", 0)
+	ci, previous, err := cache.Refresh(ctx, time.Hour)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(previous).To(BeNil())
+	g.Expect(ci.ComputeZones).To(Equal([]string{"nova"}))
+	g.Expect(cache.Get()).To(BeIdenticalTo(ci))
+
+	// within the TTL, the cloud isn't queried again
+	requests := cloud.Requests("compute", http.MethodGet, "/os-availability-zone")
+	cloud.ComputeZones = fake.Zones("nova", "az2")
+	cached, previous, err := cache.Refresh(ctx, time.Hour)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(previous).To(BeNil())
+	g.Expect(cached).To(BeIdenticalTo(ci))
+	g.Expect(cloud.Requests("compute", http.MethodGet, "/os-availability-zone")).To(Equal(requests))
+
+	// once expired, the new info is returned along with the previous info
+	refreshed, previous, err := cache.Refresh(ctx, 0)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(previous).To(BeIdenticalTo(ci))
+	g.Expect(refreshed.ComputeZones).To(Equal([]string{"az2", "nova"}))
+
+	// stale volume types are preferred to none
+	cloud.VolumeTypes = []fake.VolumeType{{ID: "1", Name: "ssd"}}
+	withTypes, _, err := cache.Refresh(ctx, 0)
+	g.Expect(err).ToNot(HaveOccurred())
+	cloud.Fail("volume", http.MethodGet, "/types", http.StatusInternalServerError)
+	cloud.ComputeZones = fake.Zones("nova")
+	withStaleTypes, previous, err := cache.Refresh(ctx, 0)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(previous).To(BeIdenticalTo(withTypes))
+	g.Expect(withStaleTypes.ComputeZones).To(Equal([]string{"nova"}))
+	g.Expect(withStaleTypes.VolumeTypes).To(Equal(withTypes.VolumeTypes))
+	g.Expect(withStaleTypes.VolumeTypesErr).ToNot(HaveOccurred())
+
+	// stale info is preferred to an error
+	cloud.Fail("compute", http.MethodGet, "/os-availability-zone", http.StatusInternalServerError)
+	stale, previous, err := cache.Refresh(ctx, 0)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(previous).To(BeNil())
+	g.Expect(stale).To(BeIdenticalTo(withStaleTypes))
+}
+
+// blockingProvider is a Provider whose GetCloudInfo waits until unblocked
+type blockingProvider struct {
+	cloudinfo.Provider
+	ci      *cloudinfo.CloudInfo
+	started chan struct{}
+	unblock chan struct{}
+}
+
+func (p *blockingProvider) GetCloudInfo(ctx context.Context) (*cloudinfo.CloudInfo, error) {
+	p.started <- struct{}{}
+	<-p.unblock
+	return p.ci, nil
+}
+
+func TestCacheRefreshDoesNotBlockGet(t *testing.T) {
+	g := NewWithT(t)
+	ctx := context.TODO()
+
+	provider := &blockingProvider{
+		ci:      &cloudinfo.CloudInfo{ComputeZones: []string{"nova"}},
+		started: make(chan struct{}),
+		unblock: make(chan struct{}),
+	}
+	cache := cloudinfo.NewCache(provider)
+
+	go func() {
+		<-provider.started
+		g.Expect(cache.Get()).To(BeNil())
+		// expiring during a refresh means the next refresh fetches again
+		cache.Expire()
+		close(provider.unblock)
+	}()
+	ci, _, err := cache.Refresh(ctx, time.Hour)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(cache.Get()).To(BeIdenticalTo(ci))
+
+	go func() { <-provider.started }()
+	_, previous, err := cache.Refresh(ctx, time.Hour)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(previous).To(BeIdenticalTo(ci))
+}
@@ -0,0 +1,120 @@
+package cloudinfo
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gophercloud/gophercloud/v2/openstack/blockstorage/v3/schedulerstats"
+	"github.com/gophercloud/gophercloud/v2/openstack/blockstorage/v3/services"
+)
+
+// StoragePool describes the capacity of a Cinder backend pool
+type StoragePool struct {
+	// Name is of the form 'host@backend#pool'
+	Name              string
+	VolumeBackendName string
+	// FreeCapacityGB and TotalCapacityGB are +Inf if the backend reports its
+	// capacity as infinite
+	FreeCapacityGB  float64
+	TotalCapacityGB float64
+}
+
+// Host returns the 'host@backend' part of the pool name, which identifies the
+// cinder-volume service that manages the pool
+func (p StoragePool) Host() string {
+	host, _, _ := strings.Cut(p.Name, "#")
+	return host
+}
+
+// VolumeService describes a Cinder service such as cinder-volume
+type VolumeService struct {
+	Binary string
+	// Host is of the form 'host@backend' for cinder-volume services
+	Host string
+	// Cluster is set if the service is part of an active-active cluster
+	Cluster   string
+	Zone      string
+	State     string
+	Status    string
+	UpdatedAt time.Time
+}
+
+// GetStoragePools fetches the capacity of all Cinder backend pools. Listing
+// pools is usually restricted to administrators, so callers should be
+// prepared for this to fail with a 403 error.
+func (p *openStackProvider) GetStoragePools(ctx context.Context) ([]StoragePool, error) {
+	volumeClient, err := p.newServiceClient(ctx, "volume")
+	if err != nil {
+		return nil, err
+	}
+
+	allPages, err := schedulerstats.List(volumeClient, schedulerstats.ListOpts{Detail: true}).AllPages(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list storage pools: %w", err)
+	}
+
+	poolInfo, err := schedulerstats.ExtractStoragePools(allPages)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse response with storage pool list: %w", err)
+	}
+
+	var pools []StoragePool
+	for _, pool := range poolInfo {
+		pools = append(pools, StoragePool{
+			Name:              pool.Name,
+			VolumeBackendName: pool.Capabilities.VolumeBackendName,
+			FreeCapacityGB:    pool.Capabilities.FreeCapacityGB,
+			TotalCapacityGB:   pool.Capabilities.TotalCapacityGB,
+		})
+	}
+
+	sort.Slice(pools, func(i, j int) bool {
+		return pools[i].Name < pools[j].Name
+	})
+
+	return pools, nil
+}
+
+// GetVolumeServices fetches the Cinder services, optionally filtered by
+// binary, e.g. 'cinder-volume'
+func (p *openStackProvider) GetVolumeServices(ctx context.Context, binary string) ([]VolumeService, error) {
+	volumeClient, err := p.newServiceClient(ctx, "volume")
+	if err != nil {
+		return nil, err
+	}
+
+	allPages, err := services.List(volumeClient, services.ListOpts{Binary: binary}).AllPages(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list volume services: %w", err)
+	}
+
+	serviceInfo, err := services.ExtractServices(allPages)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse response with volume service list: %w", err)
+	}
+
+	var volumeServices []VolumeService
+	for _, service := range serviceInfo {
+		volumeServices = append(volumeServices, VolumeService{
+			Binary:    service.Binary,
+			Host:      service.Host,
+			Cluster:   service.Cluster,
+			Zone:      service.Zone,
+			State:     service.State,
+			Status:    service.Status,
+			UpdatedAt: service.UpdatedAt,
+		})
+	}
+
+	sort.Slice(volumeServices, func(i, j int) bool {
+		if volumeServices[i].Binary != volumeServices[j].Binary {
+			return volumeServices[i].Binary < volumeServices[j].Binary
+		}
+		return volumeServices[i].Host < volumeServices[j].Host
+	})
+
+	return volumeServices, nil
+}
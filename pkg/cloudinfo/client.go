@@ -0,0 +1,147 @@
+package cloudinfo
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/gophercloud/gophercloud/v2"
+	"github.com/gophercloud/gophercloud/v2/openstack"
+	"github.com/gophercloud/utils/v2/openstack/clientconfig"
+	"k8s.io/klog/v2"
+
+	"github.com/openshift/openstack-cinder-csi-driver-operator/pkg/version"
+)
+
+// newServiceClient returns a client for the given service ("compute",
+// "volume" or "image"). The clients share a provider client, which is only
+// authenticated again if the credentials or the HTTP client have changed
+// since the last call, or once its token has expired.
+func (p *openStackProvider) newServiceClient(ctx context.Context, service string) (*gophercloud.ServiceClient, error) {
+	client, err := p.getServiceClient(ctx, service, false)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create a %s client: %w", service, err)
+	}
+
+	// callers may set a microversion, so each gets its own copy
+	serviceClient := *client
+	return &serviceClient, nil
+}
+
+// getServiceClient returns the cached client for the given service. If
+// reauth is set, a new token is requested even if the credentials haven't
+// changed.
+func (p *openStackProvider) getServiceClient(ctx context.Context, service string, reauth bool) (*gophercloud.ServiceClient, error) {
+	httpClient, httpClientHash, err := p.getHTTPClient()
+	if err != nil {
+		return nil, err
+	}
+
+	cloud := &clientconfig.Cloud{}
+	if p.opts.Cloud != "" {
+		cloud, err = clientconfig.GetCloudFromYAML(p.opts)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// this fills in defaults in opts.AuthInfo, so must come before hashing
+	authOptions, err := clientconfig.AuthOptions(p.opts)
+	if err != nil {
+		return nil, err
+	}
+
+	hash, err := hashObjects(cloud, p.opts.AuthInfo, p.opts.AuthType, p.opts.RegionName, p.opts.EndpointType, httpClientHash)
+	if err != nil {
+		return nil, err
+	}
+
+	p.clientLock.Lock()
+	defer p.clientLock.Unlock()
+
+	if reauth || p.providerClient == nil || p.providerClientHash != hash {
+		providerClient, err := newProviderClient(ctx, authOptions, httpClient)
+		if err != nil {
+			return nil, err
+		}
+		if p.providerClient != nil && p.providerClientHash != hash {
+			klog.Infof("Authenticating with OpenStack again as the credentials or the HTTP client configuration changed")
+		}
+		p.providerClient = providerClient
+		p.providerClientHash = hash
+		p.serviceClients = map[string]*gophercloud.ServiceClient{}
+	}
+
+	if client, ok := p.serviceClients[service]; ok {
+		return client, nil
+	}
+
+	client, err := newServiceClientFor(p.providerClient, cloud, p.opts, service)
+	if err != nil {
+		return nil, err
+	}
+	p.serviceClients[service] = client
+
+	return client, nil
+}
+
+// newProviderClient authenticates with the given credentials
+func newProviderClient(ctx context.Context, authOptions *gophercloud.AuthOptions, httpClient *http.Client) (*gophercloud.ProviderClient, error) {
+	// the client is kept for as long as the credentials are unchanged, so
+	// it must be able to get a new token once the first expires
+	authOptions.AllowReauth = true
+
+	providerClient, err := openstack.NewClient(authOptions.IdentityEndpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	providerClient.HTTPClient = *httpClient
+
+	// we represent version using commits since we don't tag releases
+	providerClient.UserAgent.Prepend(fmt.Sprintf("openstack-cinder-csi-driver-operator/%s", version.Get().GitCommit))
+
+	if err := openstack.Authenticate(ctx, providerClient, *authOptions); err != nil {
+		return nil, err
+	}
+
+	return providerClient, nil
+}
+
+// newServiceClientFor finds the endpoint of the given service in the catalog
+// of the provider client, in the same way as clientconfig.NewServiceClient
+func newServiceClientFor(providerClient *gophercloud.ProviderClient, cloud *clientconfig.Cloud, opts *clientconfig.ClientOpts, service string) (*gophercloud.ServiceClient, error) {
+	region := cloud.RegionName
+	if opts.RegionName != "" {
+		region = opts.RegionName
+	}
+	endpointType := cloud.EndpointType
+	if opts.EndpointType != "" {
+		endpointType = opts.EndpointType
+	}
+
+	endpointOpts := gophercloud.EndpointOpts{
+		Region:       region,
+		Availability: clientconfig.GetEndpointType(endpointType),
+	}
+
+	switch service {
+	case "compute":
+		return openstack.NewComputeV2(providerClient, endpointOpts)
+	case "image":
+		return openstack.NewImageV2(providerClient, endpointOpts)
+	case "volume":
+		switch cloud.VolumeAPIVersion {
+		case "v1", "1":
+			return openstack.NewBlockStorageV1(providerClient, endpointOpts)
+		case "v2", "2":
+			return openstack.NewBlockStorageV2(providerClient, endpointOpts)
+		case "", "v3", "3":
+			return openstack.NewBlockStorageV3(providerClient, endpointOpts)
+		default:
+			return nil, fmt.Errorf("invalid volume API version")
+		}
+	}
+
+	return nil, fmt.Errorf("unsupported service %q", service)
+}
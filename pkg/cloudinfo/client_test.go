@@ -0,0 +1,67 @@
+package cloudinfo_test
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	. "github.com/onsi/gomega"
+
+	"github.com/openshift/openstack-cinder-csi-driver-operator/pkg/cloudinfo"
+	"github.com/openshift/openstack-cinder-csi-driver-operator/pkg/cloudinfo/fake"
+)
+
+func TestClientReuse(t *testing.T) {
+	g := NewWithT(t)
+	ctx := context.TODO()
+
+	cloud := fake.New()
+	defer cloud.Close()
+	tokens := func(cloud *fake.Cloud) int {
+		return cloud.Requests("identity", http.MethodPost, "/auth/tokens")
+	}
+
+	opts := cloud.ClientOpts()
+	httpConfig := &cloudinfo.HTTPConfig{}
+	provider := cloudinfo.NewProvider(opts, func() (*cloudinfo.HTTPConfig, error) {
+		return httpConfig, nil
+	})
+
+	// the calls share a token
+	_, err := provider.GetCloudInfo(ctx)
+	g.Expect(err).ToNot(HaveOccurred())
+	_, err = provider.GetCloudInfo(ctx)
+	g.Expect(err).ToNot(HaveOccurred())
+	_, err = provider.GetVolumeQuotas(ctx)
+	g.Expect(err).ToNot(HaveOccurred())
+	_, err = provider.CheckPermissions(ctx)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(tokens(cloud)).To(Equal(1))
+
+	// validating the credentials always requests a new token
+	g.Expect(provider.ValidateCredentials(ctx)).To(Succeed())
+	g.Expect(tokens(cloud)).To(Equal(2))
+	_, err = provider.GetCloudInfo(ctx)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(tokens(cloud)).To(Equal(2))
+
+	// a new HTTP client needs a new token
+	httpConfig = &cloudinfo.HTTPConfig{NoProxy: ".example.com"}
+	_, err = provider.GetCloudInfo(ctx)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(tokens(cloud)).To(Equal(3))
+
+	// as do new credentials
+	rotatedCloud := fake.New()
+	defer rotatedCloud.Close()
+	opts.AuthInfo.AuthURL = rotatedCloud.ClientOpts().AuthInfo.AuthURL
+	_, err = provider.GetCloudInfo(ctx)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(tokens(cloud)).To(Equal(3))
+	g.Expect(tokens(rotatedCloud)).To(Equal(1))
+
+	// invalid credentials are rejected rather than using the cached token
+	opts.AuthInfo.Password = "wrong"
+	_, err = provider.GetCloudInfo(ctx)
+	g.Expect(err).To(HaveOccurred())
+}
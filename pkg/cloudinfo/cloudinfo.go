@@ -0,0 +1,255 @@
+package cloudinfo
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+
+	"github.com/gophercloud/gophercloud/v2"
+	"github.com/gophercloud/gophercloud/v2/openstack/blockstorage/v3/availabilityzones"
+	"github.com/gophercloud/gophercloud/v2/openstack/blockstorage/v3/volumetypes"
+	"github.com/gophercloud/utils/v2/openstack/clientconfig"
+	azutils "github.com/gophercloud/utils/v2/openstack/compute/v2/availabilityzones"
+	"k8s.io/klog/v2"
+)
+
+// CloudInfo caches data fetched from the user's openstack cloud
+type CloudInfo struct {
+	ComputeZones []string
+	VolumeZones  []string
+	VolumeTypes  []VolumeType
+	// VolumeTypesErr is set if the volume types couldn't be listed, in which
+	// case VolumeTypes is empty
+	VolumeTypesErr error
+}
+
+// VolumeType describes a Cinder volume type visible to the project
+type VolumeType struct {
+	Name       string
+	ExtraSpecs map[string]string
+	// Multiattach is true if volumes of this type can be attached to
+	// multiple instances at once
+	Multiattach bool
+}
+
+// MultiattachVolumeTypes returns the volume types that support attaching a
+// volume to multiple instances at once
+func (ci *CloudInfo) MultiattachVolumeTypes() []VolumeType {
+	var types []VolumeType
+	for _, t := range ci.VolumeTypes {
+		if t.Multiattach {
+			types = append(types, t)
+		}
+	}
+	return types
+}
+
+// Provider fetches information about the user's openstack cloud
+type Provider interface {
+	// GetCloudInfo fetches the current CloudInfo from the cloud
+	GetCloudInfo(ctx context.Context) (*CloudInfo, error)
+	// GetVolumeQuotas fetches the Cinder quota usage of the project
+	GetVolumeQuotas(ctx context.Context) (*VolumeQuotas, error)
+	// GetStoragePools fetches the capacity of the Cinder backend pools
+	GetStoragePools(ctx context.Context) ([]StoragePool, error)
+	// GetVolumeServices fetches the Cinder services with the given binary,
+	// or all services if binary is empty
+	GetVolumeServices(ctx context.Context, binary string) ([]VolumeService, error)
+	// ValidateCredentials checks that the credentials can be used to access
+	// Cinder and Nova, returning a *CredentialsError if not
+	ValidateCredentials(ctx context.Context) error
+	// CheckPermissions checks whether the credentials have each of the
+	// Permissions the driver needs
+	CheckPermissions(ctx context.Context) ([]PermissionCheck, error)
+	// GetClusterVolumes fetches the volumes the driver created for the
+	// cluster with the given ID
+	GetClusterVolumes(ctx context.Context, clusterID string) ([]Volume, error)
+	// GetClusterSnapshots fetches the volume snapshots the driver created
+	// for the cluster with the given ID
+	GetClusterSnapshots(ctx context.Context, clusterID string) ([]Snapshot, error)
+	// DeleteVolume deletes the volume with the given ID
+	DeleteVolume(ctx context.Context, id string) error
+	// DeleteSnapshot deletes the volume snapshot with the given ID
+	DeleteSnapshot(ctx context.Context, id string) error
+	// ServerExists returns whether the Nova server with the given ID exists
+	ServerExists(ctx context.Context, id string) (bool, error)
+	// ForceDetachVolume removes an attachment of a volume in Cinder only
+	ForceDetachVolume(ctx context.Context, volumeID, attachmentID string) error
+	// GetServerDisks fetches the disk properties of the Nova server with the
+	// given ID
+	GetServerDisks(ctx context.Context, serverID string) (*ServerDisks, error)
+	// GetServerIDByName returns the ID of the Nova server with the given
+	// name, or an empty string if there is none
+	GetServerIDByName(ctx context.Context, name string) (string, error)
+	// GetServerZone fetches the compute availability zone of the Nova server
+	// with the given ID
+	GetServerZone(ctx context.Context, serverID string) (string, error)
+}
+
+type clients struct {
+	computeClient *gophercloud.ServiceClient
+	volumeClient  *gophercloud.ServiceClient
+}
+
+type openStackProvider struct {
+	opts       *clientconfig.ClientOpts
+	httpConfig HTTPConfigFunc
+
+	lock           sync.Mutex
+	httpClient     *http.Client
+	httpClientHash string
+
+	// clientLock guards the authenticated clients, which are shared by all
+	// calls so that we don't request a token for each of them
+	clientLock         sync.Mutex
+	providerClient     *gophercloud.ProviderClient
+	providerClientHash string
+	serviceClients     map[string]*gophercloud.ServiceClient
+}
+
+// NewProvider returns a Provider that talks to the cloud described by opts.
+// If httpConfig is not nil, it provides the proxy and CA bundle used to
+// connect to the cloud.
+func NewProvider(opts *clientconfig.ClientOpts, httpConfig HTTPConfigFunc) Provider {
+	return &openStackProvider{
+		opts:       opts,
+		httpConfig: httpConfig,
+	}
+}
+
+// GetCloudInfo fetches metadata from openstack
+func (p *openStackProvider) GetCloudInfo(ctx context.Context) (*CloudInfo, error) {
+	clients, err := p.newClients(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	ci := &CloudInfo{}
+
+	err = ci.collectInfo(ctx, clients)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate OpenStack cloud info: %w", err)
+	}
+
+	return ci, nil
+}
+
+func (p *openStackProvider) newClients(ctx context.Context) (*clients, error) {
+	var err error
+
+	c := &clients{}
+
+	c.computeClient, err = p.newServiceClient(ctx, "compute")
+	if err != nil {
+		return nil, err
+	}
+
+	c.volumeClient, err = p.newServiceClient(ctx, "volume")
+	if err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+func (ci *CloudInfo) collectInfo(ctx context.Context, clients *clients) error {
+	var err error
+
+	ci.ComputeZones, err = getComputeZones(ctx, clients)
+	if err != nil {
+		return err
+	}
+
+	ci.VolumeZones, err = getVolumeZones(ctx, clients)
+	if err != nil {
+		return err
+	}
+
+	// volume types are only needed for some StorageClasses, so failing to
+	// list them mustn't hold up the availability zones
+	ci.VolumeTypes, err = getVolumeTypes(ctx, clients)
+	if err != nil {
+		klog.Warningf("Failed to list volume types: %v", err)
+		ci.VolumeTypesErr = err
+	}
+
+	return nil
+}
+
+func getComputeZones(ctx context.Context, clients *clients) ([]string, error) {
+	zones, err := azutils.ListAvailableAvailabilityZones(ctx, clients.computeClient)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list compute availability zones: %w", err)
+	}
+
+	if len(zones) == 0 {
+		return nil, fmt.Errorf("could not find an available compute availability zone")
+	}
+
+	sort.Strings(zones)
+
+	return zones, nil
+}
+
+func getVolumeZones(ctx context.Context, clients *clients) ([]string, error) {
+	allPages, err := availabilityzones.List(clients.volumeClient).AllPages(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list volume availability zones: %w", err)
+	}
+
+	availabilityZoneInfo, err := availabilityzones.ExtractAvailabilityZones(allPages)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse response with volume availability zone list: %w", err)
+	}
+
+	if len(availabilityZoneInfo) == 0 {
+		return nil, fmt.Errorf("could not find an available volume availability zone")
+	}
+
+	var zones []string
+	for _, zone := range availabilityZoneInfo {
+		if zone.ZoneState.Available {
+			zones = append(zones, zone.ZoneName)
+		}
+	}
+
+	sort.Strings(zones)
+
+	return zones, nil
+}
+
+func getVolumeTypes(ctx context.Context, clients *clients) ([]VolumeType, error) {
+	allPages, err := volumetypes.List(clients.volumeClient, volumetypes.ListOpts{}).AllPages(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list volume types: %w", err)
+	}
+
+	volumeTypeInfo, err := volumetypes.ExtractVolumeTypes(allPages)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse response with volume type list: %w", err)
+	}
+
+	var types []VolumeType
+	for _, volumeType := range volumeTypeInfo {
+		types = append(types, VolumeType{
+			Name:        volumeType.Name,
+			ExtraSpecs:  volumeType.ExtraSpecs,
+			Multiattach: isMultiattach(volumeType.ExtraSpecs),
+		})
+	}
+
+	sort.Slice(types, func(i, j int) bool {
+		return types[i].Name < types[j].Name
+	})
+
+	return types, nil
+}
+
+// isMultiattach returns true if the volume type extra specs enable
+// multiattach. This matches the exact comparison Cinder makes when creating
+// a volume.
+func isMultiattach(extraSpecs map[string]string) bool {
+	return extraSpecs["multiattach"] == "<is> True"
+}
@@ -0,0 +1,147 @@
+package cloudinfo
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/gophercloud/gophercloud/v2"
+	"github.com/gophercloud/utils/v2/openstack/clientconfig"
+)
+
+// Reasons a CredentialsError may have. These are used as condition reasons
+// so must be CamelCase.
+const (
+	ReasonInvalidCloudConfig           = "InvalidCloudConfig"
+	ReasonAuthURLUnreachable           = "AuthURLUnreachable"
+	ReasonTLSVerificationFailed        = "TLSVerificationFailed"
+	ReasonInvalidCredentials           = "InvalidCredentials"
+	ReasonApplicationCredentialExpired = "ApplicationCredentialExpired"
+	ReasonMissingProjectScope          = "MissingProjectScope"
+	ReasonServiceNotInCatalog          = "ServiceNotInCatalog"
+	ReasonAuthenticationFailed         = "AuthenticationFailed"
+)
+
+// requestIDHeader is the header OpenStack services use to return the ID of
+// a request, which can be used to find it in the service's logs
+const requestIDHeader = "X-Openstack-Request-Id"
+
+// CredentialsError describes why the OpenStack credentials could not be used
+// to access the services the driver needs
+type CredentialsError struct {
+	// Reason is one of the Reason constants
+	Reason string
+	// Message is a human readable description of the problem
+	Message string
+	// RequestID is the ID of the failed Keystone request, if known
+	RequestID string
+
+	Err error
+}
+
+func (e *CredentialsError) Error() string {
+	return e.Message
+}
+
+func (e *CredentialsError) Unwrap() error {
+	return e.Err
+}
+
+// ValidateCredentials checks that the credentials can be used to get
+// a project scoped token with Cinder and Nova endpoints. A *CredentialsError
+// is returned if not.
+func (p *openStackProvider) ValidateCredentials(ctx context.Context) error {
+	authOptions, err := clientconfig.AuthOptions(p.opts)
+	if err != nil {
+		return &CredentialsError{
+			Reason:  ReasonInvalidCloudConfig,
+			Message: fmt.Sprintf("Failed to load the OpenStack credentials: %v", err),
+			Err:     err,
+		}
+	}
+
+	// a new token is requested even if the credentials are unchanged, as
+	// Keystone may since have revoked them
+	for i, service := range []string{"volume", "compute"} {
+		if _, err := p.getServiceClient(ctx, service, i == 0); err != nil {
+			return classifyCredentialsError(err, service, authOptions)
+		}
+	}
+
+	return nil
+}
+
+// classifyCredentialsError determines why a service client for the given
+// service could not be created
+func classifyCredentialsError(err error, service string, authOptions *gophercloud.AuthOptions) *CredentialsError {
+	credentialsErr := &CredentialsError{
+		Reason:  ReasonAuthenticationFailed,
+		Message: fmt.Sprintf("Failed to authenticate with OpenStack: %v", err),
+		Err:     err,
+	}
+
+	var responseErr gophercloud.ErrUnexpectedResponseCode
+	if errors.As(err, &responseErr) {
+		credentialsErr.RequestID = responseErr.ResponseHeader.Get(requestIDHeader)
+	}
+
+	var urlErr *url.Error
+	var endpointErr *gophercloud.ErrEndpointNotFound
+	switch {
+	case isTLSError(err):
+		credentialsErr.Reason = ReasonTLSVerificationFailed
+		credentialsErr.Message = fmt.Sprintf("Failed to verify the TLS certificate of the OpenStack auth URL %s; check that the CA bundle in clouds.yaml is correct: %v", authOptions.IdentityEndpoint, err)
+	case errors.As(err, &urlErr):
+		credentialsErr.Reason = ReasonAuthURLUnreachable
+		credentialsErr.Message = fmt.Sprintf("Failed to connect to the OpenStack auth URL %s: %v", authOptions.IdentityEndpoint, err)
+	case gophercloud.ResponseCodeIs(err, http.StatusUnauthorized) && isApplicationCredential(authOptions):
+		// Keystone doesn't tell us why an application credential was
+		// rejected, but expiry is by far the most likely cause
+		credentialsErr.Reason = ReasonApplicationCredentialExpired
+		credentialsErr.Message = "Keystone rejected the application credential; it has probably expired or been deleted and must be replaced"
+	case gophercloud.ResponseCodeIs(err, http.StatusUnauthorized):
+		credentialsErr.Reason = ReasonInvalidCredentials
+		credentialsErr.Message = "Keystone rejected the OpenStack credentials; check the username, password, domain and project"
+	case errors.As(err, &endpointErr) && !isProjectScoped(authOptions):
+		credentialsErr.Reason = ReasonMissingProjectScope
+		credentialsErr.Message = "The OpenStack credentials are not scoped to a project; set project_id or project_name in clouds.yaml"
+	case errors.As(err, &endpointErr):
+		credentialsErr.Reason = ReasonServiceNotInCatalog
+		credentialsErr.Message = fmt.Sprintf("No %s endpoint was found in the Keystone service catalog; check that the service is deployed and that region_name in clouds.yaml is correct", service)
+	}
+
+	return credentialsErr
+}
+
+func isTLSError(err error) bool {
+	var verificationErr *tls.CertificateVerificationError
+	var recordHeaderErr tls.RecordHeaderError
+	var unknownAuthorityErr x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+	var certificateInvalidErr x509.CertificateInvalidError
+
+	return errors.As(err, &verificationErr) ||
+		errors.As(err, &recordHeaderErr) ||
+		errors.As(err, &unknownAuthorityErr) ||
+		errors.As(err, &hostnameErr) ||
+		errors.As(err, &certificateInvalidErr)
+}
+
+// isApplicationCredential returns true if authOptions authenticate with an
+// application credential. Application credentials are always scoped to the
+// project they were created in.
+func isApplicationCredential(authOptions *gophercloud.AuthOptions) bool {
+	return authOptions.ApplicationCredentialID != "" || authOptions.ApplicationCredentialName != ""
+}
+
+// isProjectScoped returns true if authOptions request a project scoped token
+func isProjectScoped(authOptions *gophercloud.AuthOptions) bool {
+	if isApplicationCredential(authOptions) || authOptions.TenantID != "" || authOptions.TenantName != "" {
+		return true
+	}
+	return authOptions.Scope != nil && (authOptions.Scope.ProjectID != "" || authOptions.Scope.ProjectName != "")
+}
@@ -0,0 +1,902 @@
+// Package fake provides an in-process fake of the subset of the OpenStack
+// Keystone, Nova and Cinder APIs used by the operator, so that code talking to
+// OpenStack can be tested without a real cloud.
+package fake
+
+import (
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gophercloud/utils/v2/openstack/clientconfig"
+)
+
+const (
+	ProjectID   = "fake-project-id"
+	ProjectName = "fake-project"
+	Username    = "fake-user"
+	Password    = "fake-password"
+	Region      = "RegionOne"
+
+	ApplicationCredentialID     = "fake-application-credential-id"
+	ApplicationCredentialSecret = "fake-application-credential-secret"
+
+	// RequestID is returned in the X-Openstack-Request-Id header of every
+	// response
+	RequestID = "req-fake-request-id"
+
+	identityPrefix = "/identity/v3"
+	computePrefix  = "/compute/v2.1"
+	volumePrefix   = "/volume/v3/" + ProjectID
+	imagePrefix    = "/image"
+)
+
+// AvailabilityZone is a Nova or Cinder availability zone
+type AvailabilityZone struct {
+	Name      string
+	Available bool
+}
+
+// VolumeType is a Cinder volume type
+type VolumeType struct {
+	ID         string
+	Name       string
+	ExtraSpecs map[string]string
+}
+
+// QuotaUsage is the usage of a Cinder quota
+type QuotaUsage struct {
+	InUse    int
+	Reserved int
+	Limit    int
+}
+
+// StoragePool is a Cinder backend pool. A capacity of +Inf is reported as
+// 'infinite'.
+type StoragePool struct {
+	Name              string
+	VolumeBackendName string
+	FreeCapacityGB    float64
+	TotalCapacityGB   float64
+}
+
+// VolumeService is a Cinder service
+type VolumeService struct {
+	Binary    string
+	Host      string
+	Zone      string
+	State     string
+	Status    string
+	UpdatedAt time.Time
+}
+
+// Volume is a Cinder volume. UpdatedAt and CreatedAt are now if they aren't
+// set.
+type Volume struct {
+	ID          string
+	Name        string
+	Status      string
+	Size        int
+	Zone        string
+	Metadata    map[string]string
+	Attachments []VolumeAttachment
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
+	// Bootable volumes have the ImageMetadata of the image they were
+	// created from
+	Bootable      bool
+	ImageMetadata map[string]string
+}
+
+// VolumeAttachment is the attachment of a Cinder volume to a Nova server
+type VolumeAttachment struct {
+	AttachmentID string
+	ServerID     string
+}
+
+// Snapshot is a Cinder volume snapshot. CreatedAt is now if it isn't set.
+type Snapshot struct {
+	ID        string
+	Name      string
+	VolumeID  string
+	Status    string
+	Size      int
+	Metadata  map[string]string
+	CreatedAt time.Time
+}
+
+// Server is a Nova server
+type Server struct {
+	ID               string
+	Name             string
+	Flavor           string
+	FlavorExtraSpecs map[string]string
+	// Zone is the compute availability zone of the server, which defaults
+	// to nova
+	Zone string
+	// ImageID is empty if the server was booted from a volume
+	ImageID         string
+	AttachedVolumes []string
+}
+
+// Image is a Glance image
+type Image struct {
+	ID         string
+	Properties map[string]string
+}
+
+// Cloud is a fake OpenStack cloud. Its exported fields may be modified to
+// change the responses it serves, but not while requests are in flight.
+type Cloud struct {
+	Server *httptest.Server
+
+	ComputeZones []AvailabilityZone
+	VolumeZones  []AvailabilityZone
+	VolumeTypes  []VolumeType
+	// VolumeQuotas is keyed by quota name, e.g. 'gigabytes'
+	VolumeQuotas map[string]QuotaUsage
+	StoragePools []StoragePool
+	// VolumeServices have an UpdatedAt of now if it isn't set
+	VolumeServices []VolumeService
+	// Volumes and Snapshots are removed when they are deleted
+	Volumes   []Volume
+	Snapshots []Snapshot
+	Servers   []Server
+	Images    []Image
+	// MissingServices are service types, e.g. 'volumev3', which are left
+	// out of the service catalog
+	MissingServices []string
+
+	lock     sync.Mutex
+	failures map[string]int
+	requests map[string]int
+}
+
+// New starts a fake cloud with a single 'nova' compute and volume
+// availability zone, a single default volume type and a single server. Call Close when done.
+func New() *Cloud {
+	return newCloud(httptest.NewServer)
+}
+
+// NewTLS is like New, but the fake cloud is served over HTTPS with
+// a certificate signed by CABundle
+func NewTLS() *Cloud {
+	return newCloud(httptest.NewTLSServer)
+}
+
+func newCloud(newServer func(http.Handler) *httptest.Server) *Cloud {
+	c := &Cloud{
+		ComputeZones: Zones("nova"),
+		VolumeZones:  Zones("nova"),
+		VolumeTypes: []VolumeType{
+			{ID: "fake-volume-type-id", Name: "__DEFAULT__"},
+		},
+		VolumeQuotas: map[string]QuotaUsage{
+			"volumes":   {Limit: 10},
+			"gigabytes": {Limit: 1000},
+			"snapshots": {Limit: 10},
+		},
+		StoragePools: []StoragePool{
+			{Name: "cinder@lvm#lvm", VolumeBackendName: "lvm", FreeCapacityGB: 900, TotalCapacityGB: 1000},
+		},
+		VolumeServices: []VolumeService{
+			{Binary: "cinder-scheduler", Host: "cinder", Zone: "nova", State: "up", Status: "enabled"},
+			{Binary: "cinder-volume", Host: "cinder@lvm", Zone: "nova", State: "up", Status: "enabled"},
+		},
+		Servers: []Server{
+			{ID: "fake-server-id", Name: "fake-server"},
+		},
+		failures: map[string]int{},
+		requests: map[string]int{},
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST "+identityPrefix+"/auth/tokens", c.handleCreateToken)
+	mux.HandleFunc("GET "+computePrefix+"/os-availability-zone", c.handleComputeZones)
+	mux.HandleFunc("GET "+volumePrefix+"/os-availability-zone", c.handleVolumeZones)
+	mux.HandleFunc("GET "+volumePrefix+"/types", c.handleVolumeTypes)
+	mux.HandleFunc("GET "+volumePrefix+"/os-quota-sets/{project}", c.handleVolumeQuotas)
+	mux.HandleFunc("GET "+volumePrefix+"/scheduler-stats/get_pools", c.handleStoragePools)
+	mux.HandleFunc("GET "+volumePrefix+"/os-services", c.handleVolumeServices)
+	mux.HandleFunc("GET "+volumePrefix+"/volumes/detail", c.handleVolumes)
+	mux.HandleFunc("GET "+volumePrefix+"/volumes/{id}", c.handleVolume)
+	mux.HandleFunc("DELETE "+volumePrefix+"/volumes/{id}", c.handleDeleteVolume)
+	mux.HandleFunc("GET "+volumePrefix+"/snapshots", c.handleSnapshots)
+	mux.HandleFunc("DELETE "+volumePrefix+"/snapshots/{id}", c.handleDeleteSnapshot)
+	mux.HandleFunc("GET "+volumePrefix+"/backups", c.handleEmptyList("backups"))
+	mux.HandleFunc("GET "+volumePrefix+"/attachments/detail", c.handleEmptyList("attachments"))
+	mux.HandleFunc("DELETE "+volumePrefix+"/attachments/{id}", c.handleDeleteAttachment)
+	mux.HandleFunc("POST "+volumePrefix+"/volumes/{id}/action", c.handleVolumeAction)
+	mux.HandleFunc("GET "+computePrefix+"/servers", c.handleServers)
+	mux.HandleFunc("GET "+computePrefix+"/servers/detail", c.handleServers)
+	mux.HandleFunc("GET "+computePrefix+"/servers/{id}", c.handleServer)
+	mux.HandleFunc("GET "+computePrefix+"/servers/{id}/os-volume_attachments", c.handleEmptyList("volumeAttachments"))
+	mux.HandleFunc("GET "+imagePrefix+"/v2/images/{id}", c.handleImage)
+
+	c.Server = newServer(c.intercept(mux))
+
+	return c
+}
+
+// Close shuts down the fake cloud
+func (c *Cloud) Close() {
+	c.Server.Close()
+}
+
+// CABundle returns the PEM encoded certificate of a cloud created by NewTLS
+func (c *Cloud) CABundle() []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.Server.Certificate().Raw})
+}
+
+// Zones returns available availability zones with the given names
+func Zones(names ...string) []AvailabilityZone {
+	zones := make([]AvailabilityZone, 0, len(names))
+	for _, name := range names {
+		zones = append(zones, AvailabilityZone{Name: name, Available: true})
+	}
+	return zones
+}
+
+// ClientOpts returns options for connecting to the fake cloud
+func (c *Cloud) ClientOpts() *clientconfig.ClientOpts {
+	return &clientconfig.ClientOpts{
+		AuthInfo: &clientconfig.AuthInfo{
+			AuthURL:     c.Server.URL + identityPrefix,
+			Username:    Username,
+			Password:    Password,
+			ProjectName: ProjectName,
+			DomainName:  "Default",
+		},
+		RegionName: Region,
+	}
+}
+
+// CloudsYAML returns a clouds.yaml describing the fake cloud as the cloud
+// named 'openstack', as provisioned by the Cloud Credential Operator
+func (c *Cloud) CloudsYAML() []byte {
+	return []byte(fmt.Sprintf(`clouds:
+  openstack:
+    auth:
+      auth_url: %s
+      username: %s
+      password: %s
+      project_name: %s
+      user_domain_name: Default
+      project_domain_name: Default
+    region_name: %s
+`, c.Server.URL+identityPrefix, Username, Password, ProjectName, Region))
+}
+
+// Fail causes subsequent requests to the given service ("identity", "compute"
+// or "volume"), method and path (relative to the service endpoint) to fail
+// with the given HTTP status code. A status code of 0 clears the failure.
+func (c *Cloud) Fail(service, method, path string, status int) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	key := requestKey(service, method, path)
+	if status == 0 {
+		delete(c.failures, key)
+	} else {
+		c.failures[key] = status
+	}
+}
+
+// Requests returns the number of requests received for the given service,
+// method and path
+func (c *Cloud) Requests(service, method, path string) int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.requests[requestKey(service, method, path)]
+}
+
+func requestKey(service, method, path string) string {
+	return fmt.Sprintf("%s %s %s", service, method, path)
+}
+
+// intercept records requests and injects any configured failures
+func (c *Cloud) intercept(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var service, path string
+		for _, s := range []struct{ service, prefix string }{
+			{"identity", identityPrefix},
+			{"compute", computePrefix},
+			{"volume", volumePrefix},
+			{"image", imagePrefix},
+		} {
+			if strings.HasPrefix(r.URL.Path, s.prefix) {
+				service = s.service
+				path = strings.TrimPrefix(r.URL.Path, s.prefix)
+				break
+			}
+		}
+		key := requestKey(service, r.Method, path)
+
+		w.Header().Set("X-Openstack-Request-Id", RequestID)
+
+		c.lock.Lock()
+		c.requests[key]++
+		status, fail := c.failures[key]
+		c.lock.Unlock()
+
+		if fail {
+			writeJSON(w, status, map[string]interface{}{
+				"error": map[string]interface{}{
+					"code":    status,
+					"message": "injected failure",
+				},
+			})
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// tokenRequest is the subset of a Keystone token request the fake checks
+type tokenRequest struct {
+	Auth struct {
+		Identity struct {
+			Methods  []string `json:"methods"`
+			Password struct {
+				User struct {
+					Password string `json:"password"`
+				} `json:"user"`
+			} `json:"password"`
+			ApplicationCredential struct {
+				Secret string `json:"secret"`
+			} `json:"application_credential"`
+		} `json:"identity"`
+		Scope map[string]interface{} `json:"scope"`
+	} `json:"auth"`
+}
+
+// handleCreateToken issues a token for the fake user's password or the fake
+// application credential. Like Keystone, a token which is not scoped to
+// a project has no service catalog.
+func (c *Cloud) handleCreateToken(w http.ResponseWriter, r *http.Request) {
+	var req tokenRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]interface{}{
+			"error": map[string]interface{}{"code": http.StatusBadRequest, "message": err.Error()},
+		})
+		return
+	}
+
+	identity := req.Auth.Identity
+	applicationCredential := len(identity.Methods) == 1 && identity.Methods[0] == "application_credential"
+	if (applicationCredential && identity.ApplicationCredential.Secret != ApplicationCredentialSecret) ||
+		(!applicationCredential && identity.Password.User.Password != Password) {
+		writeJSON(w, http.StatusUnauthorized, map[string]interface{}{
+			"error": map[string]interface{}{"code": http.StatusUnauthorized, "message": "The request you have made requires authentication."},
+		})
+		return
+	}
+
+	endpoint := func(url string) []map[string]interface{} {
+		return []map[string]interface{}{
+			{
+				"id":        "fake-endpoint-id",
+				"interface": "public",
+				"region":    Region,
+				"region_id": Region,
+				"url":       url,
+			},
+		}
+	}
+
+	token := map[string]interface{}{
+		"methods":    identity.Methods,
+		"expires_at": time.Now().Add(time.Hour).UTC().Format("2006-01-02T15:04:05.000000Z"),
+		"issued_at":  time.Now().UTC().Format("2006-01-02T15:04:05.000000Z"),
+		"user": map[string]interface{}{
+			"id":     "fake-user-id",
+			"name":   Username,
+			"domain": map[string]interface{}{"id": "default", "name": "Default"},
+		},
+	}
+
+	if _, ok := req.Auth.Scope["project"]; ok || applicationCredential {
+		token["project"] = map[string]interface{}{
+			"id":     ProjectID,
+			"name":   ProjectName,
+			"domain": map[string]interface{}{"id": "default", "name": "Default"},
+		}
+
+		var catalog []map[string]interface{}
+		for _, service := range []struct{ id, serviceType, name, url string }{
+			{"fake-identity-id", "identity", "keystone", c.Server.URL + identityPrefix},
+			{"fake-compute-id", "compute", "nova", c.Server.URL + computePrefix},
+			{"fake-volume-id", "volumev3", "cinder", c.Server.URL + volumePrefix},
+			{"fake-image-id", "image", "glance", c.Server.URL + imagePrefix},
+		} {
+			if slices.Contains(c.MissingServices, service.serviceType) {
+				continue
+			}
+			catalog = append(catalog, map[string]interface{}{
+				"id":        service.id,
+				"type":      service.serviceType,
+				"name":      service.name,
+				"endpoints": endpoint(service.url),
+			})
+		}
+		token["catalog"] = catalog
+	}
+
+	w.Header().Set("X-Subject-Token", "fake-token")
+	writeJSON(w, http.StatusCreated, map[string]interface{}{
+		"token": token,
+	})
+}
+
+func (c *Cloud) handleComputeZones(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"availabilityZoneInfo": zoneInfo(c.ComputeZones),
+	})
+}
+
+func (c *Cloud) handleVolumeZones(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"availabilityZoneInfo": zoneInfo(c.VolumeZones),
+	})
+}
+
+func (c *Cloud) handleVolumeTypes(w http.ResponseWriter, r *http.Request) {
+	types := make([]map[string]interface{}, 0, len(c.VolumeTypes))
+	for _, t := range c.VolumeTypes {
+		extraSpecs := t.ExtraSpecs
+		if extraSpecs == nil {
+			extraSpecs = map[string]string{}
+		}
+		types = append(types, map[string]interface{}{
+			"id":          t.ID,
+			"name":        t.Name,
+			"extra_specs": extraSpecs,
+			"is_public":   true,
+		})
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"volume_types": types,
+	})
+}
+
+func (c *Cloud) handleVolumeQuotas(w http.ResponseWriter, r *http.Request) {
+	if r.PathValue("project") != ProjectID {
+		writeJSON(w, http.StatusForbidden, map[string]interface{}{
+			"forbidden": map[string]interface{}{
+				"code":    http.StatusForbidden,
+				"message": "Policy doesn't allow this operation to be performed.",
+			},
+		})
+		return
+	}
+
+	quotaSet := map[string]interface{}{
+		"id": ProjectID,
+	}
+	for name, q := range c.VolumeQuotas {
+		if r.URL.Query().Get("usage") == "true" {
+			quotaSet[name] = map[string]interface{}{
+				"in_use":    q.InUse,
+				"reserved":  q.Reserved,
+				"limit":     q.Limit,
+				"allocated": 0,
+			}
+		} else {
+			quotaSet[name] = q.Limit
+		}
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"quota_set": quotaSet,
+	})
+}
+
+func (c *Cloud) handleStoragePools(w http.ResponseWriter, r *http.Request) {
+	capacity := func(gb float64) interface{} {
+		if math.IsInf(gb, 1) {
+			return "infinite"
+		}
+		return gb
+	}
+
+	pools := make([]map[string]interface{}, 0, len(c.StoragePools))
+	for _, pool := range c.StoragePools {
+		pools = append(pools, map[string]interface{}{
+			"name": pool.Name,
+			"capabilities": map[string]interface{}{
+				"volume_backend_name": pool.VolumeBackendName,
+				"free_capacity_gb":    capacity(pool.FreeCapacityGB),
+				"total_capacity_gb":   capacity(pool.TotalCapacityGB),
+			},
+		})
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"pools": pools,
+	})
+}
+
+func (c *Cloud) handleVolumeServices(w http.ResponseWriter, r *http.Request) {
+	binary := r.URL.Query().Get("binary")
+
+	services := make([]map[string]interface{}, 0, len(c.VolumeServices))
+	for _, service := range c.VolumeServices {
+		if binary != "" && service.Binary != binary {
+			continue
+		}
+		updatedAt := service.UpdatedAt
+		if updatedAt.IsZero() {
+			updatedAt = time.Now()
+		}
+		services = append(services, map[string]interface{}{
+			"binary":     service.Binary,
+			"host":       service.Host,
+			"zone":       service.Zone,
+			"state":      service.State,
+			"status":     service.Status,
+			"updated_at": updatedAt.UTC().Format("2006-01-02T15:04:05.000000"),
+		})
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"services": services,
+	})
+}
+
+// handleVolumes lists the volumes, filtered by the metadata query parameter
+func (c *Cloud) handleVolumes(w http.ResponseWriter, r *http.Request) {
+	filter := metadataFilter(r)
+	now := time.Now()
+
+	volumes := make([]map[string]interface{}, 0, len(c.Volumes))
+	for _, volume := range c.Volumes {
+		if !matchesMetadata(volume.Metadata, filter) {
+			continue
+		}
+		volumes = append(volumes, volumeInfo(volume, now))
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"volumes": volumes,
+	})
+}
+
+func (c *Cloud) handleVolume(w http.ResponseWriter, r *http.Request) {
+	for _, volume := range c.Volumes {
+		if volume.ID == r.PathValue("id") {
+			writeJSON(w, http.StatusOK, map[string]interface{}{
+				"volume": volumeInfo(volume, time.Now()),
+			})
+			return
+		}
+	}
+	writeJSON(w, http.StatusNotFound, map[string]interface{}{
+		"itemNotFound": map[string]interface{}{"code": http.StatusNotFound, "message": "Volume could not be found"},
+	})
+}
+
+// volumeInfo returns the API representation of the volume, with timestamps
+// which aren't set defaulting to now
+func volumeInfo(volume Volume, now time.Time) map[string]interface{} {
+	timestamp := func(t time.Time) string {
+		if t.IsZero() {
+			t = now
+		}
+		return t.UTC().Format("2006-01-02T15:04:05.000000")
+	}
+
+	metadata := volume.Metadata
+	if metadata == nil {
+		metadata = map[string]string{}
+	}
+	attachments := make([]map[string]interface{}, 0, len(volume.Attachments))
+	for _, attachment := range volume.Attachments {
+		attachments = append(attachments, map[string]interface{}{
+			"id":            volume.ID,
+			"attachment_id": attachment.AttachmentID,
+			"server_id":     attachment.ServerID,
+			"volume_id":     volume.ID,
+			"attached_at":   timestamp(volume.UpdatedAt),
+		})
+	}
+	info := map[string]interface{}{
+		"id":                volume.ID,
+		"name":              volume.Name,
+		"status":            volume.Status,
+		"size":              volume.Size,
+		"availability_zone": volume.Zone,
+		"bootable":          strconv.FormatBool(volume.Bootable),
+		"metadata":          metadata,
+		"attachments":       attachments,
+		"created_at":        timestamp(volume.CreatedAt),
+		"updated_at":        timestamp(volume.UpdatedAt),
+	}
+	if volume.ImageMetadata != nil {
+		info["volume_image_metadata"] = volume.ImageMetadata
+	}
+	return info
+}
+
+// handleDeleteVolume removes the volume from Volumes
+func (c *Cloud) handleDeleteVolume(w http.ResponseWriter, r *http.Request) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	for i, volume := range c.Volumes {
+		if volume.ID == r.PathValue("id") {
+			c.Volumes = append(c.Volumes[:i], c.Volumes[i+1:]...)
+			w.WriteHeader(http.StatusAccepted)
+			return
+		}
+	}
+	writeJSON(w, http.StatusNotFound, map[string]interface{}{
+		"itemNotFound": map[string]interface{}{"code": http.StatusNotFound, "message": "Volume could not be found"},
+	})
+}
+
+// handleSnapshots lists the snapshots, filtered by the metadata query
+// parameter like handleVolumes
+func (c *Cloud) handleSnapshots(w http.ResponseWriter, r *http.Request) {
+	filter := metadataFilter(r)
+	now := time.Now()
+
+	snapshots := make([]map[string]interface{}, 0, len(c.Snapshots))
+	for _, snapshot := range c.Snapshots {
+		if !matchesMetadata(snapshot.Metadata, filter) {
+			continue
+		}
+
+		metadata := snapshot.Metadata
+		if metadata == nil {
+			metadata = map[string]string{}
+		}
+		createdAt := snapshot.CreatedAt
+		if createdAt.IsZero() {
+			createdAt = now
+		}
+		snapshots = append(snapshots, map[string]interface{}{
+			"id":         snapshot.ID,
+			"name":       snapshot.Name,
+			"volume_id":  snapshot.VolumeID,
+			"status":     snapshot.Status,
+			"size":       snapshot.Size,
+			"metadata":   metadata,
+			"created_at": createdAt.UTC().Format("2006-01-02T15:04:05.000000"),
+		})
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"snapshots": snapshots,
+	})
+}
+
+// handleDeleteSnapshot removes the snapshot from Snapshots
+func (c *Cloud) handleDeleteSnapshot(w http.ResponseWriter, r *http.Request) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	for i, snapshot := range c.Snapshots {
+		if snapshot.ID == r.PathValue("id") {
+			c.Snapshots = append(c.Snapshots[:i], c.Snapshots[i+1:]...)
+			w.WriteHeader(http.StatusAccepted)
+			return
+		}
+	}
+	writeJSON(w, http.StatusNotFound, map[string]interface{}{
+		"itemNotFound": map[string]interface{}{"code": http.StatusNotFound, "message": "Snapshot could not be found"},
+	})
+}
+
+// handleDeleteAttachment removes the attachment from its volume
+func (c *Cloud) handleDeleteAttachment(w http.ResponseWriter, r *http.Request) {
+	if !c.removeAttachment("", r.PathValue("id")) {
+		writeJSON(w, http.StatusNotFound, map[string]interface{}{
+			"itemNotFound": map[string]interface{}{"code": http.StatusNotFound, "message": "Attachment could not be found"},
+		})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{})
+}
+
+// handleVolumeAction supports only the os-force_detach action, which removes
+// the attachment from the volume
+func (c *Cloud) handleVolumeAction(w http.ResponseWriter, r *http.Request) {
+	var action struct {
+		ForceDetach *struct {
+			AttachmentID string `json:"attachment_id"`
+		} `json:"os-force_detach"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&action); err != nil || action.ForceDetach == nil {
+		writeJSON(w, http.StatusBadRequest, map[string]interface{}{
+			"badRequest": map[string]interface{}{"code": http.StatusBadRequest, "message": "Unsupported volume action"},
+		})
+		return
+	}
+
+	if !c.removeAttachment(r.PathValue("id"), action.ForceDetach.AttachmentID) {
+		writeJSON(w, http.StatusNotFound, map[string]interface{}{
+			"itemNotFound": map[string]interface{}{"code": http.StatusNotFound, "message": "Attachment could not be found"},
+		})
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// removeAttachment removes the attachment with the given ID from the volume
+// with the given ID, or from any volume if volumeID is empty. A volume with
+// no attachments left becomes available.
+func (c *Cloud) removeAttachment(volumeID, attachmentID string) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	for i := range c.Volumes {
+		volume := &c.Volumes[i]
+		if volumeID != "" && volume.ID != volumeID {
+			continue
+		}
+		for j, attachment := range volume.Attachments {
+			if attachment.AttachmentID != attachmentID {
+				continue
+			}
+			volume.Attachments = append(volume.Attachments[:j], volume.Attachments[j+1:]...)
+			if len(volume.Attachments) == 0 {
+				volume.Status = "available"
+			}
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Cloud) handleServers(w http.ResponseWriter, r *http.Request) {
+	// like Nova, the name filter is a regular expression
+	var nameFilter *regexp.Regexp
+	if name := r.URL.Query().Get("name"); name != "" {
+		var err error
+		if nameFilter, err = regexp.Compile(name); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]interface{}{
+				"badRequest": map[string]interface{}{"code": http.StatusBadRequest, "message": err.Error()},
+			})
+			return
+		}
+	}
+
+	servers := make([]map[string]interface{}, 0, len(c.Servers))
+	for _, server := range c.Servers {
+		if nameFilter != nil && !nameFilter.MatchString(server.Name) {
+			continue
+		}
+		servers = append(servers, map[string]interface{}{
+			"id":   server.ID,
+			"name": server.Name,
+		})
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"servers": servers,
+	})
+}
+
+func (c *Cloud) handleServer(w http.ResponseWriter, r *http.Request) {
+	for _, server := range c.Servers {
+		if server.ID != r.PathValue("id") {
+			continue
+		}
+
+		// like Nova, the image is an empty string when booted from a volume
+		var image interface{} = ""
+		if server.ImageID != "" {
+			image = map[string]interface{}{"id": server.ImageID}
+		}
+		zone := server.Zone
+		if zone == "" {
+			zone = "nova"
+		}
+		extraSpecs := server.FlavorExtraSpecs
+		if extraSpecs == nil {
+			extraSpecs = map[string]string{}
+		}
+		attached := make([]map[string]interface{}, 0, len(server.AttachedVolumes))
+		for _, id := range server.AttachedVolumes {
+			attached = append(attached, map[string]interface{}{"id": id})
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"server": map[string]interface{}{
+				"id":                                   server.ID,
+				"name":                                 server.Name,
+				"image":                                image,
+				"OS-EXT-AZ:availability_zone":          zone,
+				"flavor":                               map[string]interface{}{"original_name": server.Flavor, "extra_specs": extraSpecs},
+				"os-extended-volumes:volumes_attached": attached,
+			},
+		})
+		return
+	}
+	writeJSON(w, http.StatusNotFound, map[string]interface{}{
+		"itemNotFound": map[string]interface{}{"code": http.StatusNotFound, "message": "Instance could not be found"},
+	})
+}
+
+func (c *Cloud) handleImage(w http.ResponseWriter, r *http.Request) {
+	for _, image := range c.Images {
+		if image.ID != r.PathValue("id") {
+			continue
+		}
+
+		// like Glance, properties are top-level keys of the image
+		info := map[string]interface{}{}
+		for key, value := range image.Properties {
+			info[key] = value
+		}
+		info["id"] = image.ID
+		info["status"] = "active"
+		info["created_at"] = "2024-01-01T00:00:00Z"
+		info["updated_at"] = "2024-01-01T00:00:00Z"
+		writeJSON(w, http.StatusOK, info)
+		return
+	}
+	writeJSON(w, http.StatusNotFound, map[string]interface{}{
+		"itemNotFound": map[string]interface{}{"code": http.StatusNotFound, "message": "Image could not be found"},
+	})
+}
+
+// handleEmptyList serves an empty list of the resources with the given key
+func (c *Cloud) handleEmptyList(key string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			key: []interface{}{},
+		})
+	}
+}
+
+// metadataFilter parses the metadata query parameter of the request, which
+// is of the form {'key':'value', ...}
+func metadataFilter(r *http.Request) map[string]string {
+	filter := map[string]string{}
+	if metadata := r.URL.Query().Get("metadata"); metadata != "" {
+		for _, pair := range strings.Split(strings.Trim(metadata, "{}"), ",") {
+			key, value, _ := strings.Cut(strings.TrimSpace(pair), ":")
+			filter[strings.Trim(key, "'")] = strings.Trim(value, "'")
+		}
+	}
+	return filter
+}
+
+func matchesMetadata(metadata, filter map[string]string) bool {
+	for key, value := range filter {
+		if metadata[key] != value {
+			return false
+		}
+	}
+	return true
+}
+
+func zoneInfo(zones []AvailabilityZone) []map[string]interface{} {
+	info := make([]map[string]interface{}, 0, len(zones))
+	for _, zone := range zones {
+		info = append(info, map[string]interface{}{
+			"zoneName":  zone.Name,
+			"zoneState": map[string]interface{}{"available": zone.Available},
+			"hosts":     nil,
+		})
+	}
+	return info
+}
+
+func writeJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(body)
+}
@@ -0,0 +1,194 @@
+package cloudinfo
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/gophercloud/utils/v2/openstack/clientconfig"
+	"golang.org/x/net/http/httpproxy"
+	"k8s.io/klog/v2"
+)
+
+// requestTimeout bounds each request to OpenStack, so that an unresponsive
+// endpoint can't stall the controllers
+const requestTimeout = time.Minute
+
+// HTTPConfig configures the HTTP client used to talk to OpenStack
+type HTTPConfig struct {
+	HTTPProxy  string
+	HTTPSProxy string
+	NoProxy    string
+	// CABundle contains PEM encoded CA certificates to trust in addition to
+	// the system roots
+	CABundle []byte
+}
+
+// HTTPConfigFunc returns the HTTPConfig the client should currently use. It
+// is called whenever a client is created, so must be cheap.
+type HTTPConfigFunc func() (*HTTPConfig, error)
+
+// tlsSettings are the TLS settings of the cloud in clouds.yaml
+type tlsSettings struct {
+	CACert     []byte
+	ClientCert []byte
+	ClientKey  []byte
+	Insecure   bool
+}
+
+// getHTTPClient returns the HTTP client for the current HTTPConfig, and a
+// hash of its configuration. The client is only rebuilt if the HTTPConfig or
+// the TLS settings of the cloud have changed since the last call, so that
+// connections can be reused. If there is no HTTPConfigFunc, the client uses
+// the proxy settings in the environment.
+func (p *openStackProvider) getHTTPClient() (*http.Client, string, error) {
+	httpConfig := &HTTPConfig{}
+	if p.httpConfig != nil {
+		var err error
+		httpConfig, err = p.httpConfig()
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to get the OpenStack HTTP client configuration: %w", err)
+		}
+		if httpConfig == nil {
+			httpConfig = &HTTPConfig{}
+		}
+	}
+
+	tlsSettings, err := p.getTLSSettings()
+	if err != nil {
+		return nil, "", err
+	}
+
+	hash, err := hashObjects(httpConfig, tlsSettings)
+	if err != nil {
+		return nil, "", err
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.httpClient != nil && p.httpClientHash == hash {
+		return p.httpClient, hash, nil
+	}
+
+	httpClient, err := newHTTPClient(httpConfig, tlsSettings)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if p.httpClient != nil {
+		klog.Infof("Rebuilding the OpenStack HTTP client as its proxy or CA bundle configuration changed")
+		p.httpClient.CloseIdleConnections()
+	}
+	p.httpClient = httpClient
+	p.httpClientHash = hash
+
+	return httpClient, hash, nil
+}
+
+// getTLSSettings reads the TLS settings of the cloud from clouds.yaml. These
+// would otherwise be ignored once we provide our own HTTP client.
+func (p *openStackProvider) getTLSSettings() (*tlsSettings, error) {
+	settings := &tlsSettings{}
+	if p.opts.Cloud == "" {
+		return settings, nil
+	}
+
+	cloud, err := clientconfig.GetCloudFromYAML(p.opts)
+	if err != nil {
+		return nil, err
+	}
+
+	if cloud.Verify != nil {
+		settings.Insecure = !*cloud.Verify
+	}
+
+	// clouds.yaml is written for the driver, so the CA bundle it references
+	// may not be mounted in our pod. We get the same bundle from the
+	// HTTPConfig.
+	for _, f := range []struct {
+		path     string
+		data     *[]byte
+		optional bool
+	}{
+		{cloud.CACertFile, &settings.CACert, true},
+		{cloud.ClientCertFile, &settings.ClientCert, false},
+		{cloud.ClientKeyFile, &settings.ClientKey, false},
+	} {
+		if f.path == "" {
+			continue
+		}
+		*f.data, err = os.ReadFile(f.path)
+		if err != nil {
+			if os.IsNotExist(err) && f.optional {
+				klog.V(4).Infof("Ignoring %s referenced by clouds.yaml as it does not exist", f.path)
+				continue
+			}
+			return nil, fmt.Errorf("failed to read %s referenced by clouds.yaml: %w", f.path, err)
+		}
+	}
+
+	return settings, nil
+}
+
+func newHTTPClient(httpConfig *HTTPConfig, tlsSettings *tlsSettings) (*http.Client, error) {
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: tlsSettings.Insecure,
+	}
+
+	if len(httpConfig.CABundle) > 0 || len(tlsSettings.CACert) > 0 {
+		rootCAs, err := x509.SystemCertPool()
+		if err != nil {
+			rootCAs = x509.NewCertPool()
+		}
+		for _, bundle := range [][]byte{httpConfig.CABundle, tlsSettings.CACert} {
+			if len(bundle) > 0 && !rootCAs.AppendCertsFromPEM(bundle) {
+				return nil, fmt.Errorf("failed to parse the CA bundle: no valid certificates found")
+			}
+		}
+		tlsConfig.RootCAs = rootCAs
+	}
+
+	if len(tlsSettings.ClientCert) > 0 {
+		cert, err := tls.X509KeyPair(tlsSettings.ClientCert, tlsSettings.ClientKey)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load the client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+
+	if httpConfig.HTTPProxy != "" || httpConfig.HTTPSProxy != "" {
+		proxyFunc := (&httpproxy.Config{
+			HTTPProxy:  httpConfig.HTTPProxy,
+			HTTPSProxy: httpConfig.HTTPSProxy,
+			NoProxy:    httpConfig.NoProxy,
+		}).ProxyFunc()
+		transport.Proxy = func(req *http.Request) (*url.URL, error) {
+			return proxyFunc(req.URL)
+		}
+	}
+
+	return &http.Client{Transport: transport, Timeout: requestTimeout}, nil
+}
+
+func hashObjects(objects ...interface{}) (string, error) {
+	hash := sha256.New()
+	for _, o := range objects {
+		data, err := json.Marshal(o)
+		if err != nil {
+			return "", err
+		}
+		hash.Write(data)
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
@@ -0,0 +1,87 @@
+package cloudinfo_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"sync/atomic"
+	"testing"
+
+	. "github.com/onsi/gomega"
+
+	"github.com/openshift/openstack-cinder-csi-driver-operator/pkg/cloudinfo"
+	"github.com/openshift/openstack-cinder-csi-driver-operator/pkg/cloudinfo/fake"
+)
+
+func TestHTTPConfigCABundle(t *testing.T) {
+	g := NewWithT(t)
+
+	cloud := fake.NewTLS()
+	defer cloud.Close()
+
+	// the certificate of the cloud isn't trusted by default
+	_, err := cloudinfo.NewProvider(cloud.ClientOpts(), nil).GetCloudInfo(context.TODO())
+	g.Expect(err).To(MatchError(ContainSubstring("certificate")))
+
+	httpConfig := &cloudinfo.HTTPConfig{}
+	provider := cloudinfo.NewProvider(cloud.ClientOpts(), func() (*cloudinfo.HTTPConfig, error) {
+		return httpConfig, nil
+	})
+
+	_, err = provider.GetCloudInfo(context.TODO())
+	g.Expect(err).To(MatchError(ContainSubstring("certificate")))
+
+	// the client is rebuilt once the CA bundle is added
+	httpConfig = &cloudinfo.HTTPConfig{CABundle: cloud.CABundle()}
+	_, err = provider.GetCloudInfo(context.TODO())
+	g.Expect(err).ToNot(HaveOccurred())
+
+	httpConfig = &cloudinfo.HTTPConfig{CABundle: []byte("not a certificate")}
+	_, err = provider.GetCloudInfo(context.TODO())
+	g.Expect(err).To(MatchError(ContainSubstring("failed to parse the CA bundle")))
+}
+
+func TestHTTPConfigProxy(t *testing.T) {
+	g := NewWithT(t)
+
+	cloud := fake.New()
+	defer cloud.Close()
+
+	cloudURL, err := url.Parse(cloud.Server.URL)
+	g.Expect(err).ToNot(HaveOccurred())
+
+	var proxied atomic.Int32
+	reverseProxy := httputil.NewSingleHostReverseProxy(cloudURL)
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxied.Add(1)
+		reverseProxy.ServeHTTP(w, r)
+	}))
+	defer proxy.Close()
+
+	// requests to loopback addresses are never proxied, so the auth URL
+	// uses a name which is only reachable through the proxy. The catalog
+	// still points at the loopback address.
+	opts := cloud.ClientOpts()
+	opts.AuthInfo.AuthURL = "http://keystone.invalid/identity/v3"
+
+	_, err = cloudinfo.NewProvider(opts, nil).GetCloudInfo(context.TODO())
+	g.Expect(err).To(HaveOccurred())
+	g.Expect(proxied.Load()).To(BeZero())
+
+	provider := cloudinfo.NewProvider(opts, func() (*cloudinfo.HTTPConfig, error) {
+		return &cloudinfo.HTTPConfig{HTTPProxy: proxy.URL}, nil
+	})
+	_, err = provider.GetCloudInfo(context.TODO())
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(proxied.Load()).ToNot(BeZero())
+
+	provider = cloudinfo.NewProvider(opts, func() (*cloudinfo.HTTPConfig, error) {
+		return &cloudinfo.HTTPConfig{HTTPProxy: proxy.URL, NoProxy: ".invalid"}, nil
+	})
+	proxied.Store(0)
+	_, err = provider.GetCloudInfo(context.TODO())
+	g.Expect(err).To(HaveOccurred())
+	g.Expect(proxied.Load()).To(BeZero())
+}
@@ -0,0 +1,174 @@
+package cloudinfo
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/gophercloud/gophercloud/v2"
+	"github.com/gophercloud/gophercloud/v2/openstack/blockstorage/v3/attachments"
+	"github.com/gophercloud/gophercloud/v2/openstack/blockstorage/v3/backups"
+	"github.com/gophercloud/gophercloud/v2/openstack/blockstorage/v3/snapshots"
+	"github.com/gophercloud/gophercloud/v2/openstack/blockstorage/v3/volumes"
+	"github.com/gophercloud/gophercloud/v2/openstack/compute/v2/servers"
+	"github.com/gophercloud/gophercloud/v2/openstack/compute/v2/volumeattach"
+	"github.com/gophercloud/gophercloud/v2/pagination"
+)
+
+// PermissionStatus is the result of checking a Permission
+type PermissionStatus string
+
+const (
+	PermissionAllowed PermissionStatus = "Allowed"
+	PermissionDenied  PermissionStatus = "Denied"
+	// PermissionUnknown is used if the check failed for any reason other
+	// than the request being forbidden
+	PermissionUnknown PermissionStatus = "Unknown"
+)
+
+// attachmentsMicroversion is the Cinder microversion that introduced the
+// attachments API
+const attachmentsMicroversion = "3.27"
+
+// Permission is an OpenStack permission needed by the driver. Each is checked
+// with a read-only list call which is governed by the same policy rule as the
+// calls the driver makes, as we can't create resources to find out.
+type Permission struct {
+	// Name is CamelCase, e.g. 'ListVolumes'
+	Name string
+	// Service is the OpenStack service, 'volume' or 'compute'
+	Service string
+	// Required is false if the permission is only needed by optional
+	// features
+	Required bool
+	// NeededFor describes what the driver can't do without the permission
+	NeededFor string
+
+	check func(ctx context.Context, client *gophercloud.ServiceClient) error
+}
+
+// PermissionCheck is the result of checking a Permission
+type PermissionCheck struct {
+	Permission
+	Status PermissionStatus
+	// Message describes why the status is Denied or Unknown
+	Message string
+}
+
+// Permissions are the permissions checked by CheckPermissions
+var Permissions = []Permission{
+	{
+		Name:      "ListVolumes",
+		Service:   "volume",
+		Required:  true,
+		NeededFor: "create, delete and extend volumes",
+		check: func(ctx context.Context, client *gophercloud.ServiceClient) error {
+			return firstPage(ctx, volumes.List(client, volumes.ListOpts{Limit: 1}))
+		},
+	},
+	{
+		Name:      "ListSnapshots",
+		Service:   "volume",
+		Required:  true,
+		NeededFor: "create and delete volume snapshots",
+		check: func(ctx context.Context, client *gophercloud.ServiceClient) error {
+			return firstPage(ctx, snapshots.List(client, snapshots.ListOpts{Limit: 1}))
+		},
+	},
+	{
+		Name:      "ListServerVolumeAttachments",
+		Service:   "compute",
+		Required:  true,
+		NeededFor: "attach and detach volumes",
+		check:     checkServerVolumeAttachments,
+	},
+	{
+		Name:      "ListVolumeAttachments",
+		Service:   "volume",
+		Required:  false,
+		NeededFor: "inspect volume attachments in Cinder",
+		check: func(ctx context.Context, client *gophercloud.ServiceClient) error {
+			client.Microversion = attachmentsMicroversion
+			return firstPage(ctx, attachments.List(client, attachments.ListOpts{Limit: 1}))
+		},
+	},
+	{
+		Name:      "ListBackups",
+		Service:   "volume",
+		Required:  false,
+		NeededFor: "create volume snapshots of the 'backup' type",
+		check: func(ctx context.Context, client *gophercloud.ServiceClient) error {
+			return firstPage(ctx, backups.List(client, backups.ListOpts{Limit: 1}))
+		},
+	},
+}
+
+// CheckPermissions checks each of the Permissions. An error is only returned
+// if we couldn't connect to OpenStack at all, as reported by
+// ValidateCredentials.
+func (p *openStackProvider) CheckPermissions(ctx context.Context) ([]PermissionCheck, error) {
+	clients := map[string]*gophercloud.ServiceClient{}
+	for _, permission := range Permissions {
+		if _, ok := clients[permission.Service]; ok {
+			continue
+		}
+		client, err := p.newServiceClient(ctx, permission.Service)
+		if err != nil {
+			return nil, err
+		}
+		clients[permission.Service] = client
+	}
+
+	checks := make([]PermissionCheck, 0, len(Permissions))
+	for _, permission := range Permissions {
+		// copy the client, as checks may set a microversion
+		client := *clients[permission.Service]
+
+		check := PermissionCheck{
+			Permission: permission,
+			Status:     PermissionAllowed,
+		}
+		if err := permission.check(ctx, &client); err != nil {
+			check.Status = PermissionUnknown
+			if gophercloud.ResponseCodeIs(err, http.StatusForbidden) {
+				check.Status = PermissionDenied
+			}
+			check.Message = err.Error()
+		}
+		checks = append(checks, check)
+	}
+
+	return checks, nil
+}
+
+// checkServerVolumeAttachments lists the volume attachments of any server in
+// the project. There must be at least one, as the cluster runs on it.
+func checkServerVolumeAttachments(ctx context.Context, client *gophercloud.ServiceClient) error {
+	var serverID string
+	err := servers.ListSimple(client, servers.ListOpts{Limit: 1}).EachPage(ctx, func(_ context.Context, page pagination.Page) (bool, error) {
+		s, err := servers.ExtractServers(page)
+		if err != nil {
+			return false, err
+		}
+		if len(s) > 0 {
+			serverID = s[0].ID
+		}
+		return false, nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to list servers: %w", err)
+	}
+	if serverID == "" {
+		return fmt.Errorf("no servers found to check against")
+	}
+
+	return firstPage(ctx, volumeattach.List(client, serverID))
+}
+
+// firstPage fetches only the first page of pager, which is all that is needed
+// to find out whether we are permitted to list the resource
+func firstPage(ctx context.Context, pager pagination.Pager) error {
+	return pager.EachPage(ctx, func(context.Context, pagination.Page) (bool, error) {
+		return false, nil
+	})
+}
@@ -0,0 +1,83 @@
+package cloudinfo
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/gophercloud/gophercloud/v2"
+	"github.com/gophercloud/gophercloud/v2/openstack/blockstorage/v3/quotasets"
+	"github.com/gophercloud/gophercloud/v2/openstack/identity/v3/tokens"
+)
+
+// QuotaUsage describes the usage of a single Cinder quota
+type QuotaUsage struct {
+	InUse    int
+	Reserved int
+	// Limit is negative if the quota is unlimited
+	Limit int
+}
+
+// Used returns the amount of the quota consumed, including reservations
+func (q QuotaUsage) Used() int {
+	return q.InUse + q.Reserved
+}
+
+// VolumeQuotas describes the Cinder quota usage of the project
+type VolumeQuotas struct {
+	Volumes   QuotaUsage
+	Gigabytes QuotaUsage
+	Snapshots QuotaUsage
+}
+
+// GetVolumeQuotas fetches the Cinder quota usage of the project we are
+// authenticated against
+func (p *openStackProvider) GetVolumeQuotas(ctx context.Context) (*VolumeQuotas, error) {
+	volumeClient, err := p.newServiceClient(ctx, "volume")
+	if err != nil {
+		return nil, err
+	}
+
+	projectID, err := getProjectID(volumeClient)
+	if err != nil {
+		return nil, err
+	}
+
+	usage, err := quotasets.GetUsage(ctx, volumeClient, projectID).Extract()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get volume quota usage: %w", err)
+	}
+
+	convert := func(q quotasets.QuotaUsage) QuotaUsage {
+		return QuotaUsage{
+			InUse:    q.InUse,
+			Reserved: q.Reserved,
+			Limit:    q.Limit,
+		}
+	}
+
+	return &VolumeQuotas{
+		Volumes:   convert(usage.Volumes),
+		Gigabytes: convert(usage.Gigabytes),
+		Snapshots: convert(usage.Snapshots),
+	}, nil
+}
+
+// getProjectID returns the ID of the project the client's token is scoped to
+func getProjectID(client *gophercloud.ServiceClient) (string, error) {
+	result, ok := client.ProviderClient.GetAuthResult().(interface {
+		ExtractProject() (*tokens.Project, error)
+	})
+	if !ok {
+		return "", fmt.Errorf("failed to determine the project ID: unsupported authentication result")
+	}
+
+	project, err := result.ExtractProject()
+	if err != nil {
+		return "", fmt.Errorf("failed to determine the project ID: %w", err)
+	}
+	if project == nil || project.ID == "" {
+		return "", fmt.Errorf("failed to determine the project ID: token is not scoped to a project")
+	}
+
+	return project.ID, nil
+}
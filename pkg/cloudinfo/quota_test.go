@@ -0,0 +1,38 @@
+package cloudinfo_test
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	. "github.com/onsi/gomega"
+
+	"github.com/openshift/openstack-cinder-csi-driver-operator/pkg/cloudinfo"
+	"github.com/openshift/openstack-cinder-csi-driver-operator/pkg/cloudinfo/fake"
+)
+
+func TestGetVolumeQuotas(t *testing.T) {
+	g := NewWithT(t)
+
+	cloud := fake.New()
+	defer cloud.Close()
+
+	cloud.VolumeQuotas = map[string]fake.QuotaUsage{
+		"volumes":   {InUse: 4, Reserved: 1, Limit: 10},
+		"gigabytes": {InUse: 900, Limit: 1000},
+		"snapshots": {Limit: -1},
+	}
+
+	quotas, err := cloudinfo.NewProvider(cloud.ClientOpts(), nil).GetVolumeQuotas(context.TODO())
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(*quotas).To(Equal(cloudinfo.VolumeQuotas{
+		Volumes:   cloudinfo.QuotaUsage{InUse: 4, Reserved: 1, Limit: 10},
+		Gigabytes: cloudinfo.QuotaUsage{InUse: 900, Limit: 1000},
+		Snapshots: cloudinfo.QuotaUsage{Limit: -1},
+	}))
+	g.Expect(quotas.Volumes.Used()).To(Equal(5))
+
+	cloud.Fail("volume", http.MethodGet, "/os-quota-sets/"+fake.ProjectID, http.StatusForbidden)
+	_, err = cloudinfo.NewProvider(cloud.ClientOpts(), nil).GetVolumeQuotas(context.TODO())
+	g.Expect(err).To(MatchError(ContainSubstring("failed to get volume quota usage")))
+}
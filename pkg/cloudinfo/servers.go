@@ -0,0 +1,163 @@
+package cloudinfo
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"regexp"
+
+	"github.com/gophercloud/gophercloud/v2"
+	"github.com/gophercloud/gophercloud/v2/openstack/blockstorage/v3/volumes"
+	"github.com/gophercloud/gophercloud/v2/openstack/compute/v2/servers"
+	"github.com/gophercloud/gophercloud/v2/openstack/image/v2/images"
+)
+
+// embeddedFlavorMicroversion is the Nova microversion from which servers
+// include their flavor's name and extra specs
+const embeddedFlavorMicroversion = "2.47"
+
+// ServerDisks describes how volumes are attached to a Nova server
+type ServerDisks struct {
+	ServerID string
+	Flavor   string
+	// DiskBus and SCSIModel are the hw_disk_bus and hw_scsi_model properties
+	// of the server's image, or the hw:disk_bus and hw:scsi_model extra specs
+	// of its flavor, which are empty if not set
+	DiskBus   string
+	SCSIModel string
+}
+
+// GetServerDisks fetches the disk properties of the server with the given ID.
+// The image properties are read from the image the server was booted from,
+// or from the image metadata of its root volume if it was booted from
+// a volume. The flavor's extra specs are used for the properties the image
+// doesn't set.
+func (p *openStackProvider) GetServerDisks(ctx context.Context, serverID string) (*ServerDisks, error) {
+	computeClient, err := p.newServiceClient(ctx, "compute")
+	if err != nil {
+		return nil, err
+	}
+	computeClient.Microversion = embeddedFlavorMicroversion
+
+	server, err := servers.Get(ctx, computeClient, serverID).Extract()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get server %s: %w", serverID, err)
+	}
+
+	disks := &ServerDisks{ServerID: serverID}
+	if name, ok := server.Flavor["original_name"].(string); ok {
+		disks.Flavor = name
+	}
+	extraSpecs, _ := server.Flavor["extra_specs"].(map[string]interface{})
+
+	var properties map[string]string
+	if imageID, ok := server.Image["id"].(string); ok && imageID != "" {
+		properties, err = p.getImageProperties(ctx, imageID)
+	} else {
+		properties, err = p.getRootVolumeImageProperties(ctx, server.AttachedVolumes)
+	}
+	if err != nil {
+		return nil, err
+	}
+	disks.DiskBus = imageOrFlavorProperty(properties, extraSpecs, "hw_disk_bus", "hw:disk_bus")
+	disks.SCSIModel = imageOrFlavorProperty(properties, extraSpecs, "hw_scsi_model", "hw:scsi_model")
+
+	return disks, nil
+}
+
+// imageOrFlavorProperty returns the image property with the given name, or
+// the flavor extra spec if the image doesn't set it
+func imageOrFlavorProperty(properties map[string]string, extraSpecs map[string]interface{}, property, extraSpec string) string {
+	if value := properties[property]; value != "" {
+		return value
+	}
+	value, _ := extraSpecs[extraSpec].(string)
+	return value
+}
+
+// getImageProperties returns the string properties of the image. There are
+// none if the image has been deleted or isn't visible to the project.
+func (p *openStackProvider) getImageProperties(ctx context.Context, imageID string) (map[string]string, error) {
+	imageClient, err := p.newServiceClient(ctx, "image")
+	if err != nil {
+		return nil, err
+	}
+
+	image, err := images.Get(ctx, imageClient, imageID).Extract()
+	if err != nil {
+		if gophercloud.ResponseCodeIs(err, http.StatusNotFound) || gophercloud.ResponseCodeIs(err, http.StatusForbidden) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to get image %s: %w", imageID, err)
+	}
+
+	properties := map[string]string{}
+	for key, value := range image.Properties {
+		if s, ok := value.(string); ok {
+			properties[key] = s
+		}
+	}
+	return properties, nil
+}
+
+// getRootVolumeImageProperties returns the image metadata of the first
+// bootable volume among the attached volumes
+func (p *openStackProvider) getRootVolumeImageProperties(ctx context.Context, attached []servers.AttachedVolume) (map[string]string, error) {
+	if len(attached) == 0 {
+		return nil, nil
+	}
+
+	volumeClient, err := p.newServiceClient(ctx, "volume")
+	if err != nil {
+		return nil, err
+	}
+
+	for _, a := range attached {
+		volume, err := volumes.Get(ctx, volumeClient, a.ID).Extract()
+		if err != nil {
+			return nil, fmt.Errorf("failed to get volume %s: %w", a.ID, err)
+		}
+		if volume.Bootable == "true" {
+			return volume.VolumeImageMetadata, nil
+		}
+	}
+	return nil, nil
+}
+
+// GetServerIDByName returns the ID of the Nova server with the given name, or
+// an empty string if there is none
+func (p *openStackProvider) GetServerIDByName(ctx context.Context, name string) (string, error) {
+	computeClient, err := p.newServiceClient(ctx, "compute")
+	if err != nil {
+		return "", err
+	}
+
+	// Nova matches the name as a regular expression
+	allPages, err := servers.List(computeClient, servers.ListOpts{Name: "^" + regexp.QuoteMeta(name) + "$"}).AllPages(ctx)
+	if err != nil {
+		return "", fmt.Errorf("failed to list servers named %s: %w", name, err)
+	}
+	serverList, err := servers.ExtractServers(allPages)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse response with server list: %w", err)
+	}
+	if len(serverList) == 0 {
+		return "", nil
+	}
+	return serverList[0].ID, nil
+}
+
+// GetServerZone returns the compute availability zone of the Nova server with
+// the given ID
+func (p *openStackProvider) GetServerZone(ctx context.Context, serverID string) (string, error) {
+	computeClient, err := p.newServiceClient(ctx, "compute")
+	if err != nil {
+		return "", err
+	}
+
+	server, err := servers.Get(ctx, computeClient, serverID).Extract()
+	if err != nil {
+		return "", fmt.Errorf("failed to get server %s: %w", serverID, err)
+	}
+	return server.AvailabilityZone, nil
+}
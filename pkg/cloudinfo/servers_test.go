@@ -0,0 +1,159 @@
+package cloudinfo_test
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	. "github.com/onsi/gomega"
+
+	"github.com/openshift/openstack-cinder-csi-driver-operator/pkg/cloudinfo"
+	"github.com/openshift/openstack-cinder-csi-driver-operator/pkg/cloudinfo/fake"
+)
+
+func TestGetServerDisks(t *testing.T) {
+	tc := []struct {
+		name     string
+		server   fake.Server
+		expected cloudinfo.ServerDisks
+	}{
+		{
+			name:   "Booted from an image",
+			server: fake.Server{ID: "server-1", Flavor: "m1.large", ImageID: "scsi-image", AttachedVolumes: []string{"vol-1"}},
+			expected: cloudinfo.ServerDisks{
+				ServerID:  "server-1",
+				Flavor:    "m1.large",
+				DiskBus:   "scsi",
+				SCSIModel: "virtio-scsi",
+			},
+		}, {
+			name:   "Booted from a volume",
+			server: fake.Server{ID: "server-1", Flavor: "m1.large", AttachedVolumes: []string{"vol-1", "root-volume"}},
+			expected: cloudinfo.ServerDisks{
+				ServerID: "server-1",
+				Flavor:   "m1.large",
+				DiskBus:  "sata",
+			},
+		}, {
+			name: "Flavor extra specs",
+			server: fake.Server{
+				ID:               "server-1",
+				Flavor:           "m1.scsi",
+				FlavorExtraSpecs: map[string]string{"hw:disk_bus": "scsi", "hw:scsi_model": "virtio-scsi"},
+				ImageID:          "plain-image",
+			},
+			expected: cloudinfo.ServerDisks{
+				ServerID:  "server-1",
+				Flavor:    "m1.scsi",
+				DiskBus:   "scsi",
+				SCSIModel: "virtio-scsi",
+			},
+		}, {
+			name: "Image overrides flavor extra specs",
+			server: fake.Server{
+				ID:               "server-1",
+				Flavor:           "m1.scsi",
+				FlavorExtraSpecs: map[string]string{"hw:disk_bus": "sata"},
+				ImageID:          "scsi-image",
+			},
+			expected: cloudinfo.ServerDisks{
+				ServerID:  "server-1",
+				Flavor:    "m1.scsi",
+				DiskBus:   "scsi",
+				SCSIModel: "virtio-scsi",
+			},
+		}, {
+			name:   "Image deleted",
+			server: fake.Server{ID: "server-1", Flavor: "m1.large", ImageID: "deleted-image"},
+			expected: cloudinfo.ServerDisks{
+				ServerID: "server-1",
+				Flavor:   "m1.large",
+			},
+		},
+	}
+
+	for _, tc := range tc {
+		t.Run(tc.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			cloud := fake.New()
+			defer cloud.Close()
+			cloud.Servers = []fake.Server{tc.server}
+			cloud.Images = []fake.Image{
+				{ID: "scsi-image", Properties: map[string]string{"hw_disk_bus": "scsi", "hw_scsi_model": "virtio-scsi"}},
+				{ID: "plain-image"},
+			}
+			cloud.Volumes = []fake.Volume{
+				{ID: "vol-1", Status: "in-use"},
+				{ID: "root-volume", Status: "in-use", Bootable: true, ImageMetadata: map[string]string{"hw_disk_bus": "sata"}},
+			}
+
+			disks, err := cloudinfo.NewProvider(cloud.ClientOpts(), nil).GetServerDisks(context.TODO(), "server-1")
+			g.Expect(err).ToNot(HaveOccurred())
+			g.Expect(*disks).To(Equal(tc.expected))
+		})
+	}
+}
+
+func TestGetServerDisksErrors(t *testing.T) {
+	g := NewWithT(t)
+
+	cloud := fake.New()
+	defer cloud.Close()
+
+	_, err := cloudinfo.NewProvider(cloud.ClientOpts(), nil).GetServerDisks(context.TODO(), "missing-server")
+	g.Expect(err).To(MatchError(ContainSubstring("failed to get server missing-server")))
+
+	cloud.Servers = []fake.Server{{ID: "server-1", ImageID: "image-1"}}
+	cloud.Fail("image", http.MethodGet, "/v2/images/image-1", http.StatusInternalServerError)
+	_, err = cloudinfo.NewProvider(cloud.ClientOpts(), nil).GetServerDisks(context.TODO(), "server-1")
+	g.Expect(err).To(MatchError(ContainSubstring("failed to get image image-1")))
+}
+
+func TestGetServerIDByName(t *testing.T) {
+	g := NewWithT(t)
+
+	cloud := fake.New()
+	defer cloud.Close()
+	cloud.Servers = []fake.Server{
+		{ID: "server-1", Name: "worker-1"},
+		{ID: "server-10", Name: "worker-10"},
+		{ID: "server-2", Name: "worker.2"},
+	}
+	provider := cloudinfo.NewProvider(cloud.ClientOpts(), nil)
+
+	id, err := provider.GetServerIDByName(context.TODO(), "worker-1")
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(id).To(Equal("server-1"))
+
+	id, err = provider.GetServerIDByName(context.TODO(), "worker.2")
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(id).To(Equal("server-2"))
+
+	id, err = provider.GetServerIDByName(context.TODO(), "worker-3")
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(id).To(BeEmpty())
+}
+
+func TestGetServerZone(t *testing.T) {
+	g := NewWithT(t)
+
+	cloud := fake.New()
+	defer cloud.Close()
+	cloud.Servers = []fake.Server{
+		{ID: "server-1", Zone: "az1"},
+		{ID: "server-2"},
+	}
+	provider := cloudinfo.NewProvider(cloud.ClientOpts(), nil)
+
+	zone, err := provider.GetServerZone(context.TODO(), "server-1")
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(zone).To(Equal("az1"))
+
+	zone, err = provider.GetServerZone(context.TODO(), "server-2")
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(zone).To(Equal("nova"))
+
+	_, err = provider.GetServerZone(context.TODO(), "missing-server")
+	g.Expect(err).To(MatchError(ContainSubstring("failed to get server missing-server")))
+}
@@ -0,0 +1,258 @@
+package cloudinfo
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/gophercloud/gophercloud/v2"
+	"github.com/gophercloud/gophercloud/v2/openstack/blockstorage/v3/attachments"
+	"github.com/gophercloud/gophercloud/v2/openstack/blockstorage/v3/snapshots"
+	"github.com/gophercloud/gophercloud/v2/openstack/blockstorage/v3/volumes"
+	"github.com/gophercloud/gophercloud/v2/openstack/compute/v2/servers"
+)
+
+// ClusterMetadataKey is the volume metadata key the driver sets to the ID of
+// the cluster that created the volume, as passed in its --cluster argument
+const ClusterMetadataKey = "cinder.csi.openstack.org/cluster"
+
+// Volume describes a Cinder volume
+type Volume struct {
+	ID               string
+	Name             string
+	Status           string
+	Size             int
+	AvailabilityZone string
+	CreatedAt        time.Time
+	// UpdatedAt is when the volume was last modified, which includes any
+	// change of status
+	UpdatedAt   time.Time
+	Metadata    map[string]string
+	Attachments []VolumeAttachment
+}
+
+// VolumeAttachment describes the attachment of a Cinder volume to a server
+type VolumeAttachment struct {
+	AttachmentID string
+	ServerID     string
+	AttachedAt   time.Time
+}
+
+// GetClusterVolumes fetches the volumes created by the driver for the given
+// cluster ID, sorted by ID
+func (p *openStackProvider) GetClusterVolumes(ctx context.Context, clusterID string) ([]Volume, error) {
+	volumeClient, err := p.newServiceClient(ctx, "volume")
+	if err != nil {
+		return nil, err
+	}
+
+	opts := volumes.ListOpts{
+		Metadata: map[string]string{ClusterMetadataKey: clusterID},
+	}
+	allPages, err := volumes.List(volumeClient, opts).AllPages(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list volumes: %w", err)
+	}
+
+	volumeInfo, err := volumes.ExtractVolumes(allPages)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse response with volume list: %w", err)
+	}
+
+	var vols []Volume
+	for _, v := range volumeInfo {
+		volume := Volume{
+			ID:               v.ID,
+			Name:             v.Name,
+			Status:           v.Status,
+			Size:             v.Size,
+			AvailabilityZone: v.AvailabilityZone,
+			CreatedAt:        v.CreatedAt,
+			UpdatedAt:        v.UpdatedAt,
+			Metadata:         v.Metadata,
+		}
+		for _, a := range v.Attachments {
+			volume.Attachments = append(volume.Attachments, VolumeAttachment{
+				AttachmentID: a.AttachmentID,
+				ServerID:     a.ServerID,
+				AttachedAt:   a.AttachedAt,
+			})
+		}
+		vols = append(vols, volume)
+	}
+
+	sort.Slice(vols, func(i, j int) bool {
+		return vols[i].ID < vols[j].ID
+	})
+
+	return vols, nil
+}
+
+// Snapshot describes a Cinder volume snapshot
+type Snapshot struct {
+	ID        string
+	Name      string
+	VolumeID  string
+	Status    string
+	Size      int
+	CreatedAt time.Time
+	Metadata  map[string]string
+}
+
+// snapshotListOpts filters snapshots by metadata, which the gophercloud
+// snapshots.ListOpts does not support
+type snapshotListOpts struct {
+	Metadata map[string]string `q:"metadata"`
+}
+
+func (opts snapshotListOpts) ToSnapshotListQuery() (string, error) {
+	q, err := gophercloud.BuildQueryString(opts)
+	if err != nil {
+		return "", err
+	}
+	return q.String(), nil
+}
+
+// GetClusterSnapshots fetches the volume snapshots created by the driver for
+// the given cluster ID, sorted by ID
+func (p *openStackProvider) GetClusterSnapshots(ctx context.Context, clusterID string) ([]Snapshot, error) {
+	volumeClient, err := p.newServiceClient(ctx, "volume")
+	if err != nil {
+		return nil, err
+	}
+
+	opts := snapshotListOpts{
+		Metadata: map[string]string{ClusterMetadataKey: clusterID},
+	}
+	allPages, err := snapshots.List(volumeClient, opts).AllPages(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list snapshots: %w", err)
+	}
+
+	snapshotInfo, err := snapshots.ExtractSnapshots(allPages)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse response with snapshot list: %w", err)
+	}
+
+	var snaps []Snapshot
+	for _, s := range snapshotInfo {
+		snaps = append(snaps, Snapshot{
+			ID:        s.ID,
+			Name:      s.Name,
+			VolumeID:  s.VolumeID,
+			Status:    s.Status,
+			Size:      s.Size,
+			CreatedAt: s.CreatedAt,
+			Metadata:  s.Metadata,
+		})
+	}
+
+	sort.Slice(snaps, func(i, j int) bool {
+		return snaps[i].ID < snaps[j].ID
+	})
+
+	return snaps, nil
+}
+
+// DeleteVolume deletes the volume with the given ID
+func (p *openStackProvider) DeleteVolume(ctx context.Context, id string) error {
+	volumeClient, err := p.newServiceClient(ctx, "volume")
+	if err != nil {
+		return err
+	}
+
+	if err := volumes.Delete(ctx, volumeClient, id, nil).ExtractErr(); err != nil {
+		return fmt.Errorf("failed to delete volume %s: %w", id, err)
+	}
+	return nil
+}
+
+// DeleteSnapshot deletes the volume snapshot with the given ID
+func (p *openStackProvider) DeleteSnapshot(ctx context.Context, id string) error {
+	volumeClient, err := p.newServiceClient(ctx, "volume")
+	if err != nil {
+		return err
+	}
+
+	if err := snapshots.Delete(ctx, volumeClient, id).ExtractErr(); err != nil {
+		return fmt.Errorf("failed to delete snapshot %s: %w", id, err)
+	}
+	return nil
+}
+
+// ServerExists returns whether the Nova server with the given ID exists
+func (p *openStackProvider) ServerExists(ctx context.Context, id string) (bool, error) {
+	computeClient, err := p.newServiceClient(ctx, "compute")
+	if err != nil {
+		return false, err
+	}
+
+	if err := servers.Get(ctx, computeClient, id).Err; err != nil {
+		if gophercloud.ResponseCodeIs(err, http.StatusNotFound) {
+			return false, nil
+		}
+		return false, fmt.Errorf("failed to get server %s: %w", id, err)
+	}
+	return true, nil
+}
+
+// ForceDetachVolume removes the attachment of a volume without involving
+// Nova, which is only safe if the server it is attached to no longer exists.
+// The attachment is deleted with the attachments API, falling back to the
+// os-force_detach volume action if the cloud does not support it. It is not
+// an error if the attachment no longer exists.
+func (p *openStackProvider) ForceDetachVolume(ctx context.Context, volumeID, attachmentID string) error {
+	volumeClient, err := p.newServiceClient(ctx, "volume")
+	if err != nil {
+		return err
+	}
+
+	// copy the client, as the microversion is only needed for attachments
+	attachmentClient := *volumeClient
+	attachmentClient.Microversion = attachmentsMicroversion
+	err = attachments.Delete(ctx, &attachmentClient, attachmentID).ExtractErr()
+	if err == nil {
+		return nil
+	}
+	if !gophercloud.ResponseCodeIs(err, http.StatusNotFound) {
+		return fmt.Errorf("failed to delete attachment %s of volume %s: %w", attachmentID, volumeID, err)
+	}
+
+	// the attachment may not be found because it has already been deleted,
+	// or because the cloud doesn't support the attachments API, so we check
+	// whether the volume still has it
+	volume, err := volumes.Get(ctx, volumeClient, volumeID).Extract()
+	if gophercloud.ResponseCodeIs(err, http.StatusNotFound) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to get volume %s: %w", volumeID, err)
+	}
+	if !hasAttachment(volume, attachmentID) {
+		return nil
+	}
+
+	body := map[string]interface{}{
+		"os-force_detach": map[string]interface{}{
+			"attachment_id": attachmentID,
+		},
+	}
+	_, err = volumeClient.Post(ctx, volumeClient.ServiceURL("volumes", volumeID, "action"), body, nil, &gophercloud.RequestOpts{
+		OkCodes: []int{http.StatusAccepted},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to force detach attachment %s of volume %s: %w", attachmentID, volumeID, err)
+	}
+	return nil
+}
+
+func hasAttachment(volume *volumes.Volume, attachmentID string) bool {
+	for _, attachment := range volume.Attachments {
+		if attachment.AttachmentID == attachmentID {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,66 @@
+package cloudinfo_test
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	. "github.com/onsi/gomega"
+
+	"github.com/openshift/openstack-cinder-csi-driver-operator/pkg/cloudinfo"
+	"github.com/openshift/openstack-cinder-csi-driver-operator/pkg/cloudinfo/fake"
+)
+
+func TestForceDetachVolume(t *testing.T) {
+	tc := []struct {
+		name                  string
+		attachments           []fake.VolumeAttachment
+		attachmentsAPIMissing bool
+		expectedForceDetach   int
+	}{
+		{
+			name:        "Attachments API",
+			attachments: []fake.VolumeAttachment{{AttachmentID: "att-1", ServerID: "server-1"}},
+		}, {
+			name:                  "Attachments API not supported",
+			attachments:           []fake.VolumeAttachment{{AttachmentID: "att-1", ServerID: "server-1"}},
+			attachmentsAPIMissing: true,
+			expectedForceDetach:   1,
+		}, {
+			name:                  "Attachment already deleted",
+			attachments:           []fake.VolumeAttachment{{AttachmentID: "att-2", ServerID: "server-2"}},
+			attachmentsAPIMissing: true,
+		},
+	}
+
+	for _, tc := range tc {
+		t.Run(tc.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			cloud := fake.New()
+			defer cloud.Close()
+			cloud.Volumes = []fake.Volume{{ID: "vol-1", Status: "in-use", Attachments: tc.attachments}}
+			if tc.attachmentsAPIMissing {
+				cloud.Fail("volume", http.MethodDelete, "/attachments/att-1", http.StatusNotFound)
+			}
+
+			provider := cloudinfo.NewProvider(cloud.ClientOpts(), nil)
+			g.Expect(provider.ForceDetachVolume(context.TODO(), "vol-1", "att-1")).To(Succeed())
+			g.Expect(cloud.Requests("volume", http.MethodPost, "/volumes/vol-1/action")).To(Equal(tc.expectedForceDetach))
+			for _, attachment := range cloud.Volumes[0].Attachments {
+				g.Expect(attachment.AttachmentID).ToNot(Equal("att-1"))
+			}
+		})
+	}
+
+	t.Run("Volume already deleted", func(t *testing.T) {
+		g := NewWithT(t)
+
+		cloud := fake.New()
+		defer cloud.Close()
+
+		provider := cloudinfo.NewProvider(cloud.ClientOpts(), nil)
+		g.Expect(provider.ForceDetachVolume(context.TODO(), "vol-1", "att-1")).To(Succeed())
+		g.Expect(cloud.Requests("volume", http.MethodPost, "/volumes/vol-1/action")).To(BeZero())
+	})
+}
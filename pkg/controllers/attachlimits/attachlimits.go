@@ -0,0 +1,422 @@
+package attachlimits
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	operatorv1 "github.com/openshift/api/operator/v1"
+	"github.com/openshift/library-go/pkg/controller/factory"
+	"github.com/openshift/library-go/pkg/operator/events"
+	"github.com/openshift/library-go/pkg/operator/resource/resourceapply"
+	"github.com/openshift/library-go/pkg/operator/v1helpers"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/client-go/kubernetes"
+	appslisters "k8s.io/client-go/listers/apps/v1"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	storagelisters "k8s.io/client-go/listers/storage/v1"
+	"k8s.io/klog/v2"
+
+	"github.com/openshift/openstack-cinder-csi-driver-operator/pkg/cloudinfo"
+	"github.com/openshift/openstack-cinder-csi-driver-operator/pkg/util"
+)
+
+const (
+	driverName = "cinder.csi.openstack.org"
+
+	nodeDaemonSetName = "openstack-cinder-csi-driver-node"
+
+	// nodePluginLabel selects the pods of the node plugin DaemonSet
+	nodePluginLabel = "app"
+	nodePluginApp   = nodeDaemonSetName
+
+	// templateGenerationLabel is set on DaemonSet pods to the generation of
+	// the DaemonSet they were created from
+	templateGenerationLabel = "pod-template-generation"
+
+	// restartedAnnotation of the config map records, as a JSON object, the
+	// limit for which the node plugin pod of each node was last restarted
+	restartedAnnotation = "cinder.csi.openstack.org/restarted-node-plugins"
+	// changedAnnotation of the config map records, as a JSON object, when
+	// the limit of each node was last changed
+	changedAnnotation = "cinder.csi.openstack.org/changed-node-attach-limits"
+
+	// configMapPropagationDelay is how long the kubelet may take to update
+	// the config map mounted in the node plugin pods
+	configMapPropagationDelay = 2 * time.Minute
+
+	resyncInterval = 5 * time.Minute
+)
+
+// Attach limits of the disk buses supported by Nova. Each assumes the root
+// disk uses the same bus.
+const (
+	// virtioBlkAttachLimit is the number of PCI slots left for virtio-blk
+	// disks on the default machine type, after the root disk, network
+	// interface and other devices
+	virtioBlkAttachLimit = 24
+	// virtioSCSIAttachLimit is the number of LUNs of the single virtio-scsi
+	// controller Nova adds, less the root disk
+	virtioSCSIAttachLimit = 255
+	// scsiAttachLimit applies to the other SCSI controller models, which
+	// have 7 targets
+	scsiAttachLimit = 6
+	// sataAttachLimit is the number of ports of the SATA controller, less
+	// the root disk
+	sataAttachLimit = 5
+	// ideAttachLimit is the number of IDE devices, less the root disk and
+	// the config drive
+	ideAttachLimit = 2
+)
+
+// This AttachLimitController works out how many volumes can be attached to
+// each node from the disk bus of its Nova server, which is set by the
+// hw_disk_bus and hw_scsi_model properties of the server's image. Without
+// it, the node plugin reports the driver's default limit of 256 volumes,
+// which is far more than a virtio-blk server can take, so pods are scheduled
+// to nodes that can't attach their volumes.
+//
+// The limits are written to a config map which is mounted in the node plugin
+// pods, each of which passes the limit of its node to the driver. As the
+// limit is only read when the driver starts, the pod of a node whose
+// registered limit differs is restarted, once per limit. Pods which are not
+// up to date with the DaemonSet are left to its update strategy, so that a
+// staged rollout isn't bypassed; their replacements pick up the limit anyway.
+type AttachLimitController struct {
+	operatorClient         v1helpers.OperatorClient
+	kubeClient             kubernetes.Interface
+	nodeLister             corelisters.NodeLister
+	csiNodeLister          storagelisters.CSINodeLister
+	volumeAttachmentLister storagelisters.VolumeAttachmentLister
+	podLister              corelisters.PodLister
+	daemonSetLister        appslisters.DaemonSetLister
+	configMapLister        corelisters.ConfigMapLister
+	provider               cloudinfo.Provider
+	eventRecorder          events.Recorder
+
+	// disks caches the disk properties of each node's server, which can't
+	// change while the server exists
+	disks map[string]*cloudinfo.ServerDisks
+	now   func() time.Time
+}
+
+func NewAttachLimitController(
+	operatorClient v1helpers.OperatorClient,
+	kubeClient kubernetes.Interface,
+	informers v1helpers.KubeInformersForNamespaces,
+	provider cloudinfo.Provider,
+	eventRecorder events.Recorder) factory.Controller {
+
+	nodeInformer := informers.InformersFor("").Core().V1().Nodes()
+	csiNodeInformer := informers.InformersFor("").Storage().V1().CSINodes()
+	volumeAttachmentInformer := informers.InformersFor("").Storage().V1().VolumeAttachments()
+	namespaceInformers := informers.InformersFor(util.DefaultNamespace)
+	c := &AttachLimitController{
+		operatorClient:         operatorClient,
+		kubeClient:             kubeClient,
+		nodeLister:             nodeInformer.Lister(),
+		csiNodeLister:          csiNodeInformer.Lister(),
+		volumeAttachmentLister: volumeAttachmentInformer.Lister(),
+		podLister:              namespaceInformers.Core().V1().Pods().Lister(),
+		daemonSetLister:        namespaceInformers.Apps().V1().DaemonSets().Lister(),
+		configMapLister:        namespaceInformers.Core().V1().ConfigMaps().Lister(),
+		provider:               provider,
+		eventRecorder:          eventRecorder.WithComponentSuffix("CinderAttachLimits"),
+		disks:                  map[string]*cloudinfo.ServerDisks{},
+		now:                    time.Now,
+	}
+	return factory.New().WithSync(c.sync).ResyncEvery(resyncInterval).WithInformers(
+		operatorClient.Informer(),
+		nodeInformer.Informer(),
+		csiNodeInformer.Informer(),
+	).WithBareInformers(
+		volumeAttachmentInformer.Informer(),
+		namespaceInformers.Core().V1().Pods().Informer(),
+		namespaceInformers.Apps().V1().DaemonSets().Informer(),
+		namespaceInformers.Core().V1().ConfigMaps().Informer(),
+	).ToController("CinderAttachLimits", eventRecorder)
+}
+
+func (c *AttachLimitController) sync(ctx context.Context, syncCtx factory.SyncContext) error {
+	opSpec, _, _, err := c.operatorClient.GetOperatorState()
+	if err != nil {
+		return err
+	}
+	if opSpec.ManagementState != operatorv1.Managed {
+		return nil
+	}
+
+	nodes, err := c.nodeLister.List(labels.Everything())
+	if err != nil {
+		return err
+	}
+
+	existing, err := c.configMapLister.ConfigMaps(util.DefaultNamespace).Get(util.NodeAttachLimitsConfigName)
+	if err != nil && !errors.IsNotFound(err) {
+		return err
+	}
+	var existingData map[string]string
+	restarted := map[string]int{}
+	changed := map[string]metav1.Time{}
+	if existing != nil {
+		existingData = existing.Data
+		getAnnotationJSON(existing, restartedAnnotation, &restarted)
+		getAnnotationJSON(existing, changedAnnotation, &changed)
+	}
+
+	var errs []error
+	limits := map[string]int{}
+	data := map[string]string{}
+	servers := map[string]bool{}
+	for _, node := range nodes {
+		serverID := util.ServerIDFromProviderID(node.Spec.ProviderID)
+		if serverID == "" {
+			continue
+		}
+		servers[serverID] = true
+
+		disks, ok := c.disks[serverID]
+		if !ok {
+			disks, err = c.provider.GetServerDisks(ctx, serverID)
+			if err != nil {
+				// keep the current limit until the server can be fetched
+				if value, ok := existingData[node.Name]; ok {
+					data[node.Name] = value
+				}
+				errs = append(errs, err)
+				continue
+			}
+			c.disks[serverID] = disks
+		}
+
+		limit := AttachLimit(disks.DiskBus, disks.SCSIModel)
+		attachLimit.WithLabelValues(node.Name, diskBusLabel(disks.DiskBus)).Set(float64(limit))
+		if limit == 0 {
+			continue
+		}
+		limits[node.Name] = limit
+		data[node.Name] = strconv.Itoa(limit)
+		if existingData[node.Name] != data[node.Name] {
+			klog.Infof("Setting the volume attach limit of node %s to %d for flavor %q and disk bus %q", node.Name, limit, disks.Flavor, disks.DiskBus)
+			changed[node.Name] = metav1.NewTime(c.now())
+		} else if _, ok := changed[node.Name]; !ok {
+			// the limit was written without recording when, so give the
+			// kubelet time to update it
+			changed[node.Name] = metav1.NewTime(c.now())
+		}
+	}
+
+	// forget servers which are no longer nodes
+	for serverID := range c.disks {
+		if !servers[serverID] {
+			delete(c.disks, serverID)
+		}
+	}
+
+	if err := c.exportAttachedVolumes(nodes); err != nil {
+		errs = append(errs, err)
+	}
+
+	nodeNames := make([]string, 0, len(limits))
+	for nodeName := range limits {
+		nodeNames = append(nodeNames, nodeName)
+	}
+	sort.Strings(nodeNames)
+	for _, nodeName := range nodeNames {
+		if err := c.restartNodePlugin(ctx, syncCtx, nodeName, limits[nodeName], changed[nodeName].Time, restarted); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	for nodeName := range restarted {
+		if _, ok := limits[nodeName]; !ok {
+			delete(restarted, nodeName)
+		}
+	}
+	for nodeName := range changed {
+		if _, ok := limits[nodeName]; !ok {
+			delete(changed, nodeName)
+		}
+	}
+
+	restartedJSON, err := json.Marshal(restarted)
+	if err != nil {
+		return utilerrors.NewAggregate(append(errs, err))
+	}
+	changedJSON, err := json.Marshal(changed)
+	if err != nil {
+		return utilerrors.NewAggregate(append(errs, err))
+	}
+	configMap := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      util.NodeAttachLimitsConfigName,
+			Namespace: util.DefaultNamespace,
+			Annotations: map[string]string{
+				restartedAnnotation: string(restartedJSON),
+				changedAnnotation:   string(changedJSON),
+			},
+		},
+		Data: data,
+	}
+	if _, _, err := resourceapply.ApplyConfigMap(ctx, c.kubeClient.CoreV1(), c.eventRecorder, configMap); err != nil {
+		return utilerrors.NewAggregate(append(errs, err))
+	}
+
+	return utilerrors.NewAggregate(errs)
+}
+
+// restartNodePlugin restarts the node plugin pod of the node if the limit it
+// registered with the kubelet is not the given limit, once the config map
+// has had time to be updated in the pod since the limit changed. Pods which don't mount the config
+// map can't pick up the limit, so they are left alone. The limit for which
+// each node's pod was restarted is recorded in restarted, so that a driver
+// which doesn't pick up the limit is only restarted once, even across
+// restarts of the operator.
+func (c *AttachLimitController) restartNodePlugin(ctx context.Context, syncCtx factory.SyncContext, nodeName string, limit int, changed time.Time, restarted map[string]int) error {
+	csiNode, err := c.csiNodeLister.Get(nodeName)
+	if errors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var registered *int32
+	for _, driver := range csiNode.Spec.Drivers {
+		if driver.Name == driverName && driver.Allocatable != nil {
+			registered = driver.Allocatable.Count
+		}
+	}
+	if registered == nil || int(*registered) == limit {
+		delete(restarted, nodeName)
+		return nil
+	}
+	if restarted[nodeName] == limit {
+		// the driver didn't pick up the limit, so don't restart it forever
+		return nil
+	}
+	if wait := changed.Add(configMapPropagationDelay).Sub(c.now()); wait > 0 {
+		syncCtx.Queue().AddAfter(syncCtx.QueueKey(), wait)
+		return nil
+	}
+
+	daemonSet, err := c.daemonSetLister.DaemonSets(util.DefaultNamespace).Get(nodeDaemonSetName)
+	if errors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	generation := daemonSet.Annotations[appsv1.DeprecatedTemplateGeneration]
+
+	pods, err := c.podLister.Pods(util.DefaultNamespace).List(labels.SelectorFromSet(labels.Set{nodePluginLabel: nodePluginApp}))
+	if err != nil {
+		return err
+	}
+	for _, pod := range pods {
+		if pod.Spec.NodeName != nodeName || pod.DeletionTimestamp != nil {
+			continue
+		}
+		if !mountsAttachLimits(pod) {
+			klog.V(4).Infof("Not restarting node plugin pod %s, which doesn't mount config map %s", pod.Name, util.NodeAttachLimitsConfigName)
+			continue
+		}
+		if pod.Labels[templateGenerationLabel] != generation {
+			// with the OnDelete update strategy of a staged rollout,
+			// deleting the pod would update it out of turn
+			klog.V(4).Infof("Not restarting node plugin pod %s, which is waiting to be updated to DaemonSet generation %s", pod.Name, generation)
+			continue
+		}
+		if err := c.kubeClient.CoreV1().Pods(util.DefaultNamespace).Delete(ctx, pod.Name, metav1.DeleteOptions{}); err != nil && !errors.IsNotFound(err) {
+			return fmt.Errorf("failed to restart node plugin pod %s: %w", pod.Name, err)
+		}
+		klog.Infof("Restarted node plugin pod %s to change the volume attach limit of node %s from %d to %d", pod.Name, nodeName, *registered, limit)
+		c.eventRecorder.Eventf("NodePluginRestarted", "Restarted pod %s to change the volume attach limit of node %s from %d to %d", pod.Name, nodeName, *registered, limit)
+		restarted[nodeName] = limit
+	}
+	return nil
+}
+
+// getAnnotationJSON decodes the JSON object in the given annotation of the
+// config map into v, leaving v unchanged if it is missing or invalid
+func getAnnotationJSON(configMap *corev1.ConfigMap, annotation string, v interface{}) {
+	value, ok := configMap.Annotations[annotation]
+	if !ok {
+		return
+	}
+	if err := json.Unmarshal([]byte(value), v); err != nil {
+		klog.Warningf("Ignoring the invalid %s annotation of config map %s: %v", annotation, util.NodeAttachLimitsConfigName, err)
+	}
+}
+
+// mountsAttachLimits returns whether the pod mounts the config map of the
+// attach limits, i.e. whether it was created from a DaemonSet which passes
+// the limit to the driver
+func mountsAttachLimits(pod *corev1.Pod) bool {
+	for _, volume := range pod.Spec.Volumes {
+		if volume.ConfigMap != nil && volume.ConfigMap.Name == util.NodeAttachLimitsConfigName {
+			return true
+		}
+	}
+	return false
+}
+
+// exportAttachedVolumes sets the number of volumes attached by the driver to
+// each node
+func (c *AttachLimitController) exportAttachedVolumes(nodes []*corev1.Node) error {
+	vas, err := c.volumeAttachmentLister.List(labels.Everything())
+	if err != nil {
+		return err
+	}
+
+	counts := map[string]int{}
+	for _, node := range nodes {
+		counts[node.Name] = 0
+	}
+	for _, va := range vas {
+		if va.Spec.Attacher == driverName && va.Status.Attached {
+			counts[va.Spec.NodeName]++
+		}
+	}
+
+	attachedVolumes.Reset()
+	for nodeName, count := range counts {
+		attachedVolumes.WithLabelValues(nodeName).Set(float64(count))
+	}
+	return nil
+}
+
+// AttachLimit returns the number of volumes that can be attached to a server
+// with the given hw_disk_bus and hw_scsi_model image properties, or 0 if it
+// is not known
+func AttachLimit(diskBus, scsiModel string) int {
+	switch diskBus {
+	case "", "virtio":
+		return virtioBlkAttachLimit
+	case "scsi":
+		if scsiModel == "virtio-scsi" {
+			return virtioSCSIAttachLimit
+		}
+		return scsiAttachLimit
+	case "sata":
+		return sataAttachLimit
+	case "ide":
+		return ideAttachLimit
+	default:
+		return 0
+	}
+}
+
+func diskBusLabel(diskBus string) string {
+	if diskBus == "" {
+		return "virtio"
+	}
+	return diskBus
+}
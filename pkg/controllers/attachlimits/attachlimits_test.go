@@ -0,0 +1,390 @@
+package attachlimits
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/onsi/gomega"
+	operatorv1 "github.com/openshift/api/operator/v1"
+	"github.com/openshift/library-go/pkg/controller/factory"
+	"github.com/openshift/library-go/pkg/operator/events"
+	"github.com/openshift/library-go/pkg/operator/v1helpers"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	fakekube "k8s.io/client-go/kubernetes/fake"
+	appslisters "k8s.io/client-go/listers/apps/v1"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	storagelisters "k8s.io/client-go/listers/storage/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/component-base/metrics/legacyregistry"
+	"k8s.io/component-base/metrics/testutil"
+	"k8s.io/utils/ptr"
+
+	"github.com/openshift/openstack-cinder-csi-driver-operator/pkg/cloudinfo"
+	"github.com/openshift/openstack-cinder-csi-driver-operator/pkg/cloudinfo/fake"
+	"github.com/openshift/openstack-cinder-csi-driver-operator/pkg/util"
+)
+
+func TestAttachLimitSync(t *testing.T) {
+	g := NewWithT(t)
+
+	cloud := newTestCloud()
+	defer cloud.Close()
+
+	nodes := []*corev1.Node{
+		newNode("virtio-node", "virtio-server"),
+		newNode("scsi-node", "scsi-server"),
+		newNode("unknown-node", "unknown-server"),
+		{ObjectMeta: metav1.ObjectMeta{Name: "bare-metal-node"}},
+	}
+	va := &storagev1.VolumeAttachment{
+		ObjectMeta: metav1.ObjectMeta{Name: "va-1"},
+		Spec:       storagev1.VolumeAttachmentSpec{Attacher: driverName, NodeName: "scsi-node"},
+		Status:     storagev1.VolumeAttachmentStatus{Attached: true},
+	}
+	c, kubeClient, _ := newTestAttachLimitController(g, cloud, nodes, []runtime.Object{va})
+
+	g.Expect(c.sync(context.TODO(), factory.NewSyncContext("CinderAttachLimits", events.NewInMemoryRecorder("test")))).To(Succeed())
+
+	configMap, err := kubeClient.CoreV1().ConfigMaps(util.DefaultNamespace).Get(context.TODO(), util.NodeAttachLimitsConfigName, metav1.GetOptions{})
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(configMap.Data).To(Equal(map[string]string{
+		"virtio-node": "24",
+		"scsi-node":   "255",
+	}))
+
+	g.Expect(testutil.GetGaugeMetricValue(attachLimit.WithLabelValues("virtio-node", "virtio"))).To(BeEquivalentTo(24))
+	g.Expect(testutil.GetGaugeMetricValue(attachLimit.WithLabelValues("unknown-node", "usb"))).To(BeEquivalentTo(0))
+	g.Expect(testutil.GetGaugeMetricValue(attachedVolumes.WithLabelValues("scsi-node"))).To(BeEquivalentTo(1))
+	g.Expect(testutil.GetGaugeMetricValue(attachedVolumes.WithLabelValues("virtio-node"))).To(BeEquivalentTo(0))
+
+	// the gauges are served by the operator's metrics endpoint
+	g.Expect(testutil.GatherAndCompare(legacyregistry.DefaultGatherer, strings.NewReader(`
+# HELP openshift_openstack_cinder_csi_driver_operator_node_volume_attach_limit [ALPHA] Number of Cinder volumes that can be attached to a node, labeled by node and disk bus. Zero if the limit of the disk bus is not known, in which case the driver's default is used.
+# TYPE openshift_openstack_cinder_csi_driver_operator_node_volume_attach_limit gauge
+openshift_openstack_cinder_csi_driver_operator_node_volume_attach_limit{disk_bus="scsi",node="scsi-node"} 255
+openshift_openstack_cinder_csi_driver_operator_node_volume_attach_limit{disk_bus="usb",node="unknown-node"} 0
+openshift_openstack_cinder_csi_driver_operator_node_volume_attach_limit{disk_bus="virtio",node="virtio-node"} 24
+# HELP openshift_openstack_cinder_csi_driver_operator_node_attached_volumes [ALPHA] Number of Cinder volumes attached to a node by the driver, labeled by node.
+# TYPE openshift_openstack_cinder_csi_driver_operator_node_attached_volumes gauge
+openshift_openstack_cinder_csi_driver_operator_node_attached_volumes{node="bare-metal-node"} 0
+openshift_openstack_cinder_csi_driver_operator_node_attached_volumes{node="scsi-node"} 1
+openshift_openstack_cinder_csi_driver_operator_node_attached_volumes{node="unknown-node"} 0
+openshift_openstack_cinder_csi_driver_operator_node_attached_volumes{node="virtio-node"} 0
+`),
+		"openshift_openstack_cinder_csi_driver_operator_node_volume_attach_limit",
+		"openshift_openstack_cinder_csi_driver_operator_node_attached_volumes",
+	)).To(Succeed())
+}
+
+func TestAttachLimitSyncServerError(t *testing.T) {
+	g := NewWithT(t)
+
+	cloud := newTestCloud()
+	defer cloud.Close()
+	cloud.Fail("compute", http.MethodGet, "/servers/scsi-server", http.StatusInternalServerError)
+
+	existing := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: util.NodeAttachLimitsConfigName, Namespace: util.DefaultNamespace},
+		Data:       map[string]string{"scsi-node": "255"},
+	}
+	nodes := []*corev1.Node{
+		newNode("virtio-node", "virtio-server"),
+		newNode("scsi-node", "scsi-server"),
+	}
+	c, kubeClient, _ := newTestAttachLimitController(g, cloud, nodes, []runtime.Object{existing})
+
+	err := c.sync(context.TODO(), factory.NewSyncContext("CinderAttachLimits", events.NewInMemoryRecorder("test")))
+	g.Expect(err).To(MatchError(ContainSubstring("failed to get server scsi-server")))
+
+	configMap, err := kubeClient.CoreV1().ConfigMaps(util.DefaultNamespace).Get(context.TODO(), util.NodeAttachLimitsConfigName, metav1.GetOptions{})
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(configMap.Data).To(Equal(map[string]string{
+		"virtio-node": "24",
+		"scsi-node":   "255",
+	}))
+}
+
+func TestAttachLimitRestart(t *testing.T) {
+	tc := []struct {
+		name              string
+		registered        int32
+		restarted         string
+		changedAgo        *time.Duration
+		podWithoutLimits  bool
+		stagedRollout     bool
+		podGeneration     string
+		expectedDeleted   bool
+		expectedRestarted string
+	}{
+		{
+			name:              "Limit registered",
+			registered:        255,
+			changedAgo:        ptr.To(time.Hour),
+			expectedRestarted: "{}",
+		}, {
+			name:              "Default limit registered",
+			registered:        256,
+			changedAgo:        ptr.To(time.Hour),
+			expectedDeleted:   true,
+			expectedRestarted: `{"scsi-node":255}`,
+		}, {
+			name:              "Config map not yet propagated",
+			registered:        256,
+			changedAgo:        ptr.To(time.Minute),
+			expectedRestarted: "{}",
+		}, {
+			// the change time is only missing if an earlier version of
+			// the operator wrote the config map
+			name:              "Change time not recorded",
+			registered:        256,
+			expectedRestarted: "{}",
+		}, {
+			name:              "Already restarted",
+			registered:        256,
+			restarted:         `{"scsi-node":255}`,
+			changedAgo:        ptr.To(time.Hour),
+			expectedRestarted: `{"scsi-node":255}`,
+		}, {
+			name:              "Restarted for another limit",
+			registered:        256,
+			restarted:         `{"scsi-node":6}`,
+			changedAgo:        ptr.To(time.Hour),
+			expectedDeleted:   true,
+			expectedRestarted: `{"scsi-node":255}`,
+		}, {
+			name:              "Pod doesn't mount the limits",
+			registered:        256,
+			changedAgo:        ptr.To(time.Hour),
+			podWithoutLimits:  true,
+			expectedRestarted: "{}",
+		}, {
+			name:              "Staged rollout with the pod up to date",
+			registered:        256,
+			changedAgo:        ptr.To(time.Hour),
+			stagedRollout:     true,
+			expectedDeleted:   true,
+			expectedRestarted: `{"scsi-node":255}`,
+		}, {
+			// deleting the pod would update it ahead of the staged rollout
+			name:              "Staged rollout with the pod awaiting an update",
+			registered:        256,
+			changedAgo:        ptr.To(time.Hour),
+			stagedRollout:     true,
+			podGeneration:     "1",
+			expectedRestarted: "{}",
+		}, {
+			name:              "Rolling update with the pod awaiting an update",
+			registered:        256,
+			changedAgo:        ptr.To(time.Hour),
+			podGeneration:     "1",
+			expectedRestarted: "{}",
+		},
+	}
+
+	for _, tc := range tc {
+		t.Run(tc.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			cloud := newTestCloud()
+			defer cloud.Close()
+
+			// the change time is recorded in the config map, so it is kept
+			// across restarts of the operator
+			now := time.Now()
+			existing := &corev1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:        util.NodeAttachLimitsConfigName,
+					Namespace:   util.DefaultNamespace,
+					Annotations: map[string]string{},
+				},
+				Data: map[string]string{"scsi-node": "255"},
+			}
+			if tc.restarted != "" {
+				existing.Annotations[restartedAnnotation] = tc.restarted
+			}
+			if tc.changedAgo != nil {
+				changedJSON, err := json.Marshal(map[string]metav1.Time{"scsi-node": metav1.NewTime(now.Add(-*tc.changedAgo))})
+				g.Expect(err).ToNot(HaveOccurred())
+				existing.Annotations[changedAnnotation] = string(changedJSON)
+			}
+			csiNode := &storagev1.CSINode{
+				ObjectMeta: metav1.ObjectMeta{Name: "scsi-node"},
+				Spec: storagev1.CSINodeSpec{
+					Drivers: []storagev1.CSINodeDriver{{
+						Name:        driverName,
+						Allocatable: &storagev1.VolumeNodeResources{Count: ptr.To(tc.registered)},
+					}},
+				},
+			}
+			daemonSet := &appsv1.DaemonSet{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:        nodeDaemonSetName,
+					Namespace:   util.DefaultNamespace,
+					Annotations: map[string]string{appsv1.DeprecatedTemplateGeneration: "2"},
+				},
+				Spec: appsv1.DaemonSetSpec{
+					UpdateStrategy: appsv1.DaemonSetUpdateStrategy{Type: appsv1.RollingUpdateDaemonSetStrategyType},
+				},
+			}
+			if tc.stagedRollout {
+				daemonSet.Spec.UpdateStrategy.Type = appsv1.OnDeleteDaemonSetStrategyType
+			}
+			podGeneration := "2"
+			if tc.podGeneration != "" {
+				podGeneration = tc.podGeneration
+			}
+			pod := &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "node-plugin-1",
+					Namespace: util.DefaultNamespace,
+					Labels:    map[string]string{nodePluginLabel: nodePluginApp, templateGenerationLabel: podGeneration},
+				},
+				Spec: corev1.PodSpec{NodeName: "scsi-node"},
+			}
+			if !tc.podWithoutLimits {
+				pod.Spec.Volumes = []corev1.Volume{{
+					Name: "node-attach-limits",
+					VolumeSource: corev1.VolumeSource{
+						ConfigMap: &corev1.ConfigMapVolumeSource{
+							LocalObjectReference: corev1.LocalObjectReference{Name: util.NodeAttachLimitsConfigName},
+						},
+					},
+				}}
+			}
+			c, kubeClient, recorder := newTestAttachLimitController(g, cloud, []*corev1.Node{newNode("scsi-node", "scsi-server")}, []runtime.Object{existing, csiNode, daemonSet, pod})
+			c.now = func() time.Time { return now }
+
+			g.Expect(c.sync(context.TODO(), factory.NewSyncContext("CinderAttachLimits", recorder))).To(Succeed())
+
+			_, err := kubeClient.CoreV1().Pods(util.DefaultNamespace).Get(context.TODO(), "node-plugin-1", metav1.GetOptions{})
+			g.Expect(err != nil).To(Equal(tc.expectedDeleted))
+
+			configMap, err := kubeClient.CoreV1().ConfigMaps(util.DefaultNamespace).Get(context.TODO(), util.NodeAttachLimitsConfigName, metav1.GetOptions{})
+			g.Expect(err).ToNot(HaveOccurred())
+			g.Expect(configMap.Annotations[restartedAnnotation]).To(MatchJSON(tc.expectedRestarted))
+			changed := map[string]metav1.Time{}
+			g.Expect(json.Unmarshal([]byte(configMap.Annotations[changedAnnotation]), &changed)).To(Succeed())
+			g.Expect(changed).To(HaveKey("scsi-node"))
+
+			var events []string
+			for _, event := range recorder.Events() {
+				if event.Reason == "NodePluginRestarted" {
+					events = append(events, event.Reason)
+				}
+			}
+			if tc.expectedDeleted {
+				g.Expect(events).To(HaveLen(1))
+			} else {
+				g.Expect(events).To(BeEmpty())
+			}
+		})
+	}
+}
+
+func TestAttachLimit(t *testing.T) {
+	tc := []struct {
+		diskBus   string
+		scsiModel string
+		expected  int
+	}{
+		{"", "", virtioBlkAttachLimit},
+		{"virtio", "", virtioBlkAttachLimit},
+		{"scsi", "virtio-scsi", virtioSCSIAttachLimit},
+		{"scsi", "lsilogic", scsiAttachLimit},
+		{"scsi", "", scsiAttachLimit},
+		{"sata", "", sataAttachLimit},
+		{"ide", "", ideAttachLimit},
+		{"usb", "", 0},
+	}
+
+	for _, tc := range tc {
+		t.Run(tc.diskBus+"/"+tc.scsiModel, func(t *testing.T) {
+			g := NewWithT(t)
+			g.Expect(AttachLimit(tc.diskBus, tc.scsiModel)).To(Equal(tc.expected))
+		})
+	}
+}
+
+// newTestCloud returns a fake cloud with a server of each disk bus
+func newTestCloud() *fake.Cloud {
+	cloud := fake.New()
+	cloud.Servers = []fake.Server{
+		{ID: "virtio-server", Flavor: "m1.large", ImageID: "virtio-image"},
+		{ID: "scsi-server", Flavor: "m1.large", ImageID: "scsi-image"},
+		{ID: "unknown-server", Flavor: "m1.large", ImageID: "usb-image"},
+	}
+	cloud.Images = []fake.Image{
+		{ID: "virtio-image"},
+		{ID: "scsi-image", Properties: map[string]string{"hw_disk_bus": "scsi", "hw_scsi_model": "virtio-scsi"}},
+		{ID: "usb-image", Properties: map[string]string{"hw_disk_bus": "usb"}},
+	}
+	return cloud
+}
+
+func newNode(name, serverID string) *corev1.Node {
+	return &corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Spec:       corev1.NodeSpec{ProviderID: "openstack:///" + serverID},
+	}
+}
+
+func newTestAttachLimitController(g *WithT, cloud *fake.Cloud, nodes []*corev1.Node, objects []runtime.Object) (*AttachLimitController, *fakekube.Clientset, events.InMemoryRecorder) {
+	nodeIndexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	for _, node := range nodes {
+		g.Expect(nodeIndexer.Add(node)).To(Succeed())
+	}
+
+	namespaceIndexers := cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc}
+	csiNodeIndexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	vaIndexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	podIndexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, namespaceIndexers)
+	daemonSetIndexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, namespaceIndexers)
+	configMapIndexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, namespaceIndexers)
+	for _, obj := range objects {
+		switch obj.(type) {
+		case *storagev1.CSINode:
+			g.Expect(csiNodeIndexer.Add(obj)).To(Succeed())
+		case *storagev1.VolumeAttachment:
+			g.Expect(vaIndexer.Add(obj)).To(Succeed())
+		case *corev1.Pod:
+			g.Expect(podIndexer.Add(obj)).To(Succeed())
+		case *appsv1.DaemonSet:
+			g.Expect(daemonSetIndexer.Add(obj)).To(Succeed())
+		case *corev1.ConfigMap:
+			g.Expect(configMapIndexer.Add(obj)).To(Succeed())
+		}
+	}
+	kubeClient := fakekube.NewSimpleClientset(objects...)
+
+	operatorClient := v1helpers.NewFakeOperatorClient(
+		&operatorv1.OperatorSpec{ManagementState: operatorv1.Managed},
+		&operatorv1.OperatorStatus{},
+		nil,
+	)
+	recorder := events.NewInMemoryRecorder("test")
+
+	c := &AttachLimitController{
+		operatorClient:         operatorClient,
+		kubeClient:             kubeClient,
+		nodeLister:             corelisters.NewNodeLister(nodeIndexer),
+		csiNodeLister:          storagelisters.NewCSINodeLister(csiNodeIndexer),
+		volumeAttachmentLister: storagelisters.NewVolumeAttachmentLister(vaIndexer),
+		podLister:              corelisters.NewPodLister(podIndexer),
+		daemonSetLister:        appslisters.NewDaemonSetLister(daemonSetIndexer),
+		configMapLister:        corelisters.NewConfigMapLister(configMapIndexer),
+		provider:               cloudinfo.NewProvider(cloud.ClientOpts(), nil),
+		eventRecorder:          recorder,
+		disks:                  map[string]*cloudinfo.ServerDisks{},
+		now:                    time.Now,
+	}
+
+	return c, kubeClient, recorder
+}
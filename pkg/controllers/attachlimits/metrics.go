@@ -0,0 +1,29 @@
+package attachlimits
+
+import (
+	"k8s.io/component-base/metrics"
+	"k8s.io/component-base/metrics/legacyregistry"
+)
+
+var (
+	attachLimit = metrics.NewGaugeVec(
+		&metrics.GaugeOpts{
+			Name:           "openshift_openstack_cinder_csi_driver_operator_node_volume_attach_limit",
+			Help:           "Number of Cinder volumes that can be attached to a node, labeled by node and disk bus. Zero if the limit of the disk bus is not known, in which case the driver's default is used.",
+			StabilityLevel: metrics.ALPHA,
+		},
+		[]string{"node", "disk_bus"},
+	)
+	attachedVolumes = metrics.NewGaugeVec(
+		&metrics.GaugeOpts{
+			Name:           "openshift_openstack_cinder_csi_driver_operator_node_attached_volumes",
+			Help:           "Number of Cinder volumes attached to a node by the driver, labeled by node.",
+			StabilityLevel: metrics.ALPHA,
+		},
+		[]string{"node"},
+	)
+)
+
+func init() {
+	legacyregistry.MustRegister(attachLimit, attachedVolumes)
+}
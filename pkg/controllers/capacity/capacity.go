@@ -0,0 +1,397 @@
+package capacity
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/gophercloud/gophercloud/v2"
+	operatorv1 "github.com/openshift/api/operator/v1"
+	configinformers "github.com/openshift/client-go/config/informers/externalversions"
+	configv1listers "github.com/openshift/client-go/config/listers/config/v1"
+	"github.com/openshift/library-go/pkg/controller/factory"
+	"github.com/openshift/library-go/pkg/operator/events"
+	"github.com/openshift/library-go/pkg/operator/v1helpers"
+	storagev1 "k8s.io/api/storage/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/kubernetes"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	storagelisters "k8s.io/client-go/listers/storage/v1"
+	"k8s.io/klog/v2"
+
+	"github.com/openshift/openstack-cinder-csi-driver-operator/pkg/cloudinfo"
+	"github.com/openshift/openstack-cinder-csi-driver-operator/pkg/controllers/config"
+	"github.com/openshift/openstack-cinder-csi-driver-operator/pkg/util"
+)
+
+const (
+	provisioner = "cinder.csi.openstack.org"
+
+	// generatedByLabel marks the CSIStorageCapacity objects managed by this
+	// controller
+	generatedByLabel = "cinder.csi.openstack.org/generated-by"
+	generatorName    = "capacity"
+	// zoneAnnotation records the compute availability zone a
+	// CSIStorageCapacity object describes, if topology is enabled
+	zoneAnnotation = "cinder.csi.openstack.org/availability-zone"
+
+	topologyKey = "topology.cinder.csi.openstack.org/zone"
+
+	volumeBackendNameKey = "volume_backend_name"
+
+	// unlimitedCapacityGiB is published when neither the backend pools nor
+	// the quota limit the capacity
+	unlimitedCapacityGiB = 1 << 30
+
+	resyncInterval = 5 * time.Minute
+)
+
+// This CapacityController publishes CSIStorageCapacity objects for each
+// StorageClass using the Cinder driver, so that the scheduler can avoid
+// placing pods in availability zones whose backends are full. The driver
+// doesn't implement the CSI GetCapacity call, so the external-provisioner
+// can't do this itself. The free space is taken from the Cinder backend pool
+// statistics or, if the credentials don't allow reading these, from the
+// project's gigabytes quota.
+type CapacityController struct {
+	operatorClient       v1helpers.OperatorClient
+	kubeClient           kubernetes.Interface
+	storageClassLister   storagelisters.StorageClassLister
+	capacityLister       storagelisters.CSIStorageCapacityLister
+	configMapLister      corelisters.ConfigMapLister
+	targetConfigLister   corelisters.ConfigMapLister
+	infrastructureLister configv1listers.InfrastructureLister
+	cloudInfo            *cloudinfo.Cache
+	provider             cloudinfo.Provider
+	eventRecorder        events.Recorder
+}
+
+func NewCapacityController(
+	operatorClient v1helpers.OperatorClient,
+	kubeClient kubernetes.Interface,
+	informers v1helpers.KubeInformersForNamespaces,
+	configInformers configinformers.SharedInformerFactory,
+	cloudInfo *cloudinfo.Cache,
+	provider cloudinfo.Provider,
+	eventRecorder events.Recorder) factory.Controller {
+
+	configMapInformer := informers.InformersFor(util.OpenShiftConfigNamespace)
+	targetConfigInformer := informers.InformersFor(util.DefaultNamespace)
+	capacityInformer := targetConfigInformer.Storage().V1().CSIStorageCapacities()
+	storageClassInformer := informers.InformersFor("").Storage().V1().StorageClasses()
+	c := &CapacityController{
+		operatorClient:       operatorClient,
+		kubeClient:           kubeClient,
+		storageClassLister:   storageClassInformer.Lister(),
+		capacityLister:       capacityInformer.Lister(),
+		configMapLister:      configMapInformer.Core().V1().ConfigMaps().Lister(),
+		targetConfigLister:   targetConfigInformer.Core().V1().ConfigMaps().Lister(),
+		infrastructureLister: configInformers.Config().V1().Infrastructures().Lister(),
+		cloudInfo:            cloudInfo,
+		provider:             provider,
+		eventRecorder:        eventRecorder.WithComponentSuffix("StorageCapacity"),
+	}
+	return factory.New().WithSync(c.sync).ResyncEvery(resyncInterval).WithSyncDegradedOnError(operatorClient).WithInformers(
+		operatorClient.Informer(),
+		configMapInformer.Core().V1().ConfigMaps().Informer(),
+		targetConfigInformer.Core().V1().ConfigMaps().Informer(),
+		capacityInformer.Informer(),
+		storageClassInformer.Informer(),
+	).ToController("StorageCapacity", eventRecorder)
+}
+
+func (c *CapacityController) sync(ctx context.Context, syncCtx factory.SyncContext) error {
+	opSpec, _, _, err := c.operatorClient.GetOperatorState()
+	if err != nil {
+		return err
+	}
+	if opSpec.ManagementState != operatorv1.Managed {
+		return nil
+	}
+
+	state, err := config.GetTopologyState(c.configMapLister, c.targetConfigLister, c.infrastructureLister, c.cloudInfo)
+	if err != nil {
+		return err
+	}
+	if state == nil {
+		return nil
+	}
+
+	expected := map[string]*storagev1.CSIStorageCapacity{}
+	if state.Settings.StorageCapacity {
+		scs, err := c.storageClasses()
+		if err != nil {
+			return err
+		}
+
+		estimator, err := c.newEstimator(ctx)
+		if err != nil {
+			return err
+		}
+
+		for _, sc := range scs {
+			for _, capacity := range storageClassCapacities(sc, state, estimator) {
+				expected[capacity.Name] = capacity
+			}
+		}
+	}
+
+	return c.applyCapacities(ctx, expected)
+}
+
+// storageClasses returns the StorageClasses using the Cinder driver for which
+// the scheduler will consider capacity
+func (c *CapacityController) storageClasses() ([]*storagev1.StorageClass, error) {
+	all, err := c.storageClassLister.List(labels.Everything())
+	if err != nil {
+		return nil, err
+	}
+
+	var scs []*storagev1.StorageClass
+	for _, sc := range all {
+		if sc.Provisioner != provisioner {
+			continue
+		}
+		// capacity is only considered for delayed binding
+		if sc.VolumeBindingMode == nil || *sc.VolumeBindingMode != storagev1.VolumeBindingWaitForFirstConsumer {
+			continue
+		}
+		scs = append(scs, sc)
+	}
+
+	sort.Slice(scs, func(i, j int) bool {
+		return scs[i].Name < scs[j].Name
+	})
+
+	return scs, nil
+}
+
+// newEstimator fetches the pool statistics and quota needed to estimate
+// capacity
+func (c *CapacityController) newEstimator(ctx context.Context) (*estimator, error) {
+	e := &estimator{
+		quotaFreeGiB: -1,
+	}
+
+	pools, err := c.provider.GetStoragePools(ctx)
+	if err == nil {
+		volumeServices, err := c.provider.GetVolumeServices(ctx, "cinder-volume")
+		if err != nil {
+			return nil, err
+		}
+
+		e.pools = pools
+		e.hostZones = map[string]string{}
+		for _, service := range volumeServices {
+			e.hostZones[service.Host] = service.Zone
+			if service.Cluster != "" {
+				e.hostZones[service.Cluster] = service.Zone
+			}
+		}
+	} else if gophercloud.ResponseCodeIs(err, http.StatusForbidden) {
+		klog.V(2).Infof("Not permitted to read Cinder storage pools; estimating capacity from the quota instead")
+	} else {
+		return nil, err
+	}
+
+	quotas, err := c.provider.GetVolumeQuotas(ctx)
+	if err != nil {
+		if e.pools == nil {
+			return nil, fmt.Errorf("unable to estimate capacity from either storage pools or the quota: %w", err)
+		}
+		klog.Warningf("Failed to get the Cinder quota; capacity will not be limited by it: %v", err)
+	} else if quotas.Gigabytes.Limit >= 0 {
+		e.quotaFreeGiB = math.Max(float64(quotas.Gigabytes.Limit-quotas.Gigabytes.Used()), 0)
+	}
+
+	return e, nil
+}
+
+// estimator estimates the free capacity available to volumes
+type estimator struct {
+	// pools is nil if the pool statistics couldn't be read
+	pools []cloudinfo.StoragePool
+	// hostZones maps cinder-volume hosts to their volume availability zone
+	hostZones map[string]string
+	// quotaFreeGiB is negative if the quota is unlimited or unknown
+	quotaFreeGiB float64
+}
+
+// freeGiB returns the free capacity in GiB for volumes in the given volume
+// availability zone on the given backend. Either may be empty to consider
+// all zones or backends.
+func (e *estimator) freeGiB(volumeZone, backendName string) float64 {
+	free := math.Inf(1)
+
+	if e.pools != nil {
+		free = 0
+		for _, pool := range e.pools {
+			if backendName != "" && pool.VolumeBackendName != backendName {
+				continue
+			}
+			if volumeZone != "" && e.hostZones[pool.Host()] != volumeZone {
+				continue
+			}
+			free += pool.FreeCapacityGB
+		}
+	}
+
+	if e.quotaFreeGiB >= 0 {
+		free = math.Min(free, e.quotaFreeGiB)
+	}
+
+	return math.Min(free, unlimitedCapacityGiB)
+}
+
+// storageClassCapacities returns the CSIStorageCapacity objects describing
+// the capacity available to the StorageClass in each topology segment
+func storageClassCapacities(sc *storagev1.StorageClass, state *config.TopologyState, e *estimator) []*storagev1.CSIStorageCapacity {
+	var backendName string
+	if volumeType := sc.Parameters["type"]; volumeType != "" {
+		for _, t := range state.CloudInfo.VolumeTypes {
+			if t.Name == volumeType {
+				backendName = t.ExtraSpecs[volumeBackendNameKey]
+				break
+			}
+		}
+	}
+
+	if !state.TopologyEnabled {
+		// Without topology, volumes may be created in any availability zone
+		// and used by any node
+		return []*storagev1.CSIStorageCapacity{
+			newCapacity(sc.Name, "", e.freeGiB(sc.Parameters["availability"], backendName)),
+		}
+	}
+
+	var capacities []*storagev1.CSIStorageCapacity
+	for _, computeZone := range state.CloudInfo.ComputeZones {
+		volumeZone := sc.Parameters["availability"]
+		if volumeZone == "" {
+			volumeZone = computeZone
+			if state.ZoneMapping != nil {
+				volumeZone = state.ZoneMapping[computeZone]
+			}
+		}
+
+		capacities = append(capacities, newCapacity(sc.Name, computeZone, e.freeGiB(volumeZone, backendName)))
+	}
+
+	return capacities
+}
+
+// newCapacity returns a CSIStorageCapacity object for the StorageClass and
+// compute availability zone. If zone is empty, the object applies to all
+// nodes.
+func newCapacity(storageClassName, zone string, freeGiB float64) *storagev1.CSIStorageCapacity {
+	h := fnv.New64a()
+	h.Write([]byte(storageClassName + "/" + zone))
+
+	capacity := &storagev1.CSIStorageCapacity{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      fmt.Sprintf("cinder-csi-%x", h.Sum64()),
+			Namespace: util.DefaultNamespace,
+			Labels: map[string]string{
+				generatedByLabel: generatorName,
+			},
+		},
+		StorageClassName: storageClassName,
+		NodeTopology:     &metav1.LabelSelector{},
+		Capacity:         resource.NewQuantity(int64(math.Floor(freeGiB))*1024*1024*1024, resource.BinarySI),
+	}
+
+	if zone != "" {
+		capacity.Annotations = map[string]string{
+			zoneAnnotation: zone,
+		}
+		capacity.NodeTopology.MatchLabels = map[string]string{
+			topologyKey: zone,
+		}
+	}
+
+	return capacity
+}
+
+// applyCapacities creates or updates the expected CSIStorageCapacity objects
+// and deletes any others previously published by this controller
+func (c *CapacityController) applyCapacities(ctx context.Context, expected map[string]*storagev1.CSIStorageCapacity) error {
+	client := c.kubeClient.StorageV1().CSIStorageCapacities(util.DefaultNamespace)
+
+	names := make([]string, 0, len(expected))
+	for name := range expected {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		required := expected[name]
+
+		existing, err := c.capacityLister.CSIStorageCapacities(util.DefaultNamespace).Get(name)
+		if errors.IsNotFound(err) {
+			_, err = client.Create(ctx, required, metav1.CreateOptions{})
+			if err != nil {
+				return fmt.Errorf("failed to create CSIStorageCapacity %s: %w", name, err)
+			}
+			klog.V(2).Infof("Created CSIStorageCapacity %s for StorageClass %s with capacity %s", name, required.StorageClassName, required.Capacity)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		// the topology and StorageClass are immutable
+		if existing.StorageClassName != required.StorageClassName || !equality.Semantic.DeepEqual(existing.NodeTopology, required.NodeTopology) {
+			err = client.Delete(ctx, name, metav1.DeleteOptions{})
+			if err != nil && !errors.IsNotFound(err) {
+				return fmt.Errorf("failed to delete CSIStorageCapacity %s: %w", name, err)
+			}
+			_, err = client.Create(ctx, required, metav1.CreateOptions{})
+			if err != nil {
+				return fmt.Errorf("failed to create CSIStorageCapacity %s: %w", name, err)
+			}
+			continue
+		}
+
+		if equality.Semantic.DeepEqual(existing.Capacity, required.Capacity) &&
+			equality.Semantic.DeepEqual(existing.Labels, required.Labels) &&
+			equality.Semantic.DeepEqual(existing.Annotations, required.Annotations) {
+			continue
+		}
+
+		updated := existing.DeepCopy()
+		updated.Labels = required.Labels
+		updated.Annotations = required.Annotations
+		updated.Capacity = required.Capacity
+		_, err = client.Update(ctx, updated, metav1.UpdateOptions{})
+		if err != nil {
+			return fmt.Errorf("failed to update CSIStorageCapacity %s: %w", name, err)
+		}
+		klog.V(4).Infof("Updated CSIStorageCapacity %s for StorageClass %s with capacity %s", name, required.StorageClassName, required.Capacity)
+	}
+
+	selector := labels.SelectorFromSet(labels.Set{generatedByLabel: generatorName})
+	published, err := c.capacityLister.CSIStorageCapacities(util.DefaultNamespace).List(selector)
+	if err != nil {
+		return err
+	}
+	for _, capacity := range published {
+		if _, ok := expected[capacity.Name]; ok {
+			continue
+		}
+		klog.V(2).Infof("Deleting CSIStorageCapacity %s as it is no longer required", capacity.Name)
+		err = client.Delete(ctx, capacity.Name, metav1.DeleteOptions{})
+		if err != nil && !errors.IsNotFound(err) {
+			return fmt.Errorf("failed to delete CSIStorageCapacity %s: %w", capacity.Name, err)
+		}
+	}
+
+	return nil
+}
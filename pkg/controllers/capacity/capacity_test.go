@@ -0,0 +1,418 @@
+package capacity
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/onsi/gomega"
+	configv1 "github.com/openshift/api/config/v1"
+	operatorv1 "github.com/openshift/api/operator/v1"
+	configv1listers "github.com/openshift/client-go/config/listers/config/v1"
+	"github.com/openshift/library-go/pkg/controller/factory"
+	"github.com/openshift/library-go/pkg/operator/events"
+	"github.com/openshift/library-go/pkg/operator/v1helpers"
+	corev1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	fakekube "k8s.io/client-go/kubernetes/fake"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	storagelisters "k8s.io/client-go/listers/storage/v1"
+	"k8s.io/client-go/tools/cache"
+
+	"github.com/openshift/openstack-cinder-csi-driver-operator/assets"
+	"github.com/openshift/openstack-cinder-csi-driver-operator/pkg/cloudinfo"
+	"github.com/openshift/openstack-cinder-csi-driver-operator/pkg/cloudinfo/fake"
+	"github.com/openshift/openstack-cinder-csi-driver-operator/pkg/controllers/config"
+	"github.com/openshift/openstack-cinder-csi-driver-operator/pkg/util"
+)
+
+func gib(n int64) *resource.Quantity {
+	return resource.NewQuantity(n*1024*1024*1024, resource.BinarySI)
+}
+
+func TestStorageClassCapacities(t *testing.T) {
+	cloudInfo := &cloudinfo.CloudInfo{
+		ComputeZones: []string{"az1", "az2"},
+		VolumeZones:  []string{"cinder1", "cinder2"},
+		VolumeTypes: []cloudinfo.VolumeType{
+			{Name: "ssd", ExtraSpecs: map[string]string{"volume_backend_name": "ssd"}},
+			{Name: "any"},
+		},
+	}
+	e := &estimator{
+		pools: []cloudinfo.StoragePool{
+			{Name: "host1@ssd#a", VolumeBackendName: "ssd", FreeCapacityGB: 100.7},
+			{Name: "host1@hdd#a", VolumeBackendName: "hdd", FreeCapacityGB: 1000},
+			{Name: "host2@ssd#a", VolumeBackendName: "ssd", FreeCapacityGB: 200},
+			{Name: "host2@ssd#b", VolumeBackendName: "ssd", FreeCapacityGB: 50},
+		},
+		hostZones: map[string]string{
+			"host1@ssd": "cinder1",
+			"host1@hdd": "cinder1",
+			"host2@ssd": "cinder2",
+		},
+		quotaFreeGiB: -1,
+	}
+
+	tc := []struct {
+		name         string
+		parameters   map[string]string
+		state        *config.TopologyState
+		quotaFreeGiB float64
+		// expected maps the zone annotation to the expected capacity in GiB
+		expected map[string]int64
+	}{
+		{
+			name:       "Topology disabled",
+			parameters: map[string]string{"type": "ssd"},
+			state:      &config.TopologyState{CloudInfo: cloudInfo},
+			expected:   map[string]int64{"": 350},
+		}, {
+			name:       "Topology disabled with an availability zone",
+			parameters: map[string]string{"availability": "cinder2"},
+			state:      &config.TopologyState{CloudInfo: cloudInfo},
+			expected:   map[string]int64{"": 250},
+		}, {
+			name:       "Topology enabled with a zone mapping",
+			parameters: map[string]string{"type": "ssd"},
+			state: &config.TopologyState{
+				CloudInfo:       cloudInfo,
+				TopologyEnabled: true,
+				ZoneMapping:     config.ZoneMapping{"az1": "cinder1", "az2": "cinder2"},
+			},
+			expected: map[string]int64{"az1": 100, "az2": 250},
+		}, {
+			name:       "Topology enabled with a volume type without a backend",
+			parameters: map[string]string{"type": "any"},
+			state: &config.TopologyState{
+				CloudInfo:       cloudInfo,
+				TopologyEnabled: true,
+				ZoneMapping:     config.ZoneMapping{"az1": "cinder1", "az2": "cinder2"},
+			},
+			expected: map[string]int64{"az1": 1100, "az2": 250},
+		}, {
+			name:       "Topology enabled without a zone mapping",
+			parameters: map[string]string{},
+			state: &config.TopologyState{
+				CloudInfo:       cloudInfo,
+				TopologyEnabled: true,
+			},
+			expected: map[string]int64{"az1": 0, "az2": 0},
+		}, {
+			name:       "Topology enabled with an availability zone",
+			parameters: map[string]string{"availability": "cinder1"},
+			state: &config.TopologyState{
+				CloudInfo:       cloudInfo,
+				TopologyEnabled: true,
+				ZoneMapping:     config.ZoneMapping{"az1": "cinder1", "az2": "cinder2"},
+			},
+			expected: map[string]int64{"az1": 1100, "az2": 1100},
+		}, {
+			name:         "Limited by the quota",
+			parameters:   map[string]string{"type": "ssd"},
+			state:        &config.TopologyState{CloudInfo: cloudInfo},
+			quotaFreeGiB: 120,
+			expected:     map[string]int64{"": 120},
+		},
+	}
+
+	for _, tc := range tc {
+		t.Run(tc.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			e := *e
+			if tc.quotaFreeGiB != 0 {
+				e.quotaFreeGiB = tc.quotaFreeGiB
+			}
+
+			sc := &storagev1.StorageClass{
+				ObjectMeta: metav1.ObjectMeta{Name: "standard-csi"},
+				Parameters: tc.parameters,
+			}
+
+			actual := map[string]int64{}
+			for _, capacity := range storageClassCapacities(sc, tc.state, &e) {
+				g.Expect(capacity.StorageClassName).To(Equal("standard-csi"))
+				g.Expect(capacity.Namespace).To(Equal(util.DefaultNamespace))
+				g.Expect(capacity.Labels).To(HaveKeyWithValue(generatedByLabel, generatorName))
+
+				zone := capacity.Annotations[zoneAnnotation]
+				if zone == "" {
+					g.Expect(capacity.NodeTopology).To(Equal(&metav1.LabelSelector{}))
+				} else {
+					g.Expect(capacity.NodeTopology.MatchLabels).To(Equal(map[string]string{topologyKey: zone}))
+				}
+
+				actual[zone] = capacity.Capacity.Value() / (1024 * 1024 * 1024)
+			}
+			g.Expect(actual).To(Equal(tc.expected))
+		})
+	}
+}
+
+func TestEstimatorUnlimited(t *testing.T) {
+	g := NewWithT(t)
+
+	// neither an infinite pool nor an unknown quota can be published as is
+	e := &estimator{
+		pools: []cloudinfo.StoragePool{
+			{Name: "host@ceph#ceph", FreeCapacityGB: math.Inf(1)},
+		},
+		hostZones:    map[string]string{"host@ceph": "nova"},
+		quotaFreeGiB: -1,
+	}
+	g.Expect(e.freeGiB("nova", "")).To(Equal(float64(unlimitedCapacityGiB)))
+
+	e.quotaFreeGiB = 10
+	g.Expect(e.freeGiB("nova", "")).To(Equal(float64(10)))
+}
+
+func TestSync(t *testing.T) {
+	tc := []struct {
+		name            string
+		sourceData      map[string]string
+		enableTopology  string
+		failPools       int
+		quotas          map[string]fake.QuotaUsage
+		existing        []runtime.Object
+		expectedZones   map[string]*resource.Quantity
+		expectedDeleted []string
+		errMsg          string
+	}{
+		{
+			name:          "Capacity from storage pools",
+			sourceData:    map[string]string{"storage_capacity": "true"},
+			expectedZones: map[string]*resource.Quantity{"az1": gib(300), "az2": gib(50)},
+		}, {
+			name:       "Capacity from storage pools limited by the quota",
+			sourceData: map[string]string{"storage_capacity": "true"},
+			quotas: map[string]fake.QuotaUsage{
+				"gigabytes": {InUse: 900, Limit: 1000},
+			},
+			expectedZones: map[string]*resource.Quantity{"az1": gib(100), "az2": gib(50)},
+		}, {
+			name:       "Capacity from the quota",
+			sourceData: map[string]string{"storage_capacity": "true"},
+			failPools:  http.StatusForbidden,
+			quotas: map[string]fake.QuotaUsage{
+				"gigabytes": {InUse: 500, Reserved: 100, Limit: 1000},
+			},
+			expectedZones: map[string]*resource.Quantity{"az1": gib(400), "az2": gib(400)},
+		}, {
+			name:           "Capacity from the quota without topology",
+			sourceData:     map[string]string{"storage_capacity": "true"},
+			enableTopology: "false",
+			failPools:      http.StatusForbidden,
+			quotas: map[string]fake.QuotaUsage{
+				"gigabytes": {InUse: 500, Limit: 1000},
+			},
+			expectedZones: map[string]*resource.Quantity{"": gib(500)},
+		}, {
+			name:       "Storage pools cannot be read",
+			sourceData: map[string]string{"storage_capacity": "true"},
+			failPools:  http.StatusInternalServerError,
+			errMsg:     "failed to list storage pools",
+		}, {
+			name:       "Existing objects are updated and stale objects removed",
+			sourceData: map[string]string{"storage_capacity": "true"},
+			existing: []runtime.Object{
+				newCapacity("standard-csi", "az1", 10),
+				newCapacity("deleted-sc", "az1", 10),
+				newCapacity("standard-csi", "az3", 10),
+			},
+			expectedZones:   map[string]*resource.Quantity{"az1": gib(300), "az2": gib(50)},
+			expectedDeleted: []string{newCapacity("deleted-sc", "az1", 0).Name, newCapacity("standard-csi", "az3", 0).Name},
+		}, {
+			name: "Disabled",
+			existing: []runtime.Object{
+				newCapacity("standard-csi", "az1", 10),
+				&storagev1.CSIStorageCapacity{
+					ObjectMeta: metav1.ObjectMeta{Name: "user-owned", Namespace: util.DefaultNamespace},
+				},
+			},
+			expectedDeleted: []string{newCapacity("standard-csi", "az1", 0).Name},
+		},
+	}
+
+	for _, tc := range tc {
+		t.Run(tc.name, func(t *testing.T) {
+			g := NewWithT(t)
+			ctx := context.TODO()
+
+			cloud := fake.New()
+			defer cloud.Close()
+			cloud.ComputeZones = fake.Zones("az1", "az2")
+			cloud.VolumeZones = fake.Zones("az1", "az2")
+			cloud.StoragePools = []fake.StoragePool{
+				{Name: "host1@lvm#lvm", VolumeBackendName: "lvm", FreeCapacityGB: 300},
+				{Name: "host2@lvm#lvm", VolumeBackendName: "lvm", FreeCapacityGB: 50.5},
+			}
+			cloud.VolumeServices = []fake.VolumeService{
+				{Binary: "cinder-volume", Host: "host1@lvm", Zone: "az1", State: "up", Status: "enabled"},
+				{Binary: "cinder-volume", Host: "host2@lvm", Zone: "az2", State: "up", Status: "enabled"},
+			}
+			if tc.quotas != nil {
+				cloud.VolumeQuotas = tc.quotas
+			}
+			if tc.failPools != 0 {
+				cloud.Fail("volume", http.MethodGet, "/scheduler-stats/get_pools", tc.failPools)
+			}
+
+			provider := cloudinfo.NewProvider(cloud.ClientOpts(), nil)
+			cloudInfo := cloudinfo.NewCache(provider)
+			_, _, err := cloudInfo.Refresh(ctx, time.Hour)
+			g.Expect(err).ToNot(HaveOccurred())
+
+			enableTopology := tc.enableTopology
+			if enableTopology == "" {
+				enableTopology = "true"
+			}
+			configMaps := []*corev1.ConfigMap{
+				{
+					ObjectMeta: metav1.ObjectMeta{Name: "cloud-provider-config", Namespace: util.OpenShiftConfigNamespace},
+					Data:       map[string]string{"config": "[Global]\n"},
+				}, {
+					ObjectMeta: metav1.ObjectMeta{Name: util.CinderConfigName, Namespace: util.DefaultNamespace},
+					Data:       map[string]string{"enable_topology": enableTopology},
+				},
+			}
+			for k, v := range tc.sourceData {
+				configMaps[0].Data[k] = v
+			}
+
+			c, kubeClient := newTestCapacityController(g, cloudInfo, provider, configMaps, tc.existing)
+
+			err = c.sync(ctx, factory.NewSyncContext("StorageCapacity", events.NewInMemoryRecorder("test")))
+			if tc.errMsg != "" {
+				g.Expect(err).To(MatchError(ContainSubstring(tc.errMsg)))
+				return
+			}
+			g.Expect(err).ToNot(HaveOccurred())
+
+			list, err := kubeClient.StorageV1().CSIStorageCapacities(util.DefaultNamespace).List(ctx, metav1.ListOptions{})
+			g.Expect(err).ToNot(HaveOccurred())
+
+			actual := map[string]*resource.Quantity{}
+			for _, capacity := range list.Items {
+				if capacity.Labels[generatedByLabel] == "" {
+					continue
+				}
+				// only the WaitForFirstConsumer StorageClass using this
+				// driver is expected
+				g.Expect(capacity.StorageClassName).To(Equal("standard-csi"))
+				actual[capacity.Annotations[zoneAnnotation]] = capacity.Capacity
+			}
+			g.Expect(actual).To(HaveLen(len(tc.expectedZones)))
+			for zone, expected := range tc.expectedZones {
+				g.Expect(actual).To(HaveKey(zone))
+				g.Expect(actual[zone].Cmp(*expected)).To(BeZero(), "zone %s has capacity %s", zone, actual[zone])
+			}
+
+			var deleted []string
+			for _, action := range kubeClient.Actions() {
+				if action.GetVerb() == "delete" {
+					deleted = append(deleted, action.(interface{ GetName() string }).GetName())
+				}
+			}
+			g.Expect(deleted).To(ConsistOf(tc.expectedDeleted))
+		})
+	}
+}
+
+func TestWithStorageCapacity(t *testing.T) {
+	for _, enabled := range []bool{false, true} {
+		g := NewWithT(t)
+
+		configMapIndexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+		g.Expect(configMapIndexer.Add(&corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: "cloud-provider-config", Namespace: util.OpenShiftConfigNamespace},
+			Data: map[string]string{
+				"config":           "[Global]\n",
+				"storage_capacity": map[bool]string{false: "false", true: "true"}[enabled],
+			},
+		})).To(Succeed())
+
+		assetFunc := WithStorageCapacity(assets.ReadFile, corelisters.NewConfigMapLister(configMapIndexer), newInfrastructureLister(g))
+
+		csiDriver, err := assetFunc("csidriver.yaml")
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(strings.Contains(string(csiDriver), "storageCapacity: true")).To(Equal(enabled))
+		g.Expect(strings.Contains(string(csiDriver), "storageCapacity: false")).To(Equal(!enabled))
+
+		// other assets are untouched
+		original, err := assets.ReadFile("controller.yaml")
+		g.Expect(err).ToNot(HaveOccurred())
+		g.Expect(assetFunc("controller.yaml")).To(Equal(original))
+	}
+}
+
+func newInfrastructureLister(g *WithT) configv1listers.InfrastructureLister {
+	infraIndexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	g.Expect(infraIndexer.Add(&configv1.Infrastructure{
+		ObjectMeta: metav1.ObjectMeta{Name: "cluster"},
+		Spec: configv1.InfrastructureSpec{
+			CloudConfig: configv1.ConfigMapFileReference{Name: "cloud-provider-config"},
+		},
+	})).To(Succeed())
+	return configv1listers.NewInfrastructureLister(infraIndexer)
+}
+
+func newTestCapacityController(g *WithT, cloudInfo *cloudinfo.Cache, provider cloudinfo.Provider, configMaps []*corev1.ConfigMap, existing []runtime.Object) (*CapacityController, *fakekube.Clientset) {
+	configMapIndexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+	for _, cm := range configMaps {
+		g.Expect(configMapIndexer.Add(cm)).To(Succeed())
+	}
+
+	waitForFirstConsumer := storagev1.VolumeBindingWaitForFirstConsumer
+	immediate := storagev1.VolumeBindingImmediate
+	storageClassIndexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	for _, sc := range []*storagev1.StorageClass{
+		{
+			ObjectMeta:        metav1.ObjectMeta{Name: "standard-csi"},
+			Provisioner:       provisioner,
+			VolumeBindingMode: &waitForFirstConsumer,
+		}, {
+			ObjectMeta:        metav1.ObjectMeta{Name: "immediate"},
+			Provisioner:       provisioner,
+			VolumeBindingMode: &immediate,
+		}, {
+			ObjectMeta:        metav1.ObjectMeta{Name: "other-driver"},
+			Provisioner:       "example.com/other",
+			VolumeBindingMode: &waitForFirstConsumer,
+		},
+	} {
+		g.Expect(storageClassIndexer.Add(sc)).To(Succeed())
+	}
+
+	capacityIndexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+	for _, obj := range existing {
+		g.Expect(capacityIndexer.Add(obj)).To(Succeed())
+	}
+
+	kubeClient := fakekube.NewSimpleClientset(existing...)
+
+	c := &CapacityController{
+		operatorClient: v1helpers.NewFakeOperatorClient(
+			&operatorv1.OperatorSpec{ManagementState: operatorv1.Managed},
+			&operatorv1.OperatorStatus{},
+			nil,
+		),
+		kubeClient:           kubeClient,
+		storageClassLister:   storagelisters.NewStorageClassLister(storageClassIndexer),
+		capacityLister:       storagelisters.NewCSIStorageCapacityLister(capacityIndexer),
+		configMapLister:      corelisters.NewConfigMapLister(configMapIndexer),
+		targetConfigLister:   corelisters.NewConfigMapLister(configMapIndexer),
+		infrastructureLister: newInfrastructureLister(g),
+		cloudInfo:            cloudInfo,
+		provider:             provider,
+		eventRecorder:        events.NewInMemoryRecorder("test"),
+	}
+
+	return c, kubeClient
+}
@@ -0,0 +1,56 @@
+package capacity
+
+import (
+	"bytes"
+	"fmt"
+
+	configv1listers "github.com/openshift/client-go/config/listers/config/v1"
+	"github.com/openshift/library-go/pkg/operator/resource/resourceapply"
+	corelisters "k8s.io/client-go/listers/core/v1"
+
+	"github.com/openshift/openstack-cinder-csi-driver-operator/pkg/controllers/config"
+)
+
+const csiDriverAsset = "csidriver.yaml"
+
+var (
+	storageCapacityDisabled = []byte("storageCapacity: false")
+	storageCapacityEnabled  = []byte("storageCapacity: true")
+)
+
+// WithStorageCapacity wraps an AssetFunc so that the CSIDriver enables
+// storage capacity tracking when the operator is configured to publish
+// CSIStorageCapacity objects. All other assets are returned unmodified.
+func WithStorageCapacity(
+	assetFunc resourceapply.AssetFunc,
+	configMapLister corelisters.ConfigMapLister,
+	infrastructureLister configv1listers.InfrastructureLister,
+) resourceapply.AssetFunc {
+	return func(name string) ([]byte, error) {
+		asset, err := assetFunc(name)
+		if err != nil || name != csiDriverAsset {
+			return asset, err
+		}
+
+		sourceConfig, err := config.GetSourceConfigMap(configMapLister, infrastructureLister)
+		if err != nil {
+			return nil, err
+		}
+		if sourceConfig == nil {
+			return asset, nil
+		}
+
+		settings, err := config.ParseSettings(sourceConfig)
+		if err != nil {
+			return nil, err
+		}
+		if !settings.StorageCapacity {
+			return asset, nil
+		}
+
+		if !bytes.Contains(asset, storageCapacityDisabled) {
+			return nil, fmt.Errorf("%s does not contain %q", name, storageCapacityDisabled)
+		}
+		return bytes.Replace(asset, storageCapacityDisabled, storageCapacityEnabled, 1), nil
+	}
+}
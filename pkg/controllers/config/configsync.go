@@ -5,6 +5,7 @@ import (
 	"context"
 	"fmt"
 	"strconv"
+	"strings"
 	"time"
 
 	operatorv1 "github.com/openshift/api/operator/v1"
@@ -12,14 +13,16 @@ import (
 	configv1listers "github.com/openshift/client-go/config/listers/config/v1"
 	"github.com/openshift/library-go/pkg/controller/factory"
 	"github.com/openshift/library-go/pkg/operator/events"
-	"github.com/openshift/library-go/pkg/operator/resource/resourceapply"
 	"github.com/openshift/library-go/pkg/operator/v1helpers"
+	"github.com/openshift/openstack-cinder-csi-driver-operator/pkg/cloudinfo"
 	"github.com/openshift/openstack-cinder-csi-driver-operator/pkg/util"
 	ini "gopkg.in/ini.v1"
 	v1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
 	"k8s.io/client-go/kubernetes"
+	appslisters "k8s.io/client-go/listers/apps/v1"
 	corelisters "k8s.io/client-go/listers/core/v1"
 	"k8s.io/klog/v2"
 )
@@ -27,11 +30,27 @@ import (
 // This ConfigSyncController translates the ConfigMap provided by the user
 // containing configuration information for the Cinder CSI driver.
 type ConfigSyncController struct {
-	operatorClient       v1helpers.OperatorClient
-	kubeClient           kubernetes.Interface
-	configMapLister      corelisters.ConfigMapLister
-	infrastructureLister configv1listers.InfrastructureLister
-	eventRecorder        events.Recorder
+	operatorClient  v1helpers.OperatorClient
+	kubeClient      kubernetes.Interface
+	configMapLister corelisters.ConfigMapLister
+	// targetConfigMapLister lists the config maps in the operator namespace
+	targetConfigMapLister corelisters.ConfigMapLister
+	secretLister          corelisters.SecretLister
+	podLister             corelisters.PodLister
+	deploymentLister      appslisters.DeploymentLister
+	infrastructureLister  configv1listers.InfrastructureLister
+	cloudInfo             *cloudinfo.Cache
+	eventRecorder         events.Recorder
+
+	// lastTopologyDecision is used to only emit an event when the automatic
+	// topology configuration changes
+	lastTopologyDecision string
+	// lastCredentialsHash is used to refetch the cloud info when the
+	// credentials change
+	lastCredentialsHash string
+	// rollout is the generated config which the driver controller is
+	// rolling out, if it isn't the last known good config
+	rollout *configRollout
 }
 
 const (
@@ -47,22 +66,43 @@ func NewConfigSyncController(
 	kubeClient kubernetes.Interface,
 	informers v1helpers.KubeInformersForNamespaces,
 	configInformers configinformers.SharedInformerFactory,
+	cloudInfo *cloudinfo.Cache,
 	resyncInterval time.Duration,
 	eventRecorder events.Recorder) factory.Controller {
 
 	// Read configmap from user-managed namespace and save the translated one
 	// to the operator namespace
 	configMapInformer := informers.InformersFor(util.OpenShiftConfigNamespace)
+	targetConfigMapInformer := informers.InformersFor(util.DefaultNamespace).Core().V1().ConfigMaps()
+	secretInformer := informers.InformersFor(util.DefaultNamespace).Core().V1().Secrets()
+	podInformer := informers.InformersFor(util.DefaultNamespace).Core().V1().Pods()
+	deploymentInformer := informers.InformersFor(util.DefaultNamespace).Apps().V1().Deployments()
 	c := &ConfigSyncController{
-		operatorClient:       operatorClient,
-		kubeClient:           kubeClient,
-		configMapLister:      configMapInformer.Core().V1().ConfigMaps().Lister(),
-		infrastructureLister: configInformers.Config().V1().Infrastructures().Lister(),
-		eventRecorder:        eventRecorder.WithComponentSuffix("ConfigSync"),
+		operatorClient:        operatorClient,
+		kubeClient:            kubeClient,
+		configMapLister:       configMapInformer.Core().V1().ConfigMaps().Lister(),
+		targetConfigMapLister: targetConfigMapInformer.Lister(),
+		secretLister:          secretInformer.Lister(),
+		podLister:             podInformer.Lister(),
+		deploymentLister:      deploymentInformer.Lister(),
+		infrastructureLister:  configInformers.Config().V1().Infrastructures().Lister(),
+		cloudInfo:             cloudInfo,
+		eventRecorder:         eventRecorder.WithComponentSuffix("ConfigSync"),
 	}
+	// The Proxy and credentials are watched as they configure our OpenStack
+	// client, and the driver controller pods to roll back a config they
+	// fail with
 	return factory.New().WithSync(c.sync).ResyncEvery(resyncInterval).WithSyncDegradedOnError(operatorClient).WithInformers(
 		operatorClient.Informer(),
 		configMapInformer.Core().V1().ConfigMaps().Informer(),
+		configInformers.Config().V1().Proxies().Informer(),
+		secretInformer.Informer(),
+		deploymentInformer.Informer(),
+	).WithFilteredEventsInformers(
+		isControllerPod,
+		podInformer.Informer(),
+	).WithBareInformers(
+		targetConfigMapInformer.Informer(),
 	).ToController("ConfigSync", eventRecorder)
 }
 
@@ -77,50 +117,161 @@ func (c *ConfigSyncController) sync(ctx context.Context, syncCtx factory.SyncCon
 		return nil
 	}
 
-	enableTopologyFeature, err := enableTopologyFeature()
+	sourceConfig, err := GetSourceConfigMap(c.configMapLister, c.infrastructureLister)
 	if err != nil {
 		return err
 	}
+	if sourceConfig == nil {
+		return nil
+	}
 
-	infra, err := c.infrastructureLister.Get(infrastructureResourceName)
+	settings, err := ParseSettings(sourceConfig)
 	if err != nil {
 		return err
 	}
 
-	var sourceConfig *v1.ConfigMap
+	// Rotated credentials may not see the same cloud, so the cloud info is
+	// refetched as soon as they change
+	credentialsHash, err := GetCredentialsHash(c.secretLister)
+	if err != nil {
+		return err
+	}
+	if c.lastCredentialsHash != "" && credentialsHash != c.lastCredentialsHash {
+		klog.Info("OpenStack credentials changed; refreshing cloud info")
+		c.eventRecorder.Event("CredentialsChanged", "OpenStack credentials changed; refreshing information about the cloud")
+		c.cloudInfo.Expire()
+	}
+	c.lastCredentialsHash = credentialsHash
+
+	// The cloud info is refreshed on resync once it is older than the
+	// configured TTL. Any change to the AZs will be reflected in the
+	// generated config below.
+	cloudInfo, previousCloudInfo, err := c.cloudInfo.Refresh(ctx, settings.CloudInfoTTL)
+	if err != nil {
+		return err
+	}
+	if previousCloudInfo != nil {
+		if msg := cloudInfo.ZonesChanged(previousCloudInfo); msg != "" {
+			c.eventRecorder.Eventf("AvailabilityZonesChanged", "OpenStack %s", msg)
+		}
+	}
+
+	enableTopology, ignoreVolumeAZ := c.configureTopology(cloudInfo, settings)
+
+	targetConfig, err := translateConfigMap(sourceConfig, enableTopology, ignoreVolumeAZ)
+	if err != nil {
+		return err
+	}
+
+	// The status describes the config in place, which is the last known
+	// good config rather than the generated one if that was rolled back
+	applied, err := c.applyConfig(ctx, targetConfig, settings.ConfigRollbackWindow)
+	if applied == nil {
+		return err
+	}
+	status, statusErr := c.newConfigStatus(sourceConfig, applied, cloudInfo)
+	if statusErr == nil {
+		statusErr = c.applyConfigStatus(ctx, status)
+	}
+	return utilerrors.NewAggregate([]error{err, statusErr})
+}
+
+// configureTopology decides whether the topology feature can be enabled and,
+// if so, whether the driver must ignore the volume AZ because compute AZs are
+// mapped to volume AZs with different names
+func (c *ConfigSyncController) configureTopology(cloudInfo *cloudinfo.CloudInfo, settings *Settings) (bool, bool) {
+	var enableTopology, ignoreVolumeAZ bool
+	var reason, decision string
+
+	mapping, err := GetZoneMapping(cloudInfo, settings)
+	if err != nil {
+		reason = "TopologyDisabled"
+		decision = fmt.Sprintf("Topology support cannot be enabled automatically: %v", err)
+	} else {
+		enableTopology = true
+		ignoreVolumeAZ = !mapping.IsIdentity()
+		reason = "TopologyEnabled"
+		decision = "Topology support can be enabled automatically"
+		if ignoreVolumeAZ {
+			var pairs []string
+			for _, computeZone := range cloudInfo.ComputeZones {
+				pairs = append(pairs, computeZone+"="+mapping[computeZone])
+			}
+			decision += fmt.Sprintf(" using compute to volume availability zone mapping %s", strings.Join(pairs, ","))
+		}
+	}
+
+	if decision != c.lastTopologyDecision {
+		klog.Info(decision)
+		c.eventRecorder.Event(reason, decision)
+		c.lastTopologyDecision = decision
+	}
+
+	return enableTopology, ignoreVolumeAZ
+}
+
+// GetSourceConfigMap returns the user-provided config map containing the
+// configuration for the Cinder CSI driver. If no such config map exists yet,
+// nil is returned. If the Cinder CSI-specific config map sets config_merge to
+// layered, it is merged on top of the cloud provider config map.
+func GetSourceConfigMap(configMapLister corelisters.ConfigMapLister, infrastructureLister configv1listers.InfrastructureLister) (*v1.ConfigMap, error) {
+	infra, err := infrastructureLister.Get(infrastructureResourceName)
+	if err != nil {
+		return nil, err
+	}
 
 	// First, we try to retrieve from the Cinder CSI-specific config map
-	sourceConfig, err = c.configMapLister.ConfigMaps(util.OpenShiftConfigNamespace).Get("cinder-csi-config")
+	sourceConfig, err := configMapLister.ConfigMaps(util.OpenShiftConfigNamespace).Get("cinder-csi-config")
 	if err != nil {
 		// Failing that, we attempt to retrieve from the cloud provider-specific config map
 		if errors.IsNotFound(err) {
-			sourceConfig, err = c.configMapLister.ConfigMaps(util.OpenShiftConfigNamespace).Get(infra.Spec.CloudConfig.Name)
+			sourceConfig, err = configMapLister.ConfigMaps(util.OpenShiftConfigNamespace).Get(infra.Spec.CloudConfig.Name)
 			if err != nil {
 				if errors.IsNotFound(err) {
 					// TODO: report error after some while?
 					klog.V(2).Infof("Waiting for config map %s from %s", infra.Spec.CloudConfig.Name, util.OpenShiftConfigNamespace)
-					return nil
+					return nil, nil
 				}
-				return err
+				return nil, err
 			}
 		} else {
-			return err
+			return nil, err
 		}
+		return sourceConfig, nil
 	}
 
-	targetConfig, err := translateConfigMap(sourceConfig, enableTopologyFeature)
-	if err != nil {
-		return err
+	switch mode := sourceConfig.Data[configMergeKey]; mode {
+	case "", replaceConfigMerge:
+		return sourceConfig, nil
+	case layeredConfigMerge:
+	default:
+		return nil, fmt.Errorf("%s must be %s or %s, not %q", configMergeKey, replaceConfigMerge, layeredConfigMerge, mode)
 	}
 
-	_, _, err = resourceapply.ApplyConfigMap(ctx, c.kubeClient.CoreV1(), c.eventRecorder, targetConfig)
+	// The Cinder CSI-specific config map only holds overrides, so the cloud
+	// provider config map is needed too
+	if infra.Spec.CloudConfig.Name == "" {
+		return sourceConfig, nil
+	}
+	cloudProviderConfig, err := configMapLister.ConfigMaps(util.OpenShiftConfigNamespace).Get(infra.Spec.CloudConfig.Name)
 	if err != nil {
-		return err
+		if errors.IsNotFound(err) {
+			klog.V(2).Infof("Waiting for config map %s from %s to merge %s on top of it", infra.Spec.CloudConfig.Name, util.OpenShiftConfigNamespace, sourceConfig.Name)
+			return nil, nil
+		}
+		return nil, err
 	}
-	return nil
+	return mergeConfigMaps(cloudProviderConfig, sourceConfig)
+}
+
+// TopologyEnabled returns true if the generated config map enables the
+// topology feature, whether automatically or by the user
+func TopologyEnabled(generatedConfig *v1.ConfigMap) bool {
+	enabled, _ := strconv.ParseBool(generatedConfig.Data[enableTopologyKey])
+	return enabled
 }
 
-func translateConfigMap(cloudConfig *v1.ConfigMap, enableTopologyFeature bool) (*v1.ConfigMap, error) {
+func translateConfigMap(cloudConfig *v1.ConfigMap, enableTopologyFeature, ignoreVolumeAZ bool) (*v1.ConfigMap, error) {
 	// Process the cloud configuration
 	content, ok := cloudConfig.Data[sourceConfigKey]
 	if !ok {
@@ -132,6 +283,17 @@ func translateConfigMap(cloudConfig *v1.ConfigMap, enableTopologyFeature bool) (
 		return nil, fmt.Errorf("failed to read the cloud.conf: %w", err)
 	}
 
+	// Reject any config the driver would fail to read, so that the last
+	// good config stays in place
+	if err := validateCloudConfig(content, cfg); err != nil {
+		return nil, err
+	}
+
+	sources, err := getConfigSources(cloudConfig)
+	if err != nil {
+		return nil, err
+	}
+
 	// Set the static, must-have keys in the '[Global]' section. If these are
 	// already set by the user then tough luck
 	global, _ := cfg.GetSection("Global")
@@ -166,6 +328,7 @@ func translateConfigMap(cloudConfig *v1.ConfigMap, enableTopologyFeature bool) (
 		if err != nil {
 			return nil, fmt.Errorf("failed to modify the provided configuration: %w", err)
 		}
+		sources[cloudConfigKey(global.Name(), o.k)] = operatorSource
 	}
 
 	// Now, modify the '[BlockStorage]' section as necessary
@@ -183,6 +346,27 @@ func translateConfigMap(cloudConfig *v1.ConfigMap, enableTopologyFeature bool) (
 		}
 	}
 
+	// If compute AZs are mapped to differently named volume AZs, the driver
+	// must not use the volume AZ for topology. Respect the user's choice if
+	// they've already configured this.
+	if ignoreVolumeAZ {
+		blockStorage, err = cfg.GetSection("BlockStorage")
+		if err != nil {
+			blockStorage, err = cfg.NewSection("BlockStorage")
+			if err != nil {
+				return nil, fmt.Errorf("failed to modify the provided configuration: %w", err)
+			}
+		}
+		if !blockStorage.HasKey("ignore-volume-az") {
+			klog.Infof("Compute and volume availability zones differ; setting '[BlockStorage] ignore-volume-az'...")
+			_, err = blockStorage.NewKey("ignore-volume-az", "true")
+			if err != nil {
+				return nil, fmt.Errorf("failed to modify the provided configuration: %w", err)
+			}
+			sources[cloudConfigKey(blockStorage.Name(), "ignore-volume-az")] = operatorSource
+		}
+	}
+
 	// Generate our shiny new config map to save into the operator's namespace
 	var buf bytes.Buffer
 
@@ -199,6 +383,21 @@ func translateConfigMap(cloudConfig *v1.ConfigMap, enableTopologyFeature bool) (
 	} else {
 		// ...but fallback to the automatic configuration if not
 		enableTopologyValue = strconv.FormatBool(enableTopologyFeature)
+		sources[enableTopologyKey] = operatorSource
+	}
+
+	// Only record the sources of the keys which are still in effect
+	effectiveSources := configSources{}
+	for key, source := range sources {
+		if !strings.HasPrefix(key, "[") {
+			effectiveSources[key] = source
+		}
+	}
+	for _, section := range cfg.Sections() {
+		for _, key := range section.Keys() {
+			id := cloudConfigKey(section.Name(), key.Name())
+			effectiveSources[id] = sources[id]
+		}
 	}
 
 	config := v1.ConfigMap{
@@ -211,6 +410,9 @@ func translateConfigMap(cloudConfig *v1.ConfigMap, enableTopologyFeature bool) (
 			enableTopologyKey: enableTopologyValue,
 		},
 	}
+	if err := setConfigSources(&config, effectiveSources); err != nil {
+		return nil, err
+	}
 
 	return &config, nil
 }
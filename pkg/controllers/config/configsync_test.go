@@ -1,13 +1,32 @@
 package config
 
 import (
+	"context"
+	"net/http"
 	"strings"
 	"testing"
 
+	"github.com/gophercloud/utils/v2/openstack/clientconfig"
 	. "github.com/onsi/gomega"
 	"github.com/onsi/gomega/format"
+	configv1 "github.com/openshift/api/config/v1"
+	operatorv1 "github.com/openshift/api/operator/v1"
+	configv1listers "github.com/openshift/client-go/config/listers/config/v1"
+	"github.com/openshift/library-go/pkg/controller/factory"
+	"github.com/openshift/library-go/pkg/operator/events"
+	"github.com/openshift/library-go/pkg/operator/v1helpers"
+	ini "gopkg.in/ini.v1"
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	fakekube "k8s.io/client-go/kubernetes/fake"
+	appslisters "k8s.io/client-go/listers/apps/v1"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+
+	"github.com/openshift/openstack-cinder-csi-driver-operator/pkg/cloudinfo"
+	"github.com/openshift/openstack-cinder-csi-driver-operator/pkg/cloudinfo/fake"
+	"github.com/openshift/openstack-cinder-csi-driver-operator/pkg/util"
 )
 
 func TestTranslateConfigMap(t *testing.T) {
@@ -19,6 +38,7 @@ func TestTranslateConfigMap(t *testing.T) {
 		source                    string
 		target                    string
 		generatedTopologyValue    bool
+		generatedIgnoreVolumeAZ   bool
 		userProvidedTopologyValue string
 		expectedTopologyValue     string
 		errMsg                    string
@@ -63,6 +83,23 @@ use-clouds  = true
 clouds-file = /etc/kubernetes/secret/clouds.yaml
 cloud       = openstack`,
 			expectedTopologyValue: "false",
+		}, {
+			name: "Only the legacy trust-device-path setting is dropped",
+			source: `[BlockStorage]
+trust-device-path = /dev/sdb1
+bs-version = v3`,
+			target: `[BlockStorage]
+bs-version = v3
+
+[Global]
+use-clouds  = true
+clouds-file = /etc/kubernetes/secret/clouds.yaml
+cloud       = openstack`,
+			expectedTopologyValue: "false",
+		}, {
+			name:   "Invalid config",
+			source: `[BlockStorge]`,
+			errMsg: "invalid cloud.conf: line 1: unknown section [BlockStorge]",
 		}, {
 			name: "Multi-AZ deployment",
 			source: `
@@ -113,6 +150,33 @@ cloud       = openstack`,
 			generatedTopologyValue:    true,
 			userProvidedTopologyValue: "false",
 			expectedTopologyValue:     "false",
+		}, {
+			name:   "Compute AZs mapped to differently named volume AZs",
+			source: "",
+			target: `[Global]
+use-clouds  = true
+clouds-file = /etc/kubernetes/secret/clouds.yaml
+cloud       = openstack
+
+[BlockStorage]
+ignore-volume-az = true`,
+			generatedTopologyValue:  true,
+			generatedIgnoreVolumeAZ: true,
+			expectedTopologyValue:   "true",
+		}, {
+			name: "User-provided ignore-volume-az is not overridden",
+			source: `[BlockStorage]
+ignore-volume-az = false`,
+			target: `[BlockStorage]
+ignore-volume-az = false
+
+[Global]
+use-clouds  = true
+clouds-file = /etc/kubernetes/secret/clouds.yaml
+cloud       = openstack`,
+			generatedTopologyValue:  true,
+			generatedIgnoreVolumeAZ: true,
+			expectedTopologyValue:   "true",
 		},
 	}
 
@@ -141,7 +205,7 @@ cloud       = openstack`,
 					"enable_topology": tc.expectedTopologyValue,
 				},
 			}
-			actualConfigMap, err := translateConfigMap(&sourceConfigMap, tc.generatedTopologyValue)
+			actualConfigMap, err := translateConfigMap(&sourceConfigMap, tc.generatedTopologyValue, tc.generatedIgnoreVolumeAZ)
 			if tc.errMsg != "" {
 				g.Expect(err).Should(MatchError(tc.errMsg))
 				return
@@ -164,3 +228,335 @@ cloud       = openstack`,
 		})
 	}
 }
+
+// testCloudConfig is a minimal cloud provider config as generated by the
+// installer
+const testCloudConfig = `[Global]
+secret-name = openstack-credentials
+secret-namespace = kube-system
+`
+
+func TestSync(t *testing.T) {
+	tc := []struct {
+		name            string
+		managementState operatorv1.ManagementState
+		sourceData      map[string]string
+		computeZones    []fake.AvailabilityZone
+		volumeZones     []fake.AvailabilityZone
+		failVolumeZones bool
+		// expectedTopologyValue is empty if no config map should be generated
+		expectedTopologyValue  string
+		expectedIgnoreVolumeAZ bool
+		expectedEvents         []string
+		errMsg                 string
+	}{
+		{
+			name:                  "Matching availability zones",
+			computeZones:          fake.Zones("az1", "az2"),
+			volumeZones:           fake.Zones("az1", "az2"),
+			expectedTopologyValue: "true",
+			expectedEvents:        []string{"TopologyEnabled", "ConfigMapCreated"},
+		}, {
+			name:                  "Missing volume availability zone",
+			computeZones:          fake.Zones("az1", "az2"),
+			volumeZones:           fake.Zones("az1"),
+			expectedTopologyValue: "false",
+			expectedEvents:        []string{"TopologyDisabled", "ConfigMapCreated"},
+		}, {
+			name:                  "Unavailable volume availability zone",
+			computeZones:          fake.Zones("az1", "az2"),
+			volumeZones:           append(fake.Zones("az1"), fake.AvailabilityZone{Name: "az2"}),
+			expectedTopologyValue: "false",
+			expectedEvents:        []string{"TopologyDisabled", "ConfigMapCreated"},
+		}, {
+			name:                   "Inferred availability zone mapping",
+			sourceData:             map[string]string{"availability_zone_mapping": "auto"},
+			computeZones:           fake.Zones("az1", "az2"),
+			volumeZones:            fake.Zones("cinder"),
+			expectedTopologyValue:  "true",
+			expectedIgnoreVolumeAZ: true,
+			expectedEvents:         []string{"TopologyEnabled", "ConfigMapCreated"},
+		}, {
+			name:                  "User-provided topology value",
+			sourceData:            map[string]string{"enable_topology": "true"},
+			computeZones:          fake.Zones("az1", "az2"),
+			volumeZones:           fake.Zones("az1"),
+			expectedTopologyValue: "true",
+			expectedEvents:        []string{"TopologyDisabled", "ConfigMapCreated"},
+		}, {
+			name:            "Volume availability zones cannot be fetched",
+			computeZones:    fake.Zones("az1"),
+			volumeZones:     fake.Zones("az1"),
+			failVolumeZones: true,
+			errMsg:          "couldn't collect info about cloud availability zones",
+		}, {
+			name:            "Operator is not managed",
+			managementState: operatorv1.Unmanaged,
+			computeZones:    fake.Zones("az1"),
+			volumeZones:     fake.Zones("az1"),
+		},
+	}
+
+	for _, tc := range tc {
+		t.Run(tc.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			cloud := fake.New()
+			defer cloud.Close()
+			cloud.ComputeZones = tc.computeZones
+			cloud.VolumeZones = tc.volumeZones
+			if tc.failVolumeZones {
+				cloud.Fail("volume", http.MethodGet, "/os-availability-zone", http.StatusInternalServerError)
+			}
+
+			sourceConfigMap := &corev1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "cloud-provider-config",
+					Namespace: util.OpenShiftConfigNamespace,
+				},
+				Data: map[string]string{
+					sourceConfigKey: testCloudConfig,
+				},
+			}
+			for k, v := range tc.sourceData {
+				sourceConfigMap.Data[k] = v
+			}
+
+			managementState := tc.managementState
+			if managementState == "" {
+				managementState = operatorv1.Managed
+			}
+
+			c, kubeClient, recorder, _ := newTestConfigSyncController(g, managementState, cloud, sourceConfigMap)
+
+			err := c.sync(context.TODO(), factory.NewSyncContext("ConfigSync", recorder))
+			if tc.errMsg != "" {
+				g.Expect(err).To(MatchError(ContainSubstring(tc.errMsg)))
+			} else {
+				g.Expect(err).ToNot(HaveOccurred())
+			}
+
+			var reasons []string
+			for _, event := range recorder.Events() {
+				reasons = append(reasons, event.Reason)
+			}
+			g.Expect(reasons).To(Equal(tc.expectedEvents))
+
+			targetConfigMap, err := kubeClient.CoreV1().ConfigMaps(util.DefaultNamespace).Get(context.TODO(), util.CinderConfigName, metav1.GetOptions{})
+			if tc.expectedTopologyValue == "" {
+				g.Expect(errors.IsNotFound(err)).To(BeTrue())
+				return
+			}
+			g.Expect(err).ToNot(HaveOccurred())
+			g.Expect(targetConfigMap.Data).To(HaveKeyWithValue(enableTopologyKey, tc.expectedTopologyValue))
+
+			cfg, err := ini.Load([]byte(targetConfigMap.Data[targetConfigKey]))
+			g.Expect(err).ToNot(HaveOccurred())
+			g.Expect(cfg.Section("BlockStorage").HasKey("ignore-volume-az")).To(Equal(tc.expectedIgnoreVolumeAZ))
+		})
+	}
+}
+
+func TestSyncWithoutSourceConfig(t *testing.T) {
+	g := NewWithT(t)
+
+	cloud := fake.New()
+	defer cloud.Close()
+
+	c, kubeClient, recorder, _ := newTestConfigSyncController(g, operatorv1.Managed, cloud)
+
+	err := c.sync(context.TODO(), factory.NewSyncContext("ConfigSync", recorder))
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(recorder.Events()).To(BeEmpty())
+
+	// we shouldn't talk to the cloud until we have a config to generate
+	g.Expect(cloud.Requests("identity", http.MethodPost, "/auth/tokens")).To(BeZero())
+
+	_, err = kubeClient.CoreV1().ConfigMaps(util.DefaultNamespace).Get(context.TODO(), util.CinderConfigName, metav1.GetOptions{})
+	g.Expect(errors.IsNotFound(err)).To(BeTrue())
+}
+
+func TestSyncInvalidConfig(t *testing.T) {
+	g := NewWithT(t)
+
+	cloud := fake.New()
+	defer cloud.Close()
+
+	sourceConfigMap := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "cloud-provider-config",
+			Namespace: util.OpenShiftConfigNamespace,
+		},
+		Data: map[string]string{
+			sourceConfigKey: testCloudConfig + "\n[BlockStorage]\nrescan-on-resize = true\n",
+		},
+	}
+	c, kubeClient, recorder, _ := newTestConfigSyncController(g, operatorv1.Managed, cloud, sourceConfigMap)
+	syncCtx := factory.NewSyncContext("ConfigSync", recorder)
+
+	g.Expect(c.sync(context.TODO(), syncCtx)).To(Succeed())
+	goodConfigMap, err := kubeClient.CoreV1().ConfigMaps(util.DefaultNamespace).Get(context.TODO(), util.CinderConfigName, metav1.GetOptions{})
+	g.Expect(err).ToNot(HaveOccurred())
+
+	// the last good config is kept while the source config is invalid
+	updated := sourceConfigMap.DeepCopy()
+	updated.Data[sourceConfigKey] = testCloudConfig + "\n[BlockStorage]\nrescan-on-resize = yes please\n"
+	configMapIndexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+	g.Expect(configMapIndexer.Add(updated)).To(Succeed())
+	c.configMapLister = corelisters.NewConfigMapLister(configMapIndexer)
+	g.Expect(c.sync(context.TODO(), syncCtx)).To(MatchError(`invalid cloud.conf: line 6: '[BlockStorage] rescan-on-resize' must be a boolean, not "yes please"`))
+
+	targetConfigMap, err := kubeClient.CoreV1().ConfigMaps(util.DefaultNamespace).Get(context.TODO(), util.CinderConfigName, metav1.GetOptions{})
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(targetConfigMap.Data).To(Equal(goodConfigMap.Data))
+}
+
+func TestSyncAvailabilityZonesChanged(t *testing.T) {
+	g := NewWithT(t)
+
+	cloud := fake.New()
+	defer cloud.Close()
+	cloud.ComputeZones = fake.Zones("az1", "az2")
+	cloud.VolumeZones = fake.Zones("az1")
+
+	sourceConfigMap := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "cloud-provider-config",
+			Namespace: util.OpenShiftConfigNamespace,
+		},
+		Data: map[string]string{
+			sourceConfigKey: testCloudConfig,
+			cloudInfoTTLKey: "1ns",
+		},
+	}
+	c, kubeClient, recorder, _ := newTestConfigSyncController(g, operatorv1.Managed, cloud, sourceConfigMap)
+	syncCtx := factory.NewSyncContext("ConfigSync", recorder)
+
+	g.Expect(c.sync(context.TODO(), syncCtx)).To(Succeed())
+	targetConfigMap, err := kubeClient.CoreV1().ConfigMaps(util.DefaultNamespace).Get(context.TODO(), util.CinderConfigName, metav1.GetOptions{})
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(targetConfigMap.Data).To(HaveKeyWithValue(enableTopologyKey, "false"))
+
+	// the missing volume AZ appears and the cloud info has expired
+	cloud.VolumeZones = fake.Zones("az1", "az2")
+	g.Expect(c.sync(context.TODO(), syncCtx)).To(Succeed())
+	targetConfigMap, err = kubeClient.CoreV1().ConfigMaps(util.DefaultNamespace).Get(context.TODO(), util.CinderConfigName, metav1.GetOptions{})
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(targetConfigMap.Data).To(HaveKeyWithValue(enableTopologyKey, "true"))
+
+	var reasons []string
+	for _, event := range recorder.Events() {
+		reasons = append(reasons, event.Reason)
+	}
+	g.Expect(reasons).To(Equal([]string{"TopologyDisabled", "ConfigMapCreated", "AvailabilityZonesChanged", "TopologyEnabled", "ConfigMapUpdated"}))
+
+	// the cloud breaks but we continue with the cached info
+	cloud.Fail("compute", http.MethodGet, "/os-availability-zone", http.StatusInternalServerError)
+	g.Expect(c.sync(context.TODO(), syncCtx)).To(Succeed())
+}
+
+func TestSyncCredentialsChanged(t *testing.T) {
+	g := NewWithT(t)
+
+	cloud := fake.New()
+	defer cloud.Close()
+	cloud.ComputeZones = fake.Zones("az1", "az2")
+	cloud.VolumeZones = fake.Zones("az1")
+
+	rotatedCloud := fake.New()
+	defer rotatedCloud.Close()
+	rotatedCloud.ComputeZones = fake.Zones("az1", "az2")
+	rotatedCloud.VolumeZones = fake.Zones("az1", "az2")
+
+	sourceConfigMap := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "cloud-provider-config",
+			Namespace: util.OpenShiftConfigNamespace,
+		},
+		Data: map[string]string{
+			sourceConfigKey: testCloudConfig,
+			cloudInfoTTLKey: "1h",
+		},
+	}
+	c, kubeClient, recorder, secretIndexer := newTestConfigSyncController(g, operatorv1.Managed, cloud, sourceConfigMap)
+	syncCtx := factory.NewSyncContext("ConfigSync", recorder)
+
+	g.Expect(c.sync(context.TODO(), syncCtx)).To(Succeed())
+	targetConfigMap, err := kubeClient.CoreV1().ConfigMaps(util.DefaultNamespace).Get(context.TODO(), util.CinderConfigName, metav1.GetOptions{})
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(targetConfigMap.Data).To(HaveKeyWithValue(enableTopologyKey, "false"))
+
+	// the cloud info has not expired, but the credentials now give access
+	// to a cloud with the missing volume AZ
+	g.Expect(secretIndexer.Update(newCredentialsSecret(rotatedCloud))).To(Succeed())
+	g.Expect(c.sync(context.TODO(), syncCtx)).To(Succeed())
+	targetConfigMap, err = kubeClient.CoreV1().ConfigMaps(util.DefaultNamespace).Get(context.TODO(), util.CinderConfigName, metav1.GetOptions{})
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(targetConfigMap.Data).To(HaveKeyWithValue(enableTopologyKey, "true"))
+	g.Expect(rotatedCloud.Requests("identity", http.MethodPost, "/auth/tokens")).ToNot(BeZero())
+
+	var reasons []string
+	for _, event := range recorder.Events() {
+		reasons = append(reasons, event.Reason)
+	}
+	g.Expect(reasons).To(Equal([]string{"TopologyDisabled", "ConfigMapCreated", "CredentialsChanged", "AvailabilityZonesChanged", "TopologyEnabled", "ConfigMapUpdated"}))
+
+	// the credentials secret is required
+	g.Expect(secretIndexer.Delete(newCredentialsSecret(rotatedCloud))).To(Succeed())
+	g.Expect(c.sync(context.TODO(), syncCtx)).To(MatchError(ContainSubstring("waiting for secret")))
+}
+
+func newCredentialsSecret(cloud *fake.Cloud) *corev1.Secret {
+	return &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: util.CloudCredentialsSecretName, Namespace: util.DefaultNamespace},
+		Data:       map[string][]byte{cloudsYAMLKey: cloud.CloudsYAML()},
+	}
+}
+
+// newTestConfigSyncController returns a ConfigSyncController whose OpenStack
+// client reads the credentials of the given cloud from the credentials secret
+func newTestConfigSyncController(g *WithT, managementState operatorv1.ManagementState, cloud *fake.Cloud, configMaps ...*corev1.ConfigMap) (*ConfigSyncController, *fakekube.Clientset, events.InMemoryRecorder, cache.Indexer) {
+	configMapIndexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+	for _, cm := range configMaps {
+		g.Expect(configMapIndexer.Add(cm)).To(Succeed())
+	}
+
+	secretIndexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+	g.Expect(secretIndexer.Add(newCredentialsSecret(cloud))).To(Succeed())
+	secretLister := corelisters.NewSecretLister(secretIndexer)
+
+	infraIndexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	g.Expect(infraIndexer.Add(&configv1.Infrastructure{
+		ObjectMeta: metav1.ObjectMeta{Name: infrastructureResourceName},
+		Spec: configv1.InfrastructureSpec{
+			CloudConfig: configv1.ConfigMapFileReference{Name: "cloud-provider-config"},
+		},
+	})).To(Succeed())
+
+	kubeClient := fakekube.NewSimpleClientset()
+	recorder := events.NewInMemoryRecorder("test")
+
+	provider := cloudinfo.NewProvider(&clientconfig.ClientOpts{
+		Cloud:    "openstack",
+		YAMLOpts: CloudsYAMLFromSecret(secretLister),
+	}, nil)
+
+	c := &ConfigSyncController{
+		operatorClient: v1helpers.NewFakeOperatorClient(
+			&operatorv1.OperatorSpec{ManagementState: managementState},
+			&operatorv1.OperatorStatus{},
+			nil,
+		),
+		kubeClient:            kubeClient,
+		configMapLister:       corelisters.NewConfigMapLister(configMapIndexer),
+		targetConfigMapLister: corelisters.NewConfigMapLister(cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})),
+		secretLister:          secretLister,
+		podLister:             corelisters.NewPodLister(cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})),
+		deploymentLister:      appslisters.NewDeploymentLister(cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})),
+		infrastructureLister:  configv1listers.NewInfrastructureLister(infraIndexer),
+		cloudInfo:             cloudinfo.NewCache(provider),
+		eventRecorder:         recorder,
+	}
+
+	return c, kubeClient, recorder, secretIndexer
+}
@@ -0,0 +1,86 @@
+package config
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+
+	"github.com/gophercloud/utils/v2/openstack/clientconfig"
+	yaml "gopkg.in/yaml.v3"
+	"k8s.io/apimachinery/pkg/api/errors"
+	corelisters "k8s.io/client-go/listers/core/v1"
+
+	"github.com/openshift/openstack-cinder-csi-driver-operator/pkg/util"
+)
+
+const cloudsYAMLKey = "clouds.yaml"
+
+// secretCloudsYAML loads clouds.yaml from the credentials secret, so that
+// the operator's own OpenStack client always uses the current credentials,
+// even after they are rotated
+type secretCloudsYAML struct {
+	secretLister corelisters.SecretLister
+}
+
+var _ clientconfig.YAMLOptsBuilder = &secretCloudsYAML{}
+
+// CloudsYAMLFromSecret returns a YAMLOptsBuilder which load clouds.yaml from the
+// credentials secret rather than the filesystem
+func CloudsYAMLFromSecret(secretLister corelisters.SecretLister) clientconfig.YAMLOptsBuilder {
+	return &secretCloudsYAML{
+		secretLister: secretLister,
+	}
+}
+
+func (s *secretCloudsYAML) LoadCloudsYAML() (map[string]clientconfig.Cloud, error) {
+	content, err := getCloudsYAML(s.secretLister)
+	if err != nil {
+		return nil, err
+	}
+
+	var clouds clientconfig.Clouds
+	if err := yaml.Unmarshal(content, &clouds); err != nil {
+		return nil, fmt.Errorf("failed to parse %s in secret %s/%s: %w", cloudsYAMLKey, util.DefaultNamespace, util.CloudCredentialsSecretName, err)
+	}
+
+	return clouds.Clouds, nil
+}
+
+// LoadSecureCloudsYAML returns nothing as the secret only contains clouds.yaml
+func (s *secretCloudsYAML) LoadSecureCloudsYAML() (map[string]clientconfig.Cloud, error) {
+	return nil, nil
+}
+
+// LoadPublicCloudsYAML returns nothing as the secret only contains clouds.yaml
+func (s *secretCloudsYAML) LoadPublicCloudsYAML() (map[string]clientconfig.Cloud, error) {
+	return nil, nil
+}
+
+// GetCredentialsHash returns a hash of clouds.yaml in the credentials secret,
+// which changes whenever the credentials are rotated
+func GetCredentialsHash(secretLister corelisters.SecretLister) (string, error) {
+	content, err := getCloudsYAML(secretLister)
+	if err != nil {
+		return "", err
+	}
+
+	hash := sha256.Sum256(content)
+	return hex.EncodeToString(hash[:]), nil
+}
+
+func getCloudsYAML(secretLister corelisters.SecretLister) ([]byte, error) {
+	secret, err := secretLister.Secrets(util.DefaultNamespace).Get(util.CloudCredentialsSecretName)
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return nil, fmt.Errorf("waiting for secret %s/%s", util.DefaultNamespace, util.CloudCredentialsSecretName)
+		}
+		return nil, err
+	}
+
+	content, ok := secret.Data[cloudsYAMLKey]
+	if !ok {
+		return nil, fmt.Errorf("secret %s/%s does not contain %s", util.DefaultNamespace, util.CloudCredentialsSecretName, cloudsYAMLKey)
+	}
+
+	return content, nil
+}
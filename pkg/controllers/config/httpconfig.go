@@ -0,0 +1,49 @@
+package config
+
+import (
+	configv1listers "github.com/openshift/client-go/config/listers/config/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	corelisters "k8s.io/client-go/listers/core/v1"
+
+	"github.com/openshift/openstack-cinder-csi-driver-operator/pkg/cloudinfo"
+)
+
+const (
+	caBundleKey = "ca-bundle.pem"
+
+	proxyResourceName = "cluster"
+)
+
+// HTTPConfig returns a function providing the configuration of the operator's
+// own OpenStack client: the cluster-wide proxy, as observed in the status of
+// the Proxy resource, and the CA bundle from the source config map. These are
+// the same settings the driver is deployed with.
+func HTTPConfig(
+	configMapLister corelisters.ConfigMapLister,
+	infrastructureLister configv1listers.InfrastructureLister,
+	proxyLister configv1listers.ProxyLister,
+) cloudinfo.HTTPConfigFunc {
+	return func() (*cloudinfo.HTTPConfig, error) {
+		httpConfig := &cloudinfo.HTTPConfig{}
+
+		proxy, err := proxyLister.Get(proxyResourceName)
+		if err != nil && !errors.IsNotFound(err) {
+			return nil, err
+		}
+		if proxy != nil {
+			httpConfig.HTTPProxy = proxy.Status.HTTPProxy
+			httpConfig.HTTPSProxy = proxy.Status.HTTPSProxy
+			httpConfig.NoProxy = proxy.Status.NoProxy
+		}
+
+		sourceConfig, err := GetSourceConfigMap(configMapLister, infrastructureLister)
+		if err != nil {
+			return nil, err
+		}
+		if sourceConfig != nil {
+			httpConfig.CABundle = []byte(sourceConfig.Data[caBundleKey])
+		}
+
+		return httpConfig, nil
+	}
+}
@@ -0,0 +1,177 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	ini "gopkg.in/ini.v1"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// configMergeKey selects how the Cinder CSI-specific config map is
+	// combined with the cloud provider config map
+	configMergeKey = "config_merge"
+	// replaceConfigMerge uses the Cinder CSI-specific config map instead of
+	// the cloud provider config map. This is the default.
+	replaceConfigMerge = "replace"
+	// layeredConfigMerge applies the Cinder CSI-specific config map on top of
+	// the cloud provider config map, key by key
+	layeredConfigMerge = "layered"
+
+	// configSourcesAnnotation records the config map each effective key came
+	// from, as a JSON object keyed by config map key or, for the cloud.conf,
+	// by '[Section] key'
+	configSourcesAnnotation = "cinder.csi.openstack.org/config-sources"
+
+	// operatorSource is the source of keys set by the operator itself
+	operatorSource = "operator"
+)
+
+// configSources maps each effective key to the config map it came from
+type configSources map[string]string
+
+// cloudConfigKey returns the key of a cloud.conf key in configSources
+func cloudConfigKey(section, key string) string {
+	return fmt.Sprintf("[%s] %s", section, key)
+}
+
+// getConfigSources returns the sources recorded on a config map. Config maps
+// without any, which haven't been merged, are the source of all their keys.
+func getConfigSources(cloudConfig *v1.ConfigMap) (configSources, error) {
+	sources := configSources{}
+	if value, ok := cloudConfig.Annotations[configSourcesAnnotation]; ok {
+		if err := json.Unmarshal([]byte(value), &sources); err != nil {
+			return nil, fmt.Errorf("failed to parse the %s annotation: %w", configSourcesAnnotation, err)
+		}
+		return sources, nil
+	}
+
+	for key := range cloudConfig.Data {
+		if key != sourceConfigKey {
+			sources[key] = cloudConfig.Name
+		}
+	}
+	if content, ok := cloudConfig.Data[sourceConfigKey]; ok {
+		cfg, err := ini.Load([]byte(content))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the cloud.conf: %w", err)
+		}
+		for _, section := range cfg.Sections() {
+			for _, key := range section.Keys() {
+				sources[cloudConfigKey(section.Name(), key.Name())] = cloudConfig.Name
+			}
+		}
+	}
+	return sources, nil
+}
+
+// setConfigSources records the sources on a config map
+func setConfigSources(configMap *v1.ConfigMap, sources configSources) error {
+	value, err := json.Marshal(sources)
+	if err != nil {
+		return err
+	}
+	if configMap.Annotations == nil {
+		configMap.Annotations = map[string]string{}
+	}
+	configMap.Annotations[configSourcesAnnotation] = string(value)
+	return nil
+}
+
+// mergeConfigMaps merges config maps, each of which overrides the keys of the
+// previous ones. The cloud.conf is merged section by section and key by key,
+// ignoring case as the driver does. The merged config map takes the name of
+// the last one and records the source of every key.
+func mergeConfigMaps(layers ...*v1.ConfigMap) (*v1.ConfigMap, error) {
+	last := layers[len(layers)-1]
+	merged := &v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            last.Name,
+			Namespace:       last.Namespace,
+			ResourceVersion: last.ResourceVersion,
+		},
+		Data: map[string]string{},
+	}
+	sources := configSources{}
+
+	var mergedConfig *ini.File
+	for _, layer := range layers {
+		for key, value := range layer.Data {
+			if key == sourceConfigKey {
+				continue
+			}
+			merged.Data[key] = value
+			sources[key] = layer.Name
+		}
+
+		content, ok := layer.Data[sourceConfigKey]
+		if !ok {
+			continue
+		}
+		cfg, err := ini.Load([]byte(content))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the cloud.conf of config map %s: %w", layer.Name, err)
+		}
+		if mergedConfig == nil {
+			mergedConfig = ini.Empty()
+		}
+		for _, section := range cfg.Sections() {
+			if section.Name() == ini.DefaultSection && len(section.Keys()) == 0 {
+				continue
+			}
+			target := findSection(mergedConfig, section.Name())
+			if target == nil {
+				target, err = mergedConfig.NewSection(section.Name())
+				if err != nil {
+					return nil, fmt.Errorf("failed to merge the cloud.conf of config map %s: %w", layer.Name, err)
+				}
+			}
+			for _, key := range section.Keys() {
+				if existing := findKey(target, key.Name()); existing != nil {
+					existing.SetValue(key.Value())
+					sources[cloudConfigKey(target.Name(), existing.Name())] = layer.Name
+					continue
+				}
+				if _, err := target.NewKey(key.Name(), key.Value()); err != nil {
+					return nil, fmt.Errorf("failed to merge the cloud.conf of config map %s: %w", layer.Name, err)
+				}
+				sources[cloudConfigKey(target.Name(), key.Name())] = layer.Name
+			}
+		}
+	}
+
+	if mergedConfig != nil {
+		var buf bytes.Buffer
+		if _, err := mergedConfig.WriteTo(&buf); err != nil {
+			return nil, fmt.Errorf("failed to write the merged cloud.conf: %w", err)
+		}
+		merged.Data[sourceConfigKey] = buf.String()
+	}
+
+	if err := setConfigSources(merged, sources); err != nil {
+		return nil, err
+	}
+	return merged, nil
+}
+
+func findSection(cfg *ini.File, name string) *ini.Section {
+	for _, section := range cfg.Sections() {
+		if strings.EqualFold(section.Name(), name) {
+			return section
+		}
+	}
+	return nil
+}
+
+func findKey(section *ini.Section, name string) *ini.Key {
+	for _, key := range section.Keys() {
+		if strings.EqualFold(key.Name(), name) {
+			return key
+		}
+	}
+	return nil
+}
@@ -0,0 +1,202 @@
+package config
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	. "github.com/onsi/gomega"
+	configv1 "github.com/openshift/api/config/v1"
+	operatorv1 "github.com/openshift/api/operator/v1"
+	configv1listers "github.com/openshift/client-go/config/listers/config/v1"
+	"github.com/openshift/library-go/pkg/controller/factory"
+	ini "gopkg.in/ini.v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+
+	"github.com/openshift/openstack-cinder-csi-driver-operator/pkg/cloudinfo/fake"
+	"github.com/openshift/openstack-cinder-csi-driver-operator/pkg/util"
+)
+
+func newTestConfigMap(name string, data map[string]string) *corev1.ConfigMap {
+	return &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: util.OpenShiftConfigNamespace, ResourceVersion: "1"},
+		Data:       data,
+	}
+}
+
+func TestMergeConfigMaps(t *testing.T) {
+	g := NewWithT(t)
+
+	base := newTestConfigMap("cloud-provider-config", map[string]string{
+		sourceConfigKey: testCloudConfig + `region = regionOne
+
+[BlockStorage]
+rescan-on-resize = false
+node-volume-attach-limit = 128
+`,
+		"ca-bundle.pem":   "bundle",
+		enableTopologyKey: "true",
+	})
+	override := newTestConfigMap("cinder-csi-config", map[string]string{
+		sourceConfigKey: `[blockstorage]
+Rescan-On-Resize = true
+
+[Metadata]
+search-order = configDrive
+`,
+		configMergeKey:    layeredConfigMerge,
+		enableTopologyKey: "false",
+	})
+
+	merged, err := mergeConfigMaps(base, override)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(merged.Name).To(Equal("cinder-csi-config"))
+	g.Expect(merged.ResourceVersion).To(Equal("1"))
+	g.Expect(merged.Data).To(HaveKeyWithValue("ca-bundle.pem", "bundle"))
+	g.Expect(merged.Data).To(HaveKeyWithValue(enableTopologyKey, "false"))
+
+	cfg, err := ini.Load([]byte(merged.Data[sourceConfigKey]))
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(cfg.SectionStrings()).To(Equal([]string{ini.DefaultSection, "Global", "BlockStorage", "Metadata"}))
+	g.Expect(cfg.Section("Global").Key("region").String()).To(Equal("regionOne"))
+	g.Expect(cfg.Section("BlockStorage").KeysHash()).To(Equal(map[string]string{
+		"rescan-on-resize":         "true",
+		"node-volume-attach-limit": "128",
+	}))
+	g.Expect(cfg.Section("Metadata").Key("search-order").String()).To(Equal("configDrive"))
+
+	sources, err := getConfigSources(merged)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(sources).To(Equal(configSources{
+		"[Global] secret-name":                    "cloud-provider-config",
+		"[Global] secret-namespace":               "cloud-provider-config",
+		"[Global] region":                         "cloud-provider-config",
+		"[BlockStorage] rescan-on-resize":         "cinder-csi-config",
+		"[BlockStorage] node-volume-attach-limit": "cloud-provider-config",
+		"[Metadata] search-order":                 "cinder-csi-config",
+		"ca-bundle.pem":                           "cloud-provider-config",
+		enableTopologyKey:                         "cinder-csi-config",
+		configMergeKey:                            "cinder-csi-config",
+	}))
+}
+
+func TestGetSourceConfigMap(t *testing.T) {
+	cloudProviderConfig := newTestConfigMap("cloud-provider-config", map[string]string{
+		sourceConfigKey: testCloudConfig,
+	})
+
+	tc := []struct {
+		name            string
+		configMaps      []*corev1.ConfigMap
+		expectedName    string
+		expectedSources bool
+		errMsg          string
+	}{
+		{
+			name:         "Cloud provider config only",
+			configMaps:   []*corev1.ConfigMap{cloudProviderConfig},
+			expectedName: "cloud-provider-config",
+		}, {
+			name: "Cinder CSI config replaces the cloud provider config",
+			configMaps: []*corev1.ConfigMap{cloudProviderConfig, newTestConfigMap("cinder-csi-config", map[string]string{
+				sourceConfigKey: testCloudConfig,
+			})},
+			expectedName: "cinder-csi-config",
+		}, {
+			name: "Cinder CSI config is layered on the cloud provider config",
+			configMaps: []*corev1.ConfigMap{cloudProviderConfig, newTestConfigMap("cinder-csi-config", map[string]string{
+				configMergeKey: layeredConfigMerge,
+			})},
+			expectedName:    "cinder-csi-config",
+			expectedSources: true,
+		}, {
+			name: "Layered config without the cloud provider config",
+			configMaps: []*corev1.ConfigMap{newTestConfigMap("cinder-csi-config", map[string]string{
+				configMergeKey: layeredConfigMerge,
+			})},
+		}, {
+			name: "Unknown merge mode",
+			configMaps: []*corev1.ConfigMap{cloudProviderConfig, newTestConfigMap("cinder-csi-config", map[string]string{
+				configMergeKey: "merge",
+			})},
+			errMsg: `config_merge must be replace or layered, not "merge"`,
+		},
+	}
+
+	for _, tc := range tc {
+		t.Run(tc.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			configMapIndexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+			for _, cm := range tc.configMaps {
+				g.Expect(configMapIndexer.Add(cm)).To(Succeed())
+			}
+			infraIndexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+			g.Expect(infraIndexer.Add(&configv1.Infrastructure{
+				ObjectMeta: metav1.ObjectMeta{Name: infrastructureResourceName},
+				Spec: configv1.InfrastructureSpec{
+					CloudConfig: configv1.ConfigMapFileReference{Name: "cloud-provider-config"},
+				},
+			})).To(Succeed())
+
+			sourceConfig, err := GetSourceConfigMap(corelisters.NewConfigMapLister(configMapIndexer), configv1listers.NewInfrastructureLister(infraIndexer))
+			if tc.errMsg != "" {
+				g.Expect(err).To(MatchError(tc.errMsg))
+				return
+			}
+			g.Expect(err).ToNot(HaveOccurred())
+			if tc.expectedName == "" {
+				g.Expect(sourceConfig).To(BeNil())
+				return
+			}
+			g.Expect(sourceConfig.Name).To(Equal(tc.expectedName))
+			if tc.expectedSources {
+				g.Expect(sourceConfig.Annotations).To(HaveKey(configSourcesAnnotation))
+				g.Expect(sourceConfig.Data).To(HaveKeyWithValue(sourceConfigKey, ContainSubstring("secret-name")))
+			} else {
+				g.Expect(sourceConfig.Annotations).ToNot(HaveKey(configSourcesAnnotation))
+			}
+		})
+	}
+}
+
+func TestSyncLayeredConfig(t *testing.T) {
+	g := NewWithT(t)
+
+	cloud := fake.New()
+	defer cloud.Close()
+
+	cloudProviderConfig := newTestConfigMap("cloud-provider-config", map[string]string{
+		sourceConfigKey: testCloudConfig + "region = regionOne\n",
+	})
+	cinderConfig := newTestConfigMap("cinder-csi-config", map[string]string{
+		sourceConfigKey: "[BlockStorage]\nrescan-on-resize = true\n",
+		configMergeKey:  layeredConfigMerge,
+	})
+	c, kubeClient, recorder, _ := newTestConfigSyncController(g, operatorv1.Managed, cloud, cloudProviderConfig, cinderConfig)
+	g.Expect(c.sync(context.TODO(), factory.NewSyncContext("ConfigSync", recorder))).To(Succeed())
+
+	targetConfigMap, err := kubeClient.CoreV1().ConfigMaps(util.DefaultNamespace).Get(context.TODO(), util.CinderConfigName, metav1.GetOptions{})
+	g.Expect(err).ToNot(HaveOccurred())
+
+	cfg, err := ini.Load([]byte(targetConfigMap.Data[targetConfigKey]))
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(cfg.Section("Global").Key("region").String()).To(Equal("regionOne"))
+	g.Expect(cfg.Section("BlockStorage").Key("rescan-on-resize").String()).To(Equal("true"))
+
+	// keys dropped by the operator are not listed
+	var sources configSources
+	g.Expect(json.Unmarshal([]byte(targetConfigMap.Annotations[configSourcesAnnotation]), &sources)).To(Succeed())
+	g.Expect(sources).To(Equal(configSources{
+		"[Global] region":                 "cloud-provider-config",
+		"[Global] use-clouds":             operatorSource,
+		"[Global] clouds-file":            operatorSource,
+		"[Global] cloud":                  operatorSource,
+		"[BlockStorage] rescan-on-resize": "cinder-csi-config",
+		enableTopologyKey:                 operatorSource,
+		configMergeKey:                    "cinder-csi-config",
+	}))
+}
@@ -0,0 +1,222 @@
+package config
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"time"
+
+	"github.com/openshift/library-go/pkg/operator/resource/resourceapply"
+	"github.com/openshift/library-go/pkg/operator/resource/resourcehash"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/klog/v2"
+
+	"github.com/openshift/openstack-cinder-csi-driver-operator/pkg/util"
+)
+
+const (
+	// lastKnownGoodConfigName is a copy of the last generated config which
+	// the driver controller became ready with
+	lastKnownGoodConfigName = util.CinderConfigName + "-last-known-good"
+
+	// rejectedConfigAnnotation is set on the last known good config to the
+	// hash of a generated config which was rolled back, so that it isn't
+	// applied again until the source config changes
+	rejectedConfigAnnotation = "cinder.csi.openstack.org/rejected-config-hash"
+
+	controllerDeploymentName = "openstack-cinder-csi-driver-controller"
+	controllerPodLabel       = "app"
+
+	// crashLoopRestarts is the number of restarts of a container of a
+	// driver controller pod after which the config is considered broken
+	crashLoopRestarts = 3
+)
+
+// ConfigHashAnnotation is the annotation holding the hash of the generated
+// config on the driver controller and node plugin pods. It is set by
+// WithConfigMapHashAnnotationHook, which truncates long keys this way.
+var ConfigHashAnnotation = func() string {
+	key := fmt.Sprintf("%s.%s.configmap", util.DefaultNamespace, util.CinderConfigName)
+	annotation := "operator.openshift.io/dep-" + key
+	if len(annotation) > 63 {
+		annotation = fmt.Sprintf("operator.openshift.io/dep-%x", sha256.Sum256([]byte(key)))[:63]
+	}
+	return annotation
+}()
+
+// configRollout is a generated config which has been applied but which the
+// driver controller hasn't become ready with yet
+type configRollout struct {
+	hash    string
+	started time.Time
+}
+
+// applyConfig applies the generated config, unless it has already been
+// rolled back, and watches the driver controller roll out with it. Once all
+// of its pods are ready, the config is kept as the last known good config.
+// If any of them crash-loop, or they aren't ready within the rollback
+// window, the last known good config is restored. It returns the config
+// which is in place, if any, even if it also returns an error.
+func (c *ConfigSyncController) applyConfig(ctx context.Context, targetConfig *v1.ConfigMap, window time.Duration) (*v1.ConfigMap, error) {
+	hash, err := resourcehash.GetConfigMapHash(targetConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	// This is read from the API rather than a lister, as a stale copy
+	// without the rejected annotation would re-apply a broken config
+	lastKnownGood, err := c.kubeClient.CoreV1().ConfigMaps(util.DefaultNamespace).Get(ctx, lastKnownGoodConfigName, metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		lastKnownGood = nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if lastKnownGood != nil && lastKnownGood.Annotations[rejectedConfigAnnotation] == hash {
+		return restoredConfig(lastKnownGood), fmt.Errorf("the generated config was rolled back as the driver controller failed with it; waiting for the source config to be fixed")
+	}
+
+	applied, _, err := resourceapply.ApplyConfigMap(ctx, c.kubeClient.CoreV1(), c.eventRecorder, targetConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	if lastKnownGood != nil {
+		lastKnownGoodHash, err := resourcehash.GetConfigMapHash(lastKnownGood)
+		if err != nil {
+			return applied, err
+		}
+		if lastKnownGoodHash == hash {
+			c.rollout = nil
+			return applied, nil
+		}
+	}
+	if c.rollout == nil || c.rollout.hash != hash {
+		c.rollout = &configRollout{hash: hash, started: time.Now()}
+	}
+
+	ready, started, failure, err := c.controllerRolloutState(hash)
+	if err != nil {
+		return applied, err
+	}
+	if ready {
+		klog.Infof("The driver controller is ready with config %s; keeping it as the last known good config", hash)
+		goodConfig := &v1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      lastKnownGoodConfigName,
+				Namespace: util.DefaultNamespace,
+				Annotations: map[string]string{
+					rejectedConfigAnnotation + "-": "",
+					configSourcesAnnotation:        targetConfig.Annotations[configSourcesAnnotation],
+				},
+			},
+			Data: targetConfig.Data,
+		}
+		if _, _, err := resourceapply.ApplyConfigMap(ctx, c.kubeClient.CoreV1(), c.eventRecorder, goodConfig); err != nil {
+			return applied, err
+		}
+		c.rollout = nil
+		return applied, nil
+	}
+
+	// The window only runs out once the pods have been started with the new
+	// config, as the Deployment may be waiting for credentials
+	if failure == "" {
+		if !started || time.Since(c.rollout.started) < window {
+			return applied, nil
+		}
+		failure = fmt.Sprintf("its pods did not become ready within %s", window)
+	}
+
+	if lastKnownGood == nil {
+		return applied, fmt.Errorf("the driver controller failed with the generated config and there is no last known good config to restore: %s", failure)
+	}
+
+	klog.Warningf("Restoring the last known good config as the driver controller failed with config %s: %s", hash, failure)
+	restored, _, err := resourceapply.ApplyConfigMap(ctx, c.kubeClient.CoreV1(), c.eventRecorder, restoredConfig(lastKnownGood))
+	if err != nil {
+		return applied, err
+	}
+
+	rejected := lastKnownGood.DeepCopy()
+	if rejected.Annotations == nil {
+		rejected.Annotations = map[string]string{}
+	}
+	rejected.Annotations[rejectedConfigAnnotation] = hash
+	if _, err := c.kubeClient.CoreV1().ConfigMaps(util.DefaultNamespace).Update(ctx, rejected, metav1.UpdateOptions{}); err != nil {
+		return restored, err
+	}
+
+	c.eventRecorder.Warningf("ConfigRolledBack", "Restored the last known good config as the driver controller failed with the new config: %s", failure)
+	c.rollout = nil
+	return restored, fmt.Errorf("the generated config was rolled back as the driver controller failed with it: %s", failure)
+}
+
+// restoredConfig returns the generated config restored from the last known
+// good config
+func restoredConfig(lastKnownGood *v1.ConfigMap) *v1.ConfigMap {
+	restored := &v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: util.CinderConfigName, Namespace: util.DefaultNamespace},
+		Data:       lastKnownGood.Data,
+	}
+	if sources, ok := lastKnownGood.Annotations[configSourcesAnnotation]; ok {
+		restored.Annotations = map[string]string{configSourcesAnnotation: sources}
+	}
+	return restored
+}
+
+func isControllerPod(obj interface{}) bool {
+	pod, ok := obj.(*v1.Pod)
+	return ok && pod.Labels[controllerPodLabel] == controllerDeploymentName
+}
+
+// controllerRolloutState returns whether the driver controller is ready with
+// the config of the given hash, whether any of its pods have been started
+// with it and, if they are failing, why
+func (c *ConfigSyncController) controllerRolloutState(hash string) (bool, bool, string, error) {
+	deployment, err := c.deploymentLister.Deployments(util.DefaultNamespace).Get(controllerDeploymentName)
+	if errors.IsNotFound(err) {
+		return false, false, "", nil
+	}
+	if err != nil {
+		return false, false, "", err
+	}
+	if deployment.Spec.Template.Annotations[ConfigHashAnnotation] != hash {
+		// the Deployment hasn't been updated with the new config yet
+		return false, false, "", nil
+	}
+
+	pods, err := c.podLister.Pods(util.DefaultNamespace).List(labels.SelectorFromSet(labels.Set{controllerPodLabel: controllerDeploymentName}))
+	if err != nil {
+		return false, false, "", err
+	}
+
+	var started bool
+	var ready int32
+	for _, pod := range pods {
+		if pod.Annotations[ConfigHashAnnotation] != hash || pod.DeletionTimestamp != nil {
+			continue
+		}
+		started = true
+
+		for _, status := range pod.Status.ContainerStatuses {
+			if status.RestartCount >= crashLoopRestarts {
+				return false, true, fmt.Sprintf("container %s of pod %s has restarted %d times", status.Name, pod.Name, status.RestartCount), nil
+			}
+		}
+		for _, condition := range pod.Status.Conditions {
+			if condition.Type == v1.PodReady && condition.Status == v1.ConditionTrue {
+				ready++
+			}
+		}
+	}
+
+	replicas := int32(1)
+	if deployment.Spec.Replicas != nil {
+		replicas = *deployment.Spec.Replicas
+	}
+	return replicas > 0 && ready >= replicas, started, "", nil
+}
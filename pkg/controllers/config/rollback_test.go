@@ -0,0 +1,230 @@
+package config
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	. "github.com/onsi/gomega"
+	operatorv1 "github.com/openshift/api/operator/v1"
+	"github.com/openshift/library-go/pkg/controller/factory"
+	"github.com/openshift/library-go/pkg/operator/events"
+	"github.com/openshift/library-go/pkg/operator/resource/resourcehash"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	fakekube "k8s.io/client-go/kubernetes/fake"
+	appslisters "k8s.io/client-go/listers/apps/v1"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/utils/ptr"
+	"sigs.k8s.io/yaml"
+
+	"github.com/openshift/openstack-cinder-csi-driver-operator/pkg/cloudinfo/fake"
+	"github.com/openshift/openstack-cinder-csi-driver-operator/pkg/util"
+)
+
+func TestConfigHashAnnotation(t *testing.T) {
+	g := NewWithT(t)
+
+	// the key is too long, so it is hashed as by WithConfigMapHashAnnotationHook
+	g.Expect(ConfigHashAnnotation).To(HavePrefix("operator.openshift.io/dep-"))
+	g.Expect(ConfigHashAnnotation).To(HaveLen(63))
+}
+
+// rollbackTest drives a ConfigSyncController through config rollouts, with a
+// driver controller Deployment of a single pod
+type rollbackTest struct {
+	g                *WithT
+	c                *ConfigSyncController
+	kubeClient       *fakekube.Clientset
+	recorder         events.InMemoryRecorder
+	configMaps       cache.Indexer
+	targetConfigMaps cache.Indexer
+	pods             cache.Indexer
+	deployments      cache.Indexer
+	sourceConfigMap  *corev1.ConfigMap
+}
+
+func newRollbackTest(g *WithT, cloud *fake.Cloud) *rollbackTest {
+	sourceConfigMap := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "cloud-provider-config", Namespace: util.OpenShiftConfigNamespace},
+		Data:       map[string]string{sourceConfigKey: testCloudConfig},
+	}
+	c, kubeClient, recorder, _ := newTestConfigSyncController(g, operatorv1.Managed, cloud)
+
+	t := &rollbackTest{
+		g:                g,
+		c:                c,
+		kubeClient:       kubeClient,
+		recorder:         recorder,
+		configMaps:       cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc}),
+		targetConfigMaps: cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc}),
+		pods:             cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc}),
+		deployments:      cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc}),
+		sourceConfigMap:  sourceConfigMap,
+	}
+	g.Expect(t.configMaps.Add(sourceConfigMap)).To(Succeed())
+	c.configMapLister = corelisters.NewConfigMapLister(t.configMaps)
+	c.targetConfigMapLister = corelisters.NewConfigMapLister(t.targetConfigMaps)
+	c.podLister = corelisters.NewPodLister(t.pods)
+	c.deploymentLister = appslisters.NewDeploymentLister(t.deployments)
+	return t
+}
+
+func (t *rollbackTest) sync() error {
+	err := t.c.sync(context.TODO(), factory.NewSyncContext("ConfigSync", t.recorder))
+
+	// the informer sees the status config map
+	if status, getErr := t.kubeClient.CoreV1().ConfigMaps(util.DefaultNamespace).Get(context.TODO(), ConfigStatusName, metav1.GetOptions{}); getErr == nil {
+		t.g.Expect(t.targetConfigMaps.Update(status)).To(Succeed())
+	}
+	return err
+}
+
+// statusHash returns the config hash recorded in the status config map
+func (t *rollbackTest) statusHash() string {
+	var status configStatus
+	t.g.Expect(yaml.Unmarshal([]byte(t.configMap(ConfigStatusName).Data[configStatusKey]), &status)).To(Succeed())
+	return status.ConfigHash
+}
+
+// setSource changes the [BlockStorage] section of the source config
+func (t *rollbackTest) setSource(blockStorage string) {
+	updated := t.sourceConfigMap.DeepCopy()
+	updated.Data[sourceConfigKey] = testCloudConfig + "\n[BlockStorage]\n" + blockStorage + "\n"
+	t.g.Expect(t.configMaps.Update(updated)).To(Succeed())
+}
+
+func (t *rollbackTest) configMap(name string) *corev1.ConfigMap {
+	cm, err := t.kubeClient.CoreV1().ConfigMaps(util.DefaultNamespace).Get(context.TODO(), name, metav1.GetOptions{})
+	t.g.Expect(err).ToNot(HaveOccurred())
+	return cm
+}
+
+func (t *rollbackTest) targetHash() string {
+	hash, err := resourcehash.GetConfigMapHash(t.configMap(util.CinderConfigName))
+	t.g.Expect(err).ToNot(HaveOccurred())
+	return hash
+}
+
+// rollOut updates the driver controller to the current generated config,
+// replacing its pod with one in the given state
+func (t *rollbackTest) rollOut(ready bool, restarts int32) {
+	hash := t.targetHash()
+	annotations := map[string]string{ConfigHashAnnotation: hash}
+
+	t.g.Expect(t.deployments.Update(&appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Name: controllerDeploymentName, Namespace: util.DefaultNamespace},
+		Spec: appsv1.DeploymentSpec{
+			Replicas: ptr.To[int32](1),
+			Template: corev1.PodTemplateSpec{ObjectMeta: metav1.ObjectMeta{Annotations: annotations}},
+		},
+	})).To(Succeed())
+
+	status := corev1.ConditionFalse
+	if ready {
+		status = corev1.ConditionTrue
+	}
+	t.g.Expect(t.pods.Replace([]interface{}{&corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        fmt.Sprintf("%s-%s", controllerDeploymentName, hash),
+			Namespace:   util.DefaultNamespace,
+			Labels:      map[string]string{controllerPodLabel: controllerDeploymentName},
+			Annotations: annotations,
+		},
+		Status: corev1.PodStatus{
+			Conditions:        []corev1.PodCondition{{Type: corev1.PodReady, Status: status}},
+			ContainerStatuses: []corev1.ContainerStatus{{Name: "csi-driver", RestartCount: restarts}},
+		},
+	}}, "")).To(Succeed())
+}
+
+func (t *rollbackTest) events() []string {
+	var reasons []string
+	for _, event := range t.recorder.Events() {
+		reasons = append(reasons, event.Reason)
+	}
+	return reasons
+}
+
+func TestSyncRollsBackCrashLoopingConfig(t *testing.T) {
+	g := NewWithT(t)
+
+	cloud := fake.New()
+	defer cloud.Close()
+	test := newRollbackTest(g, cloud)
+
+	// the first config isn't kept until the driver controller is ready
+	// with it
+	g.Expect(test.sync()).To(Succeed())
+	_, err := test.kubeClient.CoreV1().ConfigMaps(util.DefaultNamespace).Get(context.TODO(), lastKnownGoodConfigName, metav1.GetOptions{})
+	g.Expect(err).To(HaveOccurred())
+
+	test.rollOut(true, 0)
+	g.Expect(test.sync()).To(Succeed())
+	goodData := test.configMap(util.CinderConfigName).Data
+	g.Expect(test.configMap(lastKnownGoodConfigName).Data).To(Equal(goodData))
+	goodHash := test.targetHash()
+	g.Expect(test.statusHash()).To(Equal(goodHash))
+
+	// a new config is applied, but the Deployment hasn't been updated yet
+	test.setSource("rescan-on-resize = true")
+	g.Expect(test.sync()).To(Succeed())
+	g.Expect(test.configMap(util.CinderConfigName).Data).ToNot(Equal(goodData))
+	badHash := test.targetHash()
+	g.Expect(test.statusHash()).To(Equal(badHash))
+
+	// the driver controller crash-loops with it
+	test.rollOut(false, crashLoopRestarts)
+	g.Expect(test.sync()).To(MatchError(ContainSubstring("rolled back as the driver controller failed with it: container csi-driver of pod")))
+	g.Expect(test.configMap(util.CinderConfigName).Data).To(Equal(goodData))
+	g.Expect(test.configMap(lastKnownGoodConfigName).Annotations).To(HaveKeyWithValue(rejectedConfigAnnotation, badHash))
+	// the status describes the restored config rather than the generated one
+	g.Expect(test.statusHash()).To(Equal(goodHash))
+
+	// it isn't applied again
+	g.Expect(test.sync()).To(MatchError(ContainSubstring("waiting for the source config to be fixed")))
+	g.Expect(test.configMap(util.CinderConfigName).Data).To(Equal(goodData))
+	g.Expect(test.statusHash()).To(Equal(goodHash))
+
+	// until the source config changes
+	test.setSource("rescan-on-resize = false")
+	g.Expect(test.sync()).To(Succeed())
+	test.rollOut(true, 0)
+	g.Expect(test.sync()).To(Succeed())
+	lastKnownGood := test.configMap(lastKnownGoodConfigName)
+	g.Expect(lastKnownGood.Data).To(Equal(test.configMap(util.CinderConfigName).Data))
+	g.Expect(lastKnownGood.Annotations).ToNot(HaveKey(rejectedConfigAnnotation))
+
+	g.Expect(test.events()).To(Equal([]string{
+		"TopologyEnabled", "ConfigMapCreated", "ConfigMapCreated",
+		"ConfigMapUpdated",
+		"ConfigMapUpdated", "ConfigRolledBack",
+		"ConfigMapUpdated", "ConfigMapUpdated",
+	}))
+}
+
+func TestSyncRollsBackConfigNotReadyInTime(t *testing.T) {
+	g := NewWithT(t)
+
+	cloud := fake.New()
+	defer cloud.Close()
+	test := newRollbackTest(g, cloud)
+
+	g.Expect(test.sync()).To(Succeed())
+	test.rollOut(true, 0)
+	g.Expect(test.sync()).To(Succeed())
+	goodData := test.configMap(util.CinderConfigName).Data
+
+	test.setSource("rescan-on-resize = true")
+	g.Expect(test.sync()).To(Succeed())
+	test.rollOut(false, 0)
+	g.Expect(test.sync()).To(Succeed())
+
+	// the pod is still not ready once the window has passed
+	test.c.rollout.started = time.Now().Add(-defaultConfigRollbackWindow)
+	g.Expect(test.sync()).To(MatchError(ContainSubstring("its pods did not become ready within 10m0s")))
+	g.Expect(test.configMap(util.CinderConfigName).Data).To(Equal(goodData))
+}
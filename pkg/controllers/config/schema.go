@@ -0,0 +1,270 @@
+package config
+
+import (
+	"bufio"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	ini "gopkg.in/ini.v1"
+)
+
+// maxNodeVolumeAttachLimit is the highest attach limit the driver accepts
+const maxNodeVolumeAttachLimit = 256
+
+// valueValidator returns an error describing why the value of a key is
+// invalid
+type valueValidator func(value string) error
+
+// cloudConfigSchema describes every key of each section of cloud.conf which
+// cinder-csi-plugin reads. Section and key names are matched
+// case-insensitively, as the driver does.
+var cloudConfigSchema = map[string]map[string]valueValidator{
+	"global": {
+		"auth-url":                      isString,
+		"user-id":                       isString,
+		"username":                      isString,
+		"password":                      isString,
+		"tenant-id":                     isString,
+		"tenant-name":                   isString,
+		"trust-id":                      isString,
+		"trustee-id":                    isString,
+		"trustee-password":              isString,
+		"domain-id":                     isString,
+		"domain-name":                   isString,
+		"tenant-domain-id":              isString,
+		"tenant-domain-name":            isString,
+		"user-domain-id":                isString,
+		"user-domain-name":              isString,
+		"region":                        isString,
+		"ca-file":                       isString,
+		"cert-file":                     isString,
+		"key-file":                      isString,
+		"tls-insecure":                  isBool,
+		"use-clouds":                    isBool,
+		"clouds-file":                   isString,
+		"cloud":                         isString,
+		"application-credential-id":     isString,
+		"application-credential-name":   isString,
+		"application-credential-secret": isString,
+		"os-endpoint-type":              isOneOf("public", "internal", "admin"),
+		// legacy keys of the in-tree cloud provider, which are checked and
+		// dropped by translateConfigMap
+		"secret-name":      isString,
+		"secret-namespace": isString,
+		"kubeconfig-path":  isString,
+	},
+	"blockstorage": {
+		"rescan-on-resize":           isBool,
+		"ignore-volume-az":           isBool,
+		"ignore-volume-microversion": isBool,
+		"node-volume-attach-limit":   isIntInRange(1, maxNodeVolumeAttachLimit),
+		"bs-version":                 isOneOf("v1", "v2", "v3", "auto"),
+		// legacy key of the in-tree cloud provider, which is dropped by
+		// translateConfigMap
+		"trust-device-path": isString,
+	},
+	"metadata": {
+		"search-order":    isListOf("configDrive", "metadataService"),
+		"request-timeout": isDuration,
+	},
+}
+
+// cloudProviderSections are sections of the cloud provider config which are
+// only read by the cloud controller manager, so they are passed through
+// without being checked
+var cloudProviderSections = []string{"loadbalancer", "loadbalancerclass", "networking", "route"}
+
+// ConfigProblem is an unknown or invalid section or key of cloud.conf
+type ConfigProblem struct {
+	// Line is the 1-based line of the section or key, or 0 if not known
+	Line    int
+	Message string
+}
+
+// ConfigValidationError lists the problems found in cloud.conf
+type ConfigValidationError struct {
+	Problems []ConfigProblem
+}
+
+func (e *ConfigValidationError) Error() string {
+	var problems []string
+	for _, p := range e.Problems {
+		if p.Line > 0 {
+			problems = append(problems, fmt.Sprintf("line %d: %s", p.Line, p.Message))
+		} else {
+			problems = append(problems, p.Message)
+		}
+	}
+	return "invalid cloud.conf: " + strings.Join(problems, "; ")
+}
+
+// validateCloudConfig checks the sections and keys of cloud.conf against the
+// schema of the driver, returning a ConfigValidationError listing any which
+// are unknown or have an invalid value
+func validateCloudConfig(content string, cfg *ini.File) error {
+	lines := indexLines(content)
+
+	var problems []ConfigProblem
+	for _, section := range cfg.Sections() {
+		name := section.Name()
+		sectionName := strings.ToLower(name)
+		if name == ini.DefaultSection {
+			for _, key := range section.Keys() {
+				problems = append(problems, ConfigProblem{
+					Line:    lines.key("", key.Name()),
+					Message: fmt.Sprintf("key %q is not in a section", key.Name()),
+				})
+			}
+			continue
+		}
+		if isCloudProviderSection(sectionName) {
+			continue
+		}
+
+		keys, ok := cloudConfigSchema[sectionName]
+		if !ok {
+			problems = append(problems, ConfigProblem{
+				Line:    lines.section(sectionName),
+				Message: fmt.Sprintf("unknown section [%s]", name),
+			})
+			continue
+		}
+
+		for _, key := range section.Keys() {
+			line := lines.key(sectionName, key.Name())
+			validate, ok := keys[strings.ToLower(key.Name())]
+			if !ok {
+				problems = append(problems, ConfigProblem{
+					Line:    line,
+					Message: fmt.Sprintf("unknown key '[%s] %s'", name, key.Name()),
+				})
+				continue
+			}
+			if err := validate(key.String()); err != nil {
+				problems = append(problems, ConfigProblem{
+					Line:    line,
+					Message: fmt.Sprintf("'[%s] %s' %v", name, key.Name(), err),
+				})
+			}
+		}
+	}
+
+	if len(problems) == 0 {
+		return nil
+	}
+	sort.SliceStable(problems, func(i, j int) bool { return problems[i].Line < problems[j].Line })
+	return &ConfigValidationError{Problems: problems}
+}
+
+func isCloudProviderSection(sectionName string) bool {
+	for _, s := range cloudProviderSections {
+		// LoadBalancerClass sections are named [LoadBalancerClass "name"]
+		if sectionName == s || strings.HasPrefix(sectionName, s+" ") {
+			return true
+		}
+	}
+	return false
+}
+
+// lineIndex holds the line of each section and key of an ini file, keyed by
+// lower-case name
+type lineIndex struct {
+	sections map[string]int
+	keys     map[string]int
+}
+
+// indexLines finds the line of each section and key of the ini file. If a
+// key is repeated the last line is used, as that is the value which is read.
+func indexLines(content string) lineIndex {
+	index := lineIndex{sections: map[string]int{}, keys: map[string]int{}}
+
+	section := ""
+	scanner := bufio.NewScanner(strings.NewReader(content))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case line == "" || line[0] == '#' || line[0] == ';':
+		case line[0] == '[':
+			end := strings.LastIndex(line, "]")
+			if end < 0 {
+				continue
+			}
+			section = strings.ToLower(strings.TrimSpace(line[1:end]))
+			if _, ok := index.sections[section]; !ok {
+				index.sections[section] = n
+			}
+		default:
+			end := strings.IndexAny(line, "=:")
+			if end < 0 {
+				continue
+			}
+			key := strings.ToLower(strings.TrimSpace(line[:end]))
+			index.keys[section+"\x00"+key] = n
+		}
+	}
+	return index
+}
+
+func (i lineIndex) section(name string) int {
+	return i.sections[name]
+}
+
+func (i lineIndex) key(section, key string) int {
+	return i.keys[section+"\x00"+strings.ToLower(key)]
+}
+
+func isString(string) error {
+	return nil
+}
+
+// isBool accepts the boolean values understood by the driver's config parser
+func isBool(value string) error {
+	switch strings.ToLower(value) {
+	case "true", "yes", "on", "1", "false", "no", "off", "0":
+		return nil
+	}
+	return fmt.Errorf("must be a boolean, not %q", value)
+}
+
+func isDuration(value string) error {
+	if _, err := time.ParseDuration(value); err != nil {
+		return fmt.Errorf("must be a duration such as 5s, not %q", value)
+	}
+	return nil
+}
+
+func isIntInRange(min, max int64) valueValidator {
+	return func(value string) error {
+		i, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || i < min || i > max {
+			return fmt.Errorf("must be an integer from %d to %d, not %q", min, max, value)
+		}
+		return nil
+	}
+}
+
+func isOneOf(allowed ...string) valueValidator {
+	return func(value string) error {
+		for _, a := range allowed {
+			if value == a {
+				return nil
+			}
+		}
+		return fmt.Errorf("must be one of %s, not %q", strings.Join(allowed, ", "), value)
+	}
+}
+
+// isListOf accepts a comma-separated list of the allowed values
+func isListOf(allowed ...string) valueValidator {
+	return func(value string) error {
+		for _, item := range strings.Split(value, ",") {
+			if err := isOneOf(allowed...)(strings.TrimSpace(item)); err != nil {
+				return fmt.Errorf("must be a comma-separated list of %s, not %q", strings.Join(allowed, ", "), value)
+			}
+		}
+		return nil
+	}
+}
@@ -0,0 +1,119 @@
+package config
+
+import (
+	"testing"
+
+	. "github.com/onsi/gomega"
+	ini "gopkg.in/ini.v1"
+)
+
+func TestValidateCloudConfig(t *testing.T) {
+	tc := []struct {
+		name             string
+		config           string
+		expectedProblems []ConfigProblem
+	}{
+		{
+			name:   "Empty config",
+			config: "",
+		}, {
+			name: "Valid config",
+			config: `[Global]
+secret-name = openstack-credentials
+secret-namespace = kube-system
+region = regionOne
+tls-insecure = Yes
+
+[BlockStorage]
+rescan-on-resize = true
+node-volume-attach-limit = 128
+bs-version = v3
+trust-device-path = /dev/sdb1
+
+[Metadata]
+search-order = configDrive, metadataService
+request-timeout = 5s
+
+[LoadBalancer]
+use-octavia = True
+
+[LoadBalancerClass "internal"]
+floating-network-id = 1234`,
+		}, {
+			name: "Keys and sections are case-insensitive",
+			config: `[blockstorage]
+Rescan-On-Resize = false`,
+		}, {
+			name: "Unknown section",
+			config: `[Global]
+region = regionOne
+
+[BlockStorge]
+rescan-on-resize = true`,
+			expectedProblems: []ConfigProblem{
+				{Line: 4, Message: "unknown section [BlockStorge]"},
+			},
+		}, {
+			name: "Unknown and invalid keys",
+			config: `# a comment
+[BlockStorage]
+rescan-on-resize = yes please
+ignore-volume-az = true
+node-volume-attach-limit = 300
+resize-on-rescan = true
+
+[Metadata]
+search-order = configDrive,metadata
+request-timeout = 5`,
+			expectedProblems: []ConfigProblem{
+				{Line: 3, Message: `'[BlockStorage] rescan-on-resize' must be a boolean, not "yes please"`},
+				{Line: 5, Message: `'[BlockStorage] node-volume-attach-limit' must be an integer from 1 to 256, not "300"`},
+				{Line: 6, Message: "unknown key '[BlockStorage] resize-on-rescan'"},
+				{Line: 9, Message: `'[Metadata] search-order' must be a comma-separated list of configDrive, metadataService, not "configDrive,metadata"`},
+				{Line: 10, Message: `'[Metadata] request-timeout' must be a duration such as 5s, not "5"`},
+			},
+		}, {
+			name: "Repeated key",
+			config: `[Global]
+os-endpoint-type = internal
+os-endpoint-type = private`,
+			expectedProblems: []ConfigProblem{
+				{Line: 3, Message: `'[Global] os-endpoint-type' must be one of public, internal, admin, not "private"`},
+			},
+		}, {
+			name: "Key outside a section",
+			config: `region = regionOne
+[Global]`,
+			expectedProblems: []ConfigProblem{
+				{Line: 1, Message: `key "region" is not in a section`},
+			},
+		},
+	}
+
+	for _, tc := range tc {
+		t.Run(tc.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			cfg, err := ini.Load([]byte(tc.config))
+			g.Expect(err).ToNot(HaveOccurred())
+
+			err = validateCloudConfig(tc.config, cfg)
+			if tc.expectedProblems == nil {
+				g.Expect(err).ToNot(HaveOccurred())
+				return
+			}
+			g.Expect(err).To(BeAssignableToTypeOf(&ConfigValidationError{}))
+			g.Expect(err.(*ConfigValidationError).Problems).To(Equal(tc.expectedProblems))
+		})
+	}
+}
+
+func TestConfigValidationErrorMessage(t *testing.T) {
+	g := NewWithT(t)
+
+	err := &ConfigValidationError{Problems: []ConfigProblem{
+		{Line: 3, Message: "unknown section [BlockStorge]"},
+		{Message: "unknown key '[Global] foo'"},
+	}}
+	g.Expect(err.Error()).To(Equal("invalid cloud.conf: line 3: unknown section [BlockStorge]; unknown key '[Global] foo'"))
+}
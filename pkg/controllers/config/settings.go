@@ -0,0 +1,252 @@
+package config
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+const (
+	cloudInfoTTLKey             = "cloud_info_ttl"
+	volumeTypeStorageClassesKey = "volume_type_storage_classes"
+	volumeTypeIncludeKey        = "volume_type_include"
+	volumeTypeExcludeKey        = "volume_type_exclude"
+	zoneStorageClassesKey       = "availability_zone_storage_classes"
+	zoneMappingKey              = "availability_zone_mapping"
+	quotaWarningThresholdKey    = "quota_warning_threshold"
+	storageCapacityKey          = "storage_capacity"
+	sharedBlockStorageClassKey  = "shared_block_storage_class"
+	sharedBlockVolumeTypeKey    = "shared_block_volume_type"
+	markUnavailableZonesKey     = "mark_unavailable_zones"
+	stuckVolumeThresholdKey     = "stuck_volume_threshold"
+	orphanDeletionAgeKey        = "orphan_deletion_age"
+	forceDetachKey              = "force_detach_deleted_servers"
+	configRollbackWindowKey     = "config_rollback_window"
+	stagedRolloutKey            = "staged_rollout"
+	stagedRolloutSoakPeriodKey  = "staged_rollout_soak_period"
+
+	// inferZoneMapping is the special value of zoneMappingKey that asks the
+	// operator to infer the mapping itself
+	inferZoneMapping = "auto"
+
+	defaultCloudInfoTTL          = time.Hour
+	defaultQuotaWarningThreshold = 90
+	defaultStuckVolumeThreshold  = 30 * time.Minute
+	defaultConfigRollbackWindow  = 10 * time.Minute
+	defaultStagedRolloutSoak     = 5 * time.Minute
+)
+
+// Settings holds the operator-level tunables that are read from the
+// user-provided config map. Unlike the 'config' key, none of these are passed
+// through to the driver.
+type Settings struct {
+	// CloudInfoTTL is how long the information fetched from OpenStack is
+	// cached before it is refreshed
+	CloudInfoTTL time.Duration
+
+	// VolumeTypeStorageClasses enables the generation of a StorageClass for
+	// each Cinder volume type
+	VolumeTypeStorageClasses bool
+	// VolumeTypeInclude, if set, limits the generated StorageClasses to
+	// volume types whose names match
+	VolumeTypeInclude *regexp.Regexp
+	// VolumeTypeExclude, if set, skips volume types whose names match
+	VolumeTypeExclude *regexp.Regexp
+
+	// ZoneStorageClasses enables the generation of a StorageClass for each
+	// volume availability zone when the topology feature is enabled
+	ZoneStorageClasses bool
+
+	// ZoneMapping explicitly maps compute availability zones to volume
+	// availability zones
+	ZoneMapping map[string]string
+	// InferZoneMapping allows compute availability zones without a volume
+	// availability zone of the same name to be mapped to the only volume
+	// availability zone
+	InferZoneMapping bool
+
+	// QuotaWarningThreshold is the percentage of a Cinder quota that may be
+	// used before a warning is raised. Zero disables the warning.
+	QuotaWarningThreshold int
+
+	// StorageCapacity enables storage capacity tracking, with the operator
+	// publishing CSIStorageCapacity objects for each StorageClass
+	StorageCapacity bool
+
+	// SharedBlockStorageClass enables the generation of a StorageClass for
+	// ReadWriteMany block volumes using a multiattach volume type
+	SharedBlockStorageClass bool
+	// SharedBlockVolumeType, if set, is the multiattach volume type used by
+	// the shared block StorageClass
+	SharedBlockVolumeType string
+
+	// MarkUnavailableZones enables annotating the availability zone
+	// StorageClasses of zones whose Cinder services are down
+	MarkUnavailableZones bool
+
+	// StuckVolumeThreshold is how long a volume may stay in a transitional
+	// or error status before it is reported as stuck
+	StuckVolumeThreshold time.Duration
+
+	// OrphanDeletionAge, if set, is the age after which orphaned volumes and
+	// snapshots are deleted. Zero disables deletion.
+	OrphanDeletionAge time.Duration
+
+	// ForceDetach enables detaching volumes from Nova servers which have been
+	// deleted along with their Node
+	ForceDetach bool
+
+	// ConfigRollbackWindow is how long the driver controller has to become
+	// ready with a new generated config before the last known good config
+	// is restored
+	ConfigRollbackWindow time.Duration
+
+	// StagedRollout enables rolling out changes to the node plugin
+	// DaemonSet in stages, after the driver controller and then a canary
+	// set of nodes
+	StagedRollout bool
+	// StagedRolloutSoakPeriod is how long the driver controller and the
+	// canary nodes must stay healthy before the next stage starts
+	StagedRolloutSoakPeriod time.Duration
+}
+
+// IncludesVolumeType returns true if a StorageClass should be generated for
+// the named volume type
+func (s *Settings) IncludesVolumeType(name string) bool {
+	if s.VolumeTypeInclude != nil && !s.VolumeTypeInclude.MatchString(name) {
+		return false
+	}
+	if s.VolumeTypeExclude != nil && s.VolumeTypeExclude.MatchString(name) {
+		return false
+	}
+	return true
+}
+
+// ParseSettings extracts the operator settings from the user-provided config
+// map, applying defaults for any that aren't set
+func ParseSettings(cloudConfig *v1.ConfigMap) (*Settings, error) {
+	settings := &Settings{
+		CloudInfoTTL:            defaultCloudInfoTTL,
+		QuotaWarningThreshold:   defaultQuotaWarningThreshold,
+		StuckVolumeThreshold:    defaultStuckVolumeThreshold,
+		ConfigRollbackWindow:    defaultConfigRollbackWindow,
+		StagedRolloutSoakPeriod: defaultStagedRolloutSoak,
+	}
+
+	for _, o := range []struct {
+		key    string
+		target *time.Duration
+	}{
+		{cloudInfoTTLKey, &settings.CloudInfoTTL},
+		{stuckVolumeThresholdKey, &settings.StuckVolumeThreshold},
+		{orphanDeletionAgeKey, &settings.OrphanDeletionAge},
+		{configRollbackWindowKey, &settings.ConfigRollbackWindow},
+		{stagedRolloutSoakPeriodKey, &settings.StagedRolloutSoakPeriod},
+	} {
+		if value, ok := cloudConfig.Data[o.key]; ok {
+			duration, err := time.ParseDuration(value)
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse %s: %w", o.key, err)
+			}
+			if duration <= 0 {
+				return nil, fmt.Errorf("%s must be a positive duration", o.key)
+			}
+			*o.target = duration
+		}
+	}
+
+	for _, o := range []struct {
+		key    string
+		target *bool
+	}{
+		{volumeTypeStorageClassesKey, &settings.VolumeTypeStorageClasses},
+		{zoneStorageClassesKey, &settings.ZoneStorageClasses},
+		{storageCapacityKey, &settings.StorageCapacity},
+		{sharedBlockStorageClassKey, &settings.SharedBlockStorageClass},
+		{markUnavailableZonesKey, &settings.MarkUnavailableZones},
+		{forceDetachKey, &settings.ForceDetach},
+		{stagedRolloutKey, &settings.StagedRollout},
+	} {
+		if value, ok := cloudConfig.Data[o.key]; ok {
+			enabled, err := strconv.ParseBool(value)
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse %s: %w", o.key, err)
+			}
+			*o.target = enabled
+		}
+	}
+
+	for _, o := range []struct {
+		key    string
+		target **regexp.Regexp
+	}{
+		{volumeTypeIncludeKey, &settings.VolumeTypeInclude},
+		{volumeTypeExcludeKey, &settings.VolumeTypeExclude},
+	} {
+		if value, ok := cloudConfig.Data[o.key]; ok && value != "" {
+			// the expression must match the entire volume type name
+			re, err := regexp.Compile("^(?:" + value + ")$")
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse %s: %w", o.key, err)
+			}
+			*o.target = re
+		}
+	}
+
+	if value, ok := cloudConfig.Data[zoneMappingKey]; ok {
+		if strings.TrimSpace(value) == inferZoneMapping {
+			settings.InferZoneMapping = true
+		} else {
+			mapping, err := parseZoneMapping(value)
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse %s: %w", zoneMappingKey, err)
+			}
+			settings.ZoneMapping = mapping
+		}
+	}
+
+	settings.SharedBlockVolumeType = strings.TrimSpace(cloudConfig.Data[sharedBlockVolumeTypeKey])
+
+	if value, ok := cloudConfig.Data[quotaWarningThresholdKey]; ok {
+		threshold, err := strconv.Atoi(strings.TrimSuffix(strings.TrimSpace(value), "%"))
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse %s: %w", quotaWarningThresholdKey, err)
+		}
+		if threshold < 0 || threshold > 100 {
+			return nil, fmt.Errorf("%s must be a percentage between 0 and 100", quotaWarningThresholdKey)
+		}
+		settings.QuotaWarningThreshold = threshold
+	}
+
+	return settings, nil
+}
+
+// parseZoneMapping parses a comma-separated list of
+// '<compute zone>=<volume zone>' pairs
+func parseZoneMapping(value string) (map[string]string, error) {
+	mapping := map[string]string{}
+
+	for _, pair := range strings.Split(value, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+
+		computeZone, volumeZone, ok := strings.Cut(pair, "=")
+		computeZone = strings.TrimSpace(computeZone)
+		volumeZone = strings.TrimSpace(volumeZone)
+		if !ok || computeZone == "" || volumeZone == "" {
+			return nil, fmt.Errorf("%q is not of the form '<compute zone>=<volume zone>'", pair)
+		}
+		if _, ok := mapping[computeZone]; ok {
+			return nil, fmt.Errorf("compute availability zone %q is mapped more than once", computeZone)
+		}
+		mapping[computeZone] = volumeZone
+	}
+
+	return mapping, nil
+}
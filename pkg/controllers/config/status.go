@@ -0,0 +1,187 @@
+package config
+
+import (
+	"context"
+	"sort"
+	"strings"
+
+	"github.com/openshift/library-go/pkg/operator/resource/resourcehash"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog/v2"
+	"sigs.k8s.io/yaml"
+
+	"github.com/openshift/openstack-cinder-csi-driver-operator/pkg/cloudinfo"
+	"github.com/openshift/openstack-cinder-csi-driver-operator/pkg/util"
+)
+
+const (
+	// ConfigStatusName is the config map in the operator namespace which
+	// summarises the generated config and where it came from
+	ConfigStatusName = "cinder-csi-config-status"
+	configStatusKey  = "status"
+
+	topologyUserProvided = "user"
+	topologyAutoDetected = "auto"
+)
+
+// configStatus is the summary of the generated config, as published in the
+// status config map
+type configStatus struct {
+	// Sources are the user-provided config maps the config was generated
+	// from, in increasing order of precedence
+	Sources []configStatusSource `json:"sources"`
+	// ConfigHash is the hash of the generated config, as set in the
+	// ConfigHashAnnotation of the driver pods using it
+	ConfigHash string `json:"configHash"`
+	// RemovedKeys and InjectedKeys are the cloud.conf keys which the
+	// operator removed from, or set in, the source config
+	RemovedKeys  []string `json:"removedKeys,omitempty"`
+	InjectedKeys []string `json:"injectedKeys,omitempty"`
+	// KeySources is the source of every effective key
+	KeySources configSources        `json:"keySources"`
+	Topology   configStatusTopology `json:"topology"`
+}
+
+type configStatusSource struct {
+	Namespace       string `json:"namespace"`
+	Name            string `json:"name"`
+	ResourceVersion string `json:"resourceVersion"`
+}
+
+type configStatusTopology struct {
+	Enabled string `json:"enabled"`
+	// Source is "user" if enable_topology was set by the user, or "auto"
+	Source string `json:"source"`
+	// Decision is why topology support can or cannot be enabled
+	// automatically
+	Decision     string   `json:"decision"`
+	ComputeZones []string `json:"computeZones"`
+	VolumeZones  []string `json:"volumeZones"`
+}
+
+// newConfigStatus summarises the config generated from the source config
+func (c *ConfigSyncController) newConfigStatus(sourceConfig, targetConfig *v1.ConfigMap, cloudInfo *cloudinfo.CloudInfo) (*configStatus, error) {
+	hash, err := resourcehash.GetConfigMapHash(targetConfig)
+	if err != nil {
+		return nil, err
+	}
+	sourceKeys, err := getConfigSources(sourceConfig)
+	if err != nil {
+		return nil, err
+	}
+	targetKeys, err := getConfigSources(targetConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	status := &configStatus{
+		ConfigHash: hash,
+		KeySources: targetKeys,
+		Topology: configStatusTopology{
+			Enabled:      targetConfig.Data[enableTopologyKey],
+			Source:       topologyAutoDetected,
+			Decision:     c.lastTopologyDecision,
+			ComputeZones: cloudInfo.ComputeZones,
+			VolumeZones:  cloudInfo.VolumeZones,
+		},
+	}
+	if targetKeys[enableTopologyKey] != operatorSource {
+		status.Topology.Source = topologyUserProvided
+	}
+
+	for key, source := range targetKeys {
+		if strings.HasPrefix(key, "[") && source == operatorSource {
+			status.InjectedKeys = append(status.InjectedKeys, key)
+		}
+	}
+	for key := range sourceKeys {
+		if _, ok := targetKeys[key]; strings.HasPrefix(key, "[") && !ok {
+			status.RemovedKeys = append(status.RemovedKeys, key)
+		}
+	}
+	sort.Strings(status.InjectedKeys)
+	sort.Strings(status.RemovedKeys)
+
+	// A merged config map only has the resource version of the last layer,
+	// so the others are looked up by the names recorded in the key sources
+	for _, name := range sourceLayers(sourceConfig.Name, sourceKeys) {
+		resourceVersion := sourceConfig.ResourceVersion
+		if name != sourceConfig.Name {
+			layer, err := c.configMapLister.ConfigMaps(util.OpenShiftConfigNamespace).Get(name)
+			if err != nil {
+				return nil, err
+			}
+			resourceVersion = layer.ResourceVersion
+		}
+		status.Sources = append(status.Sources, configStatusSource{
+			Namespace:       util.OpenShiftConfigNamespace,
+			Name:            name,
+			ResourceVersion: resourceVersion,
+		})
+	}
+
+	return status, nil
+}
+
+// sourceLayers returns the config maps recorded as key sources, ending with
+// the one of the given name
+func sourceLayers(name string, sources configSources) []string {
+	var layers []string
+	seen := map[string]bool{name: true}
+	for _, source := range sources {
+		if !seen[source] {
+			seen[source] = true
+			layers = append(layers, source)
+		}
+	}
+	sort.Strings(layers)
+	return append(layers, name)
+}
+
+// applyConfigStatus creates or updates the status config map. Unlike
+// resourceapply, no events are emitted, as it changes with the source config.
+func (c *ConfigSyncController) applyConfigStatus(ctx context.Context, status *configStatus) error {
+	content, err := yaml.Marshal(status)
+	if err != nil {
+		return err
+	}
+	data := map[string]string{configStatusKey: string(content)}
+
+	existing, err := c.targetConfigMapLister.ConfigMaps(util.DefaultNamespace).Get(ConfigStatusName)
+	if errors.IsNotFound(err) {
+		configMap := &v1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      ConfigStatusName,
+				Namespace: util.DefaultNamespace,
+			},
+			Data: data,
+		}
+		_, err = c.kubeClient.CoreV1().ConfigMaps(util.DefaultNamespace).Create(ctx, configMap, metav1.CreateOptions{})
+		return ignoreStaleLister(err)
+	}
+	if err != nil {
+		return err
+	}
+	if equality.Semantic.DeepEqual(existing.Data, data) {
+		return nil
+	}
+
+	configMap := existing.DeepCopy()
+	configMap.Data = data
+	_, err = c.kubeClient.CoreV1().ConfigMaps(util.DefaultNamespace).Update(ctx, configMap, metav1.UpdateOptions{})
+	return ignoreStaleLister(err)
+}
+
+// ignoreStaleLister ignores the errors of a write based on a copy of the
+// status config map which the lister hasn't caught up with, as the status is
+// written again on the next sync
+func ignoreStaleLister(err error) error {
+	if errors.IsAlreadyExists(err) || errors.IsConflict(err) {
+		klog.V(4).Infof("Not updating config map %s, which changed since it was last listed: %v", ConfigStatusName, err)
+		return nil
+	}
+	return err
+}
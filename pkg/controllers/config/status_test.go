@@ -0,0 +1,107 @@
+package config
+
+import (
+	"context"
+	"testing"
+
+	. "github.com/onsi/gomega"
+	operatorv1 "github.com/openshift/api/operator/v1"
+	"github.com/openshift/library-go/pkg/controller/factory"
+	"github.com/openshift/library-go/pkg/operator/resource/resourcehash"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/yaml"
+
+	"github.com/openshift/openstack-cinder-csi-driver-operator/pkg/cloudinfo/fake"
+	"github.com/openshift/openstack-cinder-csi-driver-operator/pkg/util"
+)
+
+func TestSyncConfigStatus(t *testing.T) {
+	tc := []struct {
+		name                 string
+		cinderConfigData     map[string]string
+		computeZones         []fake.AvailabilityZone
+		volumeZones          []fake.AvailabilityZone
+		expectedSources      []configStatusSource
+		expectedRemovedKeys  []string
+		expectedInjectedKeys []string
+		expectedTopology     configStatusTopology
+	}{
+		{
+			name:         "Cloud provider config",
+			computeZones: fake.Zones("az1", "az2"),
+			volumeZones:  fake.Zones("az1", "az2"),
+			expectedSources: []configStatusSource{
+				{Namespace: util.OpenShiftConfigNamespace, Name: "cloud-provider-config", ResourceVersion: "1"},
+			},
+			expectedRemovedKeys:  []string{"[Global] secret-name", "[Global] secret-namespace"},
+			expectedInjectedKeys: []string{"[Global] cloud", "[Global] clouds-file", "[Global] use-clouds"},
+			expectedTopology: configStatusTopology{
+				Enabled:      "true",
+				Source:       topologyAutoDetected,
+				Decision:     "Topology support can be enabled automatically",
+				ComputeZones: []string{"az1", "az2"},
+				VolumeZones:  []string{"az1", "az2"},
+			},
+		}, {
+			name: "Layered config with a user-provided topology value",
+			cinderConfigData: map[string]string{
+				sourceConfigKey:   "[BlockStorage]\nrescan-on-resize = true\n",
+				configMergeKey:    layeredConfigMerge,
+				enableTopologyKey: "false",
+			},
+			computeZones: fake.Zones("az1", "az2"),
+			volumeZones:  fake.Zones("cinder"),
+			expectedSources: []configStatusSource{
+				{Namespace: util.OpenShiftConfigNamespace, Name: "cloud-provider-config", ResourceVersion: "1"},
+				{Namespace: util.OpenShiftConfigNamespace, Name: "cinder-csi-config", ResourceVersion: "1"},
+			},
+			expectedRemovedKeys:  []string{"[Global] secret-name", "[Global] secret-namespace"},
+			expectedInjectedKeys: []string{"[Global] cloud", "[Global] clouds-file", "[Global] use-clouds"},
+			expectedTopology: configStatusTopology{
+				Enabled:      "false",
+				Source:       topologyUserProvided,
+				Decision:     `Topology support cannot be enabled automatically: compute availability zone "az1" has no volume availability zone of the same name; map it using availability_zone_mapping to enable topology support`,
+				ComputeZones: []string{"az1", "az2"},
+				VolumeZones:  []string{"cinder"},
+			},
+		},
+	}
+
+	for _, tc := range tc {
+		t.Run(tc.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			cloud := fake.New()
+			defer cloud.Close()
+			cloud.ComputeZones = tc.computeZones
+			cloud.VolumeZones = tc.volumeZones
+
+			configMaps := []*corev1.ConfigMap{newTestConfigMap("cloud-provider-config", map[string]string{
+				sourceConfigKey: testCloudConfig,
+			})}
+			if tc.cinderConfigData != nil {
+				configMaps = append(configMaps, newTestConfigMap("cinder-csi-config", tc.cinderConfigData))
+			}
+			c, kubeClient, recorder, _ := newTestConfigSyncController(g, operatorv1.Managed, cloud, configMaps...)
+			g.Expect(c.sync(context.TODO(), factory.NewSyncContext("ConfigSync", recorder))).To(Succeed())
+
+			targetConfigMap, err := kubeClient.CoreV1().ConfigMaps(util.DefaultNamespace).Get(context.TODO(), util.CinderConfigName, metav1.GetOptions{})
+			g.Expect(err).ToNot(HaveOccurred())
+			targetHash, err := resourcehash.GetConfigMapHash(targetConfigMap)
+			g.Expect(err).ToNot(HaveOccurred())
+
+			statusConfigMap, err := kubeClient.CoreV1().ConfigMaps(util.DefaultNamespace).Get(context.TODO(), ConfigStatusName, metav1.GetOptions{})
+			g.Expect(err).ToNot(HaveOccurred())
+			var status configStatus
+			g.Expect(yaml.Unmarshal([]byte(statusConfigMap.Data[configStatusKey]), &status)).To(Succeed())
+
+			g.Expect(status.Sources).To(Equal(tc.expectedSources))
+			g.Expect(status.ConfigHash).To(Equal(targetHash))
+			g.Expect(status.RemovedKeys).To(Equal(tc.expectedRemovedKeys))
+			g.Expect(status.InjectedKeys).To(Equal(tc.expectedInjectedKeys))
+			g.Expect(status.KeySources).To(HaveKey("[Global] use-clouds"))
+			g.Expect(status.Topology).To(Equal(tc.expectedTopology))
+		})
+	}
+}
@@ -0,0 +1,157 @@
+package config
+
+import (
+	"fmt"
+	"sort"
+
+	configv1listers "github.com/openshift/client-go/config/listers/config/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/klog/v2"
+
+	"github.com/openshift/openstack-cinder-csi-driver-operator/pkg/cloudinfo"
+	"github.com/openshift/openstack-cinder-csi-driver-operator/pkg/util"
+)
+
+// ZoneMapping maps each compute availability zone to the volume availability
+// zone that volumes for instances in that compute zone should be created in
+type ZoneMapping map[string]string
+
+// TopologyState collects everything needed by controllers whose behaviour
+// depends on the operator settings and how topology has been configured
+type TopologyState struct {
+	Settings  *Settings
+	CloudInfo *cloudinfo.CloudInfo
+	// TopologyEnabled is read from the generated config rather than derived
+	// from the cloud info since the user can override it
+	TopologyEnabled bool
+	// ZoneMapping is nil if compute AZs can't be mapped to volume AZs
+	ZoneMapping ZoneMapping
+}
+
+// GetTopologyState returns the current TopologyState, or nil if the
+// information needed isn't available yet
+func GetTopologyState(
+	configMapLister corelisters.ConfigMapLister,
+	targetConfigLister corelisters.ConfigMapLister,
+	infrastructureLister configv1listers.InfrastructureLister,
+	cloudInfoCache *cloudinfo.Cache,
+) (*TopologyState, error) {
+	sourceConfig, err := GetSourceConfigMap(configMapLister, infrastructureLister)
+	if err != nil {
+		return nil, err
+	}
+	if sourceConfig == nil {
+		return nil, nil
+	}
+
+	settings, err := ParseSettings(sourceConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	cloudInfo := cloudInfoCache.Get()
+	if cloudInfo == nil {
+		klog.V(4).Infof("Waiting for OpenStack cloud info to be collected")
+		return nil, nil
+	}
+
+	state := &TopologyState{
+		Settings:  settings,
+		CloudInfo: cloudInfo,
+	}
+
+	targetConfig, err := targetConfigLister.ConfigMaps(util.DefaultNamespace).Get(util.CinderConfigName)
+	if err != nil && !errors.IsNotFound(err) {
+		return nil, err
+	}
+	if targetConfig != nil {
+		state.TopologyEnabled = TopologyEnabled(targetConfig)
+	}
+
+	state.ZoneMapping, err = GetZoneMapping(cloudInfo, settings)
+	if err != nil {
+		// this has already been reported by the ConfigSyncController
+		state.ZoneMapping = nil
+	}
+
+	return state, nil
+}
+
+// GetZoneMapping determines how compute availability zones map to volume
+// availability zones. An error describing why is returned if no mapping is
+// possible, in which case the topology feature can't be used.
+func GetZoneMapping(ci *cloudinfo.CloudInfo, settings *Settings) (ZoneMapping, error) {
+	volumeZones := map[string]bool{}
+	for _, zone := range ci.VolumeZones {
+		volumeZones[zone] = true
+	}
+
+	mapping := ZoneMapping{}
+
+	for _, computeZone := range ci.ComputeZones {
+		// the user's mapping takes precedence...
+		if volumeZone, ok := settings.ZoneMapping[computeZone]; ok {
+			if !volumeZones[volumeZone] {
+				return nil, fmt.Errorf("compute availability zone %q is mapped to volume availability zone %q which does not exist", computeZone, volumeZone)
+			}
+			mapping[computeZone] = volumeZone
+			continue
+		}
+
+		switch {
+		case volumeZones[computeZone]:
+			// ...otherwise we prefer a volume AZ with the same name...
+			mapping[computeZone] = computeZone
+		case settings.InferZoneMapping && len(ci.VolumeZones) == 1:
+			// ...but if asked to, we'll use the only volume AZ for all
+			// remaining compute AZs
+			mapping[computeZone] = ci.VolumeZones[0]
+		case settings.InferZoneMapping:
+			return nil, fmt.Errorf("compute availability zone %q has no volume availability zone of the same name and one cannot be inferred from volume availability zones %v; map it explicitly using %s", computeZone, ci.VolumeZones, zoneMappingKey)
+		default:
+			return nil, fmt.Errorf("compute availability zone %q has no volume availability zone of the same name; map it using %s to enable topology support", computeZone, zoneMappingKey)
+		}
+	}
+
+	return mapping, nil
+}
+
+// IsIdentity returns true if every compute availability zone maps to the
+// volume availability zone of the same name
+func (m ZoneMapping) IsIdentity() bool {
+	for computeZone, volumeZone := range m {
+		if computeZone != volumeZone {
+			return false
+		}
+	}
+	return true
+}
+
+// ComputeZonesFor returns the sorted list of compute availability zones that
+// map to the given volume availability zone
+func (m ZoneMapping) ComputeZonesFor(volumeZone string) []string {
+	var zones []string
+	for computeZone, zone := range m {
+		if zone == volumeZone {
+			zones = append(zones, computeZone)
+		}
+	}
+	sort.Strings(zones)
+	return zones
+}
+
+// VolumeZones returns the sorted list of volume availability zones that are
+// mapped to by at least one compute availability zone
+func (m ZoneMapping) VolumeZones() []string {
+	seen := map[string]bool{}
+	var zones []string
+	for _, zone := range m {
+		if !seen[zone] {
+			seen[zone] = true
+			zones = append(zones, zone)
+		}
+	}
+	sort.Strings(zones)
+	return zones
+}
@@ -0,0 +1,118 @@
+package config
+
+import (
+	"testing"
+
+	. "github.com/onsi/gomega"
+
+	"github.com/openshift/openstack-cinder-csi-driver-operator/pkg/cloudinfo"
+)
+
+func TestGetZoneMapping(t *testing.T) {
+	tc := []struct {
+		name         string
+		computeZones []string
+		volumeZones  []string
+		settings     Settings
+		expected     ZoneMapping
+		identity     bool
+		errMsg       string
+	}{
+		{
+			name:         "Single matching AZ",
+			computeZones: []string{"nova"},
+			volumeZones:  []string{"nova"},
+			expected:     ZoneMapping{"nova": "nova"},
+			identity:     true,
+		}, {
+			name:         "Multiple matching AZs",
+			computeZones: []string{"az1", "az2", "az3"},
+			volumeZones:  []string{"az1", "az2", "az3"},
+			expected:     ZoneMapping{"az1": "az1", "az2": "az2", "az3": "az3"},
+			identity:     true,
+		}, {
+			name:         "More volume AZs than compute AZs",
+			computeZones: []string{"az1"},
+			volumeZones:  []string{"az1", "az2"},
+			expected:     ZoneMapping{"az1": "az1"},
+			identity:     true,
+		}, {
+			name:         "More compute AZs than volume AZs",
+			computeZones: []string{"az1", "az2", "az3"},
+			volumeZones:  []string{"nova"},
+			errMsg:       `compute availability zone "az1" has no volume availability zone of the same name; map it using availability_zone_mapping to enable topology support`,
+		}, {
+			name:         "Mismatched AZ names",
+			computeZones: []string{"az1", "az2"},
+			volumeZones:  []string{"az1", "az3"},
+			errMsg:       `compute availability zone "az2" has no volume availability zone of the same name; map it using availability_zone_mapping to enable topology support`,
+		}, {
+			name:         "Inferred mapping to single volume AZ",
+			computeZones: []string{"az1", "az2", "az3"},
+			volumeZones:  []string{"nova"},
+			settings:     Settings{InferZoneMapping: true},
+			expected:     ZoneMapping{"az1": "nova", "az2": "nova", "az3": "nova"},
+		}, {
+			name:         "Inferred mapping prefers matching names",
+			computeZones: []string{"az1", "az2"},
+			volumeZones:  []string{"az1"},
+			settings:     Settings{InferZoneMapping: true},
+			expected:     ZoneMapping{"az1": "az1", "az2": "az1"},
+		}, {
+			name:         "Mapping cannot be inferred with multiple volume AZs",
+			computeZones: []string{"az1", "az2", "az3"},
+			volumeZones:  []string{"cinder1", "cinder2"},
+			settings:     Settings{InferZoneMapping: true},
+			errMsg:       `compute availability zone "az1" has no volume availability zone of the same name and one cannot be inferred from volume availability zones [cinder1 cinder2]; map it explicitly using availability_zone_mapping`,
+		}, {
+			name:         "Explicit mapping",
+			computeZones: []string{"az1", "az2", "az3"},
+			volumeZones:  []string{"cinder1", "cinder2"},
+			settings: Settings{ZoneMapping: map[string]string{
+				"az1": "cinder1",
+				"az2": "cinder1",
+				"az3": "cinder2",
+			}},
+			expected: ZoneMapping{"az1": "cinder1", "az2": "cinder1", "az3": "cinder2"},
+		}, {
+			name:         "Partial explicit mapping falls back to matching names",
+			computeZones: []string{"az1", "az2"},
+			volumeZones:  []string{"az1"},
+			settings:     Settings{ZoneMapping: map[string]string{"az2": "az1"}},
+			expected:     ZoneMapping{"az1": "az1", "az2": "az1"},
+		}, {
+			name:         "Explicit mapping to missing volume AZ",
+			computeZones: []string{"az1"},
+			volumeZones:  []string{"cinder1"},
+			settings:     Settings{ZoneMapping: map[string]string{"az1": "cinder2"}},
+			errMsg:       `compute availability zone "az1" is mapped to volume availability zone "cinder2" which does not exist`,
+		},
+	}
+
+	for _, tc := range tc {
+		t.Run(tc.name, func(t *testing.T) {
+			g := NewWithT(t)
+			ci := &cloudinfo.CloudInfo{
+				ComputeZones: tc.computeZones,
+				VolumeZones:  tc.volumeZones,
+			}
+			mapping, err := GetZoneMapping(ci, &tc.settings)
+			if tc.errMsg != "" {
+				g.Expect(err).Should(MatchError(tc.errMsg))
+				return
+			}
+			g.Expect(err).ToNot(HaveOccurred())
+			g.Expect(mapping).To(Equal(tc.expected))
+			g.Expect(mapping.IsIdentity()).To(Equal(tc.identity))
+		})
+	}
+}
+
+func TestZoneMappingHelpers(t *testing.T) {
+	g := NewWithT(t)
+
+	mapping := ZoneMapping{"az1": "cinder1", "az3": "cinder2", "az2": "cinder1"}
+	g.Expect(mapping.VolumeZones()).To(Equal([]string{"cinder1", "cinder2"}))
+	g.Expect(mapping.ComputeZonesFor("cinder1")).To(Equal([]string{"az1", "az2"}))
+	g.Expect(mapping.ComputeZonesFor("cinder3")).To(BeEmpty())
+}
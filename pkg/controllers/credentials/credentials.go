@@ -0,0 +1,116 @@
+package credentials
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	operatorv1 "github.com/openshift/api/operator/v1"
+	"github.com/openshift/library-go/pkg/controller/factory"
+	"github.com/openshift/library-go/pkg/operator/events"
+	"github.com/openshift/library-go/pkg/operator/v1helpers"
+	corev1listers "k8s.io/client-go/listers/core/v1"
+	"k8s.io/klog/v2"
+
+	"github.com/openshift/openstack-cinder-csi-driver-operator/pkg/cloudinfo"
+	"github.com/openshift/openstack-cinder-csi-driver-operator/pkg/util"
+)
+
+const (
+	// conditionType is set to True when the OpenStack credentials can't be
+	// used. The status controller folds it into the operator's Degraded
+	// condition, with our reason.
+	conditionType = "OpenStackCredentialsDegraded"
+
+	resyncInterval = 5 * time.Minute
+)
+
+// This CredentialsController periodically checks that the OpenStack
+// credentials can be used to access Cinder and Nova. Any failure is reported
+// with a reason describing its cause, so that a broken clouds.yaml can be
+// told apart from e.g. an unreachable Keystone without reading the logs.
+type CredentialsController struct {
+	operatorClient v1helpers.OperatorClient
+	secretLister   corev1listers.SecretLister
+	provider       cloudinfo.Provider
+	eventRecorder  events.Recorder
+}
+
+func NewCredentialsController(
+	operatorClient v1helpers.OperatorClient,
+	informers v1helpers.KubeInformersForNamespaces,
+	provider cloudinfo.Provider,
+	eventRecorder events.Recorder) factory.Controller {
+
+	secretInformer := informers.InformersFor(util.DefaultNamespace).Core().V1().Secrets()
+	c := &CredentialsController{
+		operatorClient: operatorClient,
+		secretLister:   secretInformer.Lister(),
+		provider:       provider,
+		eventRecorder:  eventRecorder.WithComponentSuffix("OpenStackCredentials"),
+	}
+	return factory.New().WithSync(c.sync).ResyncEvery(resyncInterval).WithInformers(
+		operatorClient.Informer(),
+		secretInformer.Informer(),
+	).ToController("OpenStackCredentials", eventRecorder)
+}
+
+func (c *CredentialsController) sync(ctx context.Context, syncCtx factory.SyncContext) error {
+	opSpec, opStatus, _, err := c.operatorClient.GetOperatorState()
+	if err != nil {
+		return err
+	}
+	if opSpec.ManagementState != operatorv1.Managed {
+		return nil
+	}
+
+	condition := operatorv1.OperatorCondition{
+		Type:   conditionType,
+		Status: operatorv1.ConditionFalse,
+		Reason: "AsExpected",
+	}
+
+	// Until the secret has been provisioned there is nothing to validate.
+	// Why it hasn't been is reported by the
+	// CredentialsRequestStatusController.
+	secretExists, err := credentialsSecretExists(c.secretLister)
+	if err != nil {
+		return err
+	}
+	if !secretExists {
+		condition.Reason = "CredentialsNotProvisioned"
+		condition.Message = fmt.Sprintf("Waiting for secret %s/%s to be provisioned", util.DefaultNamespace, util.CloudCredentialsSecretName)
+		_, _, err = v1helpers.UpdateStatus(ctx, c.operatorClient, v1helpers.UpdateConditionFn(condition))
+		return err
+	}
+
+	err = c.provider.ValidateCredentials(ctx)
+	var credentialsErr *cloudinfo.CredentialsError
+	if err != nil && !errors.As(err, &credentialsErr) {
+		return err
+	}
+
+	previous := v1helpers.FindOperatorCondition(opStatus.Conditions, conditionType)
+	if credentialsErr != nil {
+		condition.Status = operatorv1.ConditionTrue
+		condition.Reason = credentialsErr.Reason
+		condition.Message = credentialsErr.Message
+
+		// the request ID changes on every attempt, so is only reported in
+		// the event and not the condition
+		if previous == nil || previous.Status != operatorv1.ConditionTrue || previous.Reason != condition.Reason {
+			if credentialsErr.RequestID != "" {
+				c.eventRecorder.Warningf(condition.Reason, "%s (Keystone request ID: %s)", condition.Message, credentialsErr.RequestID)
+			} else {
+				c.eventRecorder.Warning(condition.Reason, condition.Message)
+			}
+		}
+		klog.Warningf("OpenStack credentials validation failed: %v", credentialsErr.Err)
+	} else if previous != nil && previous.Status == operatorv1.ConditionTrue {
+		c.eventRecorder.Event("CredentialsValid", "The OpenStack credentials are valid again")
+	}
+
+	_, _, err = v1helpers.UpdateStatus(ctx, c.operatorClient, v1helpers.UpdateConditionFn(condition))
+	return err
+}
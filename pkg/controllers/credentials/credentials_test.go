@@ -0,0 +1,278 @@
+package credentials
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gophercloud/utils/v2/openstack/clientconfig"
+	. "github.com/onsi/gomega"
+	operatorv1 "github.com/openshift/api/operator/v1"
+	"github.com/openshift/library-go/pkg/controller/factory"
+	"github.com/openshift/library-go/pkg/operator/events"
+	"github.com/openshift/library-go/pkg/operator/v1helpers"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	corev1listers "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+
+	"github.com/openshift/openstack-cinder-csi-driver-operator/pkg/cloudinfo"
+	"github.com/openshift/openstack-cinder-csi-driver-operator/pkg/cloudinfo/fake"
+	"github.com/openshift/openstack-cinder-csi-driver-operator/pkg/util"
+)
+
+func TestSync(t *testing.T) {
+	tc := []struct {
+		name            string
+		clientOpts      func(cloud *fake.Cloud) *clientconfig.ClientOpts
+		missingServices []string
+		expectedStatus  operatorv1.ConditionStatus
+		expectedReason  string
+		expectedEvent   string
+	}{
+		{
+			name:           "Valid credentials",
+			expectedStatus: operatorv1.ConditionFalse,
+			expectedReason: "AsExpected",
+		}, {
+			name: "Valid application credential",
+			clientOpts: func(cloud *fake.Cloud) *clientconfig.ClientOpts {
+				return applicationCredentialOpts(cloud, fake.ApplicationCredentialSecret)
+			},
+			expectedStatus: operatorv1.ConditionFalse,
+			expectedReason: "AsExpected",
+		}, {
+			name: "Invalid cloud config",
+			clientOpts: func(cloud *fake.Cloud) *clientconfig.ClientOpts {
+				return &clientconfig.ClientOpts{Cloud: "missing", YAMLOpts: missingCloudsYAML{}}
+			},
+			expectedStatus: operatorv1.ConditionTrue,
+			expectedReason: cloudinfo.ReasonInvalidCloudConfig,
+		}, {
+			name: "Auth URL unreachable",
+			clientOpts: func(cloud *fake.Cloud) *clientconfig.ClientOpts {
+				opts := cloud.ClientOpts()
+				server := httptest.NewServer(http.NotFoundHandler())
+				server.Close()
+				opts.AuthInfo.AuthURL = server.URL
+				return opts
+			},
+			expectedStatus: operatorv1.ConditionTrue,
+			expectedReason: cloudinfo.ReasonAuthURLUnreachable,
+		}, {
+			name: "Untrusted certificate",
+			clientOpts: func(cloud *fake.Cloud) *clientconfig.ClientOpts {
+				opts := cloud.ClientOpts()
+				server := httptest.NewTLSServer(http.NotFoundHandler())
+				t.Cleanup(server.Close)
+				opts.AuthInfo.AuthURL = server.URL
+				return opts
+			},
+			expectedStatus: operatorv1.ConditionTrue,
+			expectedReason: cloudinfo.ReasonTLSVerificationFailed,
+		}, {
+			name: "Wrong password",
+			clientOpts: func(cloud *fake.Cloud) *clientconfig.ClientOpts {
+				opts := cloud.ClientOpts()
+				opts.AuthInfo.Password = "wrong"
+				return opts
+			},
+			expectedStatus: operatorv1.ConditionTrue,
+			expectedReason: cloudinfo.ReasonInvalidCredentials,
+			expectedEvent:  "Keystone rejected the OpenStack credentials; check the username, password, domain and project (Keystone request ID: " + fake.RequestID + ")",
+		}, {
+			name: "Expired application credential",
+			clientOpts: func(cloud *fake.Cloud) *clientconfig.ClientOpts {
+				return applicationCredentialOpts(cloud, "expired")
+			},
+			expectedStatus: operatorv1.ConditionTrue,
+			expectedReason: cloudinfo.ReasonApplicationCredentialExpired,
+			expectedEvent:  "Keystone rejected the application credential; it has probably expired or been deleted and must be replaced (Keystone request ID: " + fake.RequestID + ")",
+		}, {
+			name: "Missing project scope",
+			clientOpts: func(cloud *fake.Cloud) *clientconfig.ClientOpts {
+				opts := cloud.ClientOpts()
+				// a domain scoped token has no service catalog
+				opts.AuthInfo.ProjectName = ""
+				opts.AuthInfo.UserDomainName = "Default"
+				return opts
+			},
+			expectedStatus: operatorv1.ConditionTrue,
+			expectedReason: cloudinfo.ReasonMissingProjectScope,
+		}, {
+			name:            "Missing catalog entry",
+			missingServices: []string{"volumev3"},
+			expectedStatus:  operatorv1.ConditionTrue,
+			expectedReason:  cloudinfo.ReasonServiceNotInCatalog,
+		},
+	}
+
+	for _, tc := range tc {
+		t.Run(tc.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			cloud := fake.New()
+			defer cloud.Close()
+			cloud.MissingServices = tc.missingServices
+
+			opts := cloud.ClientOpts()
+			if tc.clientOpts != nil {
+				opts = tc.clientOpts(cloud)
+			}
+
+			c, operatorClient, recorder := newTestCredentialsController(operatorv1.Managed, cloudinfo.NewProvider(opts, nil))
+			syncCtx := factory.NewSyncContext("OpenStackCredentials", recorder)
+
+			g.Expect(c.sync(context.TODO(), syncCtx)).To(Succeed())
+
+			_, status, _, err := operatorClient.GetOperatorState()
+			g.Expect(err).ToNot(HaveOccurred())
+			condition := v1helpers.FindOperatorCondition(status.Conditions, conditionType)
+			g.Expect(condition).ToNot(BeNil())
+			g.Expect(condition.Status).To(Equal(tc.expectedStatus))
+			g.Expect(condition.Reason).To(Equal(tc.expectedReason), condition.Message)
+
+			// the warning event is only emitted when the reason changes
+			g.Expect(c.sync(context.TODO(), syncCtx)).To(Succeed())
+
+			var warnings []*corev1.Event
+			for _, event := range recorder.Events() {
+				if event.Type == corev1.EventTypeWarning {
+					warnings = append(warnings, event)
+				}
+			}
+			if tc.expectedStatus == operatorv1.ConditionFalse {
+				g.Expect(warnings).To(BeEmpty())
+				return
+			}
+			g.Expect(warnings).To(HaveLen(1))
+			g.Expect(warnings[0].Reason).To(Equal(tc.expectedReason))
+			g.Expect(warnings[0].Message).To(HavePrefix(condition.Message), "the condition message is the event message without the request ID")
+			if tc.expectedEvent != "" {
+				g.Expect(warnings[0].Message).To(Equal(tc.expectedEvent))
+			}
+		})
+	}
+}
+
+func TestSyncRecovered(t *testing.T) {
+	g := NewWithT(t)
+
+	cloud := fake.New()
+	defer cloud.Close()
+
+	c, operatorClient, recorder := newTestCredentialsController(operatorv1.Managed, cloudinfo.NewProvider(cloud.ClientOpts(), nil))
+	_, _, err := v1helpers.UpdateStatus(context.TODO(), operatorClient, v1helpers.UpdateConditionFn(operatorv1.OperatorCondition{
+		Type:   conditionType,
+		Status: operatorv1.ConditionTrue,
+		Reason: cloudinfo.ReasonInvalidCredentials,
+	}))
+	g.Expect(err).ToNot(HaveOccurred())
+
+	g.Expect(c.sync(context.TODO(), factory.NewSyncContext("OpenStackCredentials", recorder))).To(Succeed())
+
+	_, status, _, err := operatorClient.GetOperatorState()
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(v1helpers.IsOperatorConditionFalse(status.Conditions, conditionType)).To(BeTrue())
+	g.Expect(recorder.Events()).To(HaveLen(1))
+	g.Expect(recorder.Events()[0].Reason).To(Equal("CredentialsValid"))
+}
+
+func TestSyncUnmanaged(t *testing.T) {
+	g := NewWithT(t)
+
+	cloud := fake.New()
+	defer cloud.Close()
+
+	c, operatorClient, recorder := newTestCredentialsController(operatorv1.Unmanaged, cloudinfo.NewProvider(cloud.ClientOpts(), nil))
+
+	g.Expect(c.sync(context.TODO(), factory.NewSyncContext("OpenStackCredentials", recorder))).To(Succeed())
+	g.Expect(cloud.Requests("identity", http.MethodPost, "/auth/tokens")).To(BeZero())
+
+	_, status, _, err := operatorClient.GetOperatorState()
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(v1helpers.FindOperatorCondition(status.Conditions, conditionType)).To(BeNil())
+}
+
+func TestSyncSecretMissing(t *testing.T) {
+	g := NewWithT(t)
+
+	cloud := fake.New()
+	defer cloud.Close()
+
+	c, operatorClient, recorder := newTestCredentialsController(operatorv1.Managed, cloudinfo.NewProvider(cloud.ClientOpts(), nil))
+	c.secretLister = newSecretLister()
+
+	g.Expect(c.sync(context.TODO(), factory.NewSyncContext("OpenStackCredentials", recorder))).To(Succeed())
+	g.Expect(cloud.Requests("identity", http.MethodPost, "/auth/tokens")).To(BeZero())
+	g.Expect(recorder.Events()).To(BeEmpty())
+
+	_, status, _, err := operatorClient.GetOperatorState()
+	g.Expect(err).ToNot(HaveOccurred())
+	condition := v1helpers.FindOperatorCondition(status.Conditions, conditionType)
+	g.Expect(condition).ToNot(BeNil())
+	g.Expect(condition.Status).To(Equal(operatorv1.ConditionFalse))
+	g.Expect(condition.Reason).To(Equal("CredentialsNotProvisioned"))
+}
+
+func applicationCredentialOpts(cloud *fake.Cloud, secret string) *clientconfig.ClientOpts {
+	opts := cloud.ClientOpts()
+	opts.AuthType = clientconfig.AuthV3ApplicationCredential
+	opts.AuthInfo = &clientconfig.AuthInfo{
+		AuthURL:                     opts.AuthInfo.AuthURL,
+		ApplicationCredentialID:     fake.ApplicationCredentialID,
+		ApplicationCredentialSecret: secret,
+	}
+	return opts
+}
+
+// missingCloudsYAML behaves as if there was no clouds.yaml file
+type missingCloudsYAML struct{}
+
+func (missingCloudsYAML) LoadCloudsYAML() (map[string]clientconfig.Cloud, error) {
+	return nil, nil
+}
+
+func (missingCloudsYAML) LoadSecureCloudsYAML() (map[string]clientconfig.Cloud, error) {
+	return nil, nil
+}
+
+func (missingCloudsYAML) LoadPublicCloudsYAML() (map[string]clientconfig.Cloud, error) {
+	return nil, nil
+}
+
+func newTestCredentialsController(managementState operatorv1.ManagementState, provider cloudinfo.Provider) (*CredentialsController, v1helpers.OperatorClient, events.InMemoryRecorder) {
+	operatorClient := v1helpers.NewFakeOperatorClient(
+		&operatorv1.OperatorSpec{ManagementState: managementState},
+		&operatorv1.OperatorStatus{},
+		nil,
+	)
+	recorder := events.NewInMemoryRecorder("test")
+
+	c := &CredentialsController{
+		operatorClient: operatorClient,
+		secretLister:   newSecretLister(newCredentialsSecret()),
+		provider:       provider,
+		eventRecorder:  recorder,
+	}
+
+	return c, operatorClient, recorder
+}
+
+func newCredentialsSecret() *corev1.Secret {
+	return &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      util.CloudCredentialsSecretName,
+			Namespace: util.DefaultNamespace,
+		},
+	}
+}
+
+func newSecretLister(secrets ...*corev1.Secret) corev1listers.SecretLister {
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	for _, secret := range secrets {
+		indexer.Add(secret)
+	}
+	return corev1listers.NewSecretLister(indexer)
+}
@@ -0,0 +1,266 @@
+package credentials
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	operatorv1 "github.com/openshift/api/operator/v1"
+	opinformers "github.com/openshift/client-go/operator/informers/externalversions"
+	operatorv1listers "github.com/openshift/client-go/operator/listers/operator/v1"
+	"github.com/openshift/library-go/pkg/controller/factory"
+	dc "github.com/openshift/library-go/pkg/operator/deploymentcontroller"
+	"github.com/openshift/library-go/pkg/operator/events"
+	"github.com/openshift/library-go/pkg/operator/resource/resourceapply"
+	"github.com/openshift/library-go/pkg/operator/resource/resourceread"
+	"github.com/openshift/library-go/pkg/operator/v1helpers"
+	appsv1 "k8s.io/api/apps/v1"
+	apiextclient "k8s.io/apiextensions-apiserver/pkg/client/clientset/clientset"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+	corev1informers "k8s.io/client-go/informers/core/v1"
+	corev1listers "k8s.io/client-go/listers/core/v1"
+	"k8s.io/klog/v2"
+
+	"github.com/openshift/openstack-cinder-csi-driver-operator/pkg/util"
+)
+
+const (
+	// credentialsRequestConditionType is set to True when the credentials
+	// secret will not be provisioned without intervention, either because
+	// the cloud-credential-operator failed to provision it or because it is
+	// in Manual mode and nobody has created it
+	credentialsRequestConditionType = "OpenStackCredentialsRequestDegraded"
+
+	// ReasonCredentialsSecretMissing is used when the cloud-credential-operator
+	// is in Manual mode and the credentials secret does not exist
+	ReasonCredentialsSecretMissing = "CredentialsSecretMissing"
+
+	clusterCloudCredentialName = "cluster"
+
+	credentialsRequestCRDName = "credentialsrequests.cloudcredential.openshift.io"
+
+	credentialsRequestResyncInterval = time.Minute
+)
+
+var credentialsRequestGVR = schema.GroupVersionResource{
+	Group:    resourceapply.CredentialsRequestGroup,
+	Version:  resourceapply.CredentialsRequestVersion,
+	Resource: resourceapply.CredentialsRequestResource,
+}
+
+// credentialsRequestFailureConditions are the CredentialsRequest conditions
+// set by the cloud-credential-operator when it can't provision the secret
+var credentialsRequestFailureConditions = []string{
+	"CredentialsProvisionFailure",
+	"InsufficientCloudCredentials",
+	"MissingTargetNamespace",
+	"Ignored",
+}
+
+// This CredentialsRequestStatusController reports why the credentials secret
+// requested from the cloud-credential-operator has not been provisioned. The
+// CredentialsRequest itself is applied by the library-go
+// CredentialsRequestController, which only reports whether the secret has
+// been provisioned yet. If the cloud-credential-operator is not installed,
+// e.g. because the CloudCredential capability is disabled, the secret must be
+// created by the cluster administrator as in Manual mode.
+type CredentialsRequestStatusController struct {
+	operatorClient        v1helpers.OperatorClient
+	dynamicClient         dynamic.Interface
+	cloudCredentialLister operatorv1listers.CloudCredentialLister
+	secretLister          corev1listers.SecretLister
+	credentialsRequest    *unstructured.Unstructured
+	eventRecorder         events.Recorder
+}
+
+func NewCredentialsRequestStatusController(
+	operatorClient v1helpers.OperatorClient,
+	dynamicClient dynamic.Interface,
+	informers v1helpers.KubeInformersForNamespaces,
+	operatorInformers opinformers.SharedInformerFactory,
+	ccoInstalled bool,
+	manifest []byte,
+	eventRecorder events.Recorder) factory.Controller {
+
+	secretInformer := informers.InformersFor(util.DefaultNamespace).Core().V1().Secrets()
+	c := &CredentialsRequestStatusController{
+		operatorClient:     operatorClient,
+		dynamicClient:      dynamicClient,
+		secretLister:       secretInformer.Lister(),
+		credentialsRequest: resourceread.ReadCredentialRequestsOrDie(manifest),
+		eventRecorder:      eventRecorder.WithComponentSuffix("OpenStackCredentialsRequest"),
+	}
+	controllerInformers := []factory.Informer{
+		operatorClient.Informer(),
+		secretInformer.Informer(),
+	}
+	// the CloudCredential informer would never sync without its CRD
+	if ccoInstalled {
+		cloudCredentialInformer := operatorInformers.Operator().V1().CloudCredentials()
+		c.cloudCredentialLister = cloudCredentialInformer.Lister()
+		controllerInformers = append(controllerInformers, cloudCredentialInformer.Informer())
+	}
+	return factory.New().WithSync(c.sync).ResyncEvery(credentialsRequestResyncInterval).WithInformers(
+		controllerInformers...,
+	).ToController("OpenStackCredentialsRequest", eventRecorder)
+}
+
+// CloudCredentialOperatorInstalled returns whether the CredentialsRequest CRD
+// exists, which it doesn't if the CloudCredential capability is disabled
+func CloudCredentialOperatorInstalled(ctx context.Context, apiExtClient apiextclient.Interface) (bool, error) {
+	_, err := apiExtClient.ApiextensionsV1().CustomResourceDefinitions().Get(ctx, credentialsRequestCRDName, metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to check whether the cloud-credential-operator is installed: %w", err)
+	}
+	return true, nil
+}
+
+func (c *CredentialsRequestStatusController) sync(ctx context.Context, syncCtx factory.SyncContext) error {
+	opSpec, opStatus, _, err := c.operatorClient.GetOperatorState()
+	if err != nil {
+		return err
+	}
+	if opSpec.ManagementState != operatorv1.Managed {
+		return nil
+	}
+
+	ccoInstalled := c.cloudCredentialLister != nil
+	credentialsMode := operatorv1.CloudCredentialsModeManual
+	if ccoInstalled {
+		cloudCredential, err := c.cloudCredentialLister.Get(clusterCloudCredentialName)
+		if errors.IsNotFound(err) {
+			ccoInstalled = false
+		} else if err != nil {
+			return err
+		} else {
+			credentialsMode = cloudCredential.Spec.CredentialsMode
+		}
+	}
+
+	secretExists, err := credentialsSecretExists(c.secretLister)
+	if err != nil {
+		return err
+	}
+
+	condition := operatorv1.OperatorCondition{
+		Type:   credentialsRequestConditionType,
+		Status: operatorv1.ConditionFalse,
+		Reason: "AsExpected",
+	}
+
+	if !ccoInstalled || credentialsMode == operatorv1.CloudCredentialsModeManual {
+		// the CredentialsRequest is ignored or doesn't exist, so the secret
+		// must be created by the cluster administrator
+		if !secretExists {
+			state := "is in Manual mode"
+			if !ccoInstalled {
+				state = "is not installed"
+			}
+			condition.Status = operatorv1.ConditionTrue
+			condition.Reason = ReasonCredentialsSecretMissing
+			condition.Message = fmt.Sprintf("The cloud-credential-operator %s, so the %s/%s secret containing clouds.yaml must be created by the cluster administrator", state, util.DefaultNamespace, util.CloudCredentialsSecretName)
+		}
+	} else {
+		cr, err := c.dynamicClient.Resource(credentialsRequestGVR).Namespace(c.credentialsRequest.GetNamespace()).Get(ctx, c.credentialsRequest.GetName(), metav1.GetOptions{})
+		if err != nil && !errors.IsNotFound(err) {
+			return err
+		}
+		if err == nil {
+			failure, err := credentialsRequestFailure(cr)
+			if err != nil {
+				return err
+			}
+			if failure != nil {
+				condition.Status = operatorv1.ConditionTrue
+				condition.Reason = failure.Type
+				condition.Message = fmt.Sprintf("The cloud-credential-operator failed to provision the OpenStack credentials for CredentialsRequest %s/%s: %s", cr.GetNamespace(), cr.GetName(), failure.Message)
+			}
+		}
+	}
+
+	previous := v1helpers.FindOperatorCondition(opStatus.Conditions, credentialsRequestConditionType)
+	if condition.Status == operatorv1.ConditionTrue {
+		if previous == nil || previous.Status != operatorv1.ConditionTrue || previous.Reason != condition.Reason {
+			c.eventRecorder.Warning(condition.Reason, condition.Message)
+		}
+		klog.Warning(condition.Message)
+	} else if previous != nil && previous.Status == operatorv1.ConditionTrue {
+		c.eventRecorder.Event("CredentialsProvisioned", "The OpenStack credentials secret has been provisioned")
+	}
+
+	_, _, err = v1helpers.UpdateStatus(ctx, c.operatorClient, v1helpers.UpdateConditionFn(condition))
+	return err
+}
+
+// credentialsRequestCondition is a condition in the status of a
+// CredentialsRequest
+type credentialsRequestCondition struct {
+	Type    string
+	Status  string
+	Reason  string
+	Message string
+}
+
+// credentialsRequestFailure returns the first failure condition that is set
+// on the CredentialsRequest, or nil if there is none
+func credentialsRequestFailure(cr *unstructured.Unstructured) (*credentialsRequestCondition, error) {
+	conditions, _, err := unstructured.NestedSlice(cr.Object, "status", "conditions")
+	if err != nil {
+		return nil, fmt.Errorf("error reading status.conditions field from %q: %w", cr.GetName(), err)
+	}
+
+	for _, failureType := range credentialsRequestFailureConditions {
+		for _, c := range conditions {
+			fields, ok := c.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			condition := &credentialsRequestCondition{}
+			condition.Type, _, _ = unstructured.NestedString(fields, "type")
+			condition.Status, _, _ = unstructured.NestedString(fields, "status")
+			condition.Reason, _, _ = unstructured.NestedString(fields, "reason")
+			condition.Message, _, _ = unstructured.NestedString(fields, "message")
+			if condition.Type == failureType && condition.Status == string(metav1.ConditionTrue) {
+				return condition, nil
+			}
+		}
+	}
+
+	return nil, nil
+}
+
+// WithCredentialsSecretHook scales the controller Deployment to zero until
+// the credentials secret exists, so that its pods aren't stuck waiting for
+// the secret to be mounted. This must come after WithReplicasHook.
+func WithCredentialsSecretHook(secretInformer corev1informers.SecretInformer) dc.DeploymentHookFunc {
+	return func(_ *operatorv1.OperatorSpec, deployment *appsv1.Deployment) error {
+		exists, err := credentialsSecretExists(secretInformer.Lister())
+		if err != nil {
+			return err
+		}
+		if !exists {
+			klog.V(2).Infof("Waiting for secret %s/%s to be provisioned before rolling out %s", util.DefaultNamespace, util.CloudCredentialsSecretName, deployment.Name)
+			replicas := int32(0)
+			deployment.Spec.Replicas = &replicas
+		}
+		return nil
+	}
+}
+
+func credentialsSecretExists(secretLister corev1listers.SecretLister) (bool, error) {
+	_, err := secretLister.Secrets(util.DefaultNamespace).Get(util.CloudCredentialsSecretName)
+	if errors.IsNotFound(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
@@ -0,0 +1,261 @@
+package credentials
+
+import (
+	"context"
+	"testing"
+
+	. "github.com/onsi/gomega"
+	operatorv1 "github.com/openshift/api/operator/v1"
+	operatorv1listers "github.com/openshift/client-go/operator/listers/operator/v1"
+	"github.com/openshift/library-go/pkg/controller/factory"
+	"github.com/openshift/library-go/pkg/operator/events"
+	"github.com/openshift/library-go/pkg/operator/resource/resourceread"
+	"github.com/openshift/library-go/pkg/operator/v1helpers"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	fakedynamic "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/informers"
+	fakekube "k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/utils/ptr"
+
+	"github.com/openshift/openstack-cinder-csi-driver-operator/assets"
+	"github.com/openshift/openstack-cinder-csi-driver-operator/pkg/util"
+)
+
+func TestCredentialsRequestSync(t *testing.T) {
+	tc := []struct {
+		name            string
+		credentialsMode operatorv1.CloudCredentialsMode
+		secretExists    bool
+		conditions      []interface{}
+		expectedStatus  operatorv1.ConditionStatus
+		expectedReason  string
+	}{
+		{
+			name:           "Provisioned",
+			secretExists:   true,
+			expectedStatus: operatorv1.ConditionFalse,
+			expectedReason: "AsExpected",
+		}, {
+			name:           "Not provisioned yet",
+			expectedStatus: operatorv1.ConditionFalse,
+			expectedReason: "AsExpected",
+		}, {
+			name: "Provision failure",
+			conditions: []interface{}{
+				credentialsRequestConditionMap("CredentialsProvisionFailure", "True", "failed to grant creds: the root credentials are missing"),
+			},
+			expectedStatus: operatorv1.ConditionTrue,
+			expectedReason: "CredentialsProvisionFailure",
+		}, {
+			name:         "Stale failure condition",
+			secretExists: true,
+			conditions: []interface{}{
+				credentialsRequestConditionMap("CredentialsProvisionFailure", "False", ""),
+			},
+			expectedStatus: operatorv1.ConditionFalse,
+			expectedReason: "AsExpected",
+		}, {
+			name:            "Manual mode with secret",
+			credentialsMode: operatorv1.CloudCredentialsModeManual,
+			secretExists:    true,
+			expectedStatus:  operatorv1.ConditionFalse,
+			expectedReason:  "AsExpected",
+		}, {
+			name:            "Manual mode without secret",
+			credentialsMode: operatorv1.CloudCredentialsModeManual,
+			expectedStatus:  operatorv1.ConditionTrue,
+			expectedReason:  ReasonCredentialsSecretMissing,
+		},
+	}
+
+	for _, tc := range tc {
+		t.Run(tc.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			c, operatorClient, recorder := newTestCredentialsRequestStatusController(t, operatorv1.Managed, tc.credentialsMode, tc.secretExists, tc.conditions)
+			syncCtx := factory.NewSyncContext("OpenStackCredentialsRequest", recorder)
+
+			g.Expect(c.sync(context.TODO(), syncCtx)).To(Succeed())
+
+			_, status, _, err := operatorClient.GetOperatorState()
+			g.Expect(err).ToNot(HaveOccurred())
+			condition := v1helpers.FindOperatorCondition(status.Conditions, credentialsRequestConditionType)
+			g.Expect(condition).ToNot(BeNil())
+			g.Expect(condition.Status).To(Equal(tc.expectedStatus))
+			g.Expect(condition.Reason).To(Equal(tc.expectedReason), condition.Message)
+
+			// the warning event is only emitted when the reason changes
+			g.Expect(c.sync(context.TODO(), syncCtx)).To(Succeed())
+
+			if tc.expectedStatus == operatorv1.ConditionFalse {
+				g.Expect(recorder.Events()).To(BeEmpty())
+				return
+			}
+			g.Expect(recorder.Events()).To(HaveLen(1))
+			g.Expect(recorder.Events()[0].Type).To(Equal(corev1.EventTypeWarning))
+			g.Expect(recorder.Events()[0].Reason).To(Equal(tc.expectedReason))
+			g.Expect(recorder.Events()[0].Message).To(Equal(condition.Message))
+		})
+	}
+}
+
+func TestCredentialsRequestSyncWithoutCCO(t *testing.T) {
+	tc := []struct {
+		name           string
+		noCRD          bool
+		secretExists   bool
+		expectedStatus operatorv1.ConditionStatus
+		expectedReason string
+	}{
+		{
+			name:           "No CloudCredential CRD, with secret",
+			noCRD:          true,
+			secretExists:   true,
+			expectedStatus: operatorv1.ConditionFalse,
+			expectedReason: "AsExpected",
+		}, {
+			name:           "No CloudCredential CRD, without secret",
+			noCRD:          true,
+			expectedStatus: operatorv1.ConditionTrue,
+			expectedReason: ReasonCredentialsSecretMissing,
+		}, {
+			name:           "No cluster CloudCredential",
+			expectedStatus: operatorv1.ConditionTrue,
+			expectedReason: ReasonCredentialsSecretMissing,
+		},
+	}
+
+	for _, tc := range tc {
+		t.Run(tc.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			c, operatorClient, recorder := newTestCredentialsRequestStatusController(t, operatorv1.Managed, "", tc.secretExists, nil)
+			if tc.noCRD {
+				c.cloudCredentialLister = nil
+			} else {
+				c.cloudCredentialLister = operatorv1listers.NewCloudCredentialLister(cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{}))
+			}
+
+			g.Expect(c.sync(context.TODO(), factory.NewSyncContext("OpenStackCredentialsRequest", recorder))).To(Succeed())
+
+			_, status, _, err := operatorClient.GetOperatorState()
+			g.Expect(err).ToNot(HaveOccurred())
+			condition := v1helpers.FindOperatorCondition(status.Conditions, credentialsRequestConditionType)
+			g.Expect(condition).ToNot(BeNil())
+			g.Expect(condition.Status).To(Equal(tc.expectedStatus))
+			g.Expect(condition.Reason).To(Equal(tc.expectedReason), condition.Message)
+			if tc.expectedStatus == operatorv1.ConditionTrue {
+				g.Expect(condition.Message).To(ContainSubstring("cloud-credential-operator is not installed"))
+			}
+		})
+	}
+}
+
+func TestCredentialsRequestSyncUnmanaged(t *testing.T) {
+	g := NewWithT(t)
+
+	c, operatorClient, recorder := newTestCredentialsRequestStatusController(t, operatorv1.Unmanaged, operatorv1.CloudCredentialsModeManual, false, nil)
+
+	g.Expect(c.sync(context.TODO(), factory.NewSyncContext("OpenStackCredentialsRequest", recorder))).To(Succeed())
+
+	_, status, _, err := operatorClient.GetOperatorState()
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(v1helpers.FindOperatorCondition(status.Conditions, credentialsRequestConditionType)).To(BeNil())
+}
+
+func TestCredentialsSecretHook(t *testing.T) {
+	for _, secretExists := range []bool{true, false} {
+		g := NewWithT(t)
+
+		kubeClient := fakekube.NewSimpleClientset()
+		secretInformer := informers.NewSharedInformerFactory(kubeClient, 0).Core().V1().Secrets()
+		if secretExists {
+			g.Expect(secretInformer.Informer().GetIndexer().Add(newCredentialsSecret())).To(Succeed())
+		}
+
+		deployment := &appsv1.Deployment{
+			Spec: appsv1.DeploymentSpec{Replicas: ptr.To[int32](2)},
+		}
+		g.Expect(WithCredentialsSecretHook(secretInformer)(&operatorv1.OperatorSpec{}, deployment)).To(Succeed())
+
+		expectedReplicas := int32(0)
+		if secretExists {
+			expectedReplicas = 2
+		}
+		g.Expect(*deployment.Spec.Replicas).To(Equal(expectedReplicas))
+	}
+}
+
+// ensure the CredentialsRequest asks for the secret the driver uses
+func TestCredentialsRequestManifest(t *testing.T) {
+	g := NewWithT(t)
+
+	manifest, err := assets.ReadFile("credentials.yaml")
+	g.Expect(err).ToNot(HaveOccurred())
+	cr := resourceread.ReadCredentialRequestsOrDie(manifest)
+
+	name, _, _ := unstructured.NestedString(cr.Object, "spec", "secretRef", "name")
+	g.Expect(name).To(Equal(util.CloudCredentialsSecretName))
+	kind, _, _ := unstructured.NestedString(cr.Object, "spec", "providerSpec", "kind")
+	g.Expect(kind).To(Equal("OpenStackProviderSpec"))
+}
+
+func credentialsRequestConditionMap(conditionType, status, message string) map[string]interface{} {
+	return map[string]interface{}{
+		"type":    conditionType,
+		"status":  status,
+		"reason":  "TestReason",
+		"message": message,
+	}
+}
+
+func newTestCredentialsRequestStatusController(t *testing.T, managementState operatorv1.ManagementState, credentialsMode operatorv1.CloudCredentialsMode, secretExists bool, conditions []interface{}) (*CredentialsRequestStatusController, v1helpers.OperatorClient, events.InMemoryRecorder) {
+	operatorClient := v1helpers.NewFakeOperatorClient(
+		&operatorv1.OperatorSpec{ManagementState: managementState},
+		&operatorv1.OperatorStatus{},
+		nil,
+	)
+	recorder := events.NewInMemoryRecorder("test")
+
+	manifest, err := assets.ReadFile("credentials.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cr := resourceread.ReadCredentialRequestsOrDie(manifest)
+	var objects []runtime.Object
+	if credentialsMode != operatorv1.CloudCredentialsModeManual {
+		if conditions != nil {
+			if err := unstructured.SetNestedSlice(cr.Object, conditions, "status", "conditions"); err != nil {
+				t.Fatal(err)
+			}
+		}
+		objects = append(objects, cr)
+	}
+
+	cloudCredentialIndexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	cloudCredentialIndexer.Add(&operatorv1.CloudCredential{
+		ObjectMeta: metav1.ObjectMeta{Name: clusterCloudCredentialName},
+		Spec:       operatorv1.CloudCredentialSpec{CredentialsMode: credentialsMode},
+	})
+
+	var secrets []*corev1.Secret
+	if secretExists {
+		secrets = append(secrets, newCredentialsSecret())
+	}
+
+	c := &CredentialsRequestStatusController{
+		operatorClient:        operatorClient,
+		dynamicClient:         fakedynamic.NewSimpleDynamicClient(runtime.NewScheme(), objects...),
+		cloudCredentialLister: operatorv1listers.NewCloudCredentialLister(cloudCredentialIndexer),
+		secretLister:          newSecretLister(secrets...),
+		credentialsRequest:    cr,
+		eventRecorder:         recorder,
+	}
+
+	return c, operatorClient, recorder
+}
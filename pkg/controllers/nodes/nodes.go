@@ -0,0 +1,211 @@
+package nodes
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	operatorv1 "github.com/openshift/api/operator/v1"
+	"github.com/openshift/library-go/pkg/controller/factory"
+	"github.com/openshift/library-go/pkg/operator/events"
+	"github.com/openshift/library-go/pkg/operator/v1helpers"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/client-go/kubernetes"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/klog/v2"
+	"k8s.io/utils/ptr"
+
+	"github.com/openshift/openstack-cinder-csi-driver-operator/pkg/cloudinfo"
+	"github.com/openshift/openstack-cinder-csi-driver-operator/pkg/util"
+)
+
+const (
+	resyncInterval = 10 * time.Minute
+
+	// nameLookupInterval is how often a node without a provider ID is
+	// looked up by name, as its informer events are frequent
+	nameLookupInterval = time.Minute
+	// nonNovaGracePeriod is how long no server of the name of a node
+	// without a provider ID must be found before the node is excluded, so
+	// that a single failed lookup can't exclude a Nova server
+	nonNovaGracePeriod = 10 * time.Minute
+)
+
+// This NodeSelectionController labels the nodes which are not backed by a
+// Nova server, such as bare metal workers or remote edge nodes, with the
+// non-nova-node label. The node plugin DaemonSet has a node affinity which
+// excludes these nodes, as the driver can't find its instance metadata on
+// them and crash-loops. A node is backed by a Nova server if it has an
+// OpenStack provider ID or, until the cloud controller manager has set its
+// provider ID, if a server of the same name has been found within the grace
+// period. Nodes which the cluster administrator has opted out with the
+// disable-node-plugin label are left alone.
+type NodeSelectionController struct {
+	operatorClient v1helpers.OperatorClient
+	kubeClient     kubernetes.Interface
+	nodeLister     corelisters.NodeLister
+	provider       cloudinfo.Provider
+	eventRecorder  events.Recorder
+
+	// lookups are the name lookups of the nodes without a provider ID
+	// which are not excluded
+	lookups map[string]*nameLookup
+	now     func() time.Time
+}
+
+// nameLookup records the lookups of a node's server by name
+type nameLookup struct {
+	// checked is when the server was last looked up
+	checked time.Time
+	// firstMiss is when no server was first found since one last was, or
+	// zero if one was found
+	firstMiss time.Time
+}
+
+func NewNodeSelectionController(
+	operatorClient v1helpers.OperatorClient,
+	kubeClient kubernetes.Interface,
+	informers v1helpers.KubeInformersForNamespaces,
+	provider cloudinfo.Provider,
+	eventRecorder events.Recorder) factory.Controller {
+
+	nodeInformer := informers.InformersFor("").Core().V1().Nodes()
+	c := &NodeSelectionController{
+		operatorClient: operatorClient,
+		kubeClient:     kubeClient,
+		nodeLister:     nodeInformer.Lister(),
+		provider:       provider,
+		eventRecorder:  eventRecorder.WithComponentSuffix("CinderNodeSelection"),
+		lookups:        map[string]*nameLookup{},
+		now:            time.Now,
+	}
+	return factory.New().WithSync(c.sync).ResyncEvery(resyncInterval).WithInformers(
+		operatorClient.Informer(),
+		nodeInformer.Informer(),
+	).ToController("CinderNodeSelection", eventRecorder)
+}
+
+func (c *NodeSelectionController) sync(ctx context.Context, syncCtx factory.SyncContext) error {
+	opSpec, _, _, err := c.operatorClient.GetOperatorState()
+	if err != nil {
+		return err
+	}
+	if opSpec.ManagementState != operatorv1.Managed {
+		return nil
+	}
+
+	nodes, err := c.nodeLister.List(labels.Everything())
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	nodeNames := map[string]bool{}
+	for _, node := range nodes {
+		nodeNames[node.Name] = true
+		if node.Labels[util.DisableNodePluginLabel] == "true" {
+			continue
+		}
+
+		_, labelled := node.Labels[util.NonNovaNodeLabel]
+		novaServer, err := c.isNovaServer(ctx, node, labelled)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		switch {
+		case !novaServer && !labelled:
+			if err := c.setLabel(ctx, node.Name, ptr.To("true")); err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			klog.Infof("Excluding node %s with provider ID %q from the node plugin as it is not a Nova server", node.Name, node.Spec.ProviderID)
+			c.eventRecorder.Eventf("NodeExcluded", "Node %s is not a Nova server, so the node plugin will not run on it", node.Name)
+		case novaServer && labelled:
+			if err := c.setLabel(ctx, node.Name, nil); err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			klog.Infof("Including node %s with provider ID %q in the node plugin as it is a Nova server", node.Name, node.Spec.ProviderID)
+			c.eventRecorder.Eventf("NodeIncluded", "Node %s is a Nova server, so the node plugin will run on it", node.Name)
+		}
+	}
+
+	// forget nodes which have been deleted
+	for nodeName := range c.lookups {
+		if !nodeNames[nodeName] {
+			delete(c.lookups, nodeName)
+		}
+	}
+
+	return utilerrors.NewAggregate(errs)
+}
+
+// isNovaServer returns whether the node is backed by a Nova server. Nodes
+// whose provider ID hasn't been set yet are looked up by name, and are only
+// found not to be Nova servers once no server has been found for
+// nonNovaGracePeriod. Until then, and once excluded until they get
+// a provider ID, their current state is returned.
+func (c *NodeSelectionController) isNovaServer(ctx context.Context, node *corev1.Node, labelled bool) (bool, error) {
+	if util.ServerIDFromProviderID(node.Spec.ProviderID) != "" {
+		delete(c.lookups, node.Name)
+		return true, nil
+	}
+	if node.Spec.ProviderID != "" {
+		// e.g. a bare metal host managed by metal3
+		delete(c.lookups, node.Name)
+		return false, nil
+	}
+	if labelled {
+		delete(c.lookups, node.Name)
+		return false, nil
+	}
+
+	now := c.now()
+	lookup, ok := c.lookups[node.Name]
+	if !ok {
+		lookup = &nameLookup{}
+		c.lookups[node.Name] = lookup
+	}
+	if now.Sub(lookup.checked) < nameLookupInterval {
+		return true, nil
+	}
+
+	serverID, err := c.provider.GetServerIDByName(ctx, node.Name)
+	if err != nil {
+		return false, err
+	}
+	lookup.checked = now
+	if serverID != "" {
+		lookup.firstMiss = time.Time{}
+		return true, nil
+	}
+	if lookup.firstMiss.IsZero() {
+		lookup.firstMiss = now
+	}
+	return now.Sub(lookup.firstMiss) < nonNovaGracePeriod, nil
+}
+
+// setLabel sets the non-nova-node label of the node to the given value, or
+// removes it if value is nil
+func (c *NodeSelectionController) setLabel(ctx context.Context, nodeName string, value *string) error {
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"labels": map[string]*string{util.NonNovaNodeLabel: value},
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	if _, err := c.kubeClient.CoreV1().Nodes().Patch(ctx, nodeName, types.MergePatchType, patch, metav1.PatchOptions{}); err != nil {
+		return fmt.Errorf("failed to update the %s label of node %s: %w", util.NonNovaNodeLabel, nodeName, err)
+	}
+	return nil
+}
@@ -0,0 +1,182 @@
+package nodes
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	. "github.com/onsi/gomega"
+	operatorv1 "github.com/openshift/api/operator/v1"
+	"github.com/openshift/library-go/pkg/controller/factory"
+	"github.com/openshift/library-go/pkg/operator/events"
+	"github.com/openshift/library-go/pkg/operator/v1helpers"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	fakekube "k8s.io/client-go/kubernetes/fake"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+
+	"github.com/openshift/openstack-cinder-csi-driver-operator/pkg/cloudinfo"
+	"github.com/openshift/openstack-cinder-csi-driver-operator/pkg/cloudinfo/fake"
+	"github.com/openshift/openstack-cinder-csi-driver-operator/pkg/util"
+)
+
+func TestNodeSelectionSync(t *testing.T) {
+	tc := []struct {
+		name           string
+		providerID     string
+		labels         map[string]string
+		expectedLabel  bool
+		expectedEvents []string
+	}{
+		{
+			name:       "Nova server",
+			providerID: "openstack:///server-1",
+		}, {
+			name:           "Nova server which was excluded",
+			providerID:     "openstack:///server-1",
+			labels:         map[string]string{util.NonNovaNodeLabel: "true"},
+			expectedEvents: []string{"NodeIncluded"},
+		}, {
+			name:           "Bare metal host",
+			providerID:     "baremetalhost:///openshift-machine-api/worker-0/d2a8e3e6",
+			expectedLabel:  true,
+			expectedEvents: []string{"NodeExcluded"},
+		}, {
+			name:          "Bare metal host already excluded",
+			providerID:    "baremetalhost:///openshift-machine-api/worker-0/d2a8e3e6",
+			labels:        map[string]string{util.NonNovaNodeLabel: "true"},
+			expectedLabel: true,
+		}, {
+			name: "Uninitialized Nova server",
+		}, {
+			name:       "Opted out",
+			providerID: "baremetalhost:///openshift-machine-api/worker-0/d2a8e3e6",
+			labels:     map[string]string{util.DisableNodePluginLabel: "true"},
+		},
+	}
+
+	for _, tc := range tc {
+		t.Run(tc.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			cloud := fake.New()
+			defer cloud.Close()
+			cloud.Servers = []fake.Server{{ID: "server-1", Name: "node-1"}}
+
+			node := &corev1.Node{
+				ObjectMeta: metav1.ObjectMeta{Name: "node-1", Labels: tc.labels},
+				Spec:       corev1.NodeSpec{ProviderID: tc.providerID},
+			}
+			c, kubeClient, recorder := newTestNodeSelectionController(g, cloud, node)
+
+			g.Expect(c.sync(context.TODO(), factory.NewSyncContext("CinderNodeSelection", recorder))).To(Succeed())
+
+			updated, err := kubeClient.CoreV1().Nodes().Get(context.TODO(), "node-1", metav1.GetOptions{})
+			g.Expect(err).ToNot(HaveOccurred())
+			if tc.expectedLabel {
+				g.Expect(updated.Labels).To(HaveKeyWithValue(util.NonNovaNodeLabel, "true"))
+			} else {
+				g.Expect(updated.Labels).ToNot(HaveKey(util.NonNovaNodeLabel))
+			}
+
+			var events []string
+			for _, event := range recorder.Events() {
+				events = append(events, event.Reason)
+			}
+			g.Expect(events).To(Equal(tc.expectedEvents))
+		})
+	}
+}
+
+func TestNodeSelectionSyncUninitializedNode(t *testing.T) {
+	g := NewWithT(t)
+
+	cloud := fake.New()
+	defer cloud.Close()
+	node := &corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "edge-1"}}
+
+	c, kubeClient, recorder := newTestNodeSelectionController(g, cloud, node)
+	now := time.Now()
+	c.now = func() time.Time { return now }
+	sync := func() error {
+		return c.sync(context.TODO(), factory.NewSyncContext("CinderNodeSelection", recorder))
+	}
+	expectLabelled := func(labelled bool) {
+		updated, err := kubeClient.CoreV1().Nodes().Get(context.TODO(), "edge-1", metav1.GetOptions{})
+		g.Expect(err).ToNot(HaveOccurred())
+		if labelled {
+			g.Expect(updated.Labels).To(HaveKeyWithValue(util.NonNovaNodeLabel, "true"))
+		} else {
+			g.Expect(updated.Labels).ToNot(HaveKey(util.NonNovaNodeLabel))
+		}
+	}
+	lookups := func() int {
+		return cloud.Requests("compute", http.MethodGet, "/servers/detail")
+	}
+
+	// the node isn't labelled if the compute API can't be queried
+	cloud.Fail("compute", http.MethodGet, "/servers/detail", http.StatusInternalServerError)
+	g.Expect(sync()).ToNot(Succeed())
+	expectLabelled(false)
+
+	// nor the first time no server has the name of the node
+	cloud.Fail("compute", http.MethodGet, "/servers/detail", 0)
+	g.Expect(sync()).To(Succeed())
+	expectLabelled(false)
+	g.Expect(lookups()).To(Equal(2))
+
+	// the node isn't looked up on every sync
+	now = now.Add(time.Second)
+	g.Expect(sync()).To(Succeed())
+	g.Expect(lookups()).To(Equal(2))
+
+	// finding the server starts the grace period again
+	cloud.Servers = []fake.Server{{ID: "server-1", Name: "edge-1"}}
+	now = now.Add(nameLookupInterval)
+	g.Expect(sync()).To(Succeed())
+	cloud.Servers = nil
+	now = now.Add(nameLookupInterval)
+	g.Expect(sync()).To(Succeed())
+	now = now.Add(nonNovaGracePeriod - nameLookupInterval)
+	g.Expect(sync()).To(Succeed())
+	expectLabelled(false)
+
+	// the node is labelled once no server has been found for the grace
+	// period
+	now = now.Add(nameLookupInterval)
+	g.Expect(sync()).To(Succeed())
+	expectLabelled(true)
+	g.Expect(lookups()).To(Equal(6))
+}
+
+func newTestNodeSelectionController(g *WithT, cloud *fake.Cloud, nodes ...*corev1.Node) (*NodeSelectionController, *fakekube.Clientset, events.InMemoryRecorder) {
+	nodeIndexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	var objects []runtime.Object
+	for _, node := range nodes {
+		g.Expect(nodeIndexer.Add(node)).To(Succeed())
+		objects = append(objects, node)
+	}
+	kubeClient := fakekube.NewSimpleClientset(objects...)
+
+	operatorClient := v1helpers.NewFakeOperatorClient(
+		&operatorv1.OperatorSpec{ManagementState: operatorv1.Managed},
+		&operatorv1.OperatorStatus{},
+		nil,
+	)
+	recorder := events.NewInMemoryRecorder("test")
+
+	c := &NodeSelectionController{
+		operatorClient: operatorClient,
+		kubeClient:     kubeClient,
+		nodeLister:     corelisters.NewNodeLister(nodeIndexer),
+		provider:       cloudinfo.NewProvider(cloud.ClientOpts(), nil),
+		eventRecorder:  recorder,
+		lookups:        map[string]*nameLookup{},
+		now:            time.Now,
+	}
+
+	return c, kubeClient, recorder
+}
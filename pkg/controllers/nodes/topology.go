@@ -0,0 +1,266 @@
+package nodes
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	operatorv1 "github.com/openshift/api/operator/v1"
+	configinformers "github.com/openshift/client-go/config/informers/externalversions"
+	configv1listers "github.com/openshift/client-go/config/listers/config/v1"
+	"github.com/openshift/library-go/pkg/controller/factory"
+	"github.com/openshift/library-go/pkg/operator/events"
+	"github.com/openshift/library-go/pkg/operator/v1helpers"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/klog/v2"
+
+	"github.com/openshift/openstack-cinder-csi-driver-operator/pkg/cloudinfo"
+	"github.com/openshift/openstack-cinder-csi-driver-operator/pkg/controllers/config"
+	"github.com/openshift/openstack-cinder-csi-driver-operator/pkg/util"
+)
+
+const (
+	// topologyConditionType is set to True when the topology labels of any
+	// node don't match the availability zone of its Nova server. It is
+	// informational only, as the driver keeps working, but volumes may be
+	// provisioned in the wrong availability zone.
+	topologyConditionType = "CinderNodeTopologyWarning"
+
+	// csiZoneLabel is set on nodes by the kubelet from the topology the
+	// driver reports, which is the availability zone in the instance
+	// metadata
+	csiZoneLabel = "topology.cinder.csi.openstack.org/zone"
+
+	// serverZoneTTL is how long the availability zone of a server is cached.
+	// It only changes if the server is migrated to another zone.
+	serverZoneTTL = time.Hour
+
+	// maxReportedNodes limits the number of nodes listed in the condition
+	maxReportedNodes = 10
+
+	topologyResyncInterval = 10 * time.Minute
+)
+
+// serverZone is the cached availability zone of a Nova server
+type serverZone struct {
+	zone      string
+	fetchedAt time.Time
+}
+
+// This TopologyVerificationController compares the topology labels of each
+// node with the availability zone of its Nova server, when topology support
+// is enabled. The driver takes the zone of the node from the instance
+// metadata, so a wrong metadata service or a node which was relabelled by
+// hand leads to volumes being provisioned in an availability zone the node
+// can't attach them from.
+type TopologyVerificationController struct {
+	operatorClient       v1helpers.OperatorClient
+	nodeLister           corelisters.NodeLister
+	configMapLister      corelisters.ConfigMapLister
+	targetConfigLister   corelisters.ConfigMapLister
+	infrastructureLister configv1listers.InfrastructureLister
+	cloudInfo            *cloudinfo.Cache
+	provider             cloudinfo.Provider
+	eventRecorder        events.Recorder
+
+	zones map[string]serverZone
+	// reported is the problem last reported for each node, so that each is
+	// only reported once
+	reported map[string]string
+	now      func() time.Time
+}
+
+func NewTopologyVerificationController(
+	operatorClient v1helpers.OperatorClient,
+	informers v1helpers.KubeInformersForNamespaces,
+	configInformers configinformers.SharedInformerFactory,
+	cloudInfo *cloudinfo.Cache,
+	provider cloudinfo.Provider,
+	eventRecorder events.Recorder) factory.Controller {
+
+	configMapInformer := informers.InformersFor(util.OpenShiftConfigNamespace)
+	targetConfigInformer := informers.InformersFor(util.DefaultNamespace)
+	nodeInformer := informers.InformersFor("").Core().V1().Nodes()
+	c := &TopologyVerificationController{
+		operatorClient:       operatorClient,
+		nodeLister:           nodeInformer.Lister(),
+		configMapLister:      configMapInformer.Core().V1().ConfigMaps().Lister(),
+		targetConfigLister:   targetConfigInformer.Core().V1().ConfigMaps().Lister(),
+		infrastructureLister: configInformers.Config().V1().Infrastructures().Lister(),
+		cloudInfo:            cloudInfo,
+		provider:             provider,
+		eventRecorder:        eventRecorder.WithComponentSuffix("CinderNodeTopology"),
+		zones:                map[string]serverZone{},
+		reported:             map[string]string{},
+		now:                  time.Now,
+	}
+	return factory.New().WithSync(c.sync).ResyncEvery(topologyResyncInterval).WithInformers(
+		operatorClient.Informer(),
+		configMapInformer.Core().V1().ConfigMaps().Informer(),
+		targetConfigInformer.Core().V1().ConfigMaps().Informer(),
+		nodeInformer.Informer(),
+	).ToController("CinderNodeTopology", eventRecorder)
+}
+
+func (c *TopologyVerificationController) sync(ctx context.Context, syncCtx factory.SyncContext) error {
+	opSpec, opStatus, _, err := c.operatorClient.GetOperatorState()
+	if err != nil {
+		return err
+	}
+	if opSpec.ManagementState != operatorv1.Managed {
+		return nil
+	}
+
+	state, err := config.GetTopologyState(c.configMapLister, c.targetConfigLister, c.infrastructureLister, c.cloudInfo)
+	if err != nil {
+		return err
+	}
+	if state == nil {
+		return nil
+	}
+
+	condition := operatorv1.OperatorCondition{
+		Type:   topologyConditionType,
+		Status: operatorv1.ConditionFalse,
+		Reason: "AsExpected",
+	}
+	if !state.TopologyEnabled {
+		condition.Reason = "TopologyDisabled"
+		condition.Message = "Topology support is disabled, so node topology labels are not used"
+		c.reported = map[string]string{}
+		_, _, err := v1helpers.UpdateStatus(ctx, c.operatorClient, v1helpers.UpdateConditionFn(condition))
+		return err
+	}
+
+	nodes, err := c.nodeLister.List(labels.Everything())
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	var mismatched, unlabelled []string
+	servers := map[string]bool{}
+	reported := map[string]string{}
+	for _, node := range nodes {
+		serverID := util.ServerIDFromProviderID(node.Spec.ProviderID)
+		if serverID == "" || node.Labels[util.DisableNodePluginLabel] == "true" {
+			continue
+		}
+		servers[serverID] = true
+
+		zone, err := c.getServerZone(ctx, serverID)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		problem := nodeTopologyProblem(node, zone)
+		if problem == "" {
+			continue
+		}
+		if _, ok := node.Labels[csiZoneLabel]; ok {
+			mismatched = append(mismatched, node.Name)
+		} else {
+			unlabelled = append(unlabelled, node.Name)
+		}
+
+		reported[node.Name] = problem
+		if c.reported[node.Name] != problem {
+			klog.Warningf("Node %s: %s", node.Name, problem)
+			c.eventRecorder.Warningf("NodeTopologyMismatch", "Node %s: %s", node.Name, problem)
+		}
+	}
+	c.reported = reported
+
+	// forget servers which are no longer nodes
+	for serverID := range c.zones {
+		if !servers[serverID] {
+			delete(c.zones, serverID)
+		}
+	}
+
+	if len(mismatched) > 0 || len(unlabelled) > 0 {
+		condition.Status = operatorv1.ConditionTrue
+		condition.Reason = "NodesUnlabelled"
+		if len(mismatched) > 0 {
+			condition.Reason = "NodeTopologyMismatch"
+		}
+		condition.Message = topologyMessage(mismatched, unlabelled)
+	} else if len(errs) > 0 {
+		// keep reporting the last known state until the zones can be fetched
+		if previous := v1helpers.FindOperatorCondition(opStatus.Conditions, topologyConditionType); previous != nil {
+			condition = *previous
+		}
+	} else if v1helpers.IsOperatorConditionTrue(opStatus.Conditions, topologyConditionType) {
+		c.eventRecorder.Event("NodeTopologyMatches", "The topology labels of all nodes match the availability zones of their servers")
+	}
+
+	if _, _, err := v1helpers.UpdateStatus(ctx, c.operatorClient, v1helpers.UpdateConditionFn(condition)); err != nil {
+		errs = append(errs, err)
+	}
+	return utilerrors.NewAggregate(errs)
+}
+
+// getServerZone returns the availability zone of the server, which is
+// cached for serverZoneTTL
+func (c *TopologyVerificationController) getServerZone(ctx context.Context, serverID string) (string, error) {
+	if cached, ok := c.zones[serverID]; ok && c.now().Sub(cached.fetchedAt) < serverZoneTTL {
+		return cached.zone, nil
+	}
+
+	zone, err := c.provider.GetServerZone(ctx, serverID)
+	if err != nil {
+		return "", err
+	}
+	c.zones[serverID] = serverZone{zone: zone, fetchedAt: c.now()}
+	return zone, nil
+}
+
+// nodeTopologyProblem describes how the topology labels of the node differ
+// from the availability zone of its server, or returns an empty string if
+// they match
+func nodeTopologyProblem(node *corev1.Node, zone string) string {
+	var problems []string
+	for _, label := range []string{csiZoneLabel, corev1.LabelTopologyZone} {
+		value, ok := node.Labels[label]
+		switch {
+		case !ok:
+			problems = append(problems, fmt.Sprintf("label %s is not set", label))
+		case value != zone:
+			problems = append(problems, fmt.Sprintf("label %s is %q", label, value))
+		}
+	}
+	if len(problems) == 0 {
+		return ""
+	}
+	return fmt.Sprintf("%s, but its server is in availability zone %q", strings.Join(problems, " and "), zone)
+}
+
+// topologyMessage lists the nodes whose labels don't match the availability
+// zone of their server
+func topologyMessage(mismatched, unlabelled []string) string {
+	var parts []string
+	for _, nodes := range []struct {
+		names       []string
+		description string
+	}{
+		{mismatched, "have topology labels which don't match the availability zone of their server, so volumes may be provisioned in the wrong availability zone"},
+		{unlabelled, "are missing topology labels"},
+	} {
+		if len(nodes.names) == 0 {
+			continue
+		}
+		sort.Strings(nodes.names)
+		names := nodes.names
+		if len(names) > maxReportedNodes {
+			names = append(names[:maxReportedNodes:maxReportedNodes], fmt.Sprintf("and %d more", len(nodes.names)-maxReportedNodes))
+		}
+		parts = append(parts, fmt.Sprintf("Nodes %s %s", strings.Join(names, ", "), nodes.description))
+	}
+	return strings.Join(parts, "; ")
+}
@@ -0,0 +1,233 @@
+package nodes
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	. "github.com/onsi/gomega"
+	configv1 "github.com/openshift/api/config/v1"
+	operatorv1 "github.com/openshift/api/operator/v1"
+	configv1listers "github.com/openshift/client-go/config/listers/config/v1"
+	"github.com/openshift/library-go/pkg/controller/factory"
+	"github.com/openshift/library-go/pkg/operator/events"
+	"github.com/openshift/library-go/pkg/operator/v1helpers"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+
+	"github.com/openshift/openstack-cinder-csi-driver-operator/pkg/cloudinfo"
+	"github.com/openshift/openstack-cinder-csi-driver-operator/pkg/cloudinfo/fake"
+	"github.com/openshift/openstack-cinder-csi-driver-operator/pkg/util"
+)
+
+func TestTopologyVerificationSync(t *testing.T) {
+	tc := []struct {
+		name            string
+		topology        string
+		labels          map[string]string
+		providerID      string
+		expectedStatus  operatorv1.ConditionStatus
+		expectedReason  string
+		expectedMessage string
+		expectedEvents  []string
+	}{
+		{
+			name:           "Labels match",
+			labels:         map[string]string{csiZoneLabel: "az1", corev1.LabelTopologyZone: "az1"},
+			expectedStatus: operatorv1.ConditionFalse,
+			expectedReason: "AsExpected",
+		}, {
+			name:            "CSI label mismatch",
+			labels:          map[string]string{csiZoneLabel: "az2", corev1.LabelTopologyZone: "az1"},
+			expectedStatus:  operatorv1.ConditionTrue,
+			expectedReason:  "NodeTopologyMismatch",
+			expectedMessage: "Nodes node-1 have topology labels which don't match",
+			expectedEvents:  []string{"NodeTopologyMismatch"},
+		}, {
+			name:            "Labels missing",
+			expectedStatus:  operatorv1.ConditionTrue,
+			expectedReason:  "NodesUnlabelled",
+			expectedMessage: "Nodes node-1 are missing topology labels",
+			expectedEvents:  []string{"NodeTopologyMismatch"},
+		}, {
+			name:           "Topology disabled",
+			topology:       "false",
+			expectedStatus: operatorv1.ConditionFalse,
+			expectedReason: "TopologyDisabled",
+		}, {
+			name:           "Not a Nova server",
+			providerID:     "baremetalhost:///openshift-machine-api/worker-0/d2a8e3e6",
+			expectedStatus: operatorv1.ConditionFalse,
+			expectedReason: "AsExpected",
+		}, {
+			name:           "Opted out",
+			labels:         map[string]string{util.DisableNodePluginLabel: "true"},
+			expectedStatus: operatorv1.ConditionFalse,
+			expectedReason: "AsExpected",
+		},
+	}
+
+	for _, tc := range tc {
+		t.Run(tc.name, func(t *testing.T) {
+			g := NewWithT(t)
+			ctx := context.TODO()
+
+			cloud := fake.New()
+			defer cloud.Close()
+			cloud.Servers = []fake.Server{{ID: "server-1", Name: "node-1", Zone: "az1"}}
+
+			topology := tc.topology
+			if topology == "" {
+				topology = "true"
+			}
+			providerID := tc.providerID
+			if providerID == "" {
+				providerID = "openstack:///server-1"
+			}
+			node := &corev1.Node{
+				ObjectMeta: metav1.ObjectMeta{Name: "node-1", Labels: tc.labels},
+				Spec:       corev1.NodeSpec{ProviderID: providerID},
+			}
+			c, operatorClient, recorder := newTestTopologyVerificationController(g, cloud, topology, node)
+
+			g.Expect(c.sync(ctx, factory.NewSyncContext("CinderNodeTopology", recorder))).To(Succeed())
+
+			_, status, _, err := operatorClient.GetOperatorState()
+			g.Expect(err).ToNot(HaveOccurred())
+			condition := v1helpers.FindOperatorCondition(status.Conditions, topologyConditionType)
+			g.Expect(condition).ToNot(BeNil())
+			g.Expect(condition.Status).To(Equal(tc.expectedStatus))
+			g.Expect(condition.Reason).To(Equal(tc.expectedReason), condition.Message)
+			g.Expect(condition.Message).To(ContainSubstring(tc.expectedMessage))
+
+			var reasons []string
+			for _, event := range recorder.Events() {
+				reasons = append(reasons, event.Reason)
+			}
+			g.Expect(reasons).To(Equal(tc.expectedEvents))
+		})
+	}
+}
+
+func TestTopologyVerificationSyncRepeated(t *testing.T) {
+	g := NewWithT(t)
+	ctx := context.TODO()
+
+	cloud := fake.New()
+	defer cloud.Close()
+	cloud.Servers = []fake.Server{{ID: "server-1", Name: "node-1", Zone: "az1"}}
+
+	node := &corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   "node-1",
+			Labels: map[string]string{csiZoneLabel: "az2", corev1.LabelTopologyZone: "az2"},
+		},
+		Spec: corev1.NodeSpec{ProviderID: "openstack:///server-1"},
+	}
+	c, operatorClient, recorder := newTestTopologyVerificationController(g, cloud, "true", node)
+	now := time.Now()
+	c.now = func() time.Time { return now }
+	syncCtx := factory.NewSyncContext("CinderNodeTopology", recorder)
+
+	// the mismatch is only reported once
+	g.Expect(c.sync(ctx, syncCtx)).To(Succeed())
+	g.Expect(c.sync(ctx, syncCtx)).To(Succeed())
+	g.Expect(recorder.Events()).To(HaveLen(1))
+	g.Expect(cloud.Requests("compute", http.MethodGet, "/servers/server-1")).To(Equal(1))
+
+	// the last known state is kept while the zone can't be fetched
+	now = now.Add(serverZoneTTL)
+	cloud.Fail("compute", http.MethodGet, "/servers/server-1", http.StatusInternalServerError)
+	g.Expect(c.sync(ctx, syncCtx)).ToNot(Succeed())
+	_, status, _, err := operatorClient.GetOperatorState()
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(v1helpers.IsOperatorConditionTrue(status.Conditions, topologyConditionType)).To(BeTrue())
+
+	// the server has been migrated to the zone the node is labelled with
+	cloud.Fail("compute", http.MethodGet, "/servers/server-1", 0)
+	cloud.Servers[0].Zone = "az2"
+	g.Expect(c.sync(ctx, syncCtx)).To(Succeed())
+	_, status, _, err = operatorClient.GetOperatorState()
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(v1helpers.IsOperatorConditionFalse(status.Conditions, topologyConditionType)).To(BeTrue())
+
+	var reasons []string
+	for _, event := range recorder.Events() {
+		reasons = append(reasons, event.Reason)
+	}
+	g.Expect(reasons).To(Equal([]string{"NodeTopologyMismatch", "NodeTopologyMatches"}))
+}
+
+func TestTopologyMessage(t *testing.T) {
+	g := NewWithT(t)
+
+	var nodes []string
+	for _, name := range []string{"l", "k", "j", "i", "h", "g", "f", "e", "d", "c", "b", "a"} {
+		nodes = append(nodes, "node-"+name)
+	}
+	g.Expect(topologyMessage(nodes, []string{"node-z"})).To(Equal(
+		"Nodes node-a, node-b, node-c, node-d, node-e, node-f, node-g, node-h, node-i, node-j, and 2 more " +
+			"have topology labels which don't match the availability zone of their server, so volumes may be provisioned in the wrong availability zone; " +
+			"Nodes node-z are missing topology labels"))
+}
+
+func newTestTopologyVerificationController(g *WithT, cloud *fake.Cloud, topology string, nodes ...*corev1.Node) (*TopologyVerificationController, v1helpers.OperatorClient, events.InMemoryRecorder) {
+	cloud.ComputeZones = fake.Zones("az1", "az2")
+	cloud.VolumeZones = fake.Zones("az1", "az2")
+	provider := cloudinfo.NewProvider(cloud.ClientOpts(), nil)
+	cloudInfo := cloudinfo.NewCache(provider)
+	_, _, err := cloudInfo.Refresh(context.TODO(), time.Hour)
+	g.Expect(err).ToNot(HaveOccurred())
+
+	nodeIndexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	for _, node := range nodes {
+		g.Expect(nodeIndexer.Add(node)).To(Succeed())
+	}
+
+	configMapIndexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+	for _, cm := range []*corev1.ConfigMap{
+		{
+			ObjectMeta: metav1.ObjectMeta{Name: "cloud-provider-config", Namespace: util.OpenShiftConfigNamespace},
+			Data:       map[string]string{"config": "[Global]\n"},
+		}, {
+			ObjectMeta: metav1.ObjectMeta{Name: util.CinderConfigName, Namespace: util.DefaultNamespace},
+			Data:       map[string]string{"enable_topology": topology},
+		},
+	} {
+		g.Expect(configMapIndexer.Add(cm)).To(Succeed())
+	}
+
+	infraIndexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	g.Expect(infraIndexer.Add(&configv1.Infrastructure{
+		ObjectMeta: metav1.ObjectMeta{Name: "cluster"},
+		Spec: configv1.InfrastructureSpec{
+			CloudConfig: configv1.ConfigMapFileReference{Name: "cloud-provider-config"},
+		},
+	})).To(Succeed())
+
+	operatorClient := v1helpers.NewFakeOperatorClient(
+		&operatorv1.OperatorSpec{ManagementState: operatorv1.Managed},
+		&operatorv1.OperatorStatus{},
+		nil,
+	)
+	recorder := events.NewInMemoryRecorder("test")
+
+	c := &TopologyVerificationController{
+		operatorClient:       operatorClient,
+		nodeLister:           corelisters.NewNodeLister(nodeIndexer),
+		configMapLister:      corelisters.NewConfigMapLister(configMapIndexer),
+		targetConfigLister:   corelisters.NewConfigMapLister(configMapIndexer),
+		infrastructureLister: configv1listers.NewInfrastructureLister(infraIndexer),
+		cloudInfo:            cloudInfo,
+		provider:             provider,
+		eventRecorder:        recorder,
+		zones:                map[string]serverZone{},
+		reported:             map[string]string{},
+		now:                  time.Now,
+	}
+
+	return c, operatorClient, recorder
+}
@@ -0,0 +1,154 @@
+package permissions
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	operatorv1 "github.com/openshift/api/operator/v1"
+	"github.com/openshift/library-go/pkg/controller/factory"
+	"github.com/openshift/library-go/pkg/operator/events"
+	"github.com/openshift/library-go/pkg/operator/v1helpers"
+	"k8s.io/klog/v2"
+
+	"github.com/openshift/openstack-cinder-csi-driver-operator/pkg/cloudinfo"
+	"github.com/openshift/openstack-cinder-csi-driver-operator/pkg/util"
+)
+
+const (
+	// permissionConditionPrefix is followed by the name of each permission
+	// to form the capability matrix, e.g. OpenStackPermissionListVolumes.
+	// These are True if the permission is granted.
+	permissionConditionPrefix = "OpenStackPermission"
+
+	// degradedConditionType is set to True when a permission needed for the
+	// basic operation of the driver is missing
+	degradedConditionType = "OpenStackPermissionsDegraded"
+
+	// upgradeableConditionType is set to False when a permission only needed
+	// by optional features is missing, so that it is noticed before somebody
+	// tries to use them
+	upgradeableConditionType = "OpenStackPermissionsUpgradeable"
+
+	resyncInterval = 30 * time.Minute
+)
+
+// This PermissionsController checks that the OpenStack credentials have the
+// permissions the driver needs, so that a missing permission is found before
+// a PVC fails because of it. The result of each check is reported as a
+// condition.
+type PermissionsController struct {
+	operatorClient v1helpers.OperatorClient
+	provider       cloudinfo.Provider
+	eventRecorder  events.Recorder
+}
+
+func NewPermissionsController(
+	operatorClient v1helpers.OperatorClient,
+	informers v1helpers.KubeInformersForNamespaces,
+	provider cloudinfo.Provider,
+	eventRecorder events.Recorder) factory.Controller {
+
+	c := &PermissionsController{
+		operatorClient: operatorClient,
+		provider:       provider,
+		eventRecorder:  eventRecorder.WithComponentSuffix("OpenStackPermissions"),
+	}
+	return factory.New().WithSync(c.sync).ResyncEvery(resyncInterval).WithInformers(
+		operatorClient.Informer(),
+		informers.InformersFor(util.DefaultNamespace).Core().V1().Secrets().Informer(),
+	).ToController("OpenStackPermissions", eventRecorder)
+}
+
+func (c *PermissionsController) sync(ctx context.Context, syncCtx factory.SyncContext) error {
+	opSpec, opStatus, _, err := c.operatorClient.GetOperatorState()
+	if err != nil {
+		return err
+	}
+	if opSpec.ManagementState != operatorv1.Managed {
+		return nil
+	}
+
+	checks, err := c.provider.CheckPermissions(ctx)
+	if err != nil {
+		// this is reported by the CredentialsController
+		klog.V(2).Infof("Skipping the OpenStack permission checks: %v", err)
+		return nil
+	}
+
+	var updateFuncs []v1helpers.UpdateStatusFunc
+	var missingRequired, missingOptional []cloudinfo.PermissionCheck
+	for _, check := range checks {
+		condition := operatorv1.OperatorCondition{
+			Type:    permissionConditionPrefix + check.Name,
+			Status:  operatorv1.ConditionTrue,
+			Reason:  string(check.Status),
+			Message: fmt.Sprintf("Needed to %s", check.NeededFor),
+		}
+		switch check.Status {
+		case cloudinfo.PermissionDenied:
+			condition.Status = operatorv1.ConditionFalse
+			if check.Required {
+				missingRequired = append(missingRequired, check)
+			} else {
+				missingOptional = append(missingOptional, check)
+			}
+		case cloudinfo.PermissionUnknown:
+			condition.Status = operatorv1.ConditionUnknown
+			condition.Message = fmt.Sprintf("Failed to check the permission: %s", check.Message)
+		}
+		updateFuncs = append(updateFuncs, v1helpers.UpdateConditionFn(condition))
+	}
+
+	degraded := operatorv1.OperatorCondition{
+		Type:   degradedConditionType,
+		Status: operatorv1.ConditionFalse,
+		Reason: "AsExpected",
+	}
+	if len(missingRequired) > 0 {
+		degraded.Status = operatorv1.ConditionTrue
+		degraded.Reason = missingPermissionsReason(missingRequired)
+		degraded.Message = missingPermissionsMessage(missingRequired)
+	}
+
+	upgradeable := operatorv1.OperatorCondition{
+		Type:   upgradeableConditionType,
+		Status: operatorv1.ConditionTrue,
+		Reason: "AsExpected",
+	}
+	if len(missingOptional) > 0 {
+		upgradeable.Status = operatorv1.ConditionFalse
+		upgradeable.Reason = missingPermissionsReason(missingOptional)
+		upgradeable.Message = missingPermissionsMessage(missingOptional)
+	}
+
+	for _, condition := range []operatorv1.OperatorCondition{degraded, upgradeable} {
+		previous := v1helpers.FindOperatorCondition(opStatus.Conditions, condition.Type)
+		if condition.Reason != "AsExpected" && (previous == nil || previous.Reason != condition.Reason) {
+			klog.Warning(condition.Message)
+			c.eventRecorder.Warning(condition.Reason, condition.Message)
+		}
+		updateFuncs = append(updateFuncs, v1helpers.UpdateConditionFn(condition))
+	}
+
+	_, _, err = v1helpers.UpdateStatus(ctx, c.operatorClient, updateFuncs...)
+	return err
+}
+
+// missingPermissionsReason names the missing permission, e.g.
+// MissingListVolumesPermission, if only one is missing
+func missingPermissionsReason(missing []cloudinfo.PermissionCheck) string {
+	if len(missing) == 1 {
+		return fmt.Sprintf("Missing%sPermission", missing[0].Name)
+	}
+	return "MissingPermissions"
+}
+
+func missingPermissionsMessage(missing []cloudinfo.PermissionCheck) string {
+	var descriptions []string
+	for _, check := range missing {
+		descriptions = append(descriptions, fmt.Sprintf("%s (%s API, needed to %s)", check.Name, check.Service, check.NeededFor))
+	}
+	return fmt.Sprintf("The OpenStack credentials are not permitted to: %s", strings.Join(descriptions, ", "))
+}
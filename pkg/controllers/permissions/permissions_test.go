@@ -0,0 +1,183 @@
+package permissions
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	. "github.com/onsi/gomega"
+	operatorv1 "github.com/openshift/api/operator/v1"
+	"github.com/openshift/library-go/pkg/controller/factory"
+	"github.com/openshift/library-go/pkg/operator/events"
+	"github.com/openshift/library-go/pkg/operator/v1helpers"
+
+	"github.com/openshift/openstack-cinder-csi-driver-operator/pkg/cloudinfo"
+	"github.com/openshift/openstack-cinder-csi-driver-operator/pkg/cloudinfo/fake"
+)
+
+func TestSync(t *testing.T) {
+	type failure struct {
+		service, path string
+		status        int
+	}
+
+	tc := []struct {
+		name                string
+		failures            []failure
+		noServers           bool
+		expectedPermissions map[string]operatorv1.ConditionStatus
+		expectedDegraded    operatorv1.ConditionStatus
+		expectedUpgradeable operatorv1.ConditionStatus
+		expectedReason      string
+		expectedWarnings    []string
+	}{
+		{
+			name: "All permissions granted",
+			expectedPermissions: map[string]operatorv1.ConditionStatus{
+				"ListVolumes":                 operatorv1.ConditionTrue,
+				"ListSnapshots":               operatorv1.ConditionTrue,
+				"ListServerVolumeAttachments": operatorv1.ConditionTrue,
+				"ListVolumeAttachments":       operatorv1.ConditionTrue,
+				"ListBackups":                 operatorv1.ConditionTrue,
+			},
+			expectedDegraded:    operatorv1.ConditionFalse,
+			expectedUpgradeable: operatorv1.ConditionTrue,
+		}, {
+			name: "Required permission missing",
+			failures: []failure{
+				{"volume", "/volumes/detail", http.StatusForbidden},
+			},
+			expectedPermissions: map[string]operatorv1.ConditionStatus{
+				"ListVolumes":   operatorv1.ConditionFalse,
+				"ListSnapshots": operatorv1.ConditionTrue,
+			},
+			expectedDegraded:    operatorv1.ConditionTrue,
+			expectedUpgradeable: operatorv1.ConditionTrue,
+			expectedReason:      "MissingListVolumesPermission",
+			expectedWarnings:    []string{"MissingListVolumesPermission"},
+		}, {
+			name: "Several required permissions missing",
+			failures: []failure{
+				{"volume", "/snapshots", http.StatusForbidden},
+				{"compute", "/servers/fake-server-id/os-volume_attachments", http.StatusForbidden},
+			},
+			expectedPermissions: map[string]operatorv1.ConditionStatus{
+				"ListSnapshots":               operatorv1.ConditionFalse,
+				"ListServerVolumeAttachments": operatorv1.ConditionFalse,
+			},
+			expectedDegraded:    operatorv1.ConditionTrue,
+			expectedUpgradeable: operatorv1.ConditionTrue,
+			expectedReason:      "MissingPermissions",
+			expectedWarnings:    []string{"MissingPermissions"},
+		}, {
+			name: "Optional permission missing",
+			failures: []failure{
+				{"volume", "/backups", http.StatusForbidden},
+			},
+			expectedPermissions: map[string]operatorv1.ConditionStatus{
+				"ListBackups": operatorv1.ConditionFalse,
+			},
+			expectedDegraded:    operatorv1.ConditionFalse,
+			expectedUpgradeable: operatorv1.ConditionFalse,
+			expectedReason:      "MissingListBackupsPermission",
+			expectedWarnings:    []string{"MissingListBackupsPermission"},
+		}, {
+			name: "Attachments API not supported",
+			failures: []failure{
+				{"volume", "/attachments/detail", http.StatusNotFound},
+			},
+			expectedPermissions: map[string]operatorv1.ConditionStatus{
+				"ListVolumeAttachments": operatorv1.ConditionUnknown,
+			},
+			expectedDegraded:    operatorv1.ConditionFalse,
+			expectedUpgradeable: operatorv1.ConditionTrue,
+		}, {
+			name:      "No servers",
+			noServers: true,
+			expectedPermissions: map[string]operatorv1.ConditionStatus{
+				"ListServerVolumeAttachments": operatorv1.ConditionUnknown,
+			},
+			expectedDegraded:    operatorv1.ConditionFalse,
+			expectedUpgradeable: operatorv1.ConditionTrue,
+		},
+	}
+
+	for _, tc := range tc {
+		t.Run(tc.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			cloud := fake.New()
+			defer cloud.Close()
+			for _, f := range tc.failures {
+				cloud.Fail(f.service, http.MethodGet, f.path, f.status)
+			}
+			if tc.noServers {
+				cloud.Servers = nil
+			}
+
+			c, operatorClient, recorder := newTestPermissionsController(operatorv1.Managed, cloudinfo.NewProvider(cloud.ClientOpts(), nil))
+			syncCtx := factory.NewSyncContext("OpenStackPermissions", recorder)
+
+			g.Expect(c.sync(context.TODO(), syncCtx)).To(Succeed())
+			// warnings are only emitted when the reason changes
+			g.Expect(c.sync(context.TODO(), syncCtx)).To(Succeed())
+
+			_, status, _, err := operatorClient.GetOperatorState()
+			g.Expect(err).ToNot(HaveOccurred())
+
+			g.Expect(status.Conditions).To(HaveLen(len(cloudinfo.Permissions) + 2))
+			for name, expectedStatus := range tc.expectedPermissions {
+				condition := v1helpers.FindOperatorCondition(status.Conditions, permissionConditionPrefix+name)
+				g.Expect(condition).ToNot(BeNil(), name)
+				g.Expect(condition.Status).To(Equal(expectedStatus), name)
+			}
+
+			degraded := v1helpers.FindOperatorCondition(status.Conditions, degradedConditionType)
+			g.Expect(degraded.Status).To(Equal(tc.expectedDegraded))
+			upgradeable := v1helpers.FindOperatorCondition(status.Conditions, upgradeableConditionType)
+			g.Expect(upgradeable.Status).To(Equal(tc.expectedUpgradeable))
+			if tc.expectedReason != "" {
+				g.Expect([]string{degraded.Reason, upgradeable.Reason}).To(ContainElement(tc.expectedReason))
+			}
+
+			var warnings []string
+			for _, event := range recorder.Events() {
+				warnings = append(warnings, event.Reason)
+			}
+			g.Expect(warnings).To(Equal(tc.expectedWarnings))
+		})
+	}
+}
+
+func TestSyncUnmanaged(t *testing.T) {
+	g := NewWithT(t)
+
+	cloud := fake.New()
+	defer cloud.Close()
+
+	c, operatorClient, recorder := newTestPermissionsController(operatorv1.Unmanaged, cloudinfo.NewProvider(cloud.ClientOpts(), nil))
+
+	g.Expect(c.sync(context.TODO(), factory.NewSyncContext("OpenStackPermissions", recorder))).To(Succeed())
+	g.Expect(cloud.Requests("volume", http.MethodGet, "/volumes/detail")).To(BeZero())
+
+	_, status, _, err := operatorClient.GetOperatorState()
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(status.Conditions).To(BeEmpty())
+}
+
+func newTestPermissionsController(managementState operatorv1.ManagementState, provider cloudinfo.Provider) (*PermissionsController, v1helpers.OperatorClient, events.InMemoryRecorder) {
+	operatorClient := v1helpers.NewFakeOperatorClient(
+		&operatorv1.OperatorSpec{ManagementState: managementState},
+		&operatorv1.OperatorStatus{},
+		nil,
+	)
+	recorder := events.NewInMemoryRecorder("test")
+
+	c := &PermissionsController{
+		operatorClient: operatorClient,
+		provider:       provider,
+		eventRecorder:  recorder,
+	}
+
+	return c, operatorClient, recorder
+}
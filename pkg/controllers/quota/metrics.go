@@ -0,0 +1,29 @@
+package quota
+
+import (
+	"k8s.io/component-base/metrics"
+	"k8s.io/component-base/metrics/legacyregistry"
+)
+
+var (
+	quotaUsed = metrics.NewGaugeVec(
+		&metrics.GaugeOpts{
+			Name:           "openshift_openstack_cinder_csi_driver_operator_quota_used",
+			Help:           "Amount of the OpenStack project's Cinder quota that is in use or reserved, labeled by quota resource.",
+			StabilityLevel: metrics.ALPHA,
+		},
+		[]string{"resource"},
+	)
+	quotaLimit = metrics.NewGaugeVec(
+		&metrics.GaugeOpts{
+			Name:           "openshift_openstack_cinder_csi_driver_operator_quota_limit",
+			Help:           "Limit of the OpenStack project's Cinder quota, labeled by quota resource. A value of -1 means unlimited.",
+			StabilityLevel: metrics.ALPHA,
+		},
+		[]string{"resource"},
+	)
+)
+
+func init() {
+	legacyregistry.MustRegister(quotaUsed, quotaLimit)
+}
@@ -0,0 +1,151 @@
+package quota
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	operatorv1 "github.com/openshift/api/operator/v1"
+	configinformers "github.com/openshift/client-go/config/informers/externalversions"
+	configv1listers "github.com/openshift/client-go/config/listers/config/v1"
+	"github.com/openshift/library-go/pkg/controller/factory"
+	"github.com/openshift/library-go/pkg/operator/events"
+	"github.com/openshift/library-go/pkg/operator/v1helpers"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/klog/v2"
+
+	"github.com/openshift/openstack-cinder-csi-driver-operator/pkg/cloudinfo"
+	"github.com/openshift/openstack-cinder-csi-driver-operator/pkg/controllers/config"
+	"github.com/openshift/openstack-cinder-csi-driver-operator/pkg/util"
+)
+
+const (
+	// conditionType is set to True when any Cinder quota is nearly exhausted.
+	// It is informational only and doesn't affect the Degraded or Available
+	// status of the operator.
+	conditionType = "CinderQuotaWarning"
+
+	resyncInterval = 5 * time.Minute
+)
+
+// This QuotaController periodically checks the Cinder quota usage of the
+// OpenStack project, exporting it as metrics and warning when any quota is
+// close to being exhausted so that more can be requested before volume
+// provisioning starts to fail.
+type QuotaController struct {
+	operatorClient       v1helpers.OperatorClient
+	configMapLister      corelisters.ConfigMapLister
+	infrastructureLister configv1listers.InfrastructureLister
+	provider             cloudinfo.Provider
+	eventRecorder        events.Recorder
+}
+
+func NewQuotaController(
+	operatorClient v1helpers.OperatorClient,
+	informers v1helpers.KubeInformersForNamespaces,
+	configInformers configinformers.SharedInformerFactory,
+	provider cloudinfo.Provider,
+	eventRecorder events.Recorder) factory.Controller {
+
+	configMapInformer := informers.InformersFor(util.OpenShiftConfigNamespace)
+	c := &QuotaController{
+		operatorClient:       operatorClient,
+		configMapLister:      configMapInformer.Core().V1().ConfigMaps().Lister(),
+		infrastructureLister: configInformers.Config().V1().Infrastructures().Lister(),
+		provider:             provider,
+		eventRecorder:        eventRecorder.WithComponentSuffix("CinderQuota"),
+	}
+	// Failing to fetch the quota is reported through our own condition rather
+	// than degrading the operator, as the driver itself is unaffected
+	return factory.New().WithSync(c.sync).ResyncEvery(resyncInterval).WithInformers(
+		operatorClient.Informer(),
+		configMapInformer.Core().V1().ConfigMaps().Informer(),
+	).ToController("CinderQuota", eventRecorder)
+}
+
+func (c *QuotaController) sync(ctx context.Context, syncCtx factory.SyncContext) error {
+	opSpec, opStatus, _, err := c.operatorClient.GetOperatorState()
+	if err != nil {
+		return err
+	}
+	if opSpec.ManagementState != operatorv1.Managed {
+		return nil
+	}
+
+	sourceConfig, err := config.GetSourceConfigMap(c.configMapLister, c.infrastructureLister)
+	if err != nil {
+		return err
+	}
+	if sourceConfig == nil {
+		return nil
+	}
+
+	settings, err := config.ParseSettings(sourceConfig)
+	if err != nil {
+		return err
+	}
+
+	quotas, err := c.provider.GetVolumeQuotas(ctx)
+	if err != nil {
+		condition := operatorv1.OperatorCondition{
+			Type:    conditionType,
+			Status:  operatorv1.ConditionUnknown,
+			Reason:  "QuotaUnavailable",
+			Message: fmt.Sprintf("Failed to fetch Cinder quota usage: %v", err),
+		}
+		if _, _, updateErr := v1helpers.UpdateStatus(ctx, c.operatorClient, v1helpers.UpdateConditionFn(condition)); updateErr != nil {
+			return updateErr
+		}
+		return err
+	}
+
+	var exhausted []string
+	for _, q := range []struct {
+		resource string
+		usage    cloudinfo.QuotaUsage
+	}{
+		{"volumes", quotas.Volumes},
+		{"gigabytes", quotas.Gigabytes},
+		{"snapshots", quotas.Snapshots},
+	} {
+		quotaUsed.WithLabelValues(q.resource).Set(float64(q.usage.Used()))
+		quotaLimit.WithLabelValues(q.resource).Set(float64(q.usage.Limit))
+
+		if percent, ok := usedPercent(q.usage); ok && settings.QuotaWarningThreshold > 0 && percent >= settings.QuotaWarningThreshold {
+			exhausted = append(exhausted, fmt.Sprintf("%s: %d of %d used (%d%%)", q.resource, q.usage.Used(), q.usage.Limit, percent))
+		}
+	}
+
+	condition := operatorv1.OperatorCondition{
+		Type:   conditionType,
+		Status: operatorv1.ConditionFalse,
+		Reason: "AsExpected",
+	}
+	if len(exhausted) > 0 {
+		condition.Status = operatorv1.ConditionTrue
+		condition.Reason = "QuotaNearlyExhausted"
+		condition.Message = fmt.Sprintf("Cinder quota usage is at or above %d%%: %s", settings.QuotaWarningThreshold, strings.Join(exhausted, ", "))
+
+		if !v1helpers.IsOperatorConditionTrue(opStatus.Conditions, conditionType) {
+			klog.Warning(condition.Message)
+			c.eventRecorder.Warning(condition.Reason, condition.Message)
+		}
+	}
+
+	_, _, err = v1helpers.UpdateStatus(ctx, c.operatorClient, v1helpers.UpdateConditionFn(condition))
+	return err
+}
+
+// usedPercent returns the percentage of the quota which is used. A limit of
+// zero is treated as fully used, as nothing more can be created. The second
+// return value is false if the quota is unlimited.
+func usedPercent(usage cloudinfo.QuotaUsage) (int, bool) {
+	if usage.Limit < 0 {
+		return 0, false
+	}
+	if usage.Limit == 0 {
+		return 100, true
+	}
+	return usage.Used() * 100 / usage.Limit, true
+}
@@ -0,0 +1,246 @@
+package quota
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+
+	. "github.com/onsi/gomega"
+	configv1 "github.com/openshift/api/config/v1"
+	operatorv1 "github.com/openshift/api/operator/v1"
+	configv1listers "github.com/openshift/client-go/config/listers/config/v1"
+	"github.com/openshift/library-go/pkg/controller/factory"
+	"github.com/openshift/library-go/pkg/operator/events"
+	"github.com/openshift/library-go/pkg/operator/v1helpers"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/component-base/metrics/legacyregistry"
+	"k8s.io/component-base/metrics/testutil"
+
+	"github.com/openshift/openstack-cinder-csi-driver-operator/pkg/cloudinfo"
+	"github.com/openshift/openstack-cinder-csi-driver-operator/pkg/cloudinfo/fake"
+	"github.com/openshift/openstack-cinder-csi-driver-operator/pkg/util"
+)
+
+func TestSync(t *testing.T) {
+	tc := []struct {
+		name              string
+		sourceData        map[string]string
+		quotas            map[string]fake.QuotaUsage
+		failQuotas        bool
+		expectedStatus    operatorv1.ConditionStatus
+		expectedReason    string
+		expectedMessage   string
+		expectedWarnings  []string
+		expectedGigabytes float64
+		errMsg            string
+	}{
+		{
+			name: "Usage below the default threshold",
+			quotas: map[string]fake.QuotaUsage{
+				"volumes":   {InUse: 5, Limit: 10},
+				"gigabytes": {InUse: 800, Reserved: 99, Limit: 1000},
+				"snapshots": {InUse: 0, Limit: 10},
+			},
+			expectedStatus:    operatorv1.ConditionFalse,
+			expectedReason:    "AsExpected",
+			expectedGigabytes: 899,
+		}, {
+			name: "Usage above the default threshold",
+			quotas: map[string]fake.QuotaUsage{
+				"volumes":   {InUse: 9, Limit: 10},
+				"gigabytes": {InUse: 800, Reserved: 100, Limit: 1000},
+				"snapshots": {InUse: 0, Limit: 0},
+			},
+			expectedStatus:    operatorv1.ConditionTrue,
+			expectedReason:    "QuotaNearlyExhausted",
+			expectedMessage:   "Cinder quota usage is at or above 90%: volumes: 9 of 10 used (90%), gigabytes: 900 of 1000 used (90%), snapshots: 0 of 0 used (100%)",
+			expectedWarnings:  []string{"QuotaNearlyExhausted"},
+			expectedGigabytes: 900,
+		}, {
+			name:       "Usage above a custom threshold",
+			sourceData: map[string]string{"quota_warning_threshold": "50%"},
+			quotas: map[string]fake.QuotaUsage{
+				"volumes":   {InUse: 5, Limit: 10},
+				"gigabytes": {InUse: 100, Limit: -1},
+				"snapshots": {InUse: 1, Limit: 10},
+			},
+			expectedStatus:    operatorv1.ConditionTrue,
+			expectedReason:    "QuotaNearlyExhausted",
+			expectedMessage:   "Cinder quota usage is at or above 50%: volumes: 5 of 10 used (50%)",
+			expectedWarnings:  []string{"QuotaNearlyExhausted"},
+			expectedGigabytes: 100,
+		}, {
+			name:       "Warning disabled",
+			sourceData: map[string]string{"quota_warning_threshold": "0"},
+			quotas: map[string]fake.QuotaUsage{
+				"volumes":   {InUse: 10, Limit: 10},
+				"gigabytes": {InUse: 1000, Limit: 1000},
+				"snapshots": {InUse: 10, Limit: 10},
+			},
+			expectedStatus:    operatorv1.ConditionFalse,
+			expectedReason:    "AsExpected",
+			expectedGigabytes: 1000,
+		}, {
+			name:           "Quota cannot be fetched",
+			failQuotas:     true,
+			expectedStatus: operatorv1.ConditionUnknown,
+			expectedReason: "QuotaUnavailable",
+			errMsg:         "failed to get volume quota usage",
+		},
+	}
+
+	for _, tc := range tc {
+		t.Run(tc.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			cloud := fake.New()
+			defer cloud.Close()
+			cloud.VolumeQuotas = tc.quotas
+			if tc.failQuotas {
+				cloud.Fail("volume", http.MethodGet, "/os-quota-sets/"+fake.ProjectID, http.StatusInternalServerError)
+			}
+
+			sourceConfigMap := &corev1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "cloud-provider-config",
+					Namespace: util.OpenShiftConfigNamespace,
+				},
+				Data: map[string]string{
+					"config": "[Global]\n",
+				},
+			}
+			for k, v := range tc.sourceData {
+				sourceConfigMap.Data[k] = v
+			}
+
+			c, operatorClient, recorder := newTestQuotaController(g, operatorv1.Managed, cloudinfo.NewProvider(cloud.ClientOpts(), nil), sourceConfigMap)
+			syncCtx := factory.NewSyncContext("CinderQuota", recorder)
+
+			err := c.sync(context.TODO(), syncCtx)
+			if tc.errMsg != "" {
+				g.Expect(err).To(MatchError(ContainSubstring(tc.errMsg)))
+			} else {
+				g.Expect(err).ToNot(HaveOccurred())
+			}
+
+			_, status, _, err := operatorClient.GetOperatorState()
+			g.Expect(err).ToNot(HaveOccurred())
+			condition := v1helpers.FindOperatorCondition(status.Conditions, conditionType)
+			g.Expect(condition).ToNot(BeNil())
+			g.Expect(condition.Status).To(Equal(tc.expectedStatus))
+			g.Expect(condition.Reason).To(Equal(tc.expectedReason))
+			if tc.expectedMessage != "" {
+				g.Expect(condition.Message).To(Equal(tc.expectedMessage))
+			}
+
+			if tc.errMsg == "" {
+				g.Expect(testutil.GetGaugeMetricValue(quotaUsed.WithLabelValues("gigabytes"))).To(Equal(tc.expectedGigabytes))
+				g.Expect(testutil.GetGaugeMetricValue(quotaLimit.WithLabelValues("gigabytes"))).To(Equal(float64(tc.quotas["gigabytes"].Limit)))
+			}
+
+			// the warning event is only emitted when the condition changes
+			g.Expect(c.sync(context.TODO(), syncCtx) != nil).To(Equal(tc.errMsg != ""))
+
+			var warnings []string
+			for _, event := range recorder.Events() {
+				if event.Type == corev1.EventTypeWarning {
+					warnings = append(warnings, event.Reason)
+				}
+			}
+			g.Expect(warnings).To(Equal(tc.expectedWarnings))
+		})
+	}
+}
+
+func TestSyncUnmanaged(t *testing.T) {
+	g := NewWithT(t)
+
+	cloud := fake.New()
+	defer cloud.Close()
+
+	c, operatorClient, recorder := newTestQuotaController(g, operatorv1.Unmanaged, cloudinfo.NewProvider(cloud.ClientOpts(), nil))
+
+	g.Expect(c.sync(context.TODO(), factory.NewSyncContext("CinderQuota", recorder))).To(Succeed())
+	g.Expect(cloud.Requests("volume", http.MethodGet, "/os-quota-sets/"+fake.ProjectID)).To(BeZero())
+
+	_, status, _, err := operatorClient.GetOperatorState()
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(v1helpers.FindOperatorCondition(status.Conditions, conditionType)).To(BeNil())
+}
+
+func TestMetricsExported(t *testing.T) {
+	g := NewWithT(t)
+
+	cloud := fake.New()
+	defer cloud.Close()
+	cloud.VolumeQuotas = map[string]fake.QuotaUsage{
+		"volumes":   {InUse: 5, Limit: 10},
+		"gigabytes": {InUse: 800, Reserved: 99, Limit: 1000},
+		"snapshots": {InUse: 0, Limit: -1},
+	}
+
+	sourceConfigMap := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "cloud-provider-config",
+			Namespace: util.OpenShiftConfigNamespace,
+		},
+		Data: map[string]string{
+			"config": "[Global]\n",
+		},
+	}
+	c, _, recorder := newTestQuotaController(g, operatorv1.Managed, cloudinfo.NewProvider(cloud.ClientOpts(), nil), sourceConfigMap)
+	g.Expect(c.sync(context.TODO(), factory.NewSyncContext("CinderQuota", recorder))).To(Succeed())
+
+	// the gauges are served by the operator's metrics endpoint
+	g.Expect(testutil.GatherAndCompare(legacyregistry.DefaultGatherer, strings.NewReader(`
+# HELP openshift_openstack_cinder_csi_driver_operator_quota_used [ALPHA] Amount of the OpenStack project's Cinder quota that is in use or reserved, labeled by quota resource.
+# TYPE openshift_openstack_cinder_csi_driver_operator_quota_used gauge
+openshift_openstack_cinder_csi_driver_operator_quota_used{resource="gigabytes"} 899
+openshift_openstack_cinder_csi_driver_operator_quota_used{resource="snapshots"} 0
+openshift_openstack_cinder_csi_driver_operator_quota_used{resource="volumes"} 5
+# HELP openshift_openstack_cinder_csi_driver_operator_quota_limit [ALPHA] Limit of the OpenStack project's Cinder quota, labeled by quota resource. A value of -1 means unlimited.
+# TYPE openshift_openstack_cinder_csi_driver_operator_quota_limit gauge
+openshift_openstack_cinder_csi_driver_operator_quota_limit{resource="gigabytes"} 1000
+openshift_openstack_cinder_csi_driver_operator_quota_limit{resource="snapshots"} -1
+openshift_openstack_cinder_csi_driver_operator_quota_limit{resource="volumes"} 10
+`),
+		"openshift_openstack_cinder_csi_driver_operator_quota_used",
+		"openshift_openstack_cinder_csi_driver_operator_quota_limit",
+	)).To(Succeed())
+}
+
+func newTestQuotaController(g *WithT, managementState operatorv1.ManagementState, provider cloudinfo.Provider, configMaps ...*corev1.ConfigMap) (*QuotaController, v1helpers.OperatorClient, events.InMemoryRecorder) {
+	configMapIndexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+	for _, cm := range configMaps {
+		g.Expect(configMapIndexer.Add(cm)).To(Succeed())
+	}
+
+	infraIndexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	g.Expect(infraIndexer.Add(&configv1.Infrastructure{
+		ObjectMeta: metav1.ObjectMeta{Name: "cluster"},
+		Spec: configv1.InfrastructureSpec{
+			CloudConfig: configv1.ConfigMapFileReference{Name: "cloud-provider-config"},
+		},
+	})).To(Succeed())
+
+	operatorClient := v1helpers.NewFakeOperatorClient(
+		&operatorv1.OperatorSpec{ManagementState: managementState},
+		&operatorv1.OperatorStatus{},
+		nil,
+	)
+	recorder := events.NewInMemoryRecorder("test")
+
+	c := &QuotaController{
+		operatorClient:       operatorClient,
+		configMapLister:      corelisters.NewConfigMapLister(configMapIndexer),
+		infrastructureLister: configv1listers.NewInfrastructureLister(infraIndexer),
+		provider:             provider,
+		eventRecorder:        recorder,
+	}
+
+	return c, operatorClient, recorder
+}
@@ -0,0 +1,39 @@
+package rollout
+
+import (
+	operatorv1 "github.com/openshift/api/operator/v1"
+	configv1listers "github.com/openshift/client-go/config/listers/config/v1"
+	"github.com/openshift/library-go/pkg/operator/csi/csidrivernodeservicecontroller"
+	appsv1 "k8s.io/api/apps/v1"
+	corelisters "k8s.io/client-go/listers/core/v1"
+
+	"github.com/openshift/openstack-cinder-csi-driver-operator/pkg/controllers/config"
+)
+
+// WithStagedRolloutHook returns a hook for the node plugin DaemonSet that
+// switches it to the OnDelete update strategy when the staged_rollout setting
+// is enabled, so that its pods are only replaced by the
+// StagedRolloutController
+func WithStagedRolloutHook(
+	configMapLister corelisters.ConfigMapLister,
+	infrastructureLister configv1listers.InfrastructureLister,
+) csidrivernodeservicecontroller.DaemonSetHookFunc {
+	return func(_ *operatorv1.OperatorSpec, ds *appsv1.DaemonSet) error {
+		sourceConfig, err := config.GetSourceConfigMap(configMapLister, infrastructureLister)
+		if err != nil {
+			return err
+		}
+		if sourceConfig == nil {
+			return nil
+		}
+
+		settings, err := config.ParseSettings(sourceConfig)
+		if err != nil {
+			return err
+		}
+		if settings.StagedRollout {
+			ds.Spec.UpdateStrategy = appsv1.DaemonSetUpdateStrategy{Type: appsv1.OnDeleteDaemonSetStrategyType}
+		}
+		return nil
+	}
+}
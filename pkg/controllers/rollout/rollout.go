@@ -0,0 +1,488 @@
+package rollout
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	operatorv1 "github.com/openshift/api/operator/v1"
+	configinformers "github.com/openshift/client-go/config/informers/externalversions"
+	configv1listers "github.com/openshift/client-go/config/listers/config/v1"
+	"github.com/openshift/library-go/pkg/controller/factory"
+	"github.com/openshift/library-go/pkg/operator/events"
+	"github.com/openshift/library-go/pkg/operator/v1helpers"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/client-go/kubernetes"
+	appslisters "k8s.io/client-go/listers/apps/v1"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/klog/v2"
+	"k8s.io/utils/ptr"
+
+	"github.com/openshift/openstack-cinder-csi-driver-operator/pkg/controllers/config"
+	"github.com/openshift/openstack-cinder-csi-driver-operator/pkg/util"
+)
+
+const (
+	// conditionType ends with Progressing so that it is reported by the
+	// Progressing condition of the ClusterCSIDriver
+	conditionType = "CinderStagedRolloutProgressing"
+	// degradedConditionType is set while the rollout is halted, so that a
+	// halted rollout is reported by the Degraded condition
+	degradedConditionType = "CinderStagedRolloutDegraded"
+
+	controllerDeploymentName = "openstack-cinder-csi-driver-controller"
+	nodeDaemonSetName        = "openstack-cinder-csi-driver-node"
+
+	// nodePluginLabel selects the pods of the node plugin DaemonSet
+	nodePluginLabel = "app"
+	nodePluginApp   = nodeDaemonSetName
+
+	// templateGenerationLabel is set on DaemonSet pods to the generation of
+	// the DaemonSet they were created from
+	templateGenerationLabel = "pod-template-generation"
+
+	// stateAnnotation of the node plugin DaemonSet records the rolloutState
+	// as JSON, so that a rollout carries on where it was when the operator
+	// restarts
+	stateAnnotation = "cinder.csi.openstack.org/staged-rollout"
+
+	// crashLoopRestarts is the number of restarts of a container of an
+	// updated node plugin pod after which the rollout is halted
+	crashLoopRestarts = 3
+	// podReadyTimeout is how long an updated node plugin pod has to become
+	// ready before the rollout is halted
+	podReadyTimeout = 10 * time.Minute
+	// batchPercent is the percentage of node plugin pods replaced at once
+	// after the canary stage, as with the default rolling update
+	batchPercent = 10
+
+	resyncInterval = time.Minute
+)
+
+// rolloutState tracks the progress of the rollout of one generation of the
+// node plugin DaemonSet
+type rolloutState struct {
+	Generation string `json:"generation"`
+	// ControllerReadySince is when the driver controller was first seen
+	// rolled out with the same config as the DaemonSet
+	ControllerReadySince metav1.Time `json:"controllerReadySince"`
+	// CanaryNodes are the nodes which are updated first
+	CanaryNodes map[string]bool `json:"canaryNodes,omitempty"`
+	// CanaryReadySince is when all canary pods were first seen updated and
+	// ready
+	CanaryReadySince metav1.Time `json:"canaryReadySince"`
+	// Halted is why the rollout was halted, if it was
+	Halted string `json:"halted,omitempty"`
+}
+
+// This StagedRolloutController replaces the node plugin pods when the
+// staged_rollout setting is enabled, in which case the DaemonSet is switched
+// to the OnDelete update strategy by WithStagedRolloutHook. Once the driver
+// controller has rolled out with the same config as the DaemonSet and stayed
+// ready for the soak period, the pods on the canary nodes are replaced. Once
+// these have stayed healthy for the soak period, the remaining pods are
+// replaced. Pods are replaced in batches, the next batch once the previous
+// one is ready. A pod is healthy if it is ready, which requires the
+// csi-liveness-probe of the driver to pass, and its containers aren't
+// restarting. If an updated pod is unhealthy, the rollout is halted, and the
+// operator reported as degraded, until the DaemonSet changes again. The
+// progress of the rollout is recorded in an annotation of the DaemonSet.
+type StagedRolloutController struct {
+	operatorClient       v1helpers.OperatorClient
+	kubeClient           kubernetes.Interface
+	configMapLister      corelisters.ConfigMapLister
+	infrastructureLister configv1listers.InfrastructureLister
+	nodeLister           corelisters.NodeLister
+	podLister            corelisters.PodLister
+	daemonSetLister      appslisters.DaemonSetLister
+	deploymentLister     appslisters.DeploymentLister
+	eventRecorder        events.Recorder
+
+	state *rolloutState
+}
+
+func NewStagedRolloutController(
+	operatorClient v1helpers.OperatorClient,
+	kubeClient kubernetes.Interface,
+	informers v1helpers.KubeInformersForNamespaces,
+	configInformers configinformers.SharedInformerFactory,
+	eventRecorder events.Recorder) factory.Controller {
+
+	configMapInformer := informers.InformersFor(util.OpenShiftConfigNamespace).Core().V1().ConfigMaps()
+	namespaceInformers := informers.InformersFor(util.DefaultNamespace)
+	nodeInformer := informers.InformersFor("").Core().V1().Nodes()
+	c := &StagedRolloutController{
+		operatorClient:       operatorClient,
+		kubeClient:           kubeClient,
+		configMapLister:      configMapInformer.Lister(),
+		infrastructureLister: configInformers.Config().V1().Infrastructures().Lister(),
+		nodeLister:           nodeInformer.Lister(),
+		podLister:            namespaceInformers.Core().V1().Pods().Lister(),
+		daemonSetLister:      namespaceInformers.Apps().V1().DaemonSets().Lister(),
+		deploymentLister:     namespaceInformers.Apps().V1().Deployments().Lister(),
+		eventRecorder:        eventRecorder.WithComponentSuffix("CinderStagedRollout"),
+	}
+	// The soak periods are checked on resync
+	return factory.New().WithSync(c.sync).ResyncEvery(resyncInterval).WithInformers(
+		operatorClient.Informer(),
+		configMapInformer.Informer(),
+		namespaceInformers.Core().V1().Pods().Informer(),
+		namespaceInformers.Apps().V1().DaemonSets().Informer(),
+		namespaceInformers.Apps().V1().Deployments().Informer(),
+	).ToController("CinderStagedRollout", eventRecorder)
+}
+
+func (c *StagedRolloutController) sync(ctx context.Context, syncCtx factory.SyncContext) error {
+	opSpec, _, _, err := c.operatorClient.GetOperatorState()
+	if err != nil {
+		return err
+	}
+	if opSpec.ManagementState != operatorv1.Managed {
+		return nil
+	}
+
+	sourceConfig, err := config.GetSourceConfigMap(c.configMapLister, c.infrastructureLister)
+	if err != nil {
+		return err
+	}
+	if sourceConfig == nil {
+		return nil
+	}
+
+	settings, err := config.ParseSettings(sourceConfig)
+	if err != nil {
+		return err
+	}
+
+	if !settings.StagedRollout {
+		c.state = nil
+		if err := c.clearState(ctx); err != nil {
+			return err
+		}
+		return c.updateCondition(ctx, operatorv1.OperatorCondition{
+			Type:   conditionType,
+			Status: operatorv1.ConditionFalse,
+			Reason: "StagedRolloutDisabled",
+		})
+	}
+
+	daemonSet, err := c.daemonSetLister.DaemonSets(util.DefaultNamespace).Get(nodeDaemonSetName)
+	if errors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if daemonSet.Spec.UpdateStrategy.Type != appsv1.OnDeleteDaemonSetStrategyType {
+		// the DaemonSet hasn't been updated by WithStagedRolloutHook yet
+		return nil
+	}
+
+	generation := daemonSet.Annotations[appsv1.DeprecatedTemplateGeneration]
+	if c.state == nil || c.state.Generation != generation {
+		c.state = loadState(daemonSet, generation)
+	}
+
+	condition, err := c.rollout(ctx, syncCtx, daemonSet, settings)
+	if err != nil {
+		return err
+	}
+	if err := c.saveState(ctx, daemonSet); err != nil {
+		return err
+	}
+	return c.updateCondition(ctx, condition)
+}
+
+// rollout replaces the node plugin pods due at this stage of the rollout and
+// returns the Progressing condition describing it
+func (c *StagedRolloutController) rollout(ctx context.Context, syncCtx factory.SyncContext, daemonSet *appsv1.DaemonSet, settings *config.Settings) (operatorv1.OperatorCondition, error) {
+	condition := operatorv1.OperatorCondition{
+		Type:   conditionType,
+		Status: operatorv1.ConditionFalse,
+		Reason: "AsExpected",
+	}
+
+	pods, err := c.podLister.Pods(util.DefaultNamespace).List(labels.SelectorFromSet(labels.Set{nodePluginLabel: nodePluginApp}))
+	if err != nil {
+		return condition, err
+	}
+	sort.Slice(pods, func(i, j int) bool { return pods[i].Spec.NodeName < pods[j].Spec.NodeName })
+
+	var outdated, updated []*corev1.Pod
+	var deleting bool
+	for _, pod := range pods {
+		switch {
+		case pod.DeletionTimestamp != nil:
+			deleting = true
+		case pod.Labels[templateGenerationLabel] == c.state.Generation:
+			updated = append(updated, pod)
+		default:
+			outdated = append(outdated, pod)
+		}
+	}
+
+	if len(outdated) == 0 && !deleting {
+		c.state.Halted = ""
+		condition.Message = "All node plugin pods are up to date"
+		return condition, nil
+	}
+
+	condition.Status = operatorv1.ConditionTrue
+	now := time.Now()
+
+	if c.state.Halted == "" {
+		c.state.Halted = unhealthyPod(updated, now)
+		if c.state.Halted != "" {
+			klog.Warningf("Halting the rollout of the node plugin: %s", c.state.Halted)
+			c.eventRecorder.Warningf("StagedRolloutHalted", "Halted the rollout of the node plugin: %s", c.state.Halted)
+		}
+	}
+	if c.state.Halted != "" {
+		condition.Reason = "RolloutHalted"
+		condition.Message = fmt.Sprintf("The rollout of the node plugin was halted as %s; it resumes when the node plugin DaemonSet changes", c.state.Halted)
+		return condition, nil
+	}
+
+	// Stage 1: the driver controller
+	ready, err := c.controllerRolledOut(daemonSet)
+	if err != nil {
+		return condition, err
+	}
+	if !ready {
+		c.state.ControllerReadySince = metav1.Time{}
+		condition.Reason = "RollingOutController"
+		condition.Message = "Waiting for the driver controller to roll out before updating the node plugin"
+		return condition, nil
+	}
+	if c.state.ControllerReadySince.IsZero() {
+		c.state.ControllerReadySince = metav1.NewTime(now)
+	}
+	if remaining := settings.StagedRolloutSoakPeriod - now.Sub(c.state.ControllerReadySince.Time); remaining > 0 {
+		condition.Reason = "SoakingController"
+		condition.Message = fmt.Sprintf("Waiting %s for the driver controller to stay healthy before updating canary nodes", remaining.Round(time.Second))
+		syncCtx.Queue().AddAfter(syncCtx.QueueKey(), remaining)
+		return condition, nil
+	}
+
+	// Pods are only replaced once the previous ones are back and ready
+	condition.Reason, condition.Message = c.stageProgress(len(updated), len(pods))
+	if deleting || int32(len(pods)) < daemonSet.Status.DesiredNumberScheduled || !allReady(updated) {
+		return condition, nil
+	}
+	batch := len(pods) * batchPercent / 100
+	if batch < 1 {
+		batch = 1
+	}
+
+	// Stage 2: the canary nodes
+	if c.state.CanaryNodes == nil {
+		c.state.CanaryNodes, err = c.canaryNodes(outdated)
+		if err != nil {
+			return condition, err
+		}
+	}
+	var canaries []*corev1.Pod
+	for _, pod := range outdated {
+		if c.state.CanaryNodes[pod.Spec.NodeName] {
+			canaries = append(canaries, pod)
+		}
+	}
+	if len(canaries) > 0 {
+		return condition, c.deletePods(ctx, canaries[:min(batch, len(canaries))])
+	}
+	if c.state.CanaryReadySince.IsZero() {
+		c.state.CanaryReadySince = metav1.NewTime(now)
+	}
+	if remaining := settings.StagedRolloutSoakPeriod - now.Sub(c.state.CanaryReadySince.Time); remaining > 0 {
+		condition.Reason = "SoakingCanaries"
+		condition.Message = fmt.Sprintf("Waiting %s for the node plugin on canary nodes to stay healthy before updating the other nodes", remaining.Round(time.Second))
+		syncCtx.Queue().AddAfter(syncCtx.QueueKey(), remaining)
+		return condition, nil
+	}
+
+	// Stage 3: the remaining nodes
+	condition.Reason, condition.Message = c.stageProgress(len(updated), len(pods))
+	return condition, c.deletePods(ctx, outdated[:min(batch, len(outdated))])
+}
+
+// loadState returns the state recorded in the annotation of the DaemonSet if
+// it is for the given generation, or a new state otherwise
+func loadState(daemonSet *appsv1.DaemonSet, generation string) *rolloutState {
+	state := &rolloutState{}
+	if value, ok := daemonSet.Annotations[stateAnnotation]; ok {
+		if err := json.Unmarshal([]byte(value), state); err != nil {
+			klog.Warningf("Ignoring the invalid %s annotation of DaemonSet %s: %v", stateAnnotation, nodeDaemonSetName, err)
+		}
+	}
+	if state.Generation != generation {
+		return &rolloutState{Generation: generation}
+	}
+	return state
+}
+
+// saveState records the state in the annotation of the DaemonSet, if it has
+// changed
+func (c *StagedRolloutController) saveState(ctx context.Context, daemonSet *appsv1.DaemonSet) error {
+	value, err := json.Marshal(c.state)
+	if err != nil {
+		return err
+	}
+	if daemonSet.Annotations[stateAnnotation] == string(value) {
+		return nil
+	}
+	return c.patchState(ctx, ptr.To(string(value)))
+}
+
+// clearState removes the annotation of the DaemonSet, so that a stale state
+// isn't picked up if staged_rollout is enabled again
+func (c *StagedRolloutController) clearState(ctx context.Context) error {
+	daemonSet, err := c.daemonSetLister.DaemonSets(util.DefaultNamespace).Get(nodeDaemonSetName)
+	if errors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if _, ok := daemonSet.Annotations[stateAnnotation]; !ok {
+		return nil
+	}
+	return c.patchState(ctx, nil)
+}
+
+// patchState sets the state annotation of the DaemonSet to the given value,
+// or removes it if value is nil
+func (c *StagedRolloutController) patchState(ctx context.Context, value *string) error {
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]*string{stateAnnotation: value},
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	if _, err := c.kubeClient.AppsV1().DaemonSets(util.DefaultNamespace).Patch(ctx, nodeDaemonSetName, types.MergePatchType, patch, metav1.PatchOptions{}); err != nil && !errors.IsNotFound(err) {
+		return fmt.Errorf("failed to update the %s annotation of DaemonSet %s: %w", stateAnnotation, nodeDaemonSetName, err)
+	}
+	return nil
+}
+
+// stageProgress returns the reason and message of the Progressing condition
+// while node plugin pods are being replaced
+func (c *StagedRolloutController) stageProgress(updated, total int) (string, string) {
+	if c.state.CanaryReadySince.IsZero() {
+		return "RollingOutCanaries", fmt.Sprintf("Updating the node plugin on canary nodes; %d of %d node plugin pods are up to date", updated, total)
+	}
+	return "RollingOutNodes", fmt.Sprintf("Updating the node plugin on the remaining nodes; %d of %d node plugin pods are up to date", updated, total)
+}
+
+// controllerRolledOut returns whether the driver controller has rolled out
+// with the same config as the node plugin DaemonSet
+func (c *StagedRolloutController) controllerRolledOut(daemonSet *appsv1.DaemonSet) (bool, error) {
+	deployment, err := c.deploymentLister.Deployments(util.DefaultNamespace).Get(controllerDeploymentName)
+	if errors.IsNotFound(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	if deployment.Spec.Template.Annotations[config.ConfigHashAnnotation] != daemonSet.Spec.Template.Annotations[config.ConfigHashAnnotation] {
+		return false, nil
+	}
+	replicas := int32(1)
+	if deployment.Spec.Replicas != nil {
+		replicas = *deployment.Spec.Replicas
+	}
+	return deployment.Status.ObservedGeneration == deployment.Generation &&
+		deployment.Status.UpdatedReplicas == replicas &&
+		deployment.Status.AvailableReplicas == replicas, nil
+}
+
+// canaryNodes returns the nodes labelled as canary nodes by the cluster
+// administrator or, if there are none, the first node with an outdated pod
+func (c *StagedRolloutController) canaryNodes(outdated []*corev1.Pod) (map[string]bool, error) {
+	nodes, err := c.nodeLister.List(labels.SelectorFromSet(labels.Set{util.CanaryNodeLabel: "true"}))
+	if err != nil {
+		return nil, err
+	}
+
+	canaries := map[string]bool{}
+	for _, node := range nodes {
+		canaries[node.Name] = true
+	}
+	if len(canaries) == 0 && len(outdated) > 0 {
+		canaries[outdated[0].Spec.NodeName] = true
+	}
+	return canaries, nil
+}
+
+func (c *StagedRolloutController) deletePods(ctx context.Context, pods []*corev1.Pod) error {
+	var errs []error
+	for _, pod := range pods {
+		klog.Infof("Replacing node plugin pod %s on node %s", pod.Name, pod.Spec.NodeName)
+		if err := c.kubeClient.CoreV1().Pods(pod.Namespace).Delete(ctx, pod.Name, metav1.DeleteOptions{}); err != nil && !errors.IsNotFound(err) {
+			errs = append(errs, fmt.Errorf("failed to delete node plugin pod %s: %w", pod.Name, err))
+		}
+	}
+	return utilerrors.NewAggregate(errs)
+}
+
+// updateCondition sets the Progressing condition, and the Degraded condition
+// according to whether the rollout is halted
+func (c *StagedRolloutController) updateCondition(ctx context.Context, condition operatorv1.OperatorCondition) error {
+	degraded := operatorv1.OperatorCondition{
+		Type:   degradedConditionType,
+		Status: operatorv1.ConditionFalse,
+		Reason: "AsExpected",
+	}
+	if condition.Reason == "RolloutHalted" {
+		degraded.Status = operatorv1.ConditionTrue
+		degraded.Reason = condition.Reason
+		degraded.Message = condition.Message
+	}
+	_, _, err := v1helpers.UpdateStatus(ctx, c.operatorClient, v1helpers.UpdateConditionFn(condition), v1helpers.UpdateConditionFn(degraded))
+	return err
+}
+
+// unhealthyPod describes the first updated pod which is crash-looping or
+// hasn't become ready in time, or returns an empty string if there is none
+func unhealthyPod(pods []*corev1.Pod, now time.Time) string {
+	for _, pod := range pods {
+		for _, status := range pod.Status.ContainerStatuses {
+			if status.RestartCount >= crashLoopRestarts {
+				return fmt.Sprintf("container %s of pod %s on node %s has restarted %d times", status.Name, pod.Name, pod.Spec.NodeName, status.RestartCount)
+			}
+		}
+		if !isReady(pod) && now.Sub(pod.CreationTimestamp.Time) > podReadyTimeout {
+			return fmt.Sprintf("pod %s on node %s did not become ready within %s", pod.Name, pod.Spec.NodeName, podReadyTimeout)
+		}
+	}
+	return ""
+}
+
+func allReady(pods []*corev1.Pod) bool {
+	for _, pod := range pods {
+		if !isReady(pod) {
+			return false
+		}
+	}
+	return true
+}
+
+func isReady(pod *corev1.Pod) bool {
+	for _, condition := range pod.Status.Conditions {
+		if condition.Type == corev1.PodReady {
+			return condition.Status == corev1.ConditionTrue
+		}
+	}
+	return false
+}
@@ -0,0 +1,367 @@
+package rollout
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	. "github.com/onsi/gomega"
+	configv1 "github.com/openshift/api/config/v1"
+	operatorv1 "github.com/openshift/api/operator/v1"
+	configv1listers "github.com/openshift/client-go/config/listers/config/v1"
+	"github.com/openshift/library-go/pkg/controller/factory"
+	"github.com/openshift/library-go/pkg/operator/events"
+	"github.com/openshift/library-go/pkg/operator/v1helpers"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	fakekube "k8s.io/client-go/kubernetes/fake"
+	appslisters "k8s.io/client-go/listers/apps/v1"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	clienttesting "k8s.io/client-go/testing"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/utils/ptr"
+
+	"github.com/openshift/openstack-cinder-csi-driver-operator/pkg/controllers/config"
+	"github.com/openshift/openstack-cinder-csi-driver-operator/pkg/util"
+)
+
+// rolloutTest drives a StagedRolloutController through the rollout of the
+// second generation of the node plugin DaemonSet to four nodes
+type rolloutTest struct {
+	g              *WithT
+	c              *StagedRolloutController
+	kubeClient     *fakekube.Clientset
+	operatorClient v1helpers.OperatorClient
+	recorder       events.InMemoryRecorder
+	pods           cache.Indexer
+	daemonSets     cache.Indexer
+	deployments    cache.Indexer
+}
+
+func newRolloutTest(g *WithT, sourceData map[string]string, canaryNodes ...string) *rolloutTest {
+	configMapIndexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+	data := map[string]string{"config": "[Global]\n"}
+	for k, v := range sourceData {
+		data[k] = v
+	}
+	g.Expect(configMapIndexer.Add(&corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "cloud-provider-config", Namespace: util.OpenShiftConfigNamespace},
+		Data:       data,
+	})).To(Succeed())
+
+	infraIndexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	g.Expect(infraIndexer.Add(&configv1.Infrastructure{
+		ObjectMeta: metav1.ObjectMeta{Name: "cluster"},
+		Spec: configv1.InfrastructureSpec{
+			CloudConfig: configv1.ConfigMapFileReference{Name: "cloud-provider-config"},
+		},
+	})).To(Succeed())
+
+	nodeIndexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	for _, name := range canaryNodes {
+		g.Expect(nodeIndexer.Add(&corev1.Node{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Labels: map[string]string{util.CanaryNodeLabel: "true"}},
+		})).To(Succeed())
+	}
+
+	daemonSet := &appsv1.DaemonSet{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        nodeDaemonSetName,
+			Namespace:   util.DefaultNamespace,
+			Annotations: map[string]string{appsv1.DeprecatedTemplateGeneration: "2"},
+		},
+		Spec: appsv1.DaemonSetSpec{
+			UpdateStrategy: appsv1.DaemonSetUpdateStrategy{Type: appsv1.OnDeleteDaemonSetStrategyType},
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{config.ConfigHashAnnotation: "new"}},
+			},
+		},
+		Status: appsv1.DaemonSetStatus{DesiredNumberScheduled: 4},
+	}
+	daemonSetIndexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+	g.Expect(daemonSetIndexer.Add(daemonSet)).To(Succeed())
+
+	operatorClient := v1helpers.NewFakeOperatorClient(
+		&operatorv1.OperatorSpec{ManagementState: operatorv1.Managed},
+		&operatorv1.OperatorStatus{},
+		nil,
+	)
+	recorder := events.NewInMemoryRecorder("test")
+
+	t := &rolloutTest{
+		g:              g,
+		kubeClient:     fakekube.NewSimpleClientset(daemonSet),
+		operatorClient: operatorClient,
+		recorder:       recorder,
+		pods:           cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc}),
+		daemonSets:     daemonSetIndexer,
+		deployments:    cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc}),
+	}
+	for _, node := range []string{"node-a", "node-b", "node-c", "node-d"} {
+		t.setPod(node, "1", true, 0)
+	}
+	t.setController("old")
+
+	t.c = &StagedRolloutController{
+		operatorClient:       operatorClient,
+		kubeClient:           t.kubeClient,
+		configMapLister:      corelisters.NewConfigMapLister(configMapIndexer),
+		infrastructureLister: configv1listers.NewInfrastructureLister(infraIndexer),
+		nodeLister:           corelisters.NewNodeLister(nodeIndexer),
+		podLister:            corelisters.NewPodLister(t.pods),
+		daemonSetLister:      appslisters.NewDaemonSetLister(t.daemonSets),
+		deploymentLister:     appslisters.NewDeploymentLister(t.deployments),
+		eventRecorder:        recorder,
+	}
+	return t
+}
+
+// setPod replaces the node plugin pod of the node, as the DaemonSet
+// controller does once it has been deleted
+func (t *rolloutTest) setPod(node, generation string, ready bool, restarts int32) {
+	status := corev1.ConditionFalse
+	if ready {
+		status = corev1.ConditionTrue
+	}
+	t.g.Expect(t.pods.Update(&corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:              "node-plugin-" + node,
+			Namespace:         util.DefaultNamespace,
+			Labels:            map[string]string{nodePluginLabel: nodePluginApp, templateGenerationLabel: generation},
+			CreationTimestamp: metav1.Now(),
+		},
+		Spec: corev1.PodSpec{NodeName: node},
+		Status: corev1.PodStatus{
+			Conditions:        []corev1.PodCondition{{Type: corev1.PodReady, Status: status}},
+			ContainerStatuses: []corev1.ContainerStatus{{Name: "csi-driver", RestartCount: restarts}},
+		},
+	})).To(Succeed())
+}
+
+// setController rolls out the driver controller with the given config hash
+func (t *rolloutTest) setController(hash string) {
+	t.g.Expect(t.deployments.Update(&appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Name: controllerDeploymentName, Namespace: util.DefaultNamespace, Generation: 1},
+		Spec: appsv1.DeploymentSpec{
+			Replicas: ptr.To[int32](2),
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{config.ConfigHashAnnotation: hash}},
+			},
+		},
+		Status: appsv1.DeploymentStatus{ObservedGeneration: 1, UpdatedReplicas: 2, AvailableReplicas: 2},
+	})).To(Succeed())
+}
+
+// sync runs the controller and returns the reason of its condition and the
+// node plugin pods it deleted
+func (t *rolloutTest) sync() (string, []string) {
+	t.kubeClient.ClearActions()
+	t.g.Expect(t.c.sync(context.TODO(), factory.NewSyncContext("CinderStagedRollout", t.recorder))).To(Succeed())
+
+	var deleted []string
+	for _, action := range t.kubeClient.Actions() {
+		if action.GetVerb() == "delete" {
+			deleted = append(deleted, action.(clienttesting.DeleteAction).GetName())
+		}
+	}
+
+	// the informer sees the annotation recording the state
+	daemonSet, err := t.kubeClient.AppsV1().DaemonSets(util.DefaultNamespace).Get(context.TODO(), nodeDaemonSetName, metav1.GetOptions{})
+	t.g.Expect(err).ToNot(HaveOccurred())
+	t.g.Expect(t.daemonSets.Update(daemonSet)).To(Succeed())
+
+	_, status, _, err := t.operatorClient.GetOperatorState()
+	t.g.Expect(err).ToNot(HaveOccurred())
+	condition := v1helpers.FindOperatorCondition(status.Conditions, conditionType)
+	t.g.Expect(condition).ToNot(BeNil())
+	return condition.Reason, deleted
+}
+
+// degraded returns the status of the Degraded condition
+func (t *rolloutTest) degraded() operatorv1.ConditionStatus {
+	_, status, _, err := t.operatorClient.GetOperatorState()
+	t.g.Expect(err).ToNot(HaveOccurred())
+	condition := v1helpers.FindOperatorCondition(status.Conditions, degradedConditionType)
+	t.g.Expect(condition).ToNot(BeNil())
+	return condition.Status
+}
+
+// restart replaces the controller with a new one, as when the operator
+// restarts
+func (t *rolloutTest) restart() {
+	c := *t.c
+	c.state = nil
+	t.c = &c
+}
+
+func TestStagedRollout(t *testing.T) {
+	g := NewWithT(t)
+	test := newRolloutTest(g, map[string]string{"staged_rollout": "true"}, "node-c")
+
+	// the driver controller is rolled out first
+	reason, deleted := test.sync()
+	g.Expect(reason).To(Equal("RollingOutController"))
+	g.Expect(deleted).To(BeEmpty())
+
+	test.setController("new")
+	reason, deleted = test.sync()
+	g.Expect(reason).To(Equal("SoakingController"))
+	g.Expect(deleted).To(BeEmpty())
+
+	// then the canary nodes
+	test.c.state.ControllerReadySince = metav1.NewTime(time.Now().Add(-time.Hour))
+	reason, deleted = test.sync()
+	g.Expect(reason).To(Equal("RollingOutCanaries"))
+	g.Expect(deleted).To(Equal([]string{"node-plugin-node-c"}))
+
+	test.setPod("node-c", "2", false, 0)
+	reason, deleted = test.sync()
+	g.Expect(reason).To(Equal("RollingOutCanaries"))
+	g.Expect(deleted).To(BeEmpty())
+
+	test.setPod("node-c", "2", true, 0)
+	reason, deleted = test.sync()
+	g.Expect(reason).To(Equal("SoakingCanaries"))
+	g.Expect(deleted).To(BeEmpty())
+
+	// then the remaining nodes, one at a time
+	test.c.state.CanaryReadySince = metav1.NewTime(time.Now().Add(-time.Hour))
+	for _, node := range []string{"node-a", "node-b", "node-d"} {
+		reason, deleted = test.sync()
+		g.Expect(reason).To(Equal("RollingOutNodes"))
+		g.Expect(deleted).To(Equal([]string{"node-plugin-" + node}))
+		test.setPod(node, "2", true, 0)
+	}
+
+	reason, deleted = test.sync()
+	g.Expect(reason).To(Equal("AsExpected"))
+	g.Expect(deleted).To(BeEmpty())
+	g.Expect(test.recorder.Events()).To(BeEmpty())
+}
+
+func TestStagedRolloutHalted(t *testing.T) {
+	g := NewWithT(t)
+	test := newRolloutTest(g, map[string]string{"staged_rollout": "true", "staged_rollout_soak_period": "1s"})
+	test.setController("new")
+
+	// without canary nodes, the first node is used
+	test.sync()
+	test.c.state.ControllerReadySince = metav1.NewTime(time.Now().Add(-time.Hour))
+	reason, deleted := test.sync()
+	g.Expect(reason).To(Equal("RollingOutCanaries"))
+	g.Expect(deleted).To(Equal([]string{"node-plugin-node-a"}))
+
+	g.Expect(test.degraded()).To(Equal(operatorv1.ConditionFalse))
+
+	// the canary crash-loops, so no more pods are replaced
+	test.setPod("node-a", "2", false, crashLoopRestarts)
+	for i := 0; i < 2; i++ {
+		reason, deleted = test.sync()
+		g.Expect(reason).To(Equal("RolloutHalted"))
+		g.Expect(deleted).To(BeEmpty())
+		g.Expect(test.degraded()).To(Equal(operatorv1.ConditionTrue))
+	}
+
+	// the rollout stays halted when the operator restarts, even if the pod
+	// has recovered in the meantime
+	test.restart()
+	test.setPod("node-a", "2", true, 0)
+	reason, deleted = test.sync()
+	g.Expect(reason).To(Equal("RolloutHalted"))
+	g.Expect(deleted).To(BeEmpty())
+
+	var reasons []string
+	for _, event := range test.recorder.Events() {
+		reasons = append(reasons, event.Reason)
+	}
+	g.Expect(reasons).To(Equal([]string{"StagedRolloutHalted"}))
+}
+
+func TestStagedRolloutCanaryBatches(t *testing.T) {
+	g := NewWithT(t)
+	test := newRolloutTest(g, map[string]string{"staged_rollout": "true"}, "node-b", "node-c")
+	test.setController("new")
+	test.sync()
+	test.c.state.ControllerReadySince = metav1.NewTime(time.Now().Add(-time.Hour))
+
+	// the canaries are replaced one batch at a time
+	for _, node := range []string{"node-b", "node-c"} {
+		reason, deleted := test.sync()
+		g.Expect(reason).To(Equal("RollingOutCanaries"))
+		g.Expect(deleted).To(Equal([]string{"node-plugin-" + node}))
+		test.setPod(node, "2", true, 0)
+	}
+
+	reason, deleted := test.sync()
+	g.Expect(reason).To(Equal("SoakingCanaries"))
+	g.Expect(deleted).To(BeEmpty())
+}
+
+func TestStagedRolloutRestart(t *testing.T) {
+	g := NewWithT(t)
+	test := newRolloutTest(g, map[string]string{"staged_rollout": "true"}, "node-c")
+	test.setController("new")
+
+	reason, _ := test.sync()
+	g.Expect(reason).To(Equal("SoakingController"))
+
+	// the soak period isn't started again when the operator restarts
+	test.c.state.ControllerReadySince = metav1.NewTime(time.Now().Add(-time.Hour))
+	test.c.state.CanaryNodes = map[string]bool{"node-d": true}
+	reason, _ = test.sync()
+	g.Expect(reason).To(Equal("RollingOutCanaries"))
+
+	test.restart()
+	test.setPod("node-d", "2", true, 0)
+	reason, deleted := test.sync()
+	g.Expect(reason).To(Equal("SoakingCanaries"))
+	g.Expect(deleted).To(BeEmpty())
+
+	// the state of an earlier generation is ignored
+	daemonSet, err := test.c.daemonSetLister.DaemonSets(util.DefaultNamespace).Get(nodeDaemonSetName)
+	g.Expect(err).ToNot(HaveOccurred())
+	daemonSet = daemonSet.DeepCopy()
+	daemonSet.Annotations[appsv1.DeprecatedTemplateGeneration] = "3"
+	g.Expect(test.daemonSets.Update(daemonSet)).To(Succeed())
+
+	test.restart()
+	reason, deleted = test.sync()
+	g.Expect(reason).To(Equal("SoakingController"))
+	g.Expect(deleted).To(BeEmpty())
+	g.Expect(test.c.state.Generation).To(Equal("3"))
+}
+
+func TestStagedRolloutDisabled(t *testing.T) {
+	g := NewWithT(t)
+	test := newRolloutTest(g, nil)
+	test.setController("new")
+
+	reason, deleted := test.sync()
+	g.Expect(reason).To(Equal("StagedRolloutDisabled"))
+	g.Expect(deleted).To(BeEmpty())
+}
+
+func TestWithStagedRolloutHook(t *testing.T) {
+	for _, tc := range []struct {
+		staged           string
+		expectedStrategy appsv1.DaemonSetUpdateStrategyType
+	}{
+		{"true", appsv1.OnDeleteDaemonSetStrategyType},
+		{"false", appsv1.RollingUpdateDaemonSetStrategyType},
+	} {
+		t.Run(tc.staged, func(t *testing.T) {
+			g := NewWithT(t)
+			test := newRolloutTest(g, map[string]string{"staged_rollout": tc.staged})
+
+			ds := &appsv1.DaemonSet{
+				Spec: appsv1.DaemonSetSpec{
+					UpdateStrategy: appsv1.DaemonSetUpdateStrategy{Type: appsv1.RollingUpdateDaemonSetStrategyType},
+				},
+			}
+			hook := WithStagedRolloutHook(test.c.configMapLister, test.c.infrastructureLister)
+			g.Expect(hook(nil, ds)).To(Succeed())
+			g.Expect(ds.Spec.UpdateStrategy.Type).To(Equal(tc.expectedStrategy))
+		})
+	}
+}
@@ -0,0 +1,29 @@
+package servicehealth
+
+import (
+	"k8s.io/component-base/metrics"
+	"k8s.io/component-base/metrics/legacyregistry"
+)
+
+var (
+	serviceUp = metrics.NewGaugeVec(
+		&metrics.GaugeOpts{
+			Name:           "openshift_openstack_cinder_csi_driver_operator_volume_service_up",
+			Help:           "Whether a cinder-volume or cinder-scheduler service is up (1) or down (0), labeled by binary, host, volume availability zone and whether the service is enabled or disabled.",
+			StabilityLevel: metrics.ALPHA,
+		},
+		[]string{"binary", "host", "zone", "status"},
+	)
+	zoneAvailable = metrics.NewGaugeVec(
+		&metrics.GaugeOpts{
+			Name:           "openshift_openstack_cinder_csi_driver_operator_volume_zone_available",
+			Help:           "Whether the Cinder services needed to provision volumes in a volume availability zone are up (1) or not (0), labeled by zone.",
+			StabilityLevel: metrics.ALPHA,
+		},
+		[]string{"zone"},
+	)
+)
+
+func init() {
+	legacyregistry.MustRegister(serviceUp, zoneAvailable)
+}
@@ -0,0 +1,307 @@
+package servicehealth
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gophercloud/gophercloud/v2"
+	operatorv1 "github.com/openshift/api/operator/v1"
+	configinformers "github.com/openshift/client-go/config/informers/externalversions"
+	configv1listers "github.com/openshift/client-go/config/listers/config/v1"
+	"github.com/openshift/library-go/pkg/controller/factory"
+	"github.com/openshift/library-go/pkg/operator/events"
+	"github.com/openshift/library-go/pkg/operator/v1helpers"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/client-go/kubernetes"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	storagelisters "k8s.io/client-go/listers/storage/v1"
+	"k8s.io/klog/v2"
+
+	"github.com/openshift/openstack-cinder-csi-driver-operator/pkg/cloudinfo"
+	"github.com/openshift/openstack-cinder-csi-driver-operator/pkg/controllers/config"
+	"github.com/openshift/openstack-cinder-csi-driver-operator/pkg/util"
+)
+
+const (
+	// conditionType is set to True when any Cinder service needed to
+	// provision volumes is down. It is informational only, as the driver
+	// itself is unaffected.
+	conditionType = "CinderServiceHealthWarning"
+
+	volumeBinary    = "cinder-volume"
+	schedulerBinary = "cinder-scheduler"
+
+	// generatedByLabel and zoneAnnotation identify the availability zone
+	// StorageClasses generated by the StorageClassController
+	generatedByLabel = "cinder.csi.openstack.org/generated-by"
+	generatorZone    = "availability-zone"
+	zoneAnnotation   = "cinder.csi.openstack.org/availability-zone"
+	// unavailableAnnotation is set on the StorageClass of an availability
+	// zone while volumes can't be provisioned in it
+	unavailableAnnotation = "cinder.csi.openstack.org/unavailable"
+
+	resyncInterval = 2 * time.Minute
+)
+
+// This ServiceHealthController polls the state of the Cinder services so
+// that a failed cinder-volume or cinder-scheduler service is reported in the
+// cluster, rather than only being noticed when PVCs stay pending. Listing
+// services is usually restricted to administrators, so the health is unknown
+// for most credentials.
+type ServiceHealthController struct {
+	operatorClient       v1helpers.OperatorClient
+	kubeClient           kubernetes.Interface
+	storageClassLister   storagelisters.StorageClassLister
+	configMapLister      corelisters.ConfigMapLister
+	targetConfigLister   corelisters.ConfigMapLister
+	infrastructureLister configv1listers.InfrastructureLister
+	cloudInfo            *cloudinfo.Cache
+	provider             cloudinfo.Provider
+	eventRecorder        events.Recorder
+}
+
+func NewServiceHealthController(
+	operatorClient v1helpers.OperatorClient,
+	kubeClient kubernetes.Interface,
+	informers v1helpers.KubeInformersForNamespaces,
+	configInformers configinformers.SharedInformerFactory,
+	cloudInfo *cloudinfo.Cache,
+	provider cloudinfo.Provider,
+	eventRecorder events.Recorder) factory.Controller {
+
+	configMapInformer := informers.InformersFor(util.OpenShiftConfigNamespace)
+	targetConfigInformer := informers.InformersFor(util.DefaultNamespace)
+	storageClassInformer := informers.InformersFor("").Storage().V1().StorageClasses()
+	c := &ServiceHealthController{
+		operatorClient:       operatorClient,
+		kubeClient:           kubeClient,
+		storageClassLister:   storageClassInformer.Lister(),
+		configMapLister:      configMapInformer.Core().V1().ConfigMaps().Lister(),
+		targetConfigLister:   targetConfigInformer.Core().V1().ConfigMaps().Lister(),
+		infrastructureLister: configInformers.Config().V1().Infrastructures().Lister(),
+		cloudInfo:            cloudInfo,
+		provider:             provider,
+		eventRecorder:        eventRecorder.WithComponentSuffix("CinderServiceHealth"),
+	}
+	return factory.New().WithSync(c.sync).ResyncEvery(resyncInterval).WithInformers(
+		operatorClient.Informer(),
+		configMapInformer.Core().V1().ConfigMaps().Informer(),
+		targetConfigInformer.Core().V1().ConfigMaps().Informer(),
+		storageClassInformer.Informer(),
+	).ToController("CinderServiceHealth", eventRecorder)
+}
+
+func (c *ServiceHealthController) sync(ctx context.Context, syncCtx factory.SyncContext) error {
+	opSpec, opStatus, _, err := c.operatorClient.GetOperatorState()
+	if err != nil {
+		return err
+	}
+	if opSpec.ManagementState != operatorv1.Managed {
+		return nil
+	}
+
+	state, err := config.GetTopologyState(c.configMapLister, c.targetConfigLister, c.infrastructureLister, c.cloudInfo)
+	if err != nil {
+		return err
+	}
+	if state == nil {
+		return nil
+	}
+
+	services, err := c.provider.GetVolumeServices(ctx, "")
+	if err != nil {
+		condition := operatorv1.OperatorCondition{
+			Type:    conditionType,
+			Status:  operatorv1.ConditionUnknown,
+			Reason:  "ServicesUnavailable",
+			Message: fmt.Sprintf("Failed to fetch the Cinder services: %v", err),
+		}
+		if gophercloud.ResponseCodeIs(err, http.StatusForbidden) {
+			condition.Reason = "ServicesForbidden"
+			condition.Message = "The OpenStack credentials are not permitted to list the Cinder services, which is usually restricted to administrators"
+			err = nil
+		}
+		if _, _, updateErr := v1helpers.UpdateStatus(ctx, c.operatorClient, v1helpers.UpdateConditionFn(condition)); updateErr != nil {
+			return updateErr
+		}
+		return err
+	}
+
+	health := evaluateHealth(services, state.CloudInfo.VolumeZones)
+	health.exportMetrics()
+
+	condition := operatorv1.OperatorCondition{
+		Type:   conditionType,
+		Status: operatorv1.ConditionFalse,
+		Reason: "AsExpected",
+	}
+	if len(health.down) > 0 {
+		condition.Status = operatorv1.ConditionTrue
+		condition.Reason = "ServicesDown"
+		condition.Message = health.message()
+		if len(health.unavailableZones) > 0 {
+			condition.Reason = "AvailabilityZonesUnavailable"
+		}
+
+		previous := v1helpers.FindOperatorCondition(opStatus.Conditions, conditionType)
+		if previous == nil || previous.Status != operatorv1.ConditionTrue || previous.Message != condition.Message {
+			klog.Warning(condition.Message)
+			c.eventRecorder.Warning(condition.Reason, condition.Message)
+		}
+	} else if v1helpers.IsOperatorConditionTrue(opStatus.Conditions, conditionType) {
+		c.eventRecorder.Event("ServicesRecovered", "All Cinder services are up")
+	}
+
+	if _, _, err := v1helpers.UpdateStatus(ctx, c.operatorClient, v1helpers.UpdateConditionFn(condition)); err != nil {
+		return err
+	}
+
+	unavailableZones := sets.New[string]()
+	if state.Settings.MarkUnavailableZones && state.TopologyEnabled {
+		unavailableZones.Insert(health.unavailableZones...)
+	}
+	return c.markStorageClasses(ctx, unavailableZones)
+}
+
+// markStorageClasses sets the unavailable annotation on the generated
+// StorageClasses of the given volume availability zones, and removes it from
+// all others. Kubernetes has no way to disable a StorageClass, so this is
+// only a hint to users and tools choosing between them.
+func (c *ServiceHealthController) markStorageClasses(ctx context.Context, unavailableZones sets.Set[string]) error {
+	selector := labels.SelectorFromSet(labels.Set{generatedByLabel: generatorZone})
+	scs, err := c.storageClassLister.List(selector)
+	if err != nil {
+		return err
+	}
+
+	for _, sc := range scs {
+		zone := sc.Annotations[zoneAnnotation]
+		_, marked := sc.Annotations[unavailableAnnotation]
+		unavailable := unavailableZones.Has(zone)
+		if marked == unavailable {
+			continue
+		}
+
+		sc = sc.DeepCopy()
+		if sc.Annotations == nil {
+			sc.Annotations = map[string]string{}
+		}
+		if unavailable {
+			klog.Infof("Marking StorageClass %s as unavailable as the Cinder services of availability zone %q are down", sc.Name, zone)
+			sc.Annotations[unavailableAnnotation] = fmt.Sprintf("The Cinder services of availability zone %s are down, so new volumes can't be provisioned", zone)
+		} else {
+			klog.Infof("Marking StorageClass %s as available as the Cinder services of availability zone %q have recovered", sc.Name, zone)
+			delete(sc.Annotations, unavailableAnnotation)
+		}
+		if _, err := c.kubeClient.StorageV1().StorageClasses().Update(ctx, sc, metav1.UpdateOptions{}); err != nil {
+			return fmt.Errorf("failed to update StorageClass %s: %w", sc.Name, err)
+		}
+	}
+
+	return nil
+}
+
+// serviceHealth describes the health of the Cinder services needed to
+// provision volumes
+type serviceHealth struct {
+	// services are the cinder-volume and cinder-scheduler services
+	services []cloudinfo.VolumeService
+	// down are the enabled services which are not up
+	down []cloudinfo.VolumeService
+	// zones are all volume availability zones, sorted
+	zones []string
+	// unavailableZones are the volume availability zones in which volumes
+	// can't be provisioned, sorted
+	unavailableZones []string
+}
+
+// evaluateHealth determines which volume availability zones can't be used.
+// A zone is unavailable if it has cinder-volume services but none of them
+// are up, and all zones are unavailable if no cinder-scheduler is up.
+// Services which have been disabled by an administrator are ignored.
+func evaluateHealth(services []cloudinfo.VolumeService, volumeZones []string) *serviceHealth {
+	health := &serviceHealth{}
+	zones := sets.New(volumeZones...)
+	zonesWithVolumeService := sets.New[string]()
+	zonesWithVolumeServiceUp := sets.New[string]()
+	schedulers, schedulersUp := 0, 0
+
+	for _, service := range services {
+		if service.Binary != volumeBinary && service.Binary != schedulerBinary {
+			continue
+		}
+		health.services = append(health.services, service)
+		if service.Status == "disabled" {
+			continue
+		}
+
+		up := service.State == "up"
+		if !up {
+			health.down = append(health.down, service)
+		}
+
+		switch service.Binary {
+		case volumeBinary:
+			zones.Insert(service.Zone)
+			zonesWithVolumeService.Insert(service.Zone)
+			if up {
+				zonesWithVolumeServiceUp.Insert(service.Zone)
+			}
+		case schedulerBinary:
+			schedulers++
+			if up {
+				schedulersUp++
+			}
+		}
+	}
+
+	health.zones = sets.List(zones)
+	if schedulers > 0 && schedulersUp == 0 {
+		health.unavailableZones = health.zones
+	} else {
+		health.unavailableZones = sets.List(zonesWithVolumeService.Difference(zonesWithVolumeServiceUp))
+	}
+
+	return health
+}
+
+func (h *serviceHealth) message() string {
+	var down []string
+	for _, service := range h.down {
+		down = append(down, fmt.Sprintf("%s on %s in availability zone %s (state %s since %s)", service.Binary, service.Host, service.Zone, service.State, service.UpdatedAt.UTC().Format(time.RFC3339)))
+	}
+	sort.Strings(down)
+
+	message := fmt.Sprintf("Cinder services are down: %s", strings.Join(down, ", "))
+	if len(h.unavailableZones) > 0 {
+		message += fmt.Sprintf(". Volumes can't be provisioned in availability zones: %s", strings.Join(h.unavailableZones, ", "))
+	}
+	return message
+}
+
+func (h *serviceHealth) exportMetrics() {
+	serviceUp.Reset()
+	for _, service := range h.services {
+		value := 0.0
+		if service.State == "up" {
+			value = 1
+		}
+		serviceUp.WithLabelValues(service.Binary, service.Host, service.Zone, service.Status).Set(value)
+	}
+
+	zoneAvailable.Reset()
+	unavailable := sets.New(h.unavailableZones...)
+	for _, zone := range h.zones {
+		value := 1.0
+		if unavailable.Has(zone) {
+			value = 0
+		}
+		zoneAvailable.WithLabelValues(zone).Set(value)
+	}
+}
@@ -0,0 +1,328 @@
+package servicehealth
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/onsi/gomega"
+	configv1 "github.com/openshift/api/config/v1"
+	operatorv1 "github.com/openshift/api/operator/v1"
+	configv1listers "github.com/openshift/client-go/config/listers/config/v1"
+	"github.com/openshift/library-go/pkg/controller/factory"
+	"github.com/openshift/library-go/pkg/operator/events"
+	"github.com/openshift/library-go/pkg/operator/v1helpers"
+	corev1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	fakekube "k8s.io/client-go/kubernetes/fake"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	storagelisters "k8s.io/client-go/listers/storage/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/component-base/metrics/legacyregistry"
+	"k8s.io/component-base/metrics/testutil"
+
+	"github.com/openshift/openstack-cinder-csi-driver-operator/pkg/cloudinfo"
+	"github.com/openshift/openstack-cinder-csi-driver-operator/pkg/cloudinfo/fake"
+	"github.com/openshift/openstack-cinder-csi-driver-operator/pkg/util"
+)
+
+func TestEvaluateHealth(t *testing.T) {
+	tc := []struct {
+		name                     string
+		services                 []cloudinfo.VolumeService
+		expectedDown             []string
+		expectedUnavailableZones []string
+	}{
+		{
+			name: "All up",
+			services: []cloudinfo.VolumeService{
+				{Binary: schedulerBinary, Host: "cinder", Zone: "nova", State: "up", Status: "enabled"},
+				{Binary: volumeBinary, Host: "host1@lvm", Zone: "az1", State: "up", Status: "enabled"},
+				{Binary: volumeBinary, Host: "host2@lvm", Zone: "az2", State: "up", Status: "enabled"},
+			},
+		}, {
+			name: "One of several volume services in a zone down",
+			services: []cloudinfo.VolumeService{
+				{Binary: schedulerBinary, Host: "cinder", Zone: "nova", State: "up", Status: "enabled"},
+				{Binary: volumeBinary, Host: "host1@lvm", Zone: "az1", State: "down", Status: "enabled"},
+				{Binary: volumeBinary, Host: "host1@ceph", Zone: "az1", State: "up", Status: "enabled"},
+				{Binary: volumeBinary, Host: "host2@lvm", Zone: "az2", State: "up", Status: "enabled"},
+			},
+			expectedDown: []string{"host1@lvm"},
+		}, {
+			name: "All volume services in a zone down",
+			services: []cloudinfo.VolumeService{
+				{Binary: schedulerBinary, Host: "cinder", Zone: "nova", State: "up", Status: "enabled"},
+				{Binary: volumeBinary, Host: "host1@lvm", Zone: "az1", State: "down", Status: "enabled"},
+				{Binary: volumeBinary, Host: "host2@lvm", Zone: "az2", State: "up", Status: "enabled"},
+			},
+			expectedDown:             []string{"host1@lvm"},
+			expectedUnavailableZones: []string{"az1"},
+		}, {
+			name: "All schedulers down",
+			services: []cloudinfo.VolumeService{
+				{Binary: schedulerBinary, Host: "cinder1", Zone: "nova", State: "down", Status: "enabled"},
+				{Binary: schedulerBinary, Host: "cinder2", Zone: "nova", State: "down", Status: "enabled"},
+				{Binary: volumeBinary, Host: "host1@lvm", Zone: "az1", State: "up", Status: "enabled"},
+				{Binary: volumeBinary, Host: "host2@lvm", Zone: "az2", State: "up", Status: "enabled"},
+			},
+			expectedDown:             []string{"cinder1", "cinder2"},
+			expectedUnavailableZones: []string{"az1", "az2", "az3"},
+		}, {
+			name: "Disabled and other services are ignored",
+			services: []cloudinfo.VolumeService{
+				{Binary: schedulerBinary, Host: "cinder", Zone: "nova", State: "up", Status: "enabled"},
+				{Binary: "cinder-backup", Host: "cinder", Zone: "nova", State: "down", Status: "enabled"},
+				{Binary: volumeBinary, Host: "host1@lvm", Zone: "az1", State: "down", Status: "disabled"},
+				{Binary: volumeBinary, Host: "host2@lvm", Zone: "az2", State: "up", Status: "enabled"},
+			},
+		},
+	}
+
+	for _, tc := range tc {
+		t.Run(tc.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			health := evaluateHealth(tc.services, []string{"az1", "az2", "az3"})
+
+			var down []string
+			for _, service := range health.down {
+				down = append(down, service.Host)
+			}
+			g.Expect(down).To(Equal(tc.expectedDown))
+			g.Expect(health.unavailableZones).To(ConsistOf(tc.expectedUnavailableZones))
+		})
+	}
+}
+
+func TestSync(t *testing.T) {
+	tc := []struct {
+		name                string
+		sourceData          map[string]string
+		services            []fake.VolumeService
+		failServices        int
+		expectedStatus      operatorv1.ConditionStatus
+		expectedReason      string
+		expectedUnavailable []string
+		errMsg              string
+	}{
+		{
+			name:           "All up",
+			expectedStatus: operatorv1.ConditionFalse,
+			expectedReason: "AsExpected",
+		}, {
+			name: "Zone unavailable",
+			services: []fake.VolumeService{
+				{Binary: "cinder-volume", Host: "host1@lvm", Zone: "az1", State: "down", Status: "enabled"},
+			},
+			expectedStatus: operatorv1.ConditionTrue,
+			expectedReason: "AvailabilityZonesUnavailable",
+		}, {
+			name:       "Zone unavailable with StorageClasses marked",
+			sourceData: map[string]string{"mark_unavailable_zones": "true"},
+			services: []fake.VolumeService{
+				{Binary: "cinder-volume", Host: "host1@lvm", Zone: "az1", State: "down", Status: "enabled"},
+			},
+			expectedStatus:      operatorv1.ConditionTrue,
+			expectedReason:      "AvailabilityZonesUnavailable",
+			expectedUnavailable: []string{"standard-csi-az-az1"},
+		}, {
+			name:           "Services forbidden",
+			failServices:   http.StatusForbidden,
+			expectedStatus: operatorv1.ConditionUnknown,
+			expectedReason: "ServicesForbidden",
+		}, {
+			name:           "Services unavailable",
+			failServices:   http.StatusInternalServerError,
+			expectedStatus: operatorv1.ConditionUnknown,
+			expectedReason: "ServicesUnavailable",
+			errMsg:         "failed to list volume services",
+		},
+	}
+
+	for _, tc := range tc {
+		t.Run(tc.name, func(t *testing.T) {
+			g := NewWithT(t)
+			ctx := context.TODO()
+
+			cloud := fake.New()
+			defer cloud.Close()
+			cloud.ComputeZones = fake.Zones("az1", "az2")
+			cloud.VolumeZones = fake.Zones("az1", "az2")
+			cloud.VolumeServices = []fake.VolumeService{
+				{Binary: "cinder-scheduler", Host: "cinder", Zone: "nova", State: "up", Status: "enabled"},
+				{Binary: "cinder-volume", Host: "host1@lvm", Zone: "az1", State: "up", Status: "enabled"},
+				{Binary: "cinder-volume", Host: "host2@lvm", Zone: "az2", State: "up", Status: "enabled"},
+			}
+			for _, service := range tc.services {
+				for i := range cloud.VolumeServices {
+					if cloud.VolumeServices[i].Host == service.Host {
+						cloud.VolumeServices[i] = service
+					}
+				}
+			}
+			if tc.failServices != 0 {
+				cloud.Fail("volume", http.MethodGet, "/os-services", tc.failServices)
+			}
+
+			provider := cloudinfo.NewProvider(cloud.ClientOpts(), nil)
+			cloudInfo := cloudinfo.NewCache(provider)
+			_, _, err := cloudInfo.Refresh(ctx, time.Hour)
+			g.Expect(err).ToNot(HaveOccurred())
+
+			configMaps := []*corev1.ConfigMap{
+				{
+					ObjectMeta: metav1.ObjectMeta{Name: "cloud-provider-config", Namespace: util.OpenShiftConfigNamespace},
+					Data:       map[string]string{"config": "[Global]\n"},
+				}, {
+					ObjectMeta: metav1.ObjectMeta{Name: util.CinderConfigName, Namespace: util.DefaultNamespace},
+					Data:       map[string]string{"enable_topology": "true"},
+				},
+			}
+			for k, v := range tc.sourceData {
+				configMaps[0].Data[k] = v
+			}
+
+			c, operatorClient, kubeClient := newTestServiceHealthController(g, cloudInfo, provider, configMaps)
+
+			err = c.sync(ctx, factory.NewSyncContext("CinderServiceHealth", events.NewInMemoryRecorder("test")))
+			if tc.errMsg != "" {
+				g.Expect(err).To(MatchError(ContainSubstring(tc.errMsg)))
+			} else {
+				g.Expect(err).ToNot(HaveOccurred())
+			}
+
+			_, status, _, err := operatorClient.GetOperatorState()
+			g.Expect(err).ToNot(HaveOccurred())
+			condition := v1helpers.FindOperatorCondition(status.Conditions, conditionType)
+			g.Expect(condition).ToNot(BeNil())
+			g.Expect(condition.Status).To(Equal(tc.expectedStatus))
+			g.Expect(condition.Reason).To(Equal(tc.expectedReason), condition.Message)
+
+			if tc.errMsg != "" || tc.failServices != 0 {
+				return
+			}
+
+			expectedAvailable := map[string]float64{"az1": 1, "az2": 1}
+			if condition.Reason == "AvailabilityZonesUnavailable" {
+				expectedAvailable["az1"] = 0
+			}
+			for zone, expected := range expectedAvailable {
+				g.Expect(testutil.GetGaugeMetricValue(zoneAvailable.WithLabelValues(zone))).To(Equal(expected), zone)
+			}
+
+			scs, err := kubeClient.StorageV1().StorageClasses().List(ctx, metav1.ListOptions{})
+			g.Expect(err).ToNot(HaveOccurred())
+			var unavailable []string
+			for _, sc := range scs.Items {
+				if _, ok := sc.Annotations[unavailableAnnotation]; ok {
+					unavailable = append(unavailable, sc.Name)
+				}
+			}
+			g.Expect(unavailable).To(Equal(tc.expectedUnavailable))
+		})
+	}
+}
+
+func TestMetricsExported(t *testing.T) {
+	g := NewWithT(t)
+	ctx := context.TODO()
+
+	cloud := fake.New()
+	defer cloud.Close()
+	cloud.ComputeZones = fake.Zones("az1", "az2")
+	cloud.VolumeZones = fake.Zones("az1", "az2")
+	cloud.VolumeServices = []fake.VolumeService{
+		{Binary: "cinder-scheduler", Host: "cinder", Zone: "nova", State: "up", Status: "enabled"},
+		{Binary: "cinder-volume", Host: "host1@lvm", Zone: "az1", State: "down", Status: "enabled"},
+		{Binary: "cinder-volume", Host: "host2@lvm", Zone: "az2", State: "up", Status: "enabled"},
+	}
+
+	provider := cloudinfo.NewProvider(cloud.ClientOpts(), nil)
+	cloudInfo := cloudinfo.NewCache(provider)
+	_, _, err := cloudInfo.Refresh(ctx, time.Hour)
+	g.Expect(err).ToNot(HaveOccurred())
+
+	configMaps := []*corev1.ConfigMap{
+		{
+			ObjectMeta: metav1.ObjectMeta{Name: "cloud-provider-config", Namespace: util.OpenShiftConfigNamespace},
+			Data:       map[string]string{"config": "[Global]\n"},
+		}, {
+			ObjectMeta: metav1.ObjectMeta{Name: util.CinderConfigName, Namespace: util.DefaultNamespace},
+			Data:       map[string]string{"enable_topology": "true"},
+		},
+	}
+	c, _, _ := newTestServiceHealthController(g, cloudInfo, provider, configMaps)
+	g.Expect(c.sync(ctx, factory.NewSyncContext("CinderServiceHealth", events.NewInMemoryRecorder("test")))).To(Succeed())
+
+	// the gauges are served by the operator's metrics endpoint
+	g.Expect(testutil.GatherAndCompare(legacyregistry.DefaultGatherer, strings.NewReader(`
+# HELP openshift_openstack_cinder_csi_driver_operator_volume_service_up [ALPHA] Whether a cinder-volume or cinder-scheduler service is up (1) or down (0), labeled by binary, host, volume availability zone and whether the service is enabled or disabled.
+# TYPE openshift_openstack_cinder_csi_driver_operator_volume_service_up gauge
+openshift_openstack_cinder_csi_driver_operator_volume_service_up{binary="cinder-scheduler",host="cinder",status="enabled",zone="nova"} 1
+openshift_openstack_cinder_csi_driver_operator_volume_service_up{binary="cinder-volume",host="host1@lvm",status="enabled",zone="az1"} 0
+openshift_openstack_cinder_csi_driver_operator_volume_service_up{binary="cinder-volume",host="host2@lvm",status="enabled",zone="az2"} 1
+# HELP openshift_openstack_cinder_csi_driver_operator_volume_zone_available [ALPHA] Whether the Cinder services needed to provision volumes in a volume availability zone are up (1) or not (0), labeled by zone.
+# TYPE openshift_openstack_cinder_csi_driver_operator_volume_zone_available gauge
+openshift_openstack_cinder_csi_driver_operator_volume_zone_available{zone="az1"} 0
+openshift_openstack_cinder_csi_driver_operator_volume_zone_available{zone="az2"} 1
+`),
+		"openshift_openstack_cinder_csi_driver_operator_volume_service_up",
+		"openshift_openstack_cinder_csi_driver_operator_volume_zone_available",
+	)).To(Succeed())
+}
+
+func newTestServiceHealthController(g *WithT, cloudInfo *cloudinfo.Cache, provider cloudinfo.Provider, configMaps []*corev1.ConfigMap) (*ServiceHealthController, v1helpers.OperatorClient, *fakekube.Clientset) {
+	configMapIndexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+	for _, cm := range configMaps {
+		g.Expect(configMapIndexer.Add(cm)).To(Succeed())
+	}
+
+	storageClassIndexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	var scs []*storagev1.StorageClass
+	for _, zone := range []string{"az1", "az2"} {
+		scs = append(scs, &storagev1.StorageClass{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        "standard-csi-az-" + zone,
+				Labels:      map[string]string{generatedByLabel: generatorZone},
+				Annotations: map[string]string{zoneAnnotation: zone},
+			},
+		})
+	}
+	kubeClient := fakekube.NewSimpleClientset()
+	for _, sc := range scs {
+		g.Expect(storageClassIndexer.Add(sc)).To(Succeed())
+		g.Expect(kubeClient.Tracker().Add(sc)).To(Succeed())
+	}
+
+	infraIndexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	g.Expect(infraIndexer.Add(&configv1.Infrastructure{
+		ObjectMeta: metav1.ObjectMeta{Name: "cluster"},
+		Spec: configv1.InfrastructureSpec{
+			CloudConfig: configv1.ConfigMapFileReference{Name: "cloud-provider-config"},
+		},
+	})).To(Succeed())
+
+	operatorClient := v1helpers.NewFakeOperatorClient(
+		&operatorv1.OperatorSpec{ManagementState: operatorv1.Managed},
+		&operatorv1.OperatorStatus{},
+		nil,
+	)
+
+	c := &ServiceHealthController{
+		operatorClient:       operatorClient,
+		kubeClient:           kubeClient,
+		storageClassLister:   storagelisters.NewStorageClassLister(storageClassIndexer),
+		configMapLister:      corelisters.NewConfigMapLister(configMapIndexer),
+		targetConfigLister:   corelisters.NewConfigMapLister(configMapIndexer),
+		infrastructureLister: configv1listers.NewInfrastructureLister(infraIndexer),
+		cloudInfo:            cloudInfo,
+		provider:             provider,
+		eventRecorder:        events.NewInMemoryRecorder("test"),
+	}
+
+	return c, operatorClient, kubeClient
+}
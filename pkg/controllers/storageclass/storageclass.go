@@ -0,0 +1,406 @@
+package storageclass
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	operatorv1 "github.com/openshift/api/operator/v1"
+	configinformers "github.com/openshift/client-go/config/informers/externalversions"
+	configv1listers "github.com/openshift/client-go/config/listers/config/v1"
+	"github.com/openshift/library-go/pkg/controller/factory"
+	"github.com/openshift/library-go/pkg/operator/events"
+	"github.com/openshift/library-go/pkg/operator/resource/resourceapply"
+	"github.com/openshift/library-go/pkg/operator/resource/resourceread"
+	"github.com/openshift/library-go/pkg/operator/v1helpers"
+	corev1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/kubernetes"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	storagelisters "k8s.io/client-go/listers/storage/v1"
+	"k8s.io/klog/v2"
+
+	"github.com/openshift/openstack-cinder-csi-driver-operator/assets"
+	"github.com/openshift/openstack-cinder-csi-driver-operator/pkg/cloudinfo"
+	"github.com/openshift/openstack-cinder-csi-driver-operator/pkg/controllers/config"
+	"github.com/openshift/openstack-cinder-csi-driver-operator/pkg/util"
+)
+
+const (
+	// generatedByLabel marks the StorageClasses managed by this controller.
+	// The value records which generator produced the StorageClass.
+	generatedByLabel = "cinder.csi.openstack.org/generated-by"
+	// volumeTypeAnnotation records the unmodified name of the Cinder volume
+	// type a StorageClass was generated for
+	volumeTypeAnnotation = "cinder.csi.openstack.org/volume-type"
+	// zoneAnnotation records the unmodified name of the volume availability
+	// zone a StorageClass was generated for
+	zoneAnnotation = "cinder.csi.openstack.org/availability-zone"
+
+	// descriptionAnnotation is shown to users choosing a StorageClass
+	descriptionAnnotation = "kubernetes.io/description"
+
+	generatorVolumeType  = "volume-type"
+	generatorZone        = "availability-zone"
+	generatorSharedBlock = "shared-block"
+
+	// multiattachConditionType reports whether ReadWriteMany block volumes
+	// can be provisioned. It is informational only.
+	multiattachConditionType = "CinderMultiattachSupported"
+
+	topologyKey = "topology.cinder.csi.openstack.org/zone"
+
+	defaultScAnnotationKey = "storageclass.kubernetes.io/is-default-class"
+
+	storageClassPrefix = "standard-csi-"
+)
+
+var invalidNameChars = regexp.MustCompile(`[^a-z0-9.-]+`)
+
+// This StorageClassController generates additional StorageClasses based on
+// the information the operator has collected about the OpenStack cloud. Any
+// StorageClass previously generated by this controller that is no longer
+// required is deleted.
+type StorageClassController struct {
+	operatorClient       v1helpers.OperatorClient
+	kubeClient           kubernetes.Interface
+	storageClassLister   storagelisters.StorageClassLister
+	configMapLister      corelisters.ConfigMapLister
+	targetConfigLister   corelisters.ConfigMapLister
+	infrastructureLister configv1listers.InfrastructureLister
+	cloudInfo            *cloudinfo.Cache
+	eventRecorder        events.Recorder
+}
+
+func NewStorageClassController(
+	operatorClient v1helpers.OperatorClient,
+	kubeClient kubernetes.Interface,
+	informers v1helpers.KubeInformersForNamespaces,
+	configInformers configinformers.SharedInformerFactory,
+	cloudInfo *cloudinfo.Cache,
+	eventRecorder events.Recorder) factory.Controller {
+
+	configMapInformer := informers.InformersFor(util.OpenShiftConfigNamespace)
+	targetConfigInformer := informers.InformersFor(util.DefaultNamespace)
+	storageClassInformer := informers.InformersFor("").Storage().V1().StorageClasses()
+	c := &StorageClassController{
+		operatorClient:       operatorClient,
+		kubeClient:           kubeClient,
+		storageClassLister:   storageClassInformer.Lister(),
+		configMapLister:      configMapInformer.Core().V1().ConfigMaps().Lister(),
+		targetConfigLister:   targetConfigInformer.Core().V1().ConfigMaps().Lister(),
+		infrastructureLister: configInformers.Config().V1().Infrastructures().Lister(),
+		cloudInfo:            cloudInfo,
+		eventRecorder:        eventRecorder.WithComponentSuffix("GeneratedStorageClass"),
+	}
+	// The cloud info is refreshed by the ConfigSyncController and there's no
+	// informer for it, so we resync frequently to pick up changes
+	return factory.New().WithSync(c.sync).ResyncEvery(time.Minute).WithSyncDegradedOnError(operatorClient).WithInformers(
+		operatorClient.Informer(),
+		configMapInformer.Core().V1().ConfigMaps().Informer(),
+		targetConfigInformer.Core().V1().ConfigMaps().Informer(),
+		storageClassInformer.Informer(),
+	).ToController("GeneratedStorageClass", eventRecorder)
+}
+
+func (c *StorageClassController) sync(ctx context.Context, syncCtx factory.SyncContext) error {
+	opSpec, _, _, err := c.operatorClient.GetOperatorState()
+	if err != nil {
+		return err
+	}
+	if opSpec.ManagementState != operatorv1.Managed {
+		return nil
+	}
+
+	state, err := config.GetTopologyState(c.configMapLister, c.targetConfigLister, c.infrastructureLister, c.cloudInfo)
+	if err != nil {
+		return err
+	}
+	if state == nil {
+		return nil
+	}
+
+	template, err := storageClassTemplate()
+	if err != nil {
+		return err
+	}
+
+	// without the volume types, the StorageClasses which depend on them
+	// can't be told apart from ones which are no longer needed
+	if (state.Settings.VolumeTypeStorageClasses || state.Settings.SharedBlockStorageClass) && state.CloudInfo.VolumeTypesErr != nil {
+		return fmt.Errorf("cannot generate StorageClasses for volume types: %w", state.CloudInfo.VolumeTypesErr)
+	}
+
+	var scs []*storagev1.StorageClass
+	if state.Settings.VolumeTypeStorageClasses {
+		scs = append(scs, volumeTypeStorageClasses(template, state.CloudInfo, state.Settings)...)
+	}
+	if state.Settings.ZoneStorageClasses && state.TopologyEnabled {
+		scs = append(scs, zoneStorageClasses(template, state.CloudInfo, state.ZoneMapping)...)
+	}
+
+	multiattachTypes := state.CloudInfo.MultiattachVolumeTypes()
+	var sharedBlock *storagev1.StorageClass
+	if state.Settings.SharedBlockStorageClass {
+		sharedBlock, err = sharedBlockStorageClass(template, multiattachTypes, state.Settings)
+		if err != nil {
+			return err
+		}
+		if sharedBlock != nil {
+			scs = append(scs, sharedBlock)
+		}
+	}
+
+	expected := map[string]*storagev1.StorageClass{}
+	for _, sc := range scs {
+		if _, ok := expected[sc.Name]; ok {
+			klog.Warningf("Skipping %s StorageClass %s as its name conflicts with another generated StorageClass", sc.Labels[generatedByLabel], sc.Name)
+			continue
+		}
+		expected[sc.Name] = sc
+	}
+
+	err = c.applyStorageClasses(ctx, expected)
+	if err != nil {
+		return err
+	}
+
+	return c.updateMultiattachCondition(ctx, multiattachTypes, sharedBlock)
+}
+
+// updateMultiattachCondition reports whether any volume type supports
+// multiattach and so can be used for ReadWriteMany block volumes
+func (c *StorageClassController) updateMultiattachCondition(ctx context.Context, multiattachTypes []cloudinfo.VolumeType, sharedBlock *storagev1.StorageClass) error {
+	condition := operatorv1.OperatorCondition{
+		Type:    multiattachConditionType,
+		Status:  operatorv1.ConditionFalse,
+		Reason:  "NoMultiattachVolumeTypes",
+		Message: "No volume type supports multiattach; ReadWriteMany block volumes cannot be provisioned",
+	}
+
+	if len(multiattachTypes) > 0 {
+		var names []string
+		for _, t := range multiattachTypes {
+			names = append(names, t.Name)
+		}
+
+		condition.Status = operatorv1.ConditionTrue
+		condition.Reason = "MultiattachVolumeTypesFound"
+		if sharedBlock != nil {
+			condition.Message = fmt.Sprintf("Volume types %s support multiattach; ReadWriteMany block volumes can be provisioned using StorageClass %s", strings.Join(names, ", "), sharedBlock.Name)
+		} else {
+			condition.Message = fmt.Sprintf("Volume types %s support multiattach; ReadWriteMany block volumes can be provisioned using a StorageClass with one of these types", strings.Join(names, ", "))
+		}
+	}
+
+	_, _, err := v1helpers.UpdateStatus(ctx, c.operatorClient, v1helpers.UpdateConditionFn(condition))
+	return err
+}
+
+// storageClassTemplate returns the static StorageClass, stripped of its name
+// and default annotation, for use as the base of generated StorageClasses
+func storageClassTemplate() (*storagev1.StorageClass, error) {
+	scBytes, err := assets.ReadFile("storageclass.yaml")
+	if err != nil {
+		return nil, err
+	}
+
+	sc := resourceread.ReadStorageClassV1OrDie(scBytes)
+	sc.Name = ""
+	delete(sc.Annotations, defaultScAnnotationKey)
+	if sc.Labels == nil {
+		sc.Labels = map[string]string{}
+	}
+	if sc.Annotations == nil {
+		sc.Annotations = map[string]string{}
+	}
+	if sc.Parameters == nil {
+		sc.Parameters = map[string]string{}
+	}
+
+	return sc, nil
+}
+
+// applyStorageClasses creates or updates the expected StorageClasses and
+// deletes any previously generated StorageClass that is no longer expected
+func (c *StorageClassController) applyStorageClasses(ctx context.Context, expected map[string]*storagev1.StorageClass) error {
+	names := make([]string, 0, len(expected))
+	for name := range expected {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		existing, err := c.storageClassLister.Get(name)
+		if err != nil && !errors.IsNotFound(err) {
+			return err
+		}
+		if existing != nil && existing.Labels[generatedByLabel] == "" {
+			// don't take over StorageClasses created by the user
+			klog.Warningf("Not generating StorageClass %s as a StorageClass with this name already exists", name)
+			continue
+		}
+
+		_, _, err = resourceapply.ApplyStorageClass(ctx, c.kubeClient.StorageV1(), c.eventRecorder, expected[name])
+		if err != nil {
+			return fmt.Errorf("failed to apply StorageClass %s: %w", name, err)
+		}
+	}
+
+	selector, err := labels.Parse(generatedByLabel)
+	if err != nil {
+		return err
+	}
+	generated, err := c.storageClassLister.List(selector)
+	if err != nil {
+		return err
+	}
+	for _, sc := range generated {
+		if _, ok := expected[sc.Name]; ok {
+			continue
+		}
+		klog.Infof("Deleting StorageClass %s as it is no longer required", sc.Name)
+		_, _, err = resourceapply.DeleteStorageClass(ctx, c.kubeClient.StorageV1(), c.eventRecorder, sc)
+		if err != nil {
+			return fmt.Errorf("failed to delete StorageClass %s: %w", sc.Name, err)
+		}
+	}
+
+	return nil
+}
+
+// volumeTypeStorageClasses generates a StorageClass for each of the volume
+// types permitted by the settings
+func volumeTypeStorageClasses(template *storagev1.StorageClass, cloudInfo *cloudinfo.CloudInfo, settings *config.Settings) []*storagev1.StorageClass {
+	var scs []*storagev1.StorageClass
+
+	for _, volumeType := range cloudInfo.VolumeTypes {
+		if !settings.IncludesVolumeType(volumeType.Name) {
+			continue
+		}
+
+		name := storageClassName(volumeType.Name)
+		if name == "" {
+			klog.Warningf("Skipping volume type %q as no valid StorageClass name could be derived from it", volumeType.Name)
+			continue
+		}
+
+		sc := newStorageClass(template, name, generatorVolumeType)
+		sc.Annotations[volumeTypeAnnotation] = volumeType.Name
+		sc.Parameters["type"] = volumeType.Name
+		scs = append(scs, sc)
+	}
+
+	return scs
+}
+
+// zoneStorageClasses generates a StorageClass for each volume availability
+// zone, restricted to nodes in the compute availability zones that map to it.
+// If there is no mapping, the compute availability zone of the same name is
+// assumed.
+func zoneStorageClasses(template *storagev1.StorageClass, cloudInfo *cloudinfo.CloudInfo, mapping config.ZoneMapping) []*storagev1.StorageClass {
+	var scs []*storagev1.StorageClass
+
+	for _, zone := range cloudInfo.VolumeZones {
+		computeZones := []string{zone}
+		if mapping != nil {
+			computeZones = mapping.ComputeZonesFor(zone)
+			if len(computeZones) == 0 {
+				klog.V(4).Infof("Skipping availability zone %q as no compute availability zone maps to it", zone)
+				continue
+			}
+		}
+
+		name := storageClassName("az-" + zone)
+		if name == "" {
+			klog.Warningf("Skipping availability zone %q as no valid StorageClass name could be derived from it", zone)
+			continue
+		}
+
+		sc := newStorageClass(template, name, generatorZone)
+		sc.Annotations[zoneAnnotation] = zone
+		sc.Parameters["availability"] = zone
+		sc.AllowedTopologies = []corev1.TopologySelectorTerm{
+			{
+				MatchLabelExpressions: []corev1.TopologySelectorLabelRequirement{
+					{
+						Key:    topologyKey,
+						Values: computeZones,
+					},
+				},
+			},
+		}
+		scs = append(scs, sc)
+	}
+
+	return scs
+}
+
+// sharedBlockStorageClass generates a StorageClass for ReadWriteMany block
+// volumes using the configured multiattach volume type or, if none is
+// configured, the first multiattach volume type. nil is returned if there is
+// no multiattach volume type.
+func sharedBlockStorageClass(template *storagev1.StorageClass, multiattachTypes []cloudinfo.VolumeType, settings *config.Settings) (*storagev1.StorageClass, error) {
+	var volumeType string
+	if settings.SharedBlockVolumeType != "" {
+		for _, t := range multiattachTypes {
+			if t.Name == settings.SharedBlockVolumeType {
+				volumeType = t.Name
+				break
+			}
+		}
+		if volumeType == "" {
+			return nil, fmt.Errorf("volume type %q does not exist or does not support multiattach", settings.SharedBlockVolumeType)
+		}
+	} else {
+		if len(multiattachTypes) == 0 {
+			klog.V(4).Infof("Not generating a shared block StorageClass as no volume type supports multiattach")
+			return nil, nil
+		}
+		volumeType = multiattachTypes[0].Name
+	}
+
+	sc := newStorageClass(template, storageClassName("shared-block"), generatorSharedBlock)
+	sc.Annotations[volumeTypeAnnotation] = volumeType
+	sc.Annotations[descriptionAnnotation] = fmt.Sprintf("Cinder volumes of multiattach volume type %s. Use with volumeMode: Block and accessModes: [ReadWriteMany] to share a block device between nodes.", volumeType)
+	sc.Parameters["type"] = volumeType
+
+	return sc, nil
+}
+
+// newStorageClass returns a copy of the template with the given name and
+// generator label set
+func newStorageClass(template *storagev1.StorageClass, name, generator string) *storagev1.StorageClass {
+	sc := template.DeepCopy()
+	sc.ObjectMeta = metav1.ObjectMeta{
+		Name:        name,
+		Labels:      sc.Labels,
+		Annotations: sc.Annotations,
+	}
+	sc.Labels[generatedByLabel] = generator
+
+	return sc
+}
+
+// storageClassName converts an OpenStack resource name into a valid
+// StorageClass name, returning an empty string if this isn't possible
+func storageClassName(name string) string {
+	suffix := invalidNameChars.ReplaceAllString(strings.ToLower(name), "-")
+	suffix = strings.Trim(suffix, "-.")
+	if suffix == "" {
+		return ""
+	}
+
+	name = storageClassPrefix + suffix
+	if len(name) > 253 {
+		return ""
+	}
+
+	return name
+}
@@ -0,0 +1,244 @@
+package storageclass
+
+import (
+	"context"
+	"testing"
+
+	. "github.com/onsi/gomega"
+	operatorv1 "github.com/openshift/api/operator/v1"
+	"github.com/openshift/library-go/pkg/operator/v1helpers"
+	corev1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/openshift/openstack-cinder-csi-driver-operator/pkg/cloudinfo"
+	"github.com/openshift/openstack-cinder-csi-driver-operator/pkg/controllers/config"
+)
+
+func TestStorageClassName(t *testing.T) {
+	tc := []struct {
+		name     string
+		expected string
+	}{
+		{"ssd", "standard-csi-ssd"},
+		{"SSD_Fast", "standard-csi-ssd-fast"},
+		{"__DEFAULT__", "standard-csi-default"},
+		{"tier 1 (replicated)", "standard-csi-tier-1-replicated"},
+		{"___", ""},
+	}
+
+	for _, tc := range tc {
+		t.Run(tc.name, func(t *testing.T) {
+			g := NewWithT(t)
+			g.Expect(storageClassName(tc.name)).To(Equal(tc.expected))
+		})
+	}
+}
+
+func TestVolumeTypeStorageClasses(t *testing.T) {
+	cloudInfo := &cloudinfo.CloudInfo{
+		VolumeTypes: []cloudinfo.VolumeType{
+			{Name: "__DEFAULT__"},
+			{Name: "hdd"},
+			{Name: "ssd"},
+			{Name: "ssd-replicated"},
+		},
+	}
+
+	tc := []struct {
+		name     string
+		data     map[string]string
+		expected []string
+	}{
+		{
+			name:     "No filters",
+			data:     map[string]string{},
+			expected: []string{"standard-csi-default", "standard-csi-hdd", "standard-csi-ssd", "standard-csi-ssd-replicated"},
+		}, {
+			name: "Include filter",
+			data: map[string]string{
+				"volume_type_include": "ssd.*",
+			},
+			expected: []string{"standard-csi-ssd", "standard-csi-ssd-replicated"},
+		}, {
+			name: "Include filter must match the whole name",
+			data: map[string]string{
+				"volume_type_include": "ssd",
+			},
+			expected: []string{"standard-csi-ssd"},
+		}, {
+			name: "Include and exclude filters",
+			data: map[string]string{
+				"volume_type_include": "ssd.*|hdd",
+				"volume_type_exclude": ".*-replicated",
+			},
+			expected: []string{"standard-csi-hdd", "standard-csi-ssd"},
+		},
+	}
+
+	for _, tc := range tc {
+		t.Run(tc.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			settings, err := config.ParseSettings(&corev1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{Name: "cinder-csi-config"},
+				Data:       tc.data,
+			})
+			g.Expect(err).ToNot(HaveOccurred())
+
+			template, err := storageClassTemplate()
+			g.Expect(err).ToNot(HaveOccurred())
+
+			var names []string
+			for _, sc := range volumeTypeStorageClasses(template, cloudInfo, settings) {
+				g.Expect(sc.Labels).To(HaveKeyWithValue(generatedByLabel, generatorVolumeType))
+				g.Expect(sc.Annotations).ToNot(HaveKey(defaultScAnnotationKey))
+				g.Expect(sc.Parameters).To(HaveKeyWithValue("type", sc.Annotations[volumeTypeAnnotation]))
+				g.Expect(sc.Provisioner).To(Equal("cinder.csi.openstack.org"))
+				names = append(names, sc.Name)
+			}
+			g.Expect(names).To(Equal(tc.expected))
+		})
+	}
+}
+
+func TestZoneStorageClasses(t *testing.T) {
+	g := NewWithT(t)
+
+	cloudInfo := &cloudinfo.CloudInfo{
+		ComputeZones: []string{"AZ-1", "az-2"},
+		VolumeZones:  []string{"AZ-1", "az-2"},
+	}
+
+	template, err := storageClassTemplate()
+	g.Expect(err).ToNot(HaveOccurred())
+
+	scs := zoneStorageClasses(template, cloudInfo, nil)
+	g.Expect(scs).To(HaveLen(2))
+
+	for i, name := range []string{"standard-csi-az-az-1", "standard-csi-az-az-2"} {
+		zone := cloudInfo.VolumeZones[i]
+		sc := scs[i]
+		g.Expect(sc.Name).To(Equal(name))
+		g.Expect(sc.Labels).To(HaveKeyWithValue(generatedByLabel, generatorZone))
+		g.Expect(sc.Annotations).To(HaveKeyWithValue(zoneAnnotation, zone))
+		g.Expect(sc.Parameters).To(Equal(map[string]string{"availability": zone}))
+		g.Expect(sc.AllowedTopologies).To(HaveLen(1))
+		g.Expect(sc.AllowedTopologies[0].MatchLabelExpressions).To(ConsistOf(corev1.TopologySelectorLabelRequirement{
+			Key:    topologyKey,
+			Values: []string{zone},
+		}))
+	}
+}
+
+func TestZoneStorageClassesWithMapping(t *testing.T) {
+	g := NewWithT(t)
+
+	cloudInfo := &cloudinfo.CloudInfo{
+		ComputeZones: []string{"az1", "az2", "az3"},
+		VolumeZones:  []string{"cinder1", "cinder2", "cinder3"},
+	}
+	mapping := config.ZoneMapping{"az1": "cinder1", "az2": "cinder1", "az3": "cinder2"}
+
+	template, err := storageClassTemplate()
+	g.Expect(err).ToNot(HaveOccurred())
+
+	// cinder3 is skipped as no compute AZ maps to it
+	scs := zoneStorageClasses(template, cloudInfo, mapping)
+	g.Expect(scs).To(HaveLen(2))
+
+	g.Expect(scs[0].Name).To(Equal("standard-csi-az-cinder1"))
+	g.Expect(scs[0].Parameters).To(Equal(map[string]string{"availability": "cinder1"}))
+	g.Expect(scs[0].AllowedTopologies[0].MatchLabelExpressions[0].Values).To(Equal([]string{"az1", "az2"}))
+
+	g.Expect(scs[1].Name).To(Equal("standard-csi-az-cinder2"))
+	g.Expect(scs[1].Parameters).To(Equal(map[string]string{"availability": "cinder2"}))
+	g.Expect(scs[1].AllowedTopologies[0].MatchLabelExpressions[0].Values).To(Equal([]string{"az3"}))
+}
+
+func TestSharedBlockStorageClass(t *testing.T) {
+	multiattachTypes := []cloudinfo.VolumeType{
+		{Name: "ceph-multiattach", Multiattach: true},
+		{Name: "lvm-multiattach", Multiattach: true},
+	}
+
+	tc := []struct {
+		name             string
+		multiattachTypes []cloudinfo.VolumeType
+		volumeType       string
+		expected         string
+		errMsg           string
+	}{
+		{
+			name:             "First multiattach volume type",
+			multiattachTypes: multiattachTypes,
+			expected:         "ceph-multiattach",
+		}, {
+			name:             "Configured volume type",
+			multiattachTypes: multiattachTypes,
+			volumeType:       "lvm-multiattach",
+			expected:         "lvm-multiattach",
+		}, {
+			name:             "Configured volume type does not support multiattach",
+			multiattachTypes: multiattachTypes,
+			volumeType:       "ssd",
+			errMsg:           `volume type "ssd" does not exist or does not support multiattach`,
+		}, {
+			name: "No multiattach volume types",
+		},
+	}
+
+	for _, tc := range tc {
+		t.Run(tc.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			template, err := storageClassTemplate()
+			g.Expect(err).ToNot(HaveOccurred())
+
+			settings := &config.Settings{SharedBlockStorageClass: true, SharedBlockVolumeType: tc.volumeType}
+			sc, err := sharedBlockStorageClass(template, tc.multiattachTypes, settings)
+			if tc.errMsg != "" {
+				g.Expect(err).To(MatchError(tc.errMsg))
+				return
+			}
+			g.Expect(err).ToNot(HaveOccurred())
+
+			if tc.expected == "" {
+				g.Expect(sc).To(BeNil())
+				return
+			}
+			g.Expect(sc.Name).To(Equal("standard-csi-shared-block"))
+			g.Expect(sc.Labels).To(HaveKeyWithValue(generatedByLabel, generatorSharedBlock))
+			g.Expect(sc.Annotations).To(HaveKeyWithValue(volumeTypeAnnotation, tc.expected))
+			g.Expect(sc.Annotations).To(HaveKey(descriptionAnnotation))
+			g.Expect(sc.Annotations).ToNot(HaveKey(defaultScAnnotationKey))
+			g.Expect(sc.Parameters).To(HaveKeyWithValue("type", tc.expected))
+		})
+	}
+}
+
+func TestUpdateMultiattachCondition(t *testing.T) {
+	g := NewWithT(t)
+	ctx := context.TODO()
+
+	operatorClient := v1helpers.NewFakeOperatorClient(&operatorv1.OperatorSpec{}, &operatorv1.OperatorStatus{}, nil)
+	c := &StorageClassController{operatorClient: operatorClient}
+
+	g.Expect(c.updateMultiattachCondition(ctx, nil, nil)).To(Succeed())
+	_, status, _, err := operatorClient.GetOperatorState()
+	g.Expect(err).ToNot(HaveOccurred())
+	cond := v1helpers.FindOperatorCondition(status.Conditions, multiattachConditionType)
+	g.Expect(cond).ToNot(BeNil())
+	g.Expect(cond.Status).To(Equal(operatorv1.ConditionFalse))
+	g.Expect(cond.Reason).To(Equal("NoMultiattachVolumeTypes"))
+
+	sharedBlock := &storagev1.StorageClass{ObjectMeta: metav1.ObjectMeta{Name: "standard-csi-shared-block"}}
+	g.Expect(c.updateMultiattachCondition(ctx, []cloudinfo.VolumeType{{Name: "multiattach", Multiattach: true}}, sharedBlock)).To(Succeed())
+	_, status, _, err = operatorClient.GetOperatorState()
+	g.Expect(err).ToNot(HaveOccurred())
+	cond = v1helpers.FindOperatorCondition(status.Conditions, multiattachConditionType)
+	g.Expect(cond.Status).To(Equal(operatorv1.ConditionTrue))
+	g.Expect(cond.Reason).To(Equal("MultiattachVolumeTypesFound"))
+	g.Expect(cond.Message).To(ContainSubstring("multiattach"))
+	g.Expect(cond.Message).To(ContainSubstring("standard-csi-shared-block"))
+}
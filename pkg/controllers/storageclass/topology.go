@@ -0,0 +1,48 @@
+package storageclass
+
+import (
+	operatorv1 "github.com/openshift/api/operator/v1"
+	configv1listers "github.com/openshift/client-go/config/listers/config/v1"
+	"github.com/openshift/library-go/pkg/operator/csi/csistorageclasscontroller"
+	storagev1 "k8s.io/api/storage/v1"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/klog/v2"
+
+	"github.com/openshift/openstack-cinder-csi-driver-operator/pkg/cloudinfo"
+	"github.com/openshift/openstack-cinder-csi-driver-operator/pkg/controllers/config"
+)
+
+// WithZoneMappingHook returns a hook for the default StorageClass that sets
+// the 'availability' parameter when topology is enabled and all compute
+// availability zones map to a single, differently named volume availability
+// zone. Without this, the driver would try to create volumes in the volume
+// availability zone named after the node's compute availability zone.
+func WithZoneMappingHook(
+	configMapLister corelisters.ConfigMapLister,
+	targetConfigLister corelisters.ConfigMapLister,
+	infrastructureLister configv1listers.InfrastructureLister,
+	cloudInfoCache *cloudinfo.Cache,
+) csistorageclasscontroller.StorageClassHookFunc {
+	return func(_ *operatorv1.OperatorSpec, sc *storagev1.StorageClass) error {
+		state, err := config.GetTopologyState(configMapLister, targetConfigLister, infrastructureLister, cloudInfoCache)
+		if err != nil {
+			return err
+		}
+		if state == nil || !state.TopologyEnabled || state.ZoneMapping == nil || state.ZoneMapping.IsIdentity() {
+			return nil
+		}
+
+		volumeZones := state.ZoneMapping.VolumeZones()
+		if len(volumeZones) != 1 {
+			klog.Warningf("Compute availability zones map to multiple volume availability zones %v; StorageClass %s will not set an availability zone", volumeZones, sc.Name)
+			return nil
+		}
+
+		if sc.Parameters == nil {
+			sc.Parameters = map[string]string{}
+		}
+		sc.Parameters["availability"] = volumeZones[0]
+
+		return nil
+	}
+}
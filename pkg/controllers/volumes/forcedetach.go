@@ -0,0 +1,251 @@
+package volumes
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	operatorv1 "github.com/openshift/api/operator/v1"
+	configinformers "github.com/openshift/client-go/config/informers/externalversions"
+	configv1listers "github.com/openshift/client-go/config/listers/config/v1"
+	"github.com/openshift/library-go/pkg/controller/factory"
+	"github.com/openshift/library-go/pkg/operator/events"
+	"github.com/openshift/library-go/pkg/operator/v1helpers"
+	storagev1 "k8s.io/api/storage/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/client-go/kubernetes"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	storagelisters "k8s.io/client-go/listers/storage/v1"
+	"k8s.io/klog/v2"
+
+	"github.com/openshift/openstack-cinder-csi-driver-operator/pkg/cloudinfo"
+	"github.com/openshift/openstack-cinder-csi-driver-operator/pkg/controllers/config"
+	"github.com/openshift/openstack-cinder-csi-driver-operator/pkg/util"
+)
+
+const (
+	// attacherFinalizer is set on VolumeAttachments by the external-attacher
+	// and only removed once the volume has been detached
+	attacherFinalizer = "external-attacher/cinder-csi-openstack-org"
+
+	forceDetachResyncInterval = 5 * time.Minute
+)
+
+// This ForceDetachController detaches volumes from Nova servers which were
+// deleted outside of Kubernetes, along with their Node. Cinder keeps such
+// volumes in-use, so they can't be attached to any other node and the pods
+// using them, e.g. of StatefulSets, can't be moved. Once a volume is no
+// longer attached to a deleted server, the VolumeAttachments of deleted Nodes
+// are removed, including their external-attacher finalizer. It only runs if
+// the force_detach_deleted_servers setting is enabled.
+type ForceDetachController struct {
+	operatorClient         v1helpers.OperatorClient
+	kubeClient             kubernetes.Interface
+	nodeLister             corelisters.NodeLister
+	pvLister               corelisters.PersistentVolumeLister
+	volumeAttachmentLister storagelisters.VolumeAttachmentLister
+	configMapLister        corelisters.ConfigMapLister
+	infrastructureLister   configv1listers.InfrastructureLister
+	provider               cloudinfo.Provider
+	eventRecorder          events.Recorder
+}
+
+func NewForceDetachController(
+	operatorClient v1helpers.OperatorClient,
+	kubeClient kubernetes.Interface,
+	informers v1helpers.KubeInformersForNamespaces,
+	configInformers configinformers.SharedInformerFactory,
+	provider cloudinfo.Provider,
+	eventRecorder events.Recorder) factory.Controller {
+
+	configMapInformer := informers.InformersFor(util.OpenShiftConfigNamespace)
+	nodeInformer := informers.InformersFor("").Core().V1().Nodes()
+	pvInformer := informers.InformersFor("").Core().V1().PersistentVolumes()
+	volumeAttachmentInformer := informers.InformersFor("").Storage().V1().VolumeAttachments()
+	c := &ForceDetachController{
+		operatorClient:         operatorClient,
+		kubeClient:             kubeClient,
+		nodeLister:             nodeInformer.Lister(),
+		pvLister:               pvInformer.Lister(),
+		volumeAttachmentLister: volumeAttachmentInformer.Lister(),
+		configMapLister:        configMapInformer.Core().V1().ConfigMaps().Lister(),
+		infrastructureLister:   configInformers.Config().V1().Infrastructures().Lister(),
+		provider:               provider,
+		eventRecorder:          eventRecorder.WithComponentSuffix("CinderForceDetach"),
+	}
+	return factory.New().WithSync(c.sync).ResyncEvery(forceDetachResyncInterval).WithInformers(
+		operatorClient.Informer(),
+		configMapInformer.Core().V1().ConfigMaps().Informer(),
+	).WithBareInformers(
+		nodeInformer.Informer(),
+		pvInformer.Informer(),
+		volumeAttachmentInformer.Informer(),
+	).ToController("CinderForceDetach", eventRecorder)
+}
+
+func (c *ForceDetachController) sync(ctx context.Context, syncCtx factory.SyncContext) error {
+	opSpec, _, _, err := c.operatorClient.GetOperatorState()
+	if err != nil {
+		return err
+	}
+	if opSpec.ManagementState != operatorv1.Managed {
+		return nil
+	}
+
+	sourceConfig, err := config.GetSourceConfigMap(c.configMapLister, c.infrastructureLister)
+	if err != nil {
+		return err
+	}
+	if sourceConfig == nil {
+		return nil
+	}
+
+	settings, err := config.ParseSettings(sourceConfig)
+	if err != nil {
+		return err
+	}
+	if !settings.ForceDetach {
+		return nil
+	}
+
+	clusterID, err := getClusterID(c.infrastructureLister)
+	if err != nil {
+		return err
+	}
+
+	volumes, err := c.provider.GetClusterVolumes(ctx, clusterID)
+	if err != nil {
+		return err
+	}
+
+	nodes, err := c.nodeLister.List(labels.Everything())
+	if err != nil {
+		return err
+	}
+	nodeNames := sets.New[string]()
+	nodeServers := sets.New[string]()
+	for _, node := range nodes {
+		nodeNames.Insert(node.Name)
+		if serverID := util.ServerIDFromProviderID(node.Spec.ProviderID); serverID != "" {
+			nodeServers.Insert(serverID)
+		}
+	}
+
+	refs, err := newVolumeReferences(c.pvLister, c.volumeAttachmentLister)
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	for _, volume := range volumes {
+		detached, err := c.detachFromDeletedServers(ctx, volume, nodeServers)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if !detached {
+			continue
+		}
+
+		pv := refs.pvs[volume.ID]
+		if pv == nil {
+			continue
+		}
+		for _, va := range refs.volumeAttachments[pv.Name] {
+			if nodeNames.Has(va.Spec.NodeName) {
+				continue
+			}
+			if err := c.removeVolumeAttachment(ctx, va); err != nil {
+				c.eventRecorder.Warningf("VolumeAttachmentRemovalFailed", "Failed to remove VolumeAttachment %s of deleted node %s: %v", va.Name, va.Spec.NodeName, err)
+				errs = append(errs, err)
+			}
+		}
+	}
+
+	return utilerrors.NewAggregate(errs)
+}
+
+// detachFromDeletedServers removes the attachments of the volume to servers
+// which are not Nodes and no longer exist. It returns false if the volume is
+// still attached to a server which exists but is not a Node, as that server
+// may not belong to the cluster or may not have registered yet.
+func (c *ForceDetachController) detachFromDeletedServers(ctx context.Context, volume cloudinfo.Volume, nodeServers sets.Set[string]) (bool, error) {
+	for _, attachment := range volume.Attachments {
+		if nodeServers.Has(attachment.ServerID) {
+			continue
+		}
+
+		exists, err := c.provider.ServerExists(ctx, attachment.ServerID)
+		if err != nil {
+			return false, err
+		}
+		if exists {
+			klog.V(4).Infof("Volume %s is attached to server %s, which exists but is not a Node", volume.ID, attachment.ServerID)
+			return false, nil
+		}
+
+		if err := c.provider.ForceDetachVolume(ctx, volume.ID, attachment.AttachmentID); err != nil {
+			c.eventRecorder.Warningf("ForceDetachFailed", "Failed to detach Cinder volume %s from deleted server %s: %v", volume.ID, attachment.ServerID, err)
+			return false, err
+		}
+		klog.Infof("Detached volume %s from deleted server %s", volume.ID, attachment.ServerID)
+		c.eventRecorder.Eventf("VolumeForceDetached", "Detached Cinder volume %s from server %s, which has been deleted", volume.ID, attachment.ServerID)
+	}
+
+	return true, nil
+}
+
+// removeVolumeAttachment deletes the VolumeAttachment of a deleted node and
+// removes the external-attacher finalizer, which would otherwise keep it
+// forever, as the external-attacher can't detach the volume from a server
+// that doesn't exist
+func (c *ForceDetachController) removeVolumeAttachment(ctx context.Context, va *storagev1.VolumeAttachment) error {
+	client := c.kubeClient.StorageV1().VolumeAttachments()
+
+	if va.DeletionTimestamp == nil {
+		if err := client.Delete(ctx, va.Name, metav1.DeleteOptions{}); err != nil {
+			if errors.IsNotFound(err) {
+				return nil
+			}
+			return fmt.Errorf("failed to delete VolumeAttachment %s: %w", va.Name, err)
+		}
+		klog.Infof("Deleted VolumeAttachment %s of deleted node %s", va.Name, va.Spec.NodeName)
+		c.eventRecorder.Eventf("StaleVolumeAttachmentDeleted", "Deleted VolumeAttachment %s of deleted node %s", va.Name, va.Spec.NodeName)
+
+		// the finalizers may have been updated since va was cached
+		var err error
+		va, err = client.Get(ctx, va.Name, metav1.GetOptions{})
+		if err != nil {
+			if errors.IsNotFound(err) {
+				return nil
+			}
+			return err
+		}
+	}
+
+	var finalizers []string
+	for _, finalizer := range va.Finalizers {
+		if finalizer != attacherFinalizer {
+			finalizers = append(finalizers, finalizer)
+		}
+	}
+	if len(finalizers) == len(va.Finalizers) {
+		return nil
+	}
+
+	va = va.DeepCopy()
+	va.Finalizers = finalizers
+	if _, err := client.Update(ctx, va, metav1.UpdateOptions{}); err != nil {
+		if errors.IsNotFound(err) {
+			return nil
+		}
+		return fmt.Errorf("failed to remove the finalizer of VolumeAttachment %s: %w", va.Name, err)
+	}
+	klog.Infof("Removed the finalizer of VolumeAttachment %s of deleted node %s", va.Name, va.Spec.NodeName)
+	c.eventRecorder.Eventf("StaleVolumeAttachmentFinalizerRemoved", "Removed the %s finalizer of VolumeAttachment %s of deleted node %s", attacherFinalizer, va.Name, va.Spec.NodeName)
+	return nil
+}
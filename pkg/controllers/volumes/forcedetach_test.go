@@ -0,0 +1,197 @@
+package volumes
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	. "github.com/onsi/gomega"
+	configv1 "github.com/openshift/api/config/v1"
+	operatorv1 "github.com/openshift/api/operator/v1"
+	configv1listers "github.com/openshift/client-go/config/listers/config/v1"
+	"github.com/openshift/library-go/pkg/controller/factory"
+	"github.com/openshift/library-go/pkg/operator/events"
+	"github.com/openshift/library-go/pkg/operator/v1helpers"
+	corev1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	fakekube "k8s.io/client-go/kubernetes/fake"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	storagelisters "k8s.io/client-go/listers/storage/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/utils/ptr"
+
+	"github.com/openshift/openstack-cinder-csi-driver-operator/pkg/cloudinfo"
+	"github.com/openshift/openstack-cinder-csi-driver-operator/pkg/cloudinfo/fake"
+	"github.com/openshift/openstack-cinder-csi-driver-operator/pkg/util"
+)
+
+func TestForceDetachSync(t *testing.T) {
+	clusterMetadata := map[string]string{cloudinfo.ClusterMetadataKey: testClusterID}
+	attachedTo := func(serverID string) []fake.VolumeAttachment {
+		return []fake.VolumeAttachment{{AttachmentID: "att-1", ServerID: serverID}}
+	}
+
+	tc := []struct {
+		name                  string
+		disabled              bool
+		serverID              string
+		vaDeleting            bool
+		attachmentsAPIMissing bool
+		expectedStatus        string
+		expectedVA            bool
+		expectedEvents        []string
+	}{
+		{
+			name:           "Disabled",
+			disabled:       true,
+			serverID:       "deleted-server",
+			expectedStatus: "in-use",
+			expectedVA:     true,
+		}, {
+			name:           "Attached to a deleted server",
+			serverID:       "deleted-server",
+			expectedStatus: "available",
+			expectedEvents: []string{"VolumeForceDetached", "StaleVolumeAttachmentDeleted"},
+		}, {
+			name:                  "Attachments API not supported",
+			serverID:              "deleted-server",
+			attachmentsAPIMissing: true,
+			expectedStatus:        "available",
+			expectedEvents:        []string{"VolumeForceDetached", "StaleVolumeAttachmentDeleted"},
+		}, {
+			name:           "VolumeAttachment already being deleted",
+			serverID:       "deleted-server",
+			vaDeleting:     true,
+			expectedStatus: "available",
+			expectedEvents: []string{"VolumeForceDetached", "StaleVolumeAttachmentFinalizerRemoved"},
+		}, {
+			// the volume has moved to another node, but the VolumeAttachment
+			// of the deleted node is left
+			name:           "Attached to a node",
+			serverID:       "node-server-id",
+			expectedStatus: "in-use",
+			expectedEvents: []string{"StaleVolumeAttachmentDeleted"},
+		}, {
+			name:           "Attached to a server which is not a node",
+			serverID:       "fake-server-id",
+			expectedStatus: "in-use",
+			expectedVA:     true,
+		},
+	}
+
+	for _, tc := range tc {
+		t.Run(tc.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			cloud := fake.New()
+			defer cloud.Close()
+			cloud.Volumes = []fake.Volume{
+				{ID: "vol-1", Status: "in-use", Metadata: clusterMetadata, Attachments: attachedTo(tc.serverID)},
+			}
+			if tc.attachmentsAPIMissing {
+				cloud.Fail("volume", http.MethodDelete, "/attachments/att-1", http.StatusNotFound)
+			}
+
+			va := &storagev1.VolumeAttachment{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:       "va-1",
+					Finalizers: []string{attacherFinalizer},
+				},
+				Spec: storagev1.VolumeAttachmentSpec{
+					Attacher: driverName,
+					NodeName: "deleted-node",
+					Source:   storagev1.VolumeAttachmentSource{PersistentVolumeName: ptr.To("pv-1")},
+				},
+			}
+			if tc.vaDeleting {
+				va.DeletionTimestamp = ptr.To(metav1.Now())
+			}
+
+			c, kubeClient, recorder := newTestForceDetachController(g, !tc.disabled, va, cloudinfo.NewProvider(cloud.ClientOpts(), nil))
+
+			g.Expect(c.sync(context.TODO(), factory.NewSyncContext("CinderForceDetach", recorder))).To(Succeed())
+
+			g.Expect(cloud.Volumes[0].Status).To(Equal(tc.expectedStatus))
+			if tc.attachmentsAPIMissing {
+				g.Expect(cloud.Requests("volume", http.MethodPost, "/volumes/vol-1/action")).To(Equal(1))
+			}
+
+			remaining, err := kubeClient.StorageV1().VolumeAttachments().Get(context.TODO(), "va-1", metav1.GetOptions{})
+			if tc.expectedVA {
+				g.Expect(err).ToNot(HaveOccurred())
+				g.Expect(remaining.Finalizers).To(ConsistOf(attacherFinalizer))
+			} else if err == nil {
+				g.Expect(remaining.Finalizers).To(BeEmpty())
+			}
+
+			var events []string
+			for _, event := range recorder.Events() {
+				events = append(events, event.Reason)
+			}
+			g.Expect(events).To(Equal(tc.expectedEvents))
+		})
+	}
+}
+
+func newTestForceDetachController(g *WithT, enabled bool, va *storagev1.VolumeAttachment, provider cloudinfo.Provider) (*ForceDetachController, *fakekube.Clientset, events.InMemoryRecorder) {
+	data := map[string]string{"config": "[Global]\n"}
+	if enabled {
+		data["force_detach_deleted_servers"] = "true"
+	}
+	configMapIndexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+	g.Expect(configMapIndexer.Add(&corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "cloud-provider-config", Namespace: util.OpenShiftConfigNamespace},
+		Data:       data,
+	})).To(Succeed())
+
+	infraIndexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	g.Expect(infraIndexer.Add(&configv1.Infrastructure{
+		ObjectMeta: metav1.ObjectMeta{Name: "cluster"},
+		Spec: configv1.InfrastructureSpec{
+			CloudConfig: configv1.ConfigMapFileReference{Name: "cloud-provider-config"},
+		},
+		Status: configv1.InfrastructureStatus{InfrastructureName: testClusterID},
+	})).To(Succeed())
+
+	nodeIndexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	g.Expect(nodeIndexer.Add(&corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: "node-1"},
+		Spec:       corev1.NodeSpec{ProviderID: "openstack:///node-server-id"},
+	})).To(Succeed())
+
+	pvIndexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	g.Expect(pvIndexer.Add(&corev1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{Name: "pv-1"},
+		Spec: corev1.PersistentVolumeSpec{
+			PersistentVolumeSource: corev1.PersistentVolumeSource{
+				CSI: &corev1.CSIPersistentVolumeSource{Driver: driverName, VolumeHandle: "vol-1"},
+			},
+		},
+	})).To(Succeed())
+
+	vaIndexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	g.Expect(vaIndexer.Add(va)).To(Succeed())
+	kubeClient := fakekube.NewSimpleClientset(va)
+
+	operatorClient := v1helpers.NewFakeOperatorClient(
+		&operatorv1.OperatorSpec{ManagementState: operatorv1.Managed},
+		&operatorv1.OperatorStatus{},
+		nil,
+	)
+	recorder := events.NewInMemoryRecorder("test")
+
+	c := &ForceDetachController{
+		operatorClient:         operatorClient,
+		kubeClient:             kubeClient,
+		nodeLister:             corelisters.NewNodeLister(nodeIndexer),
+		pvLister:               corelisters.NewPersistentVolumeLister(pvIndexer),
+		volumeAttachmentLister: storagelisters.NewVolumeAttachmentLister(vaIndexer),
+		configMapLister:        corelisters.NewConfigMapLister(configMapIndexer),
+		infrastructureLister:   configv1listers.NewInfrastructureLister(infraIndexer),
+		provider:               provider,
+		eventRecorder:          recorder,
+	}
+
+	return c, kubeClient, recorder
+}
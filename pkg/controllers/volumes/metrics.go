@@ -0,0 +1,37 @@
+package volumes
+
+import (
+	"k8s.io/component-base/metrics"
+	"k8s.io/component-base/metrics/legacyregistry"
+)
+
+var (
+	stuckVolumes = metrics.NewGaugeVec(
+		&metrics.GaugeOpts{
+			Name:           "openshift_openstack_cinder_csi_driver_operator_stuck_volumes",
+			Help:           "Number of Cinder volumes of the cluster stuck in a transitional or error status for longer than the threshold, labeled by status.",
+			StabilityLevel: metrics.ALPHA,
+		},
+		[]string{"status"},
+	)
+	orphanedResources = metrics.NewGaugeVec(
+		&metrics.GaugeOpts{
+			Name:           "openshift_openstack_cinder_csi_driver_operator_orphaned_resources",
+			Help:           "Number of Cinder volumes without a PersistentVolume and snapshots without a VolumeSnapshotContent, labeled by resource.",
+			StabilityLevel: metrics.ALPHA,
+		},
+		[]string{"resource"},
+	)
+	orphanedGigabytes = metrics.NewGaugeVec(
+		&metrics.GaugeOpts{
+			Name:           "openshift_openstack_cinder_csi_driver_operator_orphaned_gigabytes",
+			Help:           "Total size in GiB of the orphaned Cinder volumes and snapshots, labeled by resource.",
+			StabilityLevel: metrics.ALPHA,
+		},
+		[]string{"resource"},
+	)
+)
+
+func init() {
+	legacyregistry.MustRegister(stuckVolumes, orphanedResources, orphanedGigabytes)
+}
@@ -0,0 +1,369 @@
+package volumes
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	operatorv1 "github.com/openshift/api/operator/v1"
+	configinformers "github.com/openshift/client-go/config/informers/externalversions"
+	configv1listers "github.com/openshift/client-go/config/listers/config/v1"
+	"github.com/openshift/library-go/pkg/controller/factory"
+	"github.com/openshift/library-go/pkg/operator/events"
+	"github.com/openshift/library-go/pkg/operator/v1helpers"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/klog/v2"
+	"sigs.k8s.io/yaml"
+
+	"github.com/openshift/openstack-cinder-csi-driver-operator/pkg/cloudinfo"
+	"github.com/openshift/openstack-cinder-csi-driver-operator/pkg/controllers/config"
+	"github.com/openshift/openstack-cinder-csi-driver-operator/pkg/util"
+)
+
+const (
+	// OrphanReportName is the config map in the operator namespace listing
+	// the orphaned volumes and snapshots
+	OrphanReportName = "cinder-csi-orphans"
+
+	// orphanGracePeriod is how old a volume or snapshot must be before it
+	// can be considered orphaned, so that those whose PV or
+	// VolumeSnapshotContent is still being created are not reported
+	orphanGracePeriod = time.Hour
+
+	orphanResyncInterval = 30 * time.Minute
+)
+
+var volumeSnapshotContentsResource = schema.GroupVersionResource{
+	Group:    "snapshot.storage.k8s.io",
+	Version:  "v1",
+	Resource: "volumesnapshotcontents",
+}
+
+// deletableStatuses are the statuses in which orphaned volumes and snapshots
+// are deleted. Others are either in use or already being deleted.
+var deletableStatuses = sets.New("available", "error")
+
+// This OrphanController periodically compares the volumes and snapshots the
+// driver has created for this cluster with the PVs and
+// VolumeSnapshotContents, and reports those no longer referenced, which is
+// the case when PVs with the Retain reclaim policy are deleted or when the
+// cluster is restored from a backup. They count towards the project's quota
+// until they are deleted, which is only done automatically if the
+// orphan_deletion_age setting is set.
+type OrphanController struct {
+	operatorClient       v1helpers.OperatorClient
+	kubeClient           kubernetes.Interface
+	dynamicClient        dynamic.Interface
+	pvLister             corelisters.PersistentVolumeLister
+	configMapLister      corelisters.ConfigMapLister
+	reportLister         corelisters.ConfigMapLister
+	infrastructureLister configv1listers.InfrastructureLister
+	provider             cloudinfo.Provider
+	eventRecorder        events.Recorder
+
+	now func() time.Time
+}
+
+func NewOrphanController(
+	operatorClient v1helpers.OperatorClient,
+	kubeClient kubernetes.Interface,
+	dynamicClient dynamic.Interface,
+	informers v1helpers.KubeInformersForNamespaces,
+	configInformers configinformers.SharedInformerFactory,
+	provider cloudinfo.Provider,
+	eventRecorder events.Recorder) factory.Controller {
+
+	configMapInformer := informers.InformersFor(util.OpenShiftConfigNamespace)
+	reportInformer := informers.InformersFor(util.DefaultNamespace)
+	pvInformer := informers.InformersFor("").Core().V1().PersistentVolumes()
+	c := &OrphanController{
+		operatorClient:       operatorClient,
+		kubeClient:           kubeClient,
+		dynamicClient:        dynamicClient,
+		pvLister:             pvInformer.Lister(),
+		configMapLister:      configMapInformer.Core().V1().ConfigMaps().Lister(),
+		reportLister:         reportInformer.Core().V1().ConfigMaps().Lister(),
+		infrastructureLister: configInformers.Config().V1().Infrastructures().Lister(),
+		provider:             provider,
+		eventRecorder:        eventRecorder.WithComponentSuffix("CinderOrphans"),
+		now:                  time.Now,
+	}
+	return factory.New().WithSync(c.sync).ResyncEvery(orphanResyncInterval).WithInformers(
+		operatorClient.Informer(),
+		configMapInformer.Core().V1().ConfigMaps().Informer(),
+	).WithBareInformers(
+		reportInformer.Core().V1().ConfigMaps().Informer(),
+		pvInformer.Informer(),
+	).ToController("CinderOrphans", eventRecorder)
+}
+
+func (c *OrphanController) sync(ctx context.Context, syncCtx factory.SyncContext) error {
+	opSpec, _, _, err := c.operatorClient.GetOperatorState()
+	if err != nil {
+		return err
+	}
+	if opSpec.ManagementState != operatorv1.Managed {
+		return nil
+	}
+
+	sourceConfig, err := config.GetSourceConfigMap(c.configMapLister, c.infrastructureLister)
+	if err != nil {
+		return err
+	}
+	if sourceConfig == nil {
+		return nil
+	}
+
+	settings, err := config.ParseSettings(sourceConfig)
+	if err != nil {
+		return err
+	}
+
+	clusterID, err := getClusterID(c.infrastructureLister)
+	if err != nil {
+		return err
+	}
+
+	volumes, err := c.provider.GetClusterVolumes(ctx, clusterID)
+	if err != nil {
+		return err
+	}
+	snapshots, err := c.provider.GetClusterSnapshots(ctx, clusterID)
+	if err != nil {
+		return err
+	}
+
+	pvs, err := persistentVolumesByVolumeID(c.pvLister)
+	if err != nil {
+		return err
+	}
+	snapshotHandles, err := c.snapshotHandles(ctx)
+	if err != nil {
+		return err
+	}
+
+	orphans := findOrphans(volumes, snapshots, pvs, snapshotHandles, c.now())
+
+	var errs []error
+	if settings.OrphanDeletionAge > 0 {
+		errs = c.deleteOrphans(ctx, orphans, snapshots, settings.OrphanDeletionAge)
+	}
+
+	orphans.exportMetrics()
+	if err := c.applyReport(ctx, orphans); err != nil {
+		errs = append(errs, err)
+	}
+
+	return utilerrors.NewAggregate(errs)
+}
+
+// snapshotHandles returns the IDs of the Cinder snapshots referenced by
+// VolumeSnapshotContents of the driver. There are none if the
+// VolumeSnapshotContent CRD is not installed.
+func (c *OrphanController) snapshotHandles(ctx context.Context) (sets.Set[string], error) {
+	handles := sets.New[string]()
+
+	contents, err := c.dynamicClient.Resource(volumeSnapshotContentsResource).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return handles, nil
+		}
+		return nil, fmt.Errorf("failed to list VolumeSnapshotContents: %w", err)
+	}
+
+	for _, content := range contents.Items {
+		driver, _, _ := unstructured.NestedString(content.Object, "spec", "driver")
+		if driver != driverName {
+			continue
+		}
+		// dynamically provisioned snapshots only have a handle in the status,
+		// pre-provisioned ones in the spec
+		for _, path := range [][]string{{"status", "snapshotHandle"}, {"spec", "source", "snapshotHandle"}} {
+			if handle, _, _ := unstructured.NestedString(content.Object, path...); handle != "" {
+				handles.Insert(handle)
+			}
+		}
+	}
+
+	return handles, nil
+}
+
+// deleteOrphans deletes the orphans older than deletionAge and removes them
+// from orphans. Volumes with snapshots can't be deleted, so they are left
+// until a later sync, after their snapshots have been deleted.
+func (c *OrphanController) deleteOrphans(ctx context.Context, orphans *orphans, snapshots []cloudinfo.Snapshot, deletionAge time.Duration) []error {
+	var errs []error
+
+	remainingSnapshots := []orphan{}
+	for _, o := range orphans.snapshots {
+		if o.Age < deletionAge || !deletableStatuses.Has(o.Status) {
+			remainingSnapshots = append(remainingSnapshots, o)
+			continue
+		}
+		if err := c.provider.DeleteSnapshot(ctx, o.ID); err != nil {
+			c.eventRecorder.Warningf("OrphanDeletionFailed", "Failed to delete orphaned Cinder snapshot %s: %v", o.ID, err)
+			errs = append(errs, err)
+			remainingSnapshots = append(remainingSnapshots, o)
+			continue
+		}
+		klog.Infof("Deleted orphaned Cinder snapshot %s", o.ID)
+		c.eventRecorder.Eventf("OrphanedSnapshotDeleted", "Deleted Cinder snapshot %s of %d GiB which had no VolumeSnapshotContent for %s", o.ID, o.SizeGiB, o.Age)
+	}
+	orphans.snapshots = remainingSnapshots
+
+	volumesWithSnapshots := sets.New[string]()
+	for _, s := range snapshots {
+		volumesWithSnapshots.Insert(s.VolumeID)
+	}
+
+	remainingVolumes := []orphan{}
+	for _, o := range orphans.volumes {
+		if o.Age < deletionAge || !deletableStatuses.Has(o.Status) || o.attached || volumesWithSnapshots.Has(o.ID) {
+			remainingVolumes = append(remainingVolumes, o)
+			continue
+		}
+		if err := c.provider.DeleteVolume(ctx, o.ID); err != nil {
+			c.eventRecorder.Warningf("OrphanDeletionFailed", "Failed to delete orphaned Cinder volume %s: %v", o.ID, err)
+			errs = append(errs, err)
+			remainingVolumes = append(remainingVolumes, o)
+			continue
+		}
+		klog.Infof("Deleted orphaned Cinder volume %s", o.ID)
+		c.eventRecorder.Eventf("OrphanedVolumeDeleted", "Deleted Cinder volume %s of %d GiB which had no PersistentVolume for %s", o.ID, o.SizeGiB, o.Age)
+	}
+	orphans.volumes = remainingVolumes
+
+	return errs
+}
+
+// applyReport creates or updates the report config map. Unlike
+// resourceapply, no events are emitted, as the ages change every hour.
+func (c *OrphanController) applyReport(ctx context.Context, orphans *orphans) error {
+	volumes, err := yaml.Marshal(orphans.volumes)
+	if err != nil {
+		return err
+	}
+	snapshots, err := yaml.Marshal(orphans.snapshots)
+	if err != nil {
+		return err
+	}
+	data := map[string]string{
+		"volumes":   string(volumes),
+		"snapshots": string(snapshots),
+	}
+
+	existing, err := c.reportLister.ConfigMaps(util.DefaultNamespace).Get(OrphanReportName)
+	if errors.IsNotFound(err) {
+		report := &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      OrphanReportName,
+				Namespace: util.DefaultNamespace,
+			},
+			Data: data,
+		}
+		_, err = c.kubeClient.CoreV1().ConfigMaps(util.DefaultNamespace).Create(ctx, report, metav1.CreateOptions{})
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	if equality.Semantic.DeepEqual(existing.Data, data) {
+		return nil
+	}
+
+	report := existing.DeepCopy()
+	report.Data = data
+	_, err = c.kubeClient.CoreV1().ConfigMaps(util.DefaultNamespace).Update(ctx, report, metav1.UpdateOptions{})
+	return err
+}
+
+// orphan is a volume or snapshot as listed in the report
+type orphan struct {
+	ID        string        `json:"id"`
+	Name      string        `json:"name,omitempty"`
+	Status    string        `json:"status"`
+	SizeGiB   int           `json:"sizeGiB"`
+	CreatedAt time.Time     `json:"createdAt"`
+	Age       time.Duration `json:"-"`
+	// AgeString is the age rounded to the hour
+	AgeString string `json:"age"`
+	// VolumeID is the source volume of a snapshot
+	VolumeID string `json:"volumeID,omitempty"`
+
+	attached bool
+}
+
+type orphans struct {
+	volumes   []orphan
+	snapshots []orphan
+}
+
+// findOrphans returns the volumes without a PV and the snapshots without
+// a VolumeSnapshotContent, ignoring those which are being deleted or are
+// younger than the grace period
+func findOrphans(volumes []cloudinfo.Volume, snapshots []cloudinfo.Snapshot, pvs map[string]*corev1.PersistentVolume, snapshotHandles sets.Set[string], now time.Time) *orphans {
+	o := &orphans{
+		volumes:   []orphan{},
+		snapshots: []orphan{},
+	}
+
+	for _, v := range volumes {
+		age := now.Sub(v.CreatedAt)
+		if _, ok := pvs[v.ID]; ok || age < orphanGracePeriod || v.Status == "deleting" {
+			continue
+		}
+		o.volumes = append(o.volumes, orphan{
+			ID:        v.ID,
+			Name:      v.Name,
+			Status:    v.Status,
+			SizeGiB:   v.Size,
+			CreatedAt: v.CreatedAt,
+			Age:       age,
+			AgeString: age.Truncate(time.Hour).String(),
+			attached:  len(v.Attachments) > 0,
+		})
+	}
+
+	for _, s := range snapshots {
+		age := now.Sub(s.CreatedAt)
+		if snapshotHandles.Has(s.ID) || age < orphanGracePeriod || s.Status == "deleting" {
+			continue
+		}
+		o.snapshots = append(o.snapshots, orphan{
+			ID:        s.ID,
+			Name:      s.Name,
+			Status:    s.Status,
+			SizeGiB:   s.Size,
+			CreatedAt: s.CreatedAt,
+			Age:       age,
+			AgeString: age.Truncate(time.Hour).String(),
+			VolumeID:  s.VolumeID,
+		})
+	}
+
+	return o
+}
+
+func (o *orphans) exportMetrics() {
+	for resource, list := range map[string][]orphan{
+		"volume":   o.volumes,
+		"snapshot": o.snapshots,
+	} {
+		gigabytes := 0
+		for _, orphan := range list {
+			gigabytes += orphan.SizeGiB
+		}
+		orphanedResources.WithLabelValues(resource).Set(float64(len(list)))
+		orphanedGigabytes.WithLabelValues(resource).Set(float64(gigabytes))
+	}
+}
@@ -0,0 +1,283 @@
+package volumes
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/onsi/gomega"
+	configv1 "github.com/openshift/api/config/v1"
+	operatorv1 "github.com/openshift/api/operator/v1"
+	configv1listers "github.com/openshift/client-go/config/listers/config/v1"
+	"github.com/openshift/library-go/pkg/controller/factory"
+	"github.com/openshift/library-go/pkg/operator/events"
+	"github.com/openshift/library-go/pkg/operator/v1helpers"
+	promtestutil "github.com/prometheus/client_golang/prometheus/testutil"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	fakedynamic "k8s.io/client-go/dynamic/fake"
+	fakekube "k8s.io/client-go/kubernetes/fake"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/component-base/metrics/legacyregistry"
+	"k8s.io/component-base/metrics/testutil"
+	"sigs.k8s.io/yaml"
+
+	"github.com/openshift/openstack-cinder-csi-driver-operator/pkg/cloudinfo"
+	"github.com/openshift/openstack-cinder-csi-driver-operator/pkg/cloudinfo/fake"
+	"github.com/openshift/openstack-cinder-csi-driver-operator/pkg/util"
+)
+
+func TestOrphanSync(t *testing.T) {
+	now := time.Now()
+	clusterMetadata := map[string]string{cloudinfo.ClusterMetadataKey: testClusterID}
+
+	tc := []struct {
+		name              string
+		sourceData        map[string]string
+		volumes           []fake.Volume
+		snapshots         []fake.Snapshot
+		failSnapshots     bool
+		expectedVolumes   []string
+		expectedSnapshots []string
+		expectedRemaining []string
+		expectedEvents    []string
+		expectedGigabytes float64
+		expectedError     bool
+	}{
+		{
+			name: "Orphans are reported",
+			volumes: []fake.Volume{
+				{ID: "vol-1", Status: "in-use", Size: 1, Metadata: clusterMetadata, CreatedAt: now.Add(-3 * time.Hour)},
+				{ID: "vol-orphan", Status: "available", Size: 10, Metadata: clusterMetadata, CreatedAt: now.Add(-3 * time.Hour)},
+				{ID: "vol-new", Status: "available", Size: 1, Metadata: clusterMetadata, CreatedAt: now.Add(-time.Minute)},
+				{ID: "vol-deleting", Status: "deleting", Size: 1, Metadata: clusterMetadata, CreatedAt: now.Add(-3 * time.Hour)},
+				{ID: "vol-other", Status: "available", Size: 1, Metadata: map[string]string{cloudinfo.ClusterMetadataKey: "other-cluster"}, CreatedAt: now.Add(-3 * time.Hour)},
+			},
+			snapshots: []fake.Snapshot{
+				{ID: "snap-1", VolumeID: "vol-1", Status: "available", Size: 1, Metadata: clusterMetadata, CreatedAt: now.Add(-3 * time.Hour)},
+				{ID: "snap-orphan", VolumeID: "vol-1", Status: "available", Size: 1, Metadata: clusterMetadata, CreatedAt: now.Add(-3 * time.Hour)},
+			},
+			expectedVolumes:   []string{"vol-orphan"},
+			expectedSnapshots: []string{"snap-orphan"},
+			expectedRemaining: []string{"vol-1", "vol-deleting", "vol-new", "vol-orphan", "vol-other"},
+			expectedGigabytes: 10,
+		}, {
+			name:       "Old orphans are deleted",
+			sourceData: map[string]string{"orphan_deletion_age": "2h"},
+			volumes: []fake.Volume{
+				{ID: "vol-old", Status: "available", Size: 10, Metadata: clusterMetadata, CreatedAt: now.Add(-3 * time.Hour)},
+				{ID: "vol-recent", Status: "error", Size: 5, Metadata: clusterMetadata, CreatedAt: now.Add(-90 * time.Minute)},
+				{
+					ID:          "vol-attached",
+					Status:      "in-use",
+					Size:        1,
+					Metadata:    clusterMetadata,
+					Attachments: []fake.VolumeAttachment{{AttachmentID: "att-1", ServerID: "server-1"}},
+					CreatedAt:   now.Add(-3 * time.Hour),
+				},
+				{ID: "vol-with-snapshot", Status: "available", Size: 1, Metadata: clusterMetadata, CreatedAt: now.Add(-3 * time.Hour)},
+			},
+			snapshots: []fake.Snapshot{
+				{ID: "snap-old", VolumeID: "vol-with-snapshot", Status: "available", Size: 1, Metadata: clusterMetadata, CreatedAt: now.Add(-3 * time.Hour)},
+			},
+			expectedVolumes:   []string{"vol-attached", "vol-recent", "vol-with-snapshot"},
+			expectedSnapshots: []string{},
+			// volumes with snapshots are deleted on a later sync
+			expectedRemaining: []string{"vol-attached", "vol-recent", "vol-with-snapshot"},
+			expectedEvents:    []string{"OrphanedSnapshotDeleted", "OrphanedVolumeDeleted"},
+			expectedGigabytes: 7,
+		}, {
+			name:          "Snapshots unavailable",
+			failSnapshots: true,
+			volumes: []fake.Volume{
+				{ID: "vol-orphan", Status: "available", Size: 10, Metadata: clusterMetadata, CreatedAt: now.Add(-3 * time.Hour)},
+			},
+			expectedRemaining: []string{"vol-orphan"},
+			expectedError:     true,
+		},
+	}
+
+	for _, tc := range tc {
+		t.Run(tc.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			cloud := fake.New()
+			defer cloud.Close()
+			cloud.Volumes = tc.volumes
+			cloud.Snapshots = tc.snapshots
+			if tc.failSnapshots {
+				cloud.Fail("volume", http.MethodGet, "/snapshots", http.StatusInternalServerError)
+			}
+
+			c, kubeClient, recorder := newTestOrphanController(g, tc.sourceData, cloudinfo.NewProvider(cloud.ClientOpts(), nil))
+			c.now = func() time.Time { return now }
+
+			err := c.sync(context.TODO(), factory.NewSyncContext("CinderOrphans", recorder))
+			if tc.expectedError {
+				g.Expect(err).To(HaveOccurred())
+			} else {
+				g.Expect(err).ToNot(HaveOccurred())
+			}
+
+			var remaining []string
+			for _, volume := range cloud.Volumes {
+				remaining = append(remaining, volume.ID)
+			}
+			g.Expect(remaining).To(ConsistOf(tc.expectedRemaining))
+
+			var events []string
+			for _, event := range recorder.Events() {
+				events = append(events, event.Reason)
+			}
+			g.Expect(events).To(Equal(tc.expectedEvents))
+
+			report, err := kubeClient.CoreV1().ConfigMaps(util.DefaultNamespace).Get(context.TODO(), OrphanReportName, metav1.GetOptions{})
+			if tc.expectedError {
+				g.Expect(err).To(HaveOccurred())
+				return
+			}
+			g.Expect(err).ToNot(HaveOccurred())
+			g.Expect(reportIDs(g, report.Data["volumes"])).To(Equal(tc.expectedVolumes))
+			g.Expect(reportIDs(g, report.Data["snapshots"])).To(Equal(tc.expectedSnapshots))
+
+			g.Expect(testutil.GetGaugeMetricValue(orphanedResources.WithLabelValues("volume"))).To(BeEquivalentTo(len(tc.expectedVolumes)))
+			g.Expect(testutil.GetGaugeMetricValue(orphanedGigabytes.WithLabelValues("volume"))).To(Equal(tc.expectedGigabytes))
+		})
+	}
+}
+
+func TestOrphanSyncUnmanaged(t *testing.T) {
+	g := NewWithT(t)
+
+	cloud := fake.New()
+	defer cloud.Close()
+
+	c, _, recorder := newTestOrphanController(g, nil, cloudinfo.NewProvider(cloud.ClientOpts(), nil))
+	c.operatorClient = v1helpers.NewFakeOperatorClient(
+		&operatorv1.OperatorSpec{ManagementState: operatorv1.Unmanaged},
+		&operatorv1.OperatorStatus{},
+		nil,
+	)
+
+	g.Expect(c.sync(context.TODO(), factory.NewSyncContext("CinderOrphans", recorder))).To(Succeed())
+	g.Expect(cloud.Requests("volume", http.MethodGet, "/volumes/detail")).To(BeZero())
+}
+
+// reportIDs returns the IDs of the volumes or snapshots in the report
+func reportIDs(g *WithT, data string) []string {
+	var entries []orphan
+	g.Expect(yaml.Unmarshal([]byte(data), &entries)).To(Succeed())
+
+	ids := []string{}
+	for _, entry := range entries {
+		ids = append(ids, entry.ID)
+	}
+	return ids
+}
+
+func TestOrphanMetricsExported(t *testing.T) {
+	g := NewWithT(t)
+	now := time.Now()
+	clusterMetadata := map[string]string{cloudinfo.ClusterMetadataKey: testClusterID}
+
+	cloud := fake.New()
+	defer cloud.Close()
+	cloud.Volumes = []fake.Volume{
+		{ID: "vol-orphan", Status: "available", Size: 10, Metadata: clusterMetadata, CreatedAt: now.Add(-3 * time.Hour)},
+	}
+	cloud.Snapshots = []fake.Snapshot{
+		{ID: "snap-orphan", VolumeID: "vol-orphan", Status: "available", Size: 2, Metadata: clusterMetadata, CreatedAt: now.Add(-3 * time.Hour)},
+	}
+
+	c, _, recorder := newTestOrphanController(g, nil, cloudinfo.NewProvider(cloud.ClientOpts(), nil))
+	c.now = func() time.Time { return now }
+	g.Expect(c.sync(context.TODO(), factory.NewSyncContext("CinderOrphans", recorder))).To(Succeed())
+
+	// the gauges are served by the operator's metrics endpoint. They are
+	// compared without the lint checks of the component-base testutil, which
+	// would reject the established gigabytes unit.
+	g.Expect(promtestutil.GatherAndCompare(legacyregistry.DefaultGatherer, strings.NewReader(`
+# HELP openshift_openstack_cinder_csi_driver_operator_orphaned_resources [ALPHA] Number of Cinder volumes without a PersistentVolume and snapshots without a VolumeSnapshotContent, labeled by resource.
+# TYPE openshift_openstack_cinder_csi_driver_operator_orphaned_resources gauge
+openshift_openstack_cinder_csi_driver_operator_orphaned_resources{resource="snapshot"} 1
+openshift_openstack_cinder_csi_driver_operator_orphaned_resources{resource="volume"} 1
+# HELP openshift_openstack_cinder_csi_driver_operator_orphaned_gigabytes [ALPHA] Total size in GiB of the orphaned Cinder volumes and snapshots, labeled by resource.
+# TYPE openshift_openstack_cinder_csi_driver_operator_orphaned_gigabytes gauge
+openshift_openstack_cinder_csi_driver_operator_orphaned_gigabytes{resource="snapshot"} 2
+openshift_openstack_cinder_csi_driver_operator_orphaned_gigabytes{resource="volume"} 10
+`),
+		"openshift_openstack_cinder_csi_driver_operator_orphaned_resources",
+		"openshift_openstack_cinder_csi_driver_operator_orphaned_gigabytes",
+	)).To(Succeed())
+}
+
+func newTestOrphanController(g *WithT, sourceData map[string]string, provider cloudinfo.Provider) (*OrphanController, *fakekube.Clientset, events.InMemoryRecorder) {
+	data := map[string]string{"config": "[Global]\n"}
+	for key, value := range sourceData {
+		data[key] = value
+	}
+	configMapIndexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+	g.Expect(configMapIndexer.Add(&corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "cloud-provider-config", Namespace: util.OpenShiftConfigNamespace},
+		Data:       data,
+	})).To(Succeed())
+
+	infraIndexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	g.Expect(infraIndexer.Add(&configv1.Infrastructure{
+		ObjectMeta: metav1.ObjectMeta{Name: "cluster"},
+		Spec: configv1.InfrastructureSpec{
+			CloudConfig: configv1.ConfigMapFileReference{Name: "cloud-provider-config"},
+		},
+		Status: configv1.InfrastructureStatus{InfrastructureName: testClusterID},
+	})).To(Succeed())
+
+	pvIndexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	g.Expect(pvIndexer.Add(&corev1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{Name: "pv-1"},
+		Spec: corev1.PersistentVolumeSpec{
+			PersistentVolumeSource: corev1.PersistentVolumeSource{
+				CSI: &corev1.CSIPersistentVolumeSource{Driver: driverName, VolumeHandle: "vol-1"},
+			},
+		},
+	})).To(Succeed())
+
+	content := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "snapshot.storage.k8s.io/v1",
+		"kind":       "VolumeSnapshotContent",
+		"metadata":   map[string]interface{}{"name": "snapcontent-1"},
+		"spec":       map[string]interface{}{"driver": driverName},
+		"status":     map[string]interface{}{"snapshotHandle": "snap-1"},
+	}}
+	dynamicClient := fakedynamic.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), map[schema.GroupVersionResource]string{
+		volumeSnapshotContentsResource: "VolumeSnapshotContentList",
+	}, content)
+
+	operatorClient := v1helpers.NewFakeOperatorClient(
+		&operatorv1.OperatorSpec{ManagementState: operatorv1.Managed},
+		&operatorv1.OperatorStatus{},
+		nil,
+	)
+	kubeClient := fakekube.NewSimpleClientset()
+	recorder := events.NewInMemoryRecorder("test")
+
+	c := &OrphanController{
+		operatorClient:       operatorClient,
+		kubeClient:           kubeClient,
+		dynamicClient:        dynamicClient,
+		pvLister:             corelisters.NewPersistentVolumeLister(pvIndexer),
+		configMapLister:      corelisters.NewConfigMapLister(configMapIndexer),
+		reportLister:         corelisters.NewConfigMapLister(cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})),
+		infrastructureLister: configv1listers.NewInfrastructureLister(infraIndexer),
+		provider:             provider,
+		eventRecorder:        recorder,
+		now:                  time.Now,
+	}
+
+	return c, kubeClient, recorder
+}
@@ -0,0 +1,353 @@
+package volumes
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	operatorv1 "github.com/openshift/api/operator/v1"
+	configinformers "github.com/openshift/client-go/config/informers/externalversions"
+	configv1listers "github.com/openshift/client-go/config/listers/config/v1"
+	"github.com/openshift/library-go/pkg/controller/factory"
+	"github.com/openshift/library-go/pkg/operator/events"
+	"github.com/openshift/library-go/pkg/operator/v1helpers"
+	corev1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	storagelisters "k8s.io/client-go/listers/storage/v1"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/klog/v2"
+
+	"github.com/openshift/openstack-cinder-csi-driver-operator/pkg/cloudinfo"
+	"github.com/openshift/openstack-cinder-csi-driver-operator/pkg/controllers/config"
+	"github.com/openshift/openstack-cinder-csi-driver-operator/pkg/util"
+)
+
+const (
+	// stuckConditionType is set to True when any volume has been stuck in
+	// a transitional or error status for longer than the threshold. It is
+	// informational only.
+	stuckConditionType = "CinderStuckVolumesWarning"
+
+	// maxListedVolumes limits the number of volumes described in the
+	// condition message
+	maxListedVolumes = 5
+
+	stuckResyncInterval = 5 * time.Minute
+
+	driverName                 = "cinder.csi.openstack.org"
+	infrastructureResourceName = "cluster"
+)
+
+// stuckStatuses are the volume statuses which are expected to be short-lived
+// or which need manual intervention, with a suggested remediation
+var stuckStatuses = map[string]string{
+	"attaching":       "check the VolumeAttachment and the Nova logs for server %[2]s; if the volume is not attached to the server, reset it with 'openstack volume set --state available --detached %[1]s'",
+	"reserved":        "check the VolumeAttachment and the Nova logs for server %[2]s; if the volume is not attached to the server, reset it with 'openstack volume set --state available --detached %[1]s'",
+	"detaching":       "check whether server %[2]s still has the volume attached with 'openstack server volume list %[2]s'; if not, reset it with 'openstack volume set --state available --detached %[1]s'",
+	"deleting":        "check the cinder-volume logs; if the backend volume is gone, reset the volume with 'openstack volume set --state error %[1]s' and delete it again",
+	"error_deleting":  "check the cinder-volume logs, then reset the volume with 'openstack volume set --state error %[1]s' and delete it again with 'openstack volume delete %[1]s'",
+	"error_extending": "check the cinder-volume logs, then reset the volume with 'openstack volume set --state available %[1]s' (or 'in-use' if attached) and retry the resize",
+	"error":           "check the cinder-volume and cinder-scheduler logs for the cause; delete the volume with 'openstack volume delete %[1]s' if it is not needed",
+}
+
+// This StuckVolumeController periodically lists the volumes the driver has
+// created for this cluster and reports those which have been stuck in
+// a transitional or error status for too long, as the driver and the
+// VolumeAttachments referencing them retry forever without ever succeeding.
+type StuckVolumeController struct {
+	operatorClient         v1helpers.OperatorClient
+	pvLister               corelisters.PersistentVolumeLister
+	volumeAttachmentLister storagelisters.VolumeAttachmentLister
+	configMapLister        corelisters.ConfigMapLister
+	infrastructureLister   configv1listers.InfrastructureLister
+	provider               cloudinfo.Provider
+	eventRecorder          events.Recorder
+	// pvEventRecorder emits events on PersistentVolumes
+	pvEventRecorder record.EventRecorder
+
+	// reported maps the IDs of stuck volumes to the status they were last
+	// reported as stuck in, so that each is only reported once
+	reported map[string]string
+	now      func() time.Time
+}
+
+func NewStuckVolumeController(
+	operatorClient v1helpers.OperatorClient,
+	informers v1helpers.KubeInformersForNamespaces,
+	configInformers configinformers.SharedInformerFactory,
+	provider cloudinfo.Provider,
+	eventRecorder events.Recorder,
+	pvEventRecorder record.EventRecorder) factory.Controller {
+
+	configMapInformer := informers.InformersFor(util.OpenShiftConfigNamespace)
+	pvInformer := informers.InformersFor("").Core().V1().PersistentVolumes()
+	volumeAttachmentInformer := informers.InformersFor("").Storage().V1().VolumeAttachments()
+	c := &StuckVolumeController{
+		operatorClient:         operatorClient,
+		pvLister:               pvInformer.Lister(),
+		volumeAttachmentLister: volumeAttachmentInformer.Lister(),
+		configMapLister:        configMapInformer.Core().V1().ConfigMaps().Lister(),
+		infrastructureLister:   configInformers.Config().V1().Infrastructures().Lister(),
+		provider:               provider,
+		eventRecorder:          eventRecorder.WithComponentSuffix("CinderStuckVolumes"),
+		pvEventRecorder:        pvEventRecorder,
+		reported:               map[string]string{},
+		now:                    time.Now,
+	}
+	// Only the operator and its config trigger a sync, as PVs and
+	// VolumeAttachments change far more often than we want to poll Cinder
+	return factory.New().WithSync(c.sync).ResyncEvery(stuckResyncInterval).WithInformers(
+		operatorClient.Informer(),
+		configMapInformer.Core().V1().ConfigMaps().Informer(),
+	).WithBareInformers(
+		pvInformer.Informer(),
+		volumeAttachmentInformer.Informer(),
+	).ToController("CinderStuckVolumes", eventRecorder)
+}
+
+func (c *StuckVolumeController) sync(ctx context.Context, syncCtx factory.SyncContext) error {
+	opSpec, opStatus, _, err := c.operatorClient.GetOperatorState()
+	if err != nil {
+		return err
+	}
+	if opSpec.ManagementState != operatorv1.Managed {
+		return nil
+	}
+
+	sourceConfig, err := config.GetSourceConfigMap(c.configMapLister, c.infrastructureLister)
+	if err != nil {
+		return err
+	}
+	if sourceConfig == nil {
+		return nil
+	}
+
+	settings, err := config.ParseSettings(sourceConfig)
+	if err != nil {
+		return err
+	}
+
+	clusterID, err := getClusterID(c.infrastructureLister)
+	if err != nil {
+		return err
+	}
+
+	volumes, err := c.provider.GetClusterVolumes(ctx, clusterID)
+	if err != nil {
+		condition := operatorv1.OperatorCondition{
+			Type:    stuckConditionType,
+			Status:  operatorv1.ConditionUnknown,
+			Reason:  "VolumesUnavailable",
+			Message: fmt.Sprintf("Failed to list the Cinder volumes: %v", err),
+		}
+		if _, _, updateErr := v1helpers.UpdateStatus(ctx, c.operatorClient, v1helpers.UpdateConditionFn(condition)); updateErr != nil {
+			return updateErr
+		}
+		return err
+	}
+
+	refs, err := newVolumeReferences(c.pvLister, c.volumeAttachmentLister)
+	if err != nil {
+		return err
+	}
+
+	var stuck []*stuckVolume
+	for i := range volumes {
+		volume := &volumes[i]
+		if _, ok := stuckStatuses[volume.Status]; !ok {
+			continue
+		}
+		if c.now().Sub(volume.UpdatedAt) < settings.StuckVolumeThreshold {
+			continue
+		}
+		pv := refs.pvs[volume.ID]
+		s := &stuckVolume{volume: volume, pv: pv}
+		if pv != nil {
+			s.volumeAttachments = refs.volumeAttachments[pv.Name]
+		}
+		stuck = append(stuck, s)
+	}
+
+	stuckVolumes.Reset()
+	counts := map[string]int{}
+	for _, s := range stuck {
+		counts[s.volume.Status]++
+	}
+	for status := range stuckStatuses {
+		stuckVolumes.WithLabelValues(status).Set(float64(counts[status]))
+	}
+
+	c.reportStuckVolumes(stuck)
+
+	condition := operatorv1.OperatorCondition{
+		Type:   stuckConditionType,
+		Status: operatorv1.ConditionFalse,
+		Reason: "AsExpected",
+	}
+	if len(stuck) > 0 {
+		condition.Status = operatorv1.ConditionTrue
+		condition.Reason = "VolumesStuck"
+		condition.Message = stuckMessage(stuck, settings.StuckVolumeThreshold)
+
+		if !v1helpers.IsOperatorConditionTrue(opStatus.Conditions, stuckConditionType) {
+			c.eventRecorder.Warning(condition.Reason, condition.Message)
+		}
+	}
+
+	_, _, err = v1helpers.UpdateStatus(ctx, c.operatorClient, v1helpers.UpdateConditionFn(condition))
+	return err
+}
+
+// reportStuckVolumes emits an event on the PV of each newly stuck volume
+func (c *StuckVolumeController) reportStuckVolumes(stuck []*stuckVolume) {
+	reported := map[string]string{}
+	for _, s := range stuck {
+		reported[s.volume.ID] = s.volume.Status
+		if c.reported[s.volume.ID] == s.volume.Status {
+			continue
+		}
+
+		klog.Warningf("Cinder %s", s.describe())
+		if s.pv != nil {
+			c.pvEventRecorder.Eventf(s.pv, corev1.EventTypeWarning, "VolumeStuck", "Cinder %s. To fix this, %s", s.describe(), s.remediation())
+		}
+	}
+	c.reported = reported
+}
+
+// stuckVolume is a volume stuck in one of the stuckStatuses, with the
+// Kubernetes objects referencing it
+type stuckVolume struct {
+	volume *cloudinfo.Volume
+	// pv is nil if there is no PV for the volume
+	pv                *corev1.PersistentVolume
+	volumeAttachments []*storagev1.VolumeAttachment
+}
+
+// describe summarises the state of the volume and the objects referencing it
+func (s *stuckVolume) describe() string {
+	description := fmt.Sprintf("volume %s has been %s since %s", s.volume.ID, s.volume.Status, s.volume.UpdatedAt.UTC().Format(time.RFC3339))
+	if s.pv == nil {
+		return description + " and has no PersistentVolume"
+	}
+
+	description += fmt.Sprintf(" (PersistentVolume %s", s.pv.Name)
+	for _, va := range s.volumeAttachments {
+		description += fmt.Sprintf(", VolumeAttachment %s to node %s", va.Name, va.Spec.NodeName)
+		if va.Status.AttachError != nil {
+			description += fmt.Sprintf(" failing to attach: %s", va.Status.AttachError.Message)
+		}
+		if va.Status.DetachError != nil {
+			description += fmt.Sprintf(" failing to detach: %s", va.Status.DetachError.Message)
+		}
+	}
+	return description + ")"
+}
+
+// remediation suggests how to fix the volume
+func (s *stuckVolume) remediation() string {
+	serverID := "<server>"
+	if len(s.volume.Attachments) > 0 {
+		serverID = s.volume.Attachments[0].ServerID
+	}
+	return fmt.Sprintf(stuckStatuses[s.volume.Status], s.volume.ID, serverID)
+}
+
+// stuckMessage summarises the stuck volumes, listing at most
+// maxListedVolumes
+func stuckMessage(stuck []*stuckVolume, threshold time.Duration) string {
+	counts := map[string]int{}
+	for _, s := range stuck {
+		counts[s.volume.Status]++
+	}
+	var summary []string
+	for status, count := range counts {
+		summary = append(summary, fmt.Sprintf("%d %s", count, status))
+	}
+	sort.Strings(summary)
+
+	var details []string
+	for i, s := range stuck {
+		if i == maxListedVolumes {
+			details = append(details, fmt.Sprintf("and %d more", len(stuck)-maxListedVolumes))
+			break
+		}
+		details = append(details, fmt.Sprintf("%s; to fix this, %s", s.describe(), s.remediation()))
+	}
+
+	return fmt.Sprintf("%d Cinder volumes have been stuck for longer than %s (%s): %s", len(stuck), threshold, strings.Join(summary, ", "), strings.Join(details, ". "))
+}
+
+// volumeReferences indexes the Kubernetes objects referencing Cinder volumes
+type volumeReferences struct {
+	// pvs maps volume IDs to the PVs using the driver
+	pvs map[string]*corev1.PersistentVolume
+	// volumeAttachments maps PV names to their VolumeAttachments
+	volumeAttachments map[string][]*storagev1.VolumeAttachment
+}
+
+func newVolumeReferences(pvLister corelisters.PersistentVolumeLister, volumeAttachmentLister storagelisters.VolumeAttachmentLister) (*volumeReferences, error) {
+	pvs, err := persistentVolumesByVolumeID(pvLister)
+	if err != nil {
+		return nil, err
+	}
+	refs := &volumeReferences{
+		pvs:               pvs,
+		volumeAttachments: map[string][]*storagev1.VolumeAttachment{},
+	}
+
+	vas, err := volumeAttachmentLister.List(labels.Everything())
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(vas, func(i, j int) bool {
+		return vas[i].Name < vas[j].Name
+	})
+	for _, va := range vas {
+		if va.Spec.Attacher != driverName || va.Spec.Source.PersistentVolumeName == nil {
+			continue
+		}
+		pvName := *va.Spec.Source.PersistentVolumeName
+		refs.volumeAttachments[pvName] = append(refs.volumeAttachments[pvName], va)
+	}
+
+	return refs, nil
+}
+
+// persistentVolumesByVolumeID maps the IDs of Cinder volumes to the PVs using
+// them, either through the driver or through the in-tree Cinder volume
+// plugin, whose PVs are migrated to the driver
+func persistentVolumesByVolumeID(pvLister corelisters.PersistentVolumeLister) (map[string]*corev1.PersistentVolume, error) {
+	pvs, err := pvLister.List(labels.Everything())
+	if err != nil {
+		return nil, err
+	}
+
+	byVolumeID := map[string]*corev1.PersistentVolume{}
+	for _, pv := range pvs {
+		switch {
+		case pv.Spec.CSI != nil && pv.Spec.CSI.Driver == driverName:
+			byVolumeID[pv.Spec.CSI.VolumeHandle] = pv
+		case pv.Spec.Cinder != nil:
+			byVolumeID[pv.Spec.Cinder.VolumeID] = pv
+		}
+	}
+	return byVolumeID, nil
+}
+
+// getClusterID returns the infrastructure name, which the driver is
+// configured to use as its cluster ID
+func getClusterID(infrastructureLister configv1listers.InfrastructureLister) (string, error) {
+	infra, err := infrastructureLister.Get(infrastructureResourceName)
+	if err != nil {
+		return "", err
+	}
+	if infra.Status.InfrastructureName == "" {
+		return "", fmt.Errorf("the infrastructure name is not set")
+	}
+	return infra.Status.InfrastructureName, nil
+}
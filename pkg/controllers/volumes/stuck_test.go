@@ -0,0 +1,263 @@
+package volumes
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/onsi/gomega"
+	configv1 "github.com/openshift/api/config/v1"
+	operatorv1 "github.com/openshift/api/operator/v1"
+	configv1listers "github.com/openshift/client-go/config/listers/config/v1"
+	"github.com/openshift/library-go/pkg/controller/factory"
+	"github.com/openshift/library-go/pkg/operator/events"
+	"github.com/openshift/library-go/pkg/operator/v1helpers"
+	corev1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	storagelisters "k8s.io/client-go/listers/storage/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/component-base/metrics/legacyregistry"
+	"k8s.io/component-base/metrics/testutil"
+	"k8s.io/utils/ptr"
+
+	"github.com/openshift/openstack-cinder-csi-driver-operator/pkg/cloudinfo"
+	"github.com/openshift/openstack-cinder-csi-driver-operator/pkg/cloudinfo/fake"
+	"github.com/openshift/openstack-cinder-csi-driver-operator/pkg/util"
+)
+
+const testClusterID = "test-cluster"
+
+func TestStuckVolumeSync(t *testing.T) {
+	now := time.Now()
+	clusterMetadata := map[string]string{cloudinfo.ClusterMetadataKey: testClusterID}
+
+	tc := []struct {
+		name              string
+		volumes           []fake.Volume
+		failVolumes       bool
+		expectedStatus    operatorv1.ConditionStatus
+		expectedReason    string
+		expectedMessage   []string
+		expectedPVEvents  []string
+		expectedAttaching float64
+		expectedError     bool
+	}{
+		{
+			name: "No stuck volumes",
+			volumes: []fake.Volume{
+				{ID: "vol-1", Status: "available", Metadata: clusterMetadata, UpdatedAt: now.Add(-2 * time.Hour)},
+				{ID: "vol-2", Status: "attaching", Metadata: clusterMetadata, UpdatedAt: now.Add(-time.Minute)},
+			},
+			expectedStatus: operatorv1.ConditionFalse,
+			expectedReason: "AsExpected",
+		}, {
+			name: "Volume stuck attaching",
+			volumes: []fake.Volume{
+				{
+					ID:          "vol-1",
+					Status:      "attaching",
+					Metadata:    clusterMetadata,
+					Attachments: []fake.VolumeAttachment{{AttachmentID: "att-1", ServerID: "server-1"}},
+					UpdatedAt:   now.Add(-time.Hour),
+				},
+			},
+			expectedStatus: operatorv1.ConditionTrue,
+			expectedReason: "VolumesStuck",
+			expectedMessage: []string{
+				"1 Cinder volumes have been stuck for longer than 30m0s (1 attaching)",
+				"volume vol-1 has been attaching",
+				"PersistentVolume pv-1, VolumeAttachment va-1 to node node-1 failing to attach: rpc error",
+				"openstack volume set --state available --detached vol-1",
+				"Nova logs for server server-1",
+			},
+			expectedPVEvents:  []string{"Warning VolumeStuck Cinder volume vol-1 has been attaching"},
+			expectedAttaching: 1,
+		}, {
+			name: "Volume stuck in error_deleting without a PV",
+			volumes: []fake.Volume{
+				{ID: "vol-orphan", Status: "error_deleting", Metadata: clusterMetadata, UpdatedAt: now.Add(-time.Hour)},
+			},
+			expectedStatus: operatorv1.ConditionTrue,
+			expectedReason: "VolumesStuck",
+			expectedMessage: []string{
+				"volume vol-orphan has been error_deleting",
+				"has no PersistentVolume",
+				"openstack volume set --state error vol-orphan",
+			},
+		}, {
+			name: "Volumes of other clusters are ignored",
+			volumes: []fake.Volume{
+				{ID: "vol-other", Status: "error", Metadata: map[string]string{cloudinfo.ClusterMetadataKey: "other-cluster"}, UpdatedAt: now.Add(-time.Hour)},
+			},
+			expectedStatus: operatorv1.ConditionFalse,
+			expectedReason: "AsExpected",
+		}, {
+			name:           "Volumes unavailable",
+			failVolumes:    true,
+			expectedStatus: operatorv1.ConditionUnknown,
+			expectedReason: "VolumesUnavailable",
+			expectedError:  true,
+		},
+	}
+
+	for _, tc := range tc {
+		t.Run(tc.name, func(t *testing.T) {
+			g := NewWithT(t)
+
+			cloud := fake.New()
+			defer cloud.Close()
+			cloud.Volumes = tc.volumes
+			if tc.failVolumes {
+				cloud.Fail("volume", http.MethodGet, "/volumes/detail", http.StatusInternalServerError)
+			}
+
+			c, operatorClient, pvRecorder := newTestStuckVolumeController(g, operatorv1.Managed, cloudinfo.NewProvider(cloud.ClientOpts(), nil))
+			c.now = func() time.Time { return now }
+			syncCtx := factory.NewSyncContext("CinderStuckVolumes", c.eventRecorder)
+
+			err := c.sync(context.TODO(), syncCtx)
+			if tc.expectedError {
+				g.Expect(err).To(HaveOccurred())
+			} else {
+				g.Expect(err).ToNot(HaveOccurred())
+				// stuck volumes are only reported once
+				g.Expect(c.sync(context.TODO(), syncCtx)).To(Succeed())
+			}
+
+			_, status, _, err := operatorClient.GetOperatorState()
+			g.Expect(err).ToNot(HaveOccurred())
+			condition := v1helpers.FindOperatorCondition(status.Conditions, stuckConditionType)
+			g.Expect(condition).ToNot(BeNil())
+			g.Expect(condition.Status).To(Equal(tc.expectedStatus))
+			g.Expect(condition.Reason).To(Equal(tc.expectedReason))
+			for _, message := range tc.expectedMessage {
+				g.Expect(condition.Message).To(ContainSubstring(message))
+			}
+
+			close(pvRecorder.Events)
+			var pvEvents []string
+			for event := range pvRecorder.Events {
+				pvEvents = append(pvEvents, event)
+			}
+			g.Expect(pvEvents).To(HaveLen(len(tc.expectedPVEvents)))
+			for i, event := range tc.expectedPVEvents {
+				g.Expect(pvEvents[i]).To(HavePrefix(event))
+			}
+
+			if !tc.expectedError {
+				g.Expect(testutil.GetGaugeMetricValue(stuckVolumes.WithLabelValues("attaching"))).To(Equal(tc.expectedAttaching))
+			}
+		})
+	}
+}
+
+func TestStuckVolumeSyncUnmanaged(t *testing.T) {
+	g := NewWithT(t)
+
+	cloud := fake.New()
+	defer cloud.Close()
+
+	c, operatorClient, _ := newTestStuckVolumeController(g, operatorv1.Unmanaged, cloudinfo.NewProvider(cloud.ClientOpts(), nil))
+
+	g.Expect(c.sync(context.TODO(), factory.NewSyncContext("CinderStuckVolumes", c.eventRecorder))).To(Succeed())
+	g.Expect(cloud.Requests("volume", http.MethodGet, "/volumes/detail")).To(BeZero())
+
+	_, status, _, err := operatorClient.GetOperatorState()
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(status.Conditions).To(BeEmpty())
+}
+
+func TestStuckVolumeMetricsExported(t *testing.T) {
+	g := NewWithT(t)
+	now := time.Now()
+
+	cloud := fake.New()
+	defer cloud.Close()
+	cloud.Volumes = []fake.Volume{
+		{ID: "vol-1", Status: "error_deleting", Metadata: map[string]string{cloudinfo.ClusterMetadataKey: testClusterID}, UpdatedAt: now.Add(-time.Hour)},
+	}
+
+	c, _, _ := newTestStuckVolumeController(g, operatorv1.Managed, cloudinfo.NewProvider(cloud.ClientOpts(), nil))
+	c.now = func() time.Time { return now }
+	g.Expect(c.sync(context.TODO(), factory.NewSyncContext("CinderStuckVolumes", c.eventRecorder))).To(Succeed())
+
+	// the gauge is served by the operator's metrics endpoint
+	g.Expect(testutil.GatherAndCompare(legacyregistry.DefaultGatherer, strings.NewReader(`
+# HELP openshift_openstack_cinder_csi_driver_operator_stuck_volumes [ALPHA] Number of Cinder volumes of the cluster stuck in a transitional or error status for longer than the threshold, labeled by status.
+# TYPE openshift_openstack_cinder_csi_driver_operator_stuck_volumes gauge
+openshift_openstack_cinder_csi_driver_operator_stuck_volumes{status="attaching"} 0
+openshift_openstack_cinder_csi_driver_operator_stuck_volumes{status="deleting"} 0
+openshift_openstack_cinder_csi_driver_operator_stuck_volumes{status="detaching"} 0
+openshift_openstack_cinder_csi_driver_operator_stuck_volumes{status="error"} 0
+openshift_openstack_cinder_csi_driver_operator_stuck_volumes{status="error_deleting"} 1
+openshift_openstack_cinder_csi_driver_operator_stuck_volumes{status="error_extending"} 0
+openshift_openstack_cinder_csi_driver_operator_stuck_volumes{status="reserved"} 0
+`), "openshift_openstack_cinder_csi_driver_operator_stuck_volumes")).To(Succeed())
+}
+
+func newTestStuckVolumeController(g *WithT, managementState operatorv1.ManagementState, provider cloudinfo.Provider) (*StuckVolumeController, v1helpers.OperatorClient, *record.FakeRecorder) {
+	configMapIndexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+	g.Expect(configMapIndexer.Add(&corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "cloud-provider-config", Namespace: util.OpenShiftConfigNamespace},
+		Data:       map[string]string{"config": "[Global]\n"},
+	})).To(Succeed())
+
+	infraIndexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	g.Expect(infraIndexer.Add(&configv1.Infrastructure{
+		ObjectMeta: metav1.ObjectMeta{Name: "cluster"},
+		Spec: configv1.InfrastructureSpec{
+			CloudConfig: configv1.ConfigMapFileReference{Name: "cloud-provider-config"},
+		},
+		Status: configv1.InfrastructureStatus{InfrastructureName: testClusterID},
+	})).To(Succeed())
+
+	pvIndexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	g.Expect(pvIndexer.Add(&corev1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{Name: "pv-1"},
+		Spec: corev1.PersistentVolumeSpec{
+			PersistentVolumeSource: corev1.PersistentVolumeSource{
+				CSI: &corev1.CSIPersistentVolumeSource{Driver: driverName, VolumeHandle: "vol-1"},
+			},
+		},
+	})).To(Succeed())
+
+	vaIndexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	g.Expect(vaIndexer.Add(&storagev1.VolumeAttachment{
+		ObjectMeta: metav1.ObjectMeta{Name: "va-1"},
+		Spec: storagev1.VolumeAttachmentSpec{
+			Attacher: driverName,
+			NodeName: "node-1",
+			Source:   storagev1.VolumeAttachmentSource{PersistentVolumeName: ptr.To("pv-1")},
+		},
+		Status: storagev1.VolumeAttachmentStatus{
+			AttachError: &storagev1.VolumeError{Message: "rpc error: code = Internal"},
+		},
+	})).To(Succeed())
+
+	operatorClient := v1helpers.NewFakeOperatorClient(
+		&operatorv1.OperatorSpec{ManagementState: managementState},
+		&operatorv1.OperatorStatus{},
+		nil,
+	)
+	pvRecorder := record.NewFakeRecorder(10)
+
+	c := &StuckVolumeController{
+		operatorClient:         operatorClient,
+		pvLister:               corelisters.NewPersistentVolumeLister(pvIndexer),
+		volumeAttachmentLister: storagelisters.NewVolumeAttachmentLister(vaIndexer),
+		configMapLister:        corelisters.NewConfigMapLister(configMapIndexer),
+		infrastructureLister:   configv1listers.NewInfrastructureLister(infraIndexer),
+		provider:               provider,
+		eventRecorder:          events.NewInMemoryRecorder("test"),
+		pvEventRecorder:        pvRecorder,
+		reported:               map[string]string{},
+		now:                    time.Now,
+	}
+
+	return c, operatorClient, pvRecorder
+}
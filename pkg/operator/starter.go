@@ -4,11 +4,16 @@ import (
 	"context"
 	"time"
 
+	"github.com/gophercloud/utils/v2/openstack/clientconfig"
+	corev1 "k8s.io/api/core/v1"
 	apiextclient "k8s.io/apiextensions-apiserver/pkg/client/clientset/clientset"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/dynamic"
 	kubeclient "k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	corev1client "k8s.io/client-go/kubernetes/typed/core/v1"
 	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/record"
 	"k8s.io/klog/v2"
 
 	opv1 "github.com/openshift/api/operator/v1"
@@ -25,7 +30,18 @@ import (
 	"github.com/openshift/library-go/pkg/operator/v1helpers"
 
 	"github.com/openshift/openstack-cinder-csi-driver-operator/assets"
+	"github.com/openshift/openstack-cinder-csi-driver-operator/pkg/cloudinfo"
+	"github.com/openshift/openstack-cinder-csi-driver-operator/pkg/controllers/attachlimits"
+	"github.com/openshift/openstack-cinder-csi-driver-operator/pkg/controllers/capacity"
 	"github.com/openshift/openstack-cinder-csi-driver-operator/pkg/controllers/config"
+	"github.com/openshift/openstack-cinder-csi-driver-operator/pkg/controllers/credentials"
+	"github.com/openshift/openstack-cinder-csi-driver-operator/pkg/controllers/nodes"
+	"github.com/openshift/openstack-cinder-csi-driver-operator/pkg/controllers/permissions"
+	"github.com/openshift/openstack-cinder-csi-driver-operator/pkg/controllers/quota"
+	"github.com/openshift/openstack-cinder-csi-driver-operator/pkg/controllers/rollout"
+	"github.com/openshift/openstack-cinder-csi-driver-operator/pkg/controllers/servicehealth"
+	"github.com/openshift/openstack-cinder-csi-driver-operator/pkg/controllers/storageclass"
+	"github.com/openshift/openstack-cinder-csi-driver-operator/pkg/controllers/volumes"
 	"github.com/openshift/openstack-cinder-csi-driver-operator/pkg/util"
 )
 
@@ -33,7 +49,6 @@ const (
 	operatorName          = "openstack-cinder-csi-driver-operator"
 	operandName           = "openstack-cinder-csi-driver"
 	instanceName          = "cinder.csi.openstack.org"
-	cloudCredSecretName   = "openstack-cloud-credentials"
 	metricsCertSecretName = "openstack-cinder-csi-driver-controller-metrics-serving-cert"
 	trustedCAConfigMap    = "openstack-cinder-csi-driver-trusted-ca-bundle"
 
@@ -75,6 +90,22 @@ func RunOperator(ctx context.Context, controllerConfig *controllercmd.Controller
 		return err
 	}
 
+	// Information about the OpenStack cloud is fetched by the
+	// ConfigSyncController and shared with the other controllers. The client
+	// uses the same credentials, proxy and CA bundle as the driver.
+	cloudProvider := cloudinfo.NewProvider(
+		&clientconfig.ClientOpts{
+			Cloud:    "openstack",
+			YAMLOpts: config.CloudsYAMLFromSecret(secretInformer.Lister()),
+		},
+		config.HTTPConfig(
+			kubeInformersForNamespaces.InformersFor(util.OpenShiftConfigNamespace).Core().V1().ConfigMaps().Lister(),
+			configInformers.Config().V1().Infrastructures().Lister(),
+			configInformers.Config().V1().Proxies().Lister(),
+		),
+	)
+	cloudInfo := cloudinfo.NewCache(cloudProvider)
+
 	csiControllerSet := csicontrollerset.NewCSIControllerSet(
 		operatorClient,
 		controllerConfig.EventRecorder,
@@ -86,7 +117,12 @@ func RunOperator(ctx context.Context, controllerConfig *controllercmd.Controller
 		kubeClient,
 		dynamicClient,
 		kubeInformersForNamespaces,
-		assets.ReadFile,
+		// The CSIDriver enables storage capacity tracking if configured
+		capacity.WithStorageCapacity(
+			assets.ReadFile,
+			kubeInformersForNamespaces.InformersFor(util.OpenShiftConfigNamespace).Core().V1().ConfigMaps().Lister(),
+			configInformers.Config().V1().Infrastructures().Lister(),
+		),
 		[]string{
 			// Create RBAC before creating Service Accounts.
 			// This prevents a race where the controller/node can
@@ -151,7 +187,7 @@ func RunOperator(ctx context.Context, controllerConfig *controllercmd.Controller
 			configMapInformer.Informer(),
 			configInformers.Config().V1().Proxies().Informer(),
 		},
-		csidrivercontrollerservicecontroller.WithSecretHashAnnotationHook(util.DefaultNamespace, cloudCredSecretName, secretInformer),
+		csidrivercontrollerservicecontroller.WithSecretHashAnnotationHook(util.DefaultNamespace, util.CloudCredentialsSecretName, secretInformer),
 		csidrivercontrollerservicecontroller.WithSecretHashAnnotationHook(util.DefaultNamespace, metricsCertSecretName, secretInformer),
 		csidrivercontrollerservicecontroller.WithConfigMapHashAnnotationHook(util.DefaultNamespace, util.CinderConfigName, configMapInformer),
 		csidrivercontrollerservicecontroller.WithObservedProxyDeploymentHook(),
@@ -161,14 +197,19 @@ func RunOperator(ctx context.Context, controllerConfig *controllercmd.Controller
 			configMapInformer,
 		),
 		csidrivercontrollerservicecontroller.WithReplicasHook(nodeInformer.Lister()),
+		// Don't roll out the driver until it has credentials
+		credentials.WithCredentialsSecretHook(secretInformer),
 	).WithCSIDriverNodeService(
 		"OpenStackCinderDriverNodeServiceController",
 		assets.ReadFile,
 		"node.yaml",
 		kubeClient,
 		kubeInformersForNamespaces.InformersFor(util.DefaultNamespace),
-		[]factory.Informer{configMapInformer.Informer()},
-		csidrivernodeservicecontroller.WithSecretHashAnnotationHook(util.DefaultNamespace, cloudCredSecretName, secretInformer),
+		[]factory.Informer{
+			configMapInformer.Informer(),
+			kubeInformersForNamespaces.InformersFor(util.OpenShiftConfigNamespace).Core().V1().ConfigMaps().Informer(),
+		},
+		csidrivernodeservicecontroller.WithSecretHashAnnotationHook(util.DefaultNamespace, util.CloudCredentialsSecretName, secretInformer),
 		csidrivernodeservicecontroller.WithConfigMapHashAnnotationHook(util.DefaultNamespace, util.CinderConfigName, configMapInformer),
 		csidrivernodeservicecontroller.WithObservedProxyDaemonSetHook(),
 		csidrivernodeservicecontroller.WithCABundleDaemonSetHook(
@@ -176,6 +217,10 @@ func RunOperator(ctx context.Context, controllerConfig *controllercmd.Controller
 			trustedCAConfigMap,
 			configMapInformer,
 		),
+		rollout.WithStagedRolloutHook(
+			kubeInformersForNamespaces.InformersFor(util.OpenShiftConfigNamespace).Core().V1().ConfigMaps().Lister(),
+			configInformers.Config().V1().Infrastructures().Lister(),
+		),
 	).WithServiceMonitorController(
 		"CinderServiceMonitorController",
 		dynamicClient,
@@ -190,16 +235,162 @@ func RunOperator(ctx context.Context, controllerConfig *controllercmd.Controller
 		kubeClient,
 		kubeInformersForNamespaces.InformersFor(""),
 		operatorInformers,
+		storageclass.WithZoneMappingHook(
+			kubeInformersForNamespaces.InformersFor(util.OpenShiftConfigNamespace).Core().V1().ConfigMaps().Lister(),
+			configMapInformer.Lister(),
+			configInformers.Config().V1().Infrastructures().Lister(),
+			cloudInfo,
+		),
 	)
 
+	// Without the cloud-credential-operator, e.g. if the CloudCredential
+	// capability is disabled, the credentials secret is created by the
+	// cluster administrator as in Manual mode
+	ccoInstalled, err := credentials.CloudCredentialOperatorInstalled(ctx, apiExtClient)
+	if err != nil {
+		return err
+	}
+	if ccoInstalled {
+		csiControllerSet = csiControllerSet.WithCredentialsRequestController(
+			"OpenStackCinderDriverCredentialsRequestController",
+			util.DefaultNamespace,
+			assets.ReadFile,
+			"credentials.yaml",
+			dynamicClient,
+			operatorInformers,
+		)
+	} else {
+		klog.Info("The cloud-credential-operator is not installed; not requesting the OpenStack credentials")
+	}
+
 	configSyncController := config.NewConfigSyncController(
 		operatorClient,
 		kubeClient,
 		kubeInformersForNamespaces,
 		configInformers,
+		cloudInfo,
 		resyncInterval,
 		controllerConfig.EventRecorder)
 
+	storageClassController := storageclass.NewStorageClassController(
+		operatorClient,
+		kubeClient,
+		kubeInformersForNamespaces,
+		configInformers,
+		cloudInfo,
+		controllerConfig.EventRecorder)
+
+	quotaController := quota.NewQuotaController(
+		operatorClient,
+		kubeInformersForNamespaces,
+		configInformers,
+		cloudProvider,
+		controllerConfig.EventRecorder)
+
+	capacityController := capacity.NewCapacityController(
+		operatorClient,
+		kubeClient,
+		kubeInformersForNamespaces,
+		configInformers,
+		cloudInfo,
+		cloudProvider,
+		controllerConfig.EventRecorder)
+
+	serviceHealthController := servicehealth.NewServiceHealthController(
+		operatorClient,
+		kubeClient,
+		kubeInformersForNamespaces,
+		configInformers,
+		cloudInfo,
+		cloudProvider,
+		controllerConfig.EventRecorder)
+
+	// The library-go recorder only emits events on the operator, so a
+	// separate recorder is used for events on PersistentVolumes
+	eventBroadcaster := record.NewBroadcaster()
+	eventBroadcaster.StartRecordingToSink(&corev1client.EventSinkImpl{Interface: kubeClient.CoreV1().Events("")})
+	defer eventBroadcaster.Shutdown()
+	pvEventRecorder := eventBroadcaster.NewRecorder(scheme.Scheme, corev1.EventSource{Component: operatorName})
+
+	stuckVolumeController := volumes.NewStuckVolumeController(
+		operatorClient,
+		kubeInformersForNamespaces,
+		configInformers,
+		cloudProvider,
+		controllerConfig.EventRecorder,
+		pvEventRecorder)
+
+	orphanController := volumes.NewOrphanController(
+		operatorClient,
+		kubeClient,
+		dynamicClient,
+		kubeInformersForNamespaces,
+		configInformers,
+		cloudProvider,
+		controllerConfig.EventRecorder)
+
+	forceDetachController := volumes.NewForceDetachController(
+		operatorClient,
+		kubeClient,
+		kubeInformersForNamespaces,
+		configInformers,
+		cloudProvider,
+		controllerConfig.EventRecorder)
+
+	attachLimitController := attachlimits.NewAttachLimitController(
+		operatorClient,
+		kubeClient,
+		kubeInformersForNamespaces,
+		cloudProvider,
+		controllerConfig.EventRecorder)
+
+	nodeSelectionController := nodes.NewNodeSelectionController(
+		operatorClient,
+		kubeClient,
+		kubeInformersForNamespaces,
+		cloudProvider,
+		controllerConfig.EventRecorder)
+
+	topologyVerificationController := nodes.NewTopologyVerificationController(
+		operatorClient,
+		kubeInformersForNamespaces,
+		configInformers,
+		cloudInfo,
+		cloudProvider,
+		controllerConfig.EventRecorder)
+
+	stagedRolloutController := rollout.NewStagedRolloutController(
+		operatorClient,
+		kubeClient,
+		kubeInformersForNamespaces,
+		configInformers,
+		controllerConfig.EventRecorder)
+
+	credentialsController := credentials.NewCredentialsController(
+		operatorClient,
+		kubeInformersForNamespaces,
+		cloudProvider,
+		controllerConfig.EventRecorder)
+
+	permissionsController := permissions.NewPermissionsController(
+		operatorClient,
+		kubeInformersForNamespaces,
+		cloudProvider,
+		controllerConfig.EventRecorder)
+
+	credentialsRequestManifest, err := assets.ReadFile("credentials.yaml")
+	if err != nil {
+		return err
+	}
+	credentialsRequestStatusController := credentials.NewCredentialsRequestStatusController(
+		operatorClient,
+		dynamicClient,
+		kubeInformersForNamespaces,
+		operatorInformers,
+		ccoInstalled,
+		credentialsRequestManifest,
+		controllerConfig.EventRecorder)
+
 	klog.Info("Starting the informers")
 	go kubeInformersForNamespaces.Start(ctx.Done())
 	go dynamicInformers.Start(ctx.Done())
@@ -209,6 +400,20 @@ func RunOperator(ctx context.Context, controllerConfig *controllercmd.Controller
 	klog.Info("Starting controllers")
 	go csiControllerSet.Run(ctx, 1)
 	go configSyncController.Run(ctx, 1)
+	go storageClassController.Run(ctx, 1)
+	go quotaController.Run(ctx, 1)
+	go capacityController.Run(ctx, 1)
+	go serviceHealthController.Run(ctx, 1)
+	go stuckVolumeController.Run(ctx, 1)
+	go orphanController.Run(ctx, 1)
+	go forceDetachController.Run(ctx, 1)
+	go attachLimitController.Run(ctx, 1)
+	go nodeSelectionController.Run(ctx, 1)
+	go topologyVerificationController.Run(ctx, 1)
+	go stagedRolloutController.Run(ctx, 1)
+	go credentialsController.Run(ctx, 1)
+	go credentialsRequestStatusController.Run(ctx, 1)
+	go permissionsController.Run(ctx, 1)
 
 	<-ctx.Done()
 
@@ -6,4 +6,22 @@ const (
 	OpenShiftConfigNamespace = "openshift-config"
 
 	CinderConfigName = "cloud-conf"
+
+	// NodeAttachLimitsConfigName is the config map holding the volume
+	// attach limit of each node, which is mounted in the node plugin pods
+	NodeAttachLimitsConfigName = "openstack-cinder-csi-driver-node-attach-limits"
+
+	// NonNovaNodeLabel is set by the operator on nodes which are not backed
+	// by a Nova server, so that the node plugin isn't run on them
+	NonNovaNodeLabel = "cinder.csi.openstack.org/non-nova-node"
+	// DisableNodePluginLabel may be set to "true" by the cluster
+	// administrator to keep the node plugin off a node
+	DisableNodePluginLabel = "cinder.csi.openstack.org/disable-node-plugin"
+	// CanaryNodeLabel may be set to "true" by the cluster administrator to
+	// pick the nodes which are updated first by a staged rollout
+	CanaryNodeLabel = "cinder.csi.openstack.org/canary-node"
+
+	// CloudCredentialsSecretName is the secret provisioned by the Cloud
+	// Credential Operator containing clouds.yaml
+	CloudCredentialsSecretName = "openstack-cloud-credentials"
 )
@@ -0,0 +1,13 @@
+package util
+
+import "strings"
+
+// ServerIDFromProviderID returns the Nova server ID of a node's provider ID,
+// which is of the form openstack://<region>/<server ID>, with an optional
+// region. It returns an empty string if the node is not an OpenStack server.
+func ServerIDFromProviderID(providerID string) string {
+	if !strings.HasPrefix(providerID, "openstack://") {
+		return ""
+	}
+	return providerID[strings.LastIndex(providerID, "/")+1:]
+}
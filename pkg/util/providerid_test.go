@@ -0,0 +1,16 @@
+package util
+
+import (
+	"testing"
+
+	. "github.com/onsi/gomega"
+)
+
+func TestServerIDFromProviderID(t *testing.T) {
+	g := NewWithT(t)
+
+	g.Expect(ServerIDFromProviderID("openstack:///c2c1ee2e-3e65-4c3e-9c4f-8d0d1e0bd6a7")).To(Equal("c2c1ee2e-3e65-4c3e-9c4f-8d0d1e0bd6a7"))
+	g.Expect(ServerIDFromProviderID("openstack://RegionOne/c2c1ee2e-3e65-4c3e-9c4f-8d0d1e0bd6a7")).To(Equal("c2c1ee2e-3e65-4c3e-9c4f-8d0d1e0bd6a7"))
+	g.Expect(ServerIDFromProviderID("aws:///us-east-1a/i-0123456789")).To(BeEmpty())
+	g.Expect(ServerIDFromProviderID("")).To(BeEmpty())
+}